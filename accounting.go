@@ -0,0 +1,56 @@
+package smtp
+
+import (
+	"net"
+	"time"
+)
+
+// AccountingRecord describes a message accepted by the server.
+type AccountingRecord struct {
+	Time       time.Time
+	RemoteAddr net.Addr
+	// Authenticated identity, see Conn.AuthIdentity.
+	Identity      string
+	TransactionID string
+
+	// Reverse-path from the MAIL command.
+	From string
+	// Recipients the message has been accepted for. With LMTP, recipients
+	// which got a negative reply are excluded.
+	Recipients []string
+	// Size of the message data, in bytes, after dot-unstuffing.
+	Bytes int64
+	// Time between the DATA or first BDAT command and the success reply.
+	Duration time.Duration
+}
+
+// Accounting receives a record for each accepted message, e.g. to bill
+// authenticated users. Account is called synchronously, once the success
+// reply has been sent to the client: messages rejected at any point, even
+// after their data has been received, aren't accounted for.
+type Accounting interface {
+	Account(r *AccountingRecord)
+}
+
+// account reports an accepted message to Server.Accounting, if the success
+// reply could be sent.
+func (c *Conn) account(size int64, rcpts []string) {
+	if c.server.Accounting == nil || c.tx == nil || len(rcpts) == 0 {
+		return
+	}
+	if err := c.flush(); err != nil {
+		return
+	}
+
+	now := c.server.now()
+	c.server.Accounting.Account(&AccountingRecord{
+		Time:          now,
+		RemoteAddr:    c.conn.RemoteAddr(),
+		Identity:      c.authIdentity,
+		TransactionID: c.tx.ID,
+		From:          c.tx.From,
+		Recipients:    rcpts,
+		Bytes:         size,
+		Duration:      now.Sub(c.tx.DataStartedAt),
+	})
+}
@@ -1,6 +1,9 @@
 package smtp
 
 import (
+	"context"
+	"crypto/x509"
+	"fmt"
 	"io"
 
 	"github.com/emersion/go-sasl"
@@ -29,6 +32,63 @@ var (
 	}
 )
 
+// ForwardingResult describes a recipient which isn't local but whose new
+// address is known (RFC 5321 section 3.4). Clients get it from
+// RcptStatus.Forwarding and SMTPError.Forwarding.
+//
+// Session.Rcpt (or the RcptTx and RcptContext variants) can return a
+// *ForwardingResult to reject a recipient which has moved with a 551 reply,
+// asking the client to send to Address instead. Recipients accepted for
+// forwarding get a 251 reply with AcceptedReply.ForwardTo.
+type ForwardingResult struct {
+	// Forward-path of the recipient.
+	Address string
+	// Whether the recipient has moved permanently: the recipient has been
+	// rejected with a 551 reply. Otherwise, the recipient has been accepted
+	// with a 251 reply, and the server forwards the message to Address.
+	Permanent bool
+}
+
+func (res *ForwardingResult) Error() string {
+	return fmt.Sprintf("smtp: user not local, please try <%v>", res.Address)
+}
+
+// reply returns the reply rejecting the RCPT command.
+func (res *ForwardingResult) reply() (code int, enhCode EnhancedCode, msg string) {
+	return 551, EnhancedCode{5, 1, 6}, fmt.Sprintf("User not local; please try <%v>", res.Address)
+}
+
+// AcceptedReply is a custom reply to an accepted MAIL or RCPT command, see
+// ReplySession. Each line is sent as a line of a multi-line reply, the
+// enhanced code is appended to the last one.
+type AcceptedReply struct {
+	// Defaults to 2.0.0, or 2.1.5 if ForwardTo is set.
+	EnhancedCode EnhancedCode
+	// Lines of the reply text. If empty, the default text is sent.
+	Lines []string
+	// For RCPT, the forward-path of a recipient which isn't local (RFC 5321
+	// section 3.4): a 251 reply is sent instead of a 250 one, and the backend
+	// is responsible for forwarding the message to this address.
+	ForwardTo string
+}
+
+// reply returns the code and text of the reply, given the default text.
+// ForwardTo is only used for RCPT.
+func (r *AcceptedReply) reply(msg string, rcpt bool) (int, EnhancedCode, []string) {
+	code, enhCode := 250, EnhancedCode{2, 0, 0}
+	if rcpt && r.ForwardTo != "" {
+		code, enhCode = 251, EnhancedCode{2, 1, 5}
+		msg = fmt.Sprintf("User not local; will forward to <%v>", r.ForwardTo)
+	}
+	if r.EnhancedCode != EnhancedCodeNotSet {
+		enhCode = r.EnhancedCode
+	}
+	if len(r.Lines) == 0 {
+		return code, enhCode, []string{msg}
+	}
+	return code, enhCode, r.Lines
+}
+
 // A SMTP server backend.
 type Backend interface {
 	NewSession(c *Conn) (Session, error)
@@ -57,7 +117,8 @@ type Session interface {
 
 	// Set return path for currently processed message.
 	Mail(from string, opts *MailOptions) error
-	// Add recipient for currently processed message.
+	// Add recipient for currently processed message. A *ForwardingResult can
+	// be returned to reject recipients which have moved.
 	Rcpt(to string, opts *RcptOptions) error
 	// Set currently processed message contents and send it.
 	//
@@ -86,8 +147,150 @@ type LMTPSession interface {
 	LMTPData(r io.Reader, status StatusCollector) error
 }
 
+// LMTPStatusSession is an add-on interface for LMTPSession. It customizes the
+// text of the per-recipient replies sent after the message data, e.g. to
+// mention the original recipient of an alias.
+type LMTPStatusSession interface {
+	LMTPSession
+
+	// LMTPStatusText returns the text of the reply for a recipient. The
+	// default text is "<" + status.Rcpt + "> " + status.Message.
+	LMTPStatusText(status *LMTPStatus) string
+}
+
+// LMTPStatus is the delivery status of a recipient, as passed to
+// LMTPStatusSession.LMTPStatusText.
+type LMTPStatus struct {
+	// Forward-path of the recipient.
+	Rcpt string
+	// Original recipient from the ORCPT parameter (RFC 3461), empty if not
+	// specified.
+	OriginalRecipient string
+	// Parameters of the RCPT command.
+	RcptOptions *RcptOptions
+	// Status set by the backend, nil if the message has been delivered.
+	Err error
+
+	// Reply derived from Err.
+	Code         int
+	EnhancedCode EnhancedCode
+	Message      string
+}
+
+// TransactionSession is an add-on interface for Session. It can be implemented
+// by backends which need the whole Transaction instead of individual command
+// arguments, for instance to share envelope logging between MAIL, RCPT and
+// DATA.
+//
+// If implemented, MailTx, RcptTx and DataTx are called instead of Mail, Rcpt
+// and Data. The context of the connection is available with
+// Transaction.Context.
+type TransactionSession interface {
+	Session
+
+	// MailTx is called when a MAIL command is received. tx.From and
+	// tx.MailOptions are populated.
+	MailTx(tx *Transaction) error
+	// RcptTx is called for each RCPT command. tx.Recipients doesn't include
+	// to yet.
+	RcptTx(tx *Transaction, to string, opts *RcptOptions) error
+	// DataTx is the transaction-aware version of Session.Data.
+	//
+	// r must be consumed before DataTx returns.
+	DataTx(tx *Transaction, r io.Reader) error
+}
+
+// ContextSession is an add-on interface for Session. It can be implemented by
+// backends which need to stop work when the client goes away, e.g. long
+// running content scans.
+//
+// If implemented, MailContext, RcptContext and DataContext are called instead
+// of Mail, Rcpt and Data with the context returned by Conn.Context.
+//
+// TransactionSession takes precedence over ContextSession: the
+// ContextSession methods of a session implementing both are never called by
+// the server, the TransactionSession methods can get the context from
+// Transaction.Context. Likewise, LMTPSession.LMTPData can get it from
+// Conn.Context.
+type ContextSession interface {
+	Session
+
+	MailContext(ctx context.Context, from string, opts *MailOptions) error
+	RcptContext(ctx context.Context, to string, opts *RcptOptions) error
+	// DataContext is the context-aware version of Session.Data.
+	//
+	// r must be consumed before DataContext returns.
+	DataContext(ctx context.Context, r io.Reader) error
+}
+
+// SessionLimits is an add-on interface for Session. It allows backends to
+// override server-wide limits for a single session, e.g. depending on the
+// authenticated user.
+type SessionLimits interface {
+	Session
+
+	// MaxRecipients returns the maximum number of recipients per transaction,
+	// used instead of Server.MaxRecipients. Zero means no limit.
+	//
+	// It is called for each RCPT command, so the limit can change after
+	// authentication. The limit advertised via LIMITS RCPTMAX is still
+	// Server.MaxRecipients.
+	MaxRecipients() int
+}
+
+// NotifySession is an add-on interface for Session. It can be implemented by
+// backends which need to know why a transaction or a session ended, e.g. to
+// record abandoned transactions.
+type NotifySession interface {
+	Session
+
+	// OnReset is called when the client issues a RSET command, before Reset.
+	OnReset()
+	// OnQuit is called when the session ends, before Logout.
+	OnQuit(reason QuitReason)
+}
+
+// QuitReason describes why a session ended.
+type QuitReason int
+
+const (
+	// The server closed the connection, e.g. because it is shutting down or
+	// a limit has been reached.
+	QuitServer QuitReason = iota
+	// The client issued a QUIT command.
+	QuitCommand
+	// The client closed the connection without issuing QUIT.
+	QuitDisconnected
+	// The client didn't send a command within Server.ReadTimeout.
+	QuitTimeout
+	// The connection was closed because of a protocol or I/O error.
+	QuitError
+)
+
+func (r QuitReason) String() string {
+	switch r {
+	case QuitServer:
+		return "server"
+	case QuitCommand:
+		return "quit"
+	case QuitDisconnected:
+		return "disconnected"
+	case QuitTimeout:
+		return "timeout"
+	case QuitError:
+		return "error"
+	}
+	return fmt.Sprintf("QuitReason(%d)", int(r))
+}
+
 // StatusCollector allows a backend to provide per-recipient status
 // information.
+//
+// Recipients are identified by their forward-path, or by the address of
+// their ORCPT parameter (RFC 3461) when it doesn't match a forward-path. This
+// lets backends which rewrite recipients, e.g. to resolve aliases, report
+// statuses by original recipient. Recipients specified several times get
+// their statuses in order.
 type StatusCollector interface {
 	SetStatus(rcptTo string, err error)
 }
@@ -100,3 +303,58 @@ type AuthSession interface {
 	AuthMechanisms() []string
 	Auth(mech string) (sasl.Server, error)
 }
+
+// ExternalAuthSession is an add-on interface for Session. It enables the SASL
+// EXTERNAL mechanism for clients which have presented a TLS certificate
+// verified against tls.Config.ClientCAs.
+type ExternalAuthSession interface {
+	Session
+
+	// AuthExternal is called when the client issues AUTH EXTERNAL. chains
+	// contains the verified certificate chains of the client, identity is
+	// the requested authorization identity, empty if the client wants to
+	// act as the identity derived from its certificate.
+	//
+	// A non-nil error rejects the authentication.
+	AuthExternal(chains [][]*x509.Certificate, identity string) error
+}
+
+// VerifySession is an add-on interface for Session. It implements the VRFY
+// command (RFC 5321 section 3.5.1). Without it, VRFY is answered with a 252
+// reply which neither confirms nor denies that the user exists.
+type VerifySession interface {
+	Session
+
+	// Verify returns the mailbox of a user, e.g. "alice@example.org" for
+	// "alice". An *SMTPError sets the reply, e.g. 550 if the user doesn't
+	// exist or 553 if the name is ambiguous.
+	Verify(user string) (string, error)
+}
+
+// ReplySession is an add-on interface for Session. It customizes the replies
+// to accepted MAIL and RCPT commands, e.g. to include policy notices.
+type ReplySession interface {
+	Session
+
+	// MailReply is called once Mail (or its Tx and Context variants) has
+	// accepted the sender. It returns the reply to send, nil for the default
+	// one.
+	MailReply(from string) *AcceptedReply
+	// RcptReply is called once Rcpt (or its Tx and Context variants) has
+	// accepted a recipient. It returns the reply to send, nil for the
+	// default one.
+	RcptReply(to string) *AcceptedReply
+}
+
+// ExpandSession is an add-on interface for Session. It implements the EXPN
+// command (RFC 5321 section 3.5.2). Without it, EXPN is not implemented.
+//
+// Like VRFY, EXPN lets clients harvest addresses: it should only be answered
+// for trusted clients, e.g. authenticated ones.
+type ExpandSession interface {
+	Session
+
+	// Expand returns the mailboxes of the members of a mailing list. An
+	// *SMTPError sets the reply, e.g. 550 if the list doesn't exist.
+	Expand(list string) ([]string, error)
+}
@@ -0,0 +1,2 @@
+// Package backendutil implements utilities for SMTP backends.
+package backendutil
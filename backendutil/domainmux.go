@@ -0,0 +1,294 @@
+package backendutil
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+)
+
+// DomainMux is a backend dispatching recipients to other backends depending
+// on their domain, e.g. to host several virtual domains on a single server.
+//
+// A session of the matching backend is created the first time a recipient of
+// a domain is received, and is given the MAIL command at that point. When a
+// transaction contains recipients handled by different backends, the message
+// data is spooled to a temporary file and passed to each of them. Over LMTP,
+// each recipient gets the status returned by its backend; over SMTP, the
+// message is rejected if any backend fails, even if others have accepted it.
+//
+// Sessions implementing smtp.TransactionSession are given a copy of the
+// transaction restricted to the recipients they handle.
+//
+// AUTH isn't supported.
+type DomainMux struct {
+	// Backends by domain. Domains are case-insensitive.
+	Backends map[string]smtp.Backend
+	// Backend used for domains not in Backends. If nil, their recipients are
+	// rejected.
+	Default smtp.Backend
+}
+
+var _ smtp.Backend = (*DomainMux)(nil)
+
+// Handle registers the backend for a domain.
+func (mux *DomainMux) Handle(domain string, be smtp.Backend) {
+	if mux.Backends == nil {
+		mux.Backends = make(map[string]smtp.Backend)
+	}
+	mux.Backends[strings.ToLower(domain)] = be
+}
+
+// backend returns the backend handling an address, or nil.
+func (mux *DomainMux) backend(addr string) smtp.Backend {
+	if i := strings.LastIndexByte(addr, '@'); i >= 0 {
+		domain := strings.ToLower(addr[i+1:])
+		if be, ok := mux.Backends[domain]; ok {
+			return be
+		}
+		// Domains may have been added to the map directly
+		for d, be := range mux.Backends {
+			if strings.EqualFold(d, domain) {
+				return be
+			}
+		}
+	}
+	return mux.Default
+}
+
+// NewSession implements smtp.Backend.
+func (mux *DomainMux) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return &domainMuxSession{mux: mux, conn: c}, nil
+}
+
+// domainRoute is a backend session taking part in the current transaction.
+type domainRoute struct {
+	session  smtp.Session
+	rcpts    []string
+	rcptOpts []*smtp.RcptOptions
+	tx       *smtp.Transaction // see routeTx
+}
+
+type domainMuxSession struct {
+	mux  *DomainMux
+	conn *smtp.Conn
+
+	sessions map[smtp.Backend]smtp.Session
+
+	from     string
+	mailOpts *smtp.MailOptions
+	routes   []*domainRoute
+}
+
+var (
+	_ smtp.LMTPSession  = (*domainMuxSession)(nil)
+	_ smtp.ReplySession = (*domainMuxSession)(nil)
+)
+
+var errRelayDenied = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+	Message:      "Relaying denied",
+}
+
+func (s *domainMuxSession) Reset() {
+	for _, route := range s.routes {
+		route.session.Reset()
+	}
+	s.from = ""
+	s.mailOpts = nil
+	s.routes = nil
+}
+
+func (s *domainMuxSession) Logout() error {
+	var firstErr error
+	for _, session := range s.sessions {
+		if err := session.Logout(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	s.sessions = nil
+	return firstErr
+}
+
+func (s *domainMuxSession) Mail(from string, opts *smtp.MailOptions) error {
+	s.from = from
+	s.mailOpts = opts
+	return nil
+}
+
+// route returns the route of a backend, starting a transaction with it if
+// necessary.
+func (s *domainMuxSession) route(be smtp.Backend) (*domainRoute, error) {
+	session, ok := s.sessions[be]
+	if ok {
+		for _, route := range s.routes {
+			if route.session == session {
+				return route, nil
+			}
+		}
+	} else {
+		var err error
+		session, err = be.NewSession(s.conn)
+		if err != nil {
+			return nil, err
+		}
+		if s.sessions == nil {
+			s.sessions = make(map[smtp.Backend]smtp.Session)
+		}
+		s.sessions[be] = session
+	}
+
+	route := &domainRoute{session: session}
+	var err error
+	if ts, tx := s.routeTx(route); tx != nil {
+		err = ts.MailTx(tx)
+	} else {
+		err = session.Mail(s.from, s.mailOpts)
+	}
+	if err != nil {
+		session.Reset()
+		return nil, err
+	}
+	s.routes = append(s.routes, route)
+	return route, nil
+}
+
+// routeTx returns the transaction passed to a route whose session is a
+// smtp.TransactionSession: the transaction of the connection, restricted to
+// the recipients of the route. It returns a nil transaction if the session
+// isn't a smtp.TransactionSession or if no transaction is in progress.
+func (s *domainMuxSession) routeTx(route *domainRoute) (smtp.TransactionSession, *smtp.Transaction) {
+	ts, ok := route.session.(smtp.TransactionSession)
+	if !ok {
+		return nil, nil
+	}
+	tx := s.conn.Transaction()
+	if tx == nil {
+		return nil, nil
+	}
+	if route.tx == nil {
+		route.tx = new(smtp.Transaction)
+	}
+	*route.tx = *tx
+	route.tx.Recipients = route.rcpts
+	route.tx.RcptOptions = route.rcptOpts
+	return ts, route.tx
+}
+
+func (s *domainMuxSession) Rcpt(to string, opts *smtp.RcptOptions) error {
+	be := s.mux.backend(to)
+	if be == nil {
+		return errRelayDenied
+	}
+	route, err := s.route(be)
+	if err != nil {
+		return err
+	}
+	if ts, tx := s.routeTx(route); tx != nil {
+		err = ts.RcptTx(tx, to, opts)
+	} else {
+		err = route.session.Rcpt(to, opts)
+	}
+	if err != nil {
+		return err
+	}
+	route.rcpts = append(route.rcpts, to)
+	route.rcptOpts = append(route.rcptOpts, opts)
+	return nil
+}
+
+// MailReply implements smtp.ReplySession. The backend sessions don't exist
+// yet when MAIL is accepted, so the default reply is used.
+func (s *domainMuxSession) MailReply(from string) *smtp.AcceptedReply {
+	return nil
+}
+
+func (s *domainMuxSession) RcptReply(to string) *smtp.AcceptedReply {
+	replySession, ok := s.sessions[s.mux.backend(to)].(smtp.ReplySession)
+	if !ok {
+		return nil
+	}
+	return replySession.RcptReply(to)
+}
+
+func (s *domainMuxSession) Data(r io.Reader) error {
+	var firstErr error
+	err := s.LMTPData(r, statusFunc(func(rcpt string, err error) {
+		if firstErr == nil {
+			firstErr = err
+		}
+	}))
+	if err != nil {
+		return err
+	}
+	return firstErr
+}
+
+func (s *domainMuxSession) LMTPData(r io.Reader, status smtp.StatusCollector) error {
+	var routes []*domainRoute
+	for _, route := range s.routes {
+		if len(route.rcpts) > 0 {
+			routes = append(routes, route)
+		}
+	}
+
+	if len(routes) == 1 {
+		s.routeData(routes[0], r, status)
+		return nil
+	}
+
+	// Spool the message, since it's read once per route
+	spool, err := ioutil.TempFile("", "go-smtp-domainmux-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	if _, err := io.Copy(spool, r); err != nil {
+		return err
+	}
+
+	for _, route := range routes {
+		if _, err := spool.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		s.routeData(route, spool, status)
+	}
+	return nil
+}
+
+// routeData passes the message data to a route and sets the status of its
+// recipients.
+func (s *domainMuxSession) routeData(route *domainRoute, r io.Reader, status smtp.StatusCollector) {
+	if lmtpSession, ok := route.session.(smtp.LMTPSession); ok {
+		set := make(map[string]int)
+		err := lmtpSession.LMTPData(r, statusFunc(func(rcpt string, err error) {
+			set[rcpt]++
+			status.SetStatus(rcpt, err)
+		}))
+		// Like the server, use the returned error for recipients without a
+		// status
+		for _, rcpt := range route.rcpts {
+			if set[rcpt] > 0 {
+				set[rcpt]--
+			} else {
+				status.SetStatus(rcpt, err)
+			}
+		}
+		return
+	}
+
+	var err error
+	if ts, tx := s.routeTx(route); tx != nil {
+		err = ts.DataTx(tx, r)
+	} else {
+		err = route.session.Data(r)
+	}
+	for _, rcpt := range route.rcpts {
+		status.SetStatus(rcpt, err)
+	}
+}
@@ -0,0 +1,256 @@
+package backendutil_test
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/backendutil"
+)
+
+// recordBackend records the messages delivered to it.
+type recordBackend struct {
+	dataErr error
+
+	mu       sync.Mutex
+	messages []string
+}
+
+func (be *recordBackend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return &recordSession{be: be}, nil
+}
+
+type recordSession struct {
+	be    *recordBackend
+	from  string
+	rcpts []string
+}
+
+func (s *recordSession) Reset() {
+	s.from = ""
+	s.rcpts = nil
+}
+
+func (s *recordSession) Logout() error { return nil }
+
+func (s *recordSession) Mail(from string, opts *smtp.MailOptions) error {
+	s.from = from
+	return nil
+}
+
+func (s *recordSession) Rcpt(to string, opts *smtp.RcptOptions) error {
+	s.rcpts = append(s.rcpts, to)
+	return nil
+}
+
+func (s *recordSession) Data(r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if s.be.dataErr != nil {
+		return s.be.dataErr
+	}
+	s.be.mu.Lock()
+	defer s.be.mu.Unlock()
+	s.be.messages = append(s.be.messages, s.from+" "+strings.Join(s.rcpts, ",")+" "+string(b))
+	return nil
+}
+
+// txSession is a recordSession only relying on the transaction.
+type txSession struct {
+	recordSession
+}
+
+type txBackend struct {
+	recordBackend
+}
+
+func (be *txBackend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return &txSession{recordSession{be: &be.recordBackend}}, nil
+}
+
+func (s *txSession) Mail(from string, opts *smtp.MailOptions) error {
+	panic("Mail called instead of MailTx")
+}
+
+func (s *txSession) Rcpt(to string, opts *smtp.RcptOptions) error {
+	panic("Rcpt called instead of RcptTx")
+}
+
+func (s *txSession) Data(r io.Reader) error {
+	panic("Data called instead of DataTx")
+}
+
+func (s *txSession) MailTx(tx *smtp.Transaction) error {
+	return nil
+}
+
+func (s *txSession) RcptTx(tx *smtp.Transaction, to string, opts *smtp.RcptOptions) error {
+	return nil
+}
+
+func (s *txSession) DataTx(tx *smtp.Transaction, r io.Reader) error {
+	s.from = tx.From
+	s.rcpts = tx.Recipients
+	return s.recordSession.Data(r)
+}
+
+// replySession is a recordSession with a custom reply to RCPT.
+type replySession struct {
+	recordSession
+}
+
+type replyBackend struct {
+	recordBackend
+}
+
+func (be *replyBackend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return &replySession{recordSession{be: &be.recordBackend}}, nil
+}
+
+func (s *replySession) MailReply(from string) *smtp.AcceptedReply {
+	return nil
+}
+
+func (s *replySession) RcptReply(to string) *smtp.AcceptedReply {
+	return &smtp.AcceptedReply{Lines: []string{"Hosted on example.org"}}
+}
+
+func TestDomainMux(t *testing.T) {
+	org := &recordBackend{}
+	net2 := &recordBackend{dataErr: &smtp.SMTPError{
+		Code:         452,
+		EnhancedCode: smtp.EnhancedCode{4, 2, 2},
+		Message:      "Mailbox full",
+	}}
+	mux := &backendutil.DomainMux{}
+	mux.Handle("example.org", org)
+	mux.Handle("Example.NET", net2)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := smtp.NewServer(mux)
+	s.Domain = "localhost"
+	s.LMTP = true
+	go s.Serve(l)
+	defer s.Close()
+
+	to := []string{"alice@example.org", "bob@example.net", "dave@EXAMPLE.org", "carol@example.com"}
+	status, err := smtp.SendMailLMTP("tcp", l.Addr().String(), "root@nsa.gov", to, strings.NewReader("Hey <3\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, rcpt := range []string{"alice@example.org", "dave@EXAMPLE.org"} {
+		if err := status[rcpt]; err != nil {
+			t.Errorf("Delivery to %v failed: %v", rcpt, err)
+		}
+	}
+	if err, ok := status["bob@example.net"].(*smtp.SMTPError); !ok || err.Code != 452 {
+		t.Errorf("Expected delivery to bob to fail with 452, got %v", status["bob@example.net"])
+	}
+	if err, ok := status["carol@example.com"].(*smtp.SMTPError); !ok || err.Code != 550 {
+		t.Errorf("Expected carol to be rejected with 550, got %v", status["carol@example.com"])
+	}
+
+	expected := "root@nsa.gov alice@example.org,dave@EXAMPLE.org Hey <3\r\n"
+	if len(org.messages) != 1 || org.messages[0] != expected {
+		t.Errorf("Messages delivered to example.org = %q, want %q", org.messages, expected)
+	}
+
+	// Unknown domains go to the default backend
+	other := &recordBackend{}
+	mux.Default = other
+	status, err = smtp.SendMailLMTP("tcp", l.Addr().String(), "root@nsa.gov", []string{"carol@example.com"}, strings.NewReader("Hey <3\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := status["carol@example.com"]; err != nil {
+		t.Errorf("Delivery to the default backend failed: %v", err)
+	}
+	if len(other.messages) != 1 {
+		t.Errorf("Messages delivered to the default backend = %q", other.messages)
+	}
+}
+
+func TestDomainMux_Transaction(t *testing.T) {
+	org := &txBackend{}
+	mux := &backendutil.DomainMux{}
+	mux.Handle("example.org", org)
+	mux.Handle("example.net", &recordBackend{})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := smtp.NewServer(mux)
+	s.Domain = "localhost"
+	s.LMTP = true
+	go s.Serve(l)
+	defer s.Close()
+
+	to := []string{"alice@example.org", "bob@example.net", "dave@example.org"}
+	status, err := smtp.SendMailLMTP("tcp", l.Addr().String(), "root@nsa.gov", to, strings.NewReader("Hey <3\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rcpt := range to {
+		if err := status[rcpt]; err != nil {
+			t.Errorf("Delivery to %v failed: %v", rcpt, err)
+		}
+	}
+
+	// The transaction only lists the recipients of the backend
+	expected := "root@nsa.gov alice@example.org,dave@example.org Hey <3\r\n"
+	if len(org.messages) != 1 || org.messages[0] != expected {
+		t.Errorf("Messages delivered to example.org = %q, want %q", org.messages, expected)
+	}
+}
+
+func TestDomainMux_RcptReply(t *testing.T) {
+	mux := &backendutil.DomainMux{}
+	mux.Handle("example.org", &replyBackend{})
+	mux.Handle("example.net", &recordBackend{})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := smtp.NewServer(mux)
+	s.Domain = "localhost"
+	go s.Serve(l)
+	defer s.Close()
+
+	c, err := smtp.Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Mail("root@nsa.gov", nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, to := range []string{"alice@example.org", "bob@example.net"} {
+		if err := c.Rcpt(to, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	accepted := c.TransactionStatus().Accepted
+	if len(accepted) != 2 {
+		t.Fatalf("Accepted recipients = %v, want 2", accepted)
+	}
+	if accepted[0].Message != "Hosted on example.org" {
+		t.Errorf("Reply for alice = %q, want the custom one", accepted[0].Message)
+	}
+	if accepted[1].Message == "Hosted on example.org" {
+		t.Errorf("Reply for bob = %q, want the default one", accepted[1].Message)
+	}
+}
@@ -0,0 +1,264 @@
+package backendutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+)
+
+// LogBackend wraps a backend and logs a summary line for each message
+// received: client IP, HELO domain, envelope, size, duration, result code and
+// TLS parameters.
+type LogBackend struct {
+	Backend smtp.Backend
+	Logger  smtp.Logger
+}
+
+var _ smtp.Backend = (*LogBackend)(nil)
+
+// NewLogBackend creates a new LogBackend.
+func NewLogBackend(be smtp.Backend, logger smtp.Logger) *LogBackend {
+	return &LogBackend{Backend: be, Logger: logger}
+}
+
+// NewSession implements smtp.Backend.
+func (be *LogBackend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	s, err := be.Backend.NewSession(c)
+	if err != nil {
+		return nil, err
+	}
+	return wrapLogSession(&logSession{Session: s, be: be, conn: c}), nil
+}
+
+// logSession implements the add-on interfaces which can be forwarded without
+// changing the behavior of the server, falling back to what the server does
+// when the wrapped session doesn't implement them. ContextSession methods are
+// called by the TransactionSession ones.
+type logSession struct {
+	smtp.Session
+	be   *LogBackend
+	conn *smtp.Conn
+}
+
+var (
+	_ smtp.AuthSession        = (*logSession)(nil)
+	_ smtp.TransactionSession = (*logSession)(nil)
+	_ smtp.SessionLimits      = (*logSession)(nil)
+	_ smtp.NotifySession      = (*logSession)(nil)
+	_ smtp.ReplySession       = (*logSession)(nil)
+	_ smtp.LMTPStatusSession  = (*logSession)(nil)
+	_ smtp.VerifySession      = (*logSession)(nil)
+	_ smtp.ExpandSession      = (*logSession)(nil)
+)
+
+// logExternalAuthSession is used for wrapped sessions implementing
+// ExternalAuthSession: the server offers the EXTERNAL mechanism as soon as
+// the session implements it, so there is no fallback.
+type logExternalAuthSession struct {
+	*logSession
+}
+
+var _ smtp.ExternalAuthSession = logExternalAuthSession{}
+
+// wrapLogSession returns s, with the ExternalAuthSession add-on interface if
+// the wrapped session implements it.
+func wrapLogSession(s *logSession) smtp.Session {
+	if _, ok := s.Session.(smtp.ExternalAuthSession); ok {
+		return logExternalAuthSession{s}
+	}
+	return s
+}
+
+func (s *logSession) AuthMechanisms() []string {
+	if authSession, ok := s.Session.(smtp.AuthSession); ok {
+		return authSession.AuthMechanisms()
+	}
+	return nil
+}
+
+func (s *logSession) Auth(mech string) (sasl.Server, error) {
+	if authSession, ok := s.Session.(smtp.AuthSession); ok {
+		return authSession.Auth(mech)
+	}
+	return nil, smtp.ErrAuthUnknownMechanism
+}
+
+func (s *logSession) MaxRecipients() int {
+	if limits, ok := s.Session.(smtp.SessionLimits); ok {
+		return limits.MaxRecipients()
+	}
+	return s.conn.Server().MaxRecipients
+}
+
+func (s *logSession) MailReply(from string) *smtp.AcceptedReply {
+	if replySession, ok := s.Session.(smtp.ReplySession); ok {
+		return replySession.MailReply(from)
+	}
+	return nil
+}
+
+func (s *logSession) RcptReply(to string) *smtp.AcceptedReply {
+	if replySession, ok := s.Session.(smtp.ReplySession); ok {
+		return replySession.RcptReply(to)
+	}
+	return nil
+}
+
+func (s *logSession) OnReset() {
+	if notifySession, ok := s.Session.(smtp.NotifySession); ok {
+		notifySession.OnReset()
+	}
+}
+
+func (s *logSession) OnQuit(reason smtp.QuitReason) {
+	if notifySession, ok := s.Session.(smtp.NotifySession); ok {
+		notifySession.OnQuit(reason)
+	}
+}
+
+func (s *logSession) MailTx(tx *smtp.Transaction) error {
+	switch session := s.Session.(type) {
+	case smtp.TransactionSession:
+		return session.MailTx(tx)
+	case smtp.ContextSession:
+		return session.MailContext(tx.Context(), tx.From, tx.MailOptions)
+	default:
+		return session.Mail(tx.From, tx.MailOptions)
+	}
+}
+
+func (s *logSession) RcptTx(tx *smtp.Transaction, to string, opts *smtp.RcptOptions) error {
+	switch session := s.Session.(type) {
+	case smtp.TransactionSession:
+		return session.RcptTx(tx, to, opts)
+	case smtp.ContextSession:
+		return session.RcptContext(tx.Context(), to, opts)
+	default:
+		return session.Rcpt(to, opts)
+	}
+}
+
+func (s *logSession) DataTx(tx *smtp.Transaction, r io.Reader) error {
+	cr := &countReader{r: r}
+	var err error
+	switch session := s.Session.(type) {
+	case smtp.TransactionSession:
+		err = session.DataTx(tx, cr)
+	case smtp.ContextSession:
+		err = session.DataContext(tx.Context(), cr)
+	default:
+		err = session.Data(cr)
+	}
+	s.log(tx, cr.n, err)
+	return err
+}
+
+func (s *logSession) LMTPData(r io.Reader, status smtp.StatusCollector) error {
+	tx := s.conn.Transaction()
+	lmtpSession, ok := s.Session.(smtp.LMTPSession)
+	if !ok {
+		// The server uses the same status for all recipients
+		return s.DataTx(tx, r)
+	}
+
+	cr := &countReader{r: r}
+	err := lmtpSession.LMTPData(cr, status)
+	if tx != nil {
+		s.log(tx, cr.n, err)
+	}
+	return err
+}
+
+func (s *logSession) LMTPStatusText(status *smtp.LMTPStatus) string {
+	if statusSession, ok := s.Session.(smtp.LMTPStatusSession); ok {
+		return statusSession.LMTPStatusText(status)
+	}
+	return "<" + status.Rcpt + "> " + status.Message
+}
+
+func (s *logSession) Verify(user string) (string, error) {
+	if verifySession, ok := s.Session.(smtp.VerifySession); ok {
+		return verifySession.Verify(user)
+	}
+	return "", &smtp.SMTPError{
+		Code:         252,
+		EnhancedCode: smtp.EnhancedCode{2, 5, 0},
+		Message:      "Cannot VRFY user, but will accept message",
+	}
+}
+
+func (s *logSession) Expand(list string) ([]string, error) {
+	if expandSession, ok := s.Session.(smtp.ExpandSession); ok {
+		return expandSession.Expand(list)
+	}
+	return nil, &smtp.SMTPError{
+		Code:         502,
+		EnhancedCode: smtp.EnhancedCode{5, 5, 1},
+		Message:      "EXPN command not implemented",
+	}
+}
+
+func (s logExternalAuthSession) AuthExternal(chains [][]*x509.Certificate, identity string) error {
+	return s.Session.(smtp.ExternalAuthSession).AuthExternal(chains, identity)
+}
+
+func (s *logSession) log(tx *smtp.Transaction, size int64, err error) {
+	code := 250
+	if smtpErr, ok := err.(*smtp.SMTPError); ok {
+		code = smtpErr.Code
+	} else if err != nil {
+		code = 554
+	}
+
+	tlsInfo := "none"
+	if state, ok := s.conn.TLSConnectionState(); ok {
+		tlsInfo = tlsVersionName(state.Version) + "/" + tls.CipherSuiteName(state.CipherSuite)
+	}
+
+	rcpts := make([]string, len(tx.Recipients))
+	for i, rcpt := range tx.Recipients {
+		rcpts[i] = "<" + rcpt + ">"
+	}
+
+	line := fmt.Sprintf("id=%v ip=%v helo=%v from=<%v> rcpts=%v size=%v duration=%v code=%v tls=%v",
+		tx.ID, s.conn.Conn().RemoteAddr(), s.conn.Hostname(), tx.From,
+		strings.Join(rcpts, ","), size, time.Since(tx.StartedAt).Round(time.Millisecond), code, tlsInfo)
+	if err != nil {
+		line += fmt.Sprintf(" error=%q", err.Error())
+	}
+	s.be.Logger.Println(line)
+}
+
+// tlsVersionName returns the name of a TLS version, like tls.VersionName
+// which requires Go 1.21.
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	default:
+		return fmt.Sprintf("0x%04X", version)
+	}
+}
+
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.n += int64(n)
+	return n, err
+}
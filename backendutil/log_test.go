@@ -0,0 +1,244 @@
+package backendutil_test
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/backendutil"
+)
+
+type backend struct{}
+
+func (backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return session{}, nil
+}
+
+type session struct{}
+
+func (session) Reset()        {}
+func (session) Logout() error { return nil }
+
+func (session) Mail(from string, opts *smtp.MailOptions) error {
+	return nil
+}
+
+func (session) Rcpt(to string, opts *smtp.RcptOptions) error {
+	return nil
+}
+
+func (session) Data(r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(b, []byte("spam")) {
+		return &smtp.SMTPError{Code: 550, Message: "Looks like spam"}
+	}
+	return nil
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func testServer(t *testing.T, be smtp.Backend) (s *smtp.Server, addr string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s = smtp.NewServer(be)
+	s.Domain = "localhost"
+	go s.Serve(l)
+
+	return s, l.Addr().String()
+}
+
+func TestLogBackend(t *testing.T) {
+	var buf syncBuffer
+	s, addr := testServer(t, backendutil.NewLogBackend(backend{}, log.New(&buf, "", 0)))
+	defer s.Close()
+
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Hello("client.example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SendMail("root@nsa.gov", []string{"root@gchq.gov.uk", "root@dgse.fr"}, strings.NewReader("Hey <3\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	err = c.SendMail("root@nsa.gov", []string{"root@gchq.gov.uk"}, strings.NewReader("spam\r\n"))
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 550 {
+		t.Fatal("Expected a 550 error, got:", err)
+	}
+	if err := c.Quit(); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 log lines, got:\n%v", buf.String())
+	}
+	for _, s := range []string{"ip=127.0.0.1:", "helo=client.example.org", "from=<root@nsa.gov>", "rcpts=<root@gchq.gov.uk>,<root@dgse.fr>", "size=8", "code=250", "tls=none"} {
+		if !strings.Contains(lines[0], s) {
+			t.Errorf("Log line %q doesn't contain %q", lines[0], s)
+		}
+	}
+	for _, s := range []string{"size=6", "code=550", `error="SMTP error 550: Looks like spam"`} {
+		if !strings.Contains(lines[1], s) {
+			t.Errorf("Log line %q doesn't contain %q", lines[1], s)
+		}
+	}
+}
+
+func TestLogBackend_LMTP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf syncBuffer
+	s := smtp.NewServer(backendutil.NewLogBackend(backend{}, log.New(&buf, "", 0)))
+	s.Domain = "localhost"
+	s.LMTP = true
+	go s.Serve(l)
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := smtp.NewClientLMTP(conn)
+	defer c.Close()
+
+	if err := c.Hello("client.example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Mail("root@nsa.gov", nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, rcpt := range []string{"root@gchq.gov.uk", "root@dgse.fr"} {
+		if err := c.Rcpt(rcpt, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The wrapped session doesn't implement LMTPSession: all recipients get
+	// the status returned by Data
+	var codes []int
+	w, err := c.LMTPData(func(rcpt string, status *smtp.SMTPError) {
+		code := 250
+		if status != nil {
+			code = status.Code
+		}
+		codes = append(codes, code)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, "spam\r\n")
+	w.Close()
+	if !reflect.DeepEqual(codes, []int{550, 550}) {
+		t.Errorf("Got status codes %v, want [550 550]", codes)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 || !strings.Contains(lines[0], "code=550") {
+		t.Errorf("Expected a single log line with code=550, got:\n%v", buf.String())
+	}
+}
+
+type lmtpSession struct{ session }
+
+func (lmtpSession) LMTPData(r io.Reader, status smtp.StatusCollector) error {
+	return nil
+}
+
+type verifyExpandSession struct{ session }
+
+func (verifyExpandSession) Verify(user string) (string, error) {
+	return user + "@example.org", nil
+}
+
+func (verifyExpandSession) Expand(list string) ([]string, error) {
+	return nil, nil
+}
+
+type externalAuthSession struct{ lmtpSession }
+
+func (externalAuthSession) AuthExternal(chains [][]*x509.Certificate, identity string) error {
+	return nil
+}
+
+func TestLogBackend_Interfaces(t *testing.T) {
+	wrap := func(s smtp.Session) smtp.Session {
+		be := backendutil.NewLogBackend(smtp.BackendFunc(func(c *smtp.Conn) (smtp.Session, error) {
+			return s, nil
+		}), log.New(ioutil.Discard, "", 0))
+		wrapped, err := be.NewSession(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return wrapped
+	}
+
+	for _, s := range []smtp.Session{
+		session{},
+		lmtpSession{},
+		verifyExpandSession{},
+		externalAuthSession{},
+	} {
+		wrapped := wrap(s)
+		_, want := s.(smtp.ExternalAuthSession)
+		if _, ok := wrapped.(smtp.ExternalAuthSession); ok != want {
+			t.Errorf("%T: wrapped session implements ExternalAuthSession: %v, want %v", s, ok, want)
+		}
+		if _, ok := wrapped.(smtp.TransactionSession); !ok {
+			t.Errorf("%T: wrapped session doesn't implement TransactionSession", s)
+		}
+	}
+
+	wrapped := wrap(verifyExpandSession{})
+	if mailbox, err := wrapped.(smtp.VerifySession).Verify("alice"); err != nil || mailbox != "alice@example.org" {
+		t.Errorf("Verify() = %q, %v", mailbox, err)
+	}
+
+	// Without VerifySession and ExpandSession, the server replies are kept
+	wrapped = wrap(session{})
+	var smtpErr *smtp.SMTPError
+	if _, err := wrapped.(smtp.VerifySession).Verify("alice"); !errors.As(err, &smtpErr) || smtpErr.Code != 252 {
+		t.Errorf("Verify() = %v, want a 252 reply", err)
+	}
+	if _, err := wrapped.(smtp.ExpandSession).Expand("staff"); !errors.As(err, &smtpErr) || smtpErr.Code != 502 {
+		t.Errorf("Expand() = %v, want a 502 reply", err)
+	}
+}
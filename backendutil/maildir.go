@@ -0,0 +1,183 @@
+package backendutil
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// MaildirBackend is a backend delivering messages to Maildir mailboxes. It is
+// mostly useful to build local delivery agents over LMTP: when the server is
+// in LMTP mode, the status of each recipient is the result of the write to
+// its mailbox.
+//
+// A X-Original-To header field with the envelope recipient is prepended to
+// each delivered message, and the message size is included in file names
+// (",S=<size>").
+//
+// Over SMTP, the message is rejected if the delivery to any mailbox fails.
+type MaildirBackend struct {
+	// Mailbox returns the path to the Maildir of a recipient. If it returns
+	// an error, the recipient is rejected. The Maildir must already exist.
+	Mailbox func(rcpt string) (string, error)
+}
+
+var _ smtp.Backend = (*MaildirBackend)(nil)
+
+// NewSession implements smtp.Backend.
+func (be *MaildirBackend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return &maildirSession{be: be}, nil
+}
+
+type maildirRcpt struct {
+	addr, dir string
+}
+
+type maildirSession struct {
+	be    *MaildirBackend
+	rcpts []maildirRcpt
+}
+
+var _ smtp.LMTPSession = (*maildirSession)(nil)
+
+func (s *maildirSession) Reset() {
+	s.rcpts = nil
+}
+
+func (s *maildirSession) Logout() error {
+	return nil
+}
+
+func (s *maildirSession) Mail(from string, opts *smtp.MailOptions) error {
+	return nil
+}
+
+func (s *maildirSession) Rcpt(to string, opts *smtp.RcptOptions) error {
+	dir, err := s.be.Mailbox(to)
+	if err != nil {
+		return err
+	}
+	if fi, err := os.Stat(filepath.Join(dir, "new")); err != nil || !fi.IsDir() {
+		return &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+			Message:      "Mailbox unavailable",
+		}
+	}
+	s.rcpts = append(s.rcpts, maildirRcpt{addr: to, dir: dir})
+	return nil
+}
+
+func (s *maildirSession) Data(r io.Reader) error {
+	var firstErr error
+	err := s.LMTPData(r, statusFunc(func(rcpt string, err error) {
+		if firstErr == nil {
+			firstErr = err
+		}
+	}))
+	if err != nil {
+		return err
+	}
+	return firstErr
+}
+
+func (s *maildirSession) LMTPData(r io.Reader, status smtp.StatusCollector) error {
+	// Spool the message, since it's written once per recipient
+	spool, err := ioutil.TempFile("", "go-smtp-maildir-")
+	if err != nil {
+		return maildirError(err)
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	if _, err := io.Copy(spool, r); err != nil {
+		return maildirError(err)
+	}
+
+	for _, rcpt := range s.rcpts {
+		if _, err := spool.Seek(0, io.SeekStart); err != nil {
+			return maildirError(err)
+		}
+		err := deliverMaildir(rcpt.dir, rcpt.addr, spool)
+		if err != nil {
+			err = maildirError(err)
+		}
+		status.SetStatus(rcpt.addr, err)
+	}
+	return nil
+}
+
+type statusFunc func(rcpt string, err error)
+
+func (f statusFunc) SetStatus(rcpt string, err error) {
+	f(rcpt, err)
+}
+
+func maildirError(err error) error {
+	if pathErr, ok := err.(*os.PathError); ok && pathErr.Err == syscall.ENOSPC {
+		return &smtp.SMTPError{
+			Code:         452,
+			EnhancedCode: smtp.EnhancedCode{4, 3, 1},
+			Message:      "Insufficient system storage",
+		}
+	}
+	return &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+		Message:      "Failed to deliver message",
+	}
+}
+
+var maildirCounter uint32
+
+// maildirName returns a unique file name, as described in
+// https://cr.yp.to/proto/maildir.html.
+func maildirName() string {
+	hostname, _ := os.Hostname()
+	// "/" and ":" are not allowed in file names
+	hostname = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(hostname)
+
+	now := time.Now()
+	return fmt.Sprintf("%d.M%dP%dQ%d.%s", now.Unix(), now.Nanosecond()/1000, os.Getpid(), atomic.AddUint32(&maildirCounter, 1), hostname)
+}
+
+// deliverMaildir writes a message to the tmp directory of a Maildir, then
+// moves it to the new directory once it's safely on disk.
+func deliverMaildir(dir, rcpt string, r io.Reader) error {
+	name := maildirName()
+	tmpPath := filepath.Join(dir, "tmp", name)
+
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+	defer f.Close()
+
+	header := "X-Original-To: " + rcpt + "\r\n"
+	if _, err := io.WriteString(f, header); err != nil {
+		return err
+	}
+	n, err := io.Copy(f, r)
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	size := int64(len(header)) + n
+	newPath := filepath.Join(dir, "new", fmt.Sprintf("%s,S=%d", name, size))
+	return os.Rename(tmpPath, newPath)
+}
@@ -0,0 +1,93 @@
+package backendutil_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/backendutil"
+)
+
+func TestMaildirBackend(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"alice", "bob"} {
+		for _, sub := range []string{"tmp", "new", "cur"} {
+			if err := os.MkdirAll(filepath.Join(root, name, sub), 0700); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// Deliveries to bob fail after the recipient has been accepted
+	if err := os.Remove(filepath.Join(root, "bob", "tmp")); err != nil {
+		t.Fatal(err)
+	}
+
+	be := &backendutil.MaildirBackend{
+		Mailbox: func(rcpt string) (string, error) {
+			name := strings.TrimSuffix(rcpt, "@example.org")
+			if name == rcpt {
+				return "", errors.New("relaying denied")
+			}
+			return filepath.Join(root, name), nil
+		},
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := smtp.NewServer(be)
+	s.Domain = "localhost"
+	s.LMTP = true
+	go s.Serve(l)
+	defer s.Close()
+
+	msg := "Subject: Hello\r\n\r\nHey <3\r\n"
+	to := []string{"alice@example.org", "bob@example.org", "carol@example.org", "root@nsa.gov"}
+	status, err := smtp.SendMailLMTP("tcp", l.Addr().String(), "root@example.org", to, strings.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err, ok := status["alice@example.org"]; !ok || err != nil {
+		t.Errorf("Expected delivery to alice to succeed, got %v", err)
+	}
+	if err, ok := status["bob@example.org"].(*smtp.SMTPError); !ok || err.Code != 451 {
+		t.Errorf("Expected delivery to bob to fail temporarily, got %v", status["bob@example.org"])
+	}
+	if err, ok := status["carol@example.org"].(*smtp.SMTPError); !ok || err.Code != 550 {
+		t.Errorf("Expected carol to be rejected, got %v", status["carol@example.org"])
+	}
+	if status["root@nsa.gov"] == nil {
+		t.Error("Expected root@nsa.gov to be rejected")
+	}
+
+	files, err := ioutil.ReadDir(filepath.Join(root, "alice", "new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("Expected 1 message in alice's Maildir, got %v", len(files))
+	}
+	b, err := ioutil.ReadFile(filepath.Join(root, "alice", "new", files[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "X-Original-To: alice@example.org\r\n" + msg
+	if string(b) != want {
+		t.Errorf("Invalid message: got %q, want %q", string(b), want)
+	}
+	if !strings.HasSuffix(files[0].Name(), ",S="+strconv.Itoa(len(want))) {
+		t.Errorf("Invalid size in file name: %v", files[0].Name())
+	}
+
+	if files, _ := ioutil.ReadDir(filepath.Join(root, "alice", "tmp")); len(files) != 0 {
+		t.Errorf("Expected alice's tmp directory to be empty, got %v files", len(files))
+	}
+}
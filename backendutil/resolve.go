@@ -0,0 +1,200 @@
+package backendutil
+
+import (
+	"io"
+	"strings"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+)
+
+// ErrUnknownRecipient is returned by Resolver.Resolve when the local part of
+// an address doesn't match any mailbox.
+var ErrUnknownRecipient = &smtp.SMTPError{
+	Code:         550,
+	EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+	Message:      "No such user here",
+}
+
+// DomainRules describes how the addresses of a domain are resolved to
+// mailboxes.
+type DomainRules struct {
+	// Mailboxes by local part. The values are opaque to the Resolver, e.g.
+	// canonical addresses or Maildir paths. Unless CaseSensitive is set, keys
+	// must be lower-case.
+	Mailboxes map[string]string
+	// Characters separating the user from a tag in local parts, e.g. "+" to
+	// deliver "user+tag" to the mailbox of "user". Local parts matching a
+	// mailbox are never split.
+	TagSeparators string
+	// Mailbox receiving the messages sent to unknown local parts. If empty,
+	// they are rejected.
+	CatchAll string
+	// Compare local parts case-sensitively. RFC 5321 allows it, but most
+	// servers don't.
+	CaseSensitive bool
+}
+
+// SplitTag splits a local part at the first of the separators, e.g.
+// "user+tag" into "user" and "tag". If there is no separator, tag is empty.
+func SplitTag(local, separators string) (user, tag string) {
+	if separators == "" {
+		return local, ""
+	}
+	i := strings.IndexAny(local, separators)
+	if i < 0 {
+		return local, ""
+	}
+	return local[:i], local[i+1:]
+}
+
+// resolve returns the mailbox of a local part.
+func (rules *DomainRules) resolve(local string) (string, bool) {
+	if !rules.CaseSensitive {
+		local = strings.ToLower(local)
+	}
+	if mbox, ok := rules.Mailboxes[local]; ok {
+		return mbox, true
+	}
+	if user, _ := SplitTag(local, rules.TagSeparators); user != local {
+		if mbox, ok := rules.Mailboxes[user]; ok {
+			return mbox, true
+		}
+	}
+	if rules.CatchAll != "" {
+		return rules.CatchAll, true
+	}
+	return "", false
+}
+
+// Resolver resolves recipient addresses to mailboxes with per-domain rules.
+//
+// Its Resolve method can be used as MaildirBackend.Mailbox.
+type Resolver struct {
+	// Rules by domain. Domains are case-insensitive, keys must be
+	// lower-case.
+	Domains map[string]*DomainRules
+	// Rules for addresses of other domains and addresses without a domain
+	// (e.g. "postmaster"). If nil, they are rejected.
+	Default *DomainRules
+}
+
+// Resolve returns the mailbox of a recipient address. A *smtp.SMTPError is
+// returned if the address can't be resolved.
+func (r *Resolver) Resolve(addr string) (string, error) {
+	local, domain := addr, ""
+	if i := strings.LastIndexByte(addr, '@'); i >= 0 {
+		local, domain = addr[:i], strings.ToLower(addr[i+1:])
+	}
+
+	rules := r.Default
+	if domain != "" {
+		if domainRules, ok := r.Domains[domain]; ok {
+			rules = domainRules
+		}
+	}
+	if rules == nil {
+		return "", errRelayDenied
+	}
+
+	mbox, ok := rules.resolve(local)
+	if !ok {
+		return "", ErrUnknownRecipient
+	}
+	return mbox, nil
+}
+
+// ResolveBackend wraps a backend and resolves recipients at the RCPT stage:
+// recipients which can't be resolved are rejected, and the wrapped session
+// receives the mailboxes returned by Resolver.Resolve instead of the addresses
+// sent by the client. Over LMTP, the statuses set by the wrapped session for
+// mailboxes are reported for the matching addresses.
+//
+// Sessions are wrapped as plain Session, LMTPSession and AuthSession; other
+// add-on interfaces aren't available.
+type ResolveBackend struct {
+	Backend  smtp.Backend
+	Resolver *Resolver
+}
+
+var _ smtp.Backend = (*ResolveBackend)(nil)
+
+// NewSession implements smtp.Backend.
+func (be *ResolveBackend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	s, err := be.Backend.NewSession(c)
+	if err != nil {
+		return nil, err
+	}
+	return &resolveSession{Session: s, be: be}, nil
+}
+
+type resolveSession struct {
+	smtp.Session
+	be *ResolveBackend
+
+	// Addresses sent by the client, in order, by mailbox
+	addrs map[string][]string
+}
+
+var (
+	_ smtp.AuthSession = (*resolveSession)(nil)
+	_ smtp.LMTPSession = (*resolveSession)(nil)
+)
+
+func (s *resolveSession) AuthMechanisms() []string {
+	if authSession, ok := s.Session.(smtp.AuthSession); ok {
+		return authSession.AuthMechanisms()
+	}
+	return nil
+}
+
+func (s *resolveSession) Auth(mech string) (sasl.Server, error) {
+	if authSession, ok := s.Session.(smtp.AuthSession); ok {
+		return authSession.Auth(mech)
+	}
+	return nil, smtp.ErrAuthUnknownMechanism
+}
+
+func (s *resolveSession) Reset() {
+	s.addrs = nil
+	s.Session.Reset()
+}
+
+func (s *resolveSession) Rcpt(to string, opts *smtp.RcptOptions) error {
+	mbox, err := s.be.Resolver.Resolve(to)
+	if err != nil {
+		return err
+	}
+	if err := s.Session.Rcpt(mbox, opts); err != nil {
+		return err
+	}
+	if s.addrs == nil {
+		s.addrs = make(map[string][]string)
+	}
+	s.addrs[mbox] = append(s.addrs[mbox], to)
+	return nil
+}
+
+func (s *resolveSession) Data(r io.Reader) error {
+	s.addrs = nil
+	return s.Session.Data(r)
+}
+
+func (s *resolveSession) LMTPData(r io.Reader, status smtp.StatusCollector) error {
+	lmtpSession, ok := s.Session.(smtp.LMTPSession)
+	if !ok {
+		return s.Data(r)
+	}
+
+	addrs := s.addrs
+	s.addrs = nil
+	return lmtpSession.LMTPData(r, statusFunc(func(mbox string, err error) {
+		if len(addrs[mbox]) == 0 {
+			// Let the server report the misuse
+			status.SetStatus(mbox, err)
+			return
+		}
+		status.SetStatus(addrs[mbox][0], err)
+		addrs[mbox] = addrs[mbox][1:]
+	}))
+}
@@ -0,0 +1,101 @@
+package backendutil_test
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/backendutil"
+)
+
+func TestResolver(t *testing.T) {
+	r := &backendutil.Resolver{
+		Domains: map[string]*backendutil.DomainRules{
+			"example.org": {
+				Mailboxes: map[string]string{
+					"alice":    "alice",
+					"bob":      "bob",
+					"bob+spam": "spam",
+				},
+				TagSeparators: "+-",
+			},
+			"example.net": {
+				Mailboxes:     map[string]string{"Carol": "carol"},
+				CatchAll:      "postmaster",
+				CaseSensitive: true,
+			},
+		},
+		Default: &backendutil.DomainRules{
+			Mailboxes: map[string]string{"postmaster": "postmaster"},
+		},
+	}
+
+	for _, tc := range []struct {
+		addr, mbox string
+		code       int
+	}{
+		{addr: "alice@example.org", mbox: "alice"},
+		{addr: "ALICE@Example.ORG", mbox: "alice"},
+		{addr: "alice+lists@example.org", mbox: "alice"},
+		{addr: "alice-lists+go@example.org", mbox: "alice"},
+		{addr: "bob+spam@example.org", mbox: "spam"},
+		{addr: "bob+ham@example.org", mbox: "bob"},
+		{addr: "eve@example.org", code: 550},
+		{addr: "Carol@example.net", mbox: "carol"},
+		{addr: "carol@example.net", mbox: "postmaster"},
+		{addr: "postmaster", mbox: "postmaster"},
+		{addr: "postmaster@example.com", mbox: "postmaster"},
+		{addr: "root@example.com", code: 550},
+	} {
+		mbox, err := r.Resolve(tc.addr)
+		if tc.code != 0 {
+			if smtpErr, ok := err.(*smtp.SMTPError); !ok || smtpErr.Code != tc.code {
+				t.Errorf("Resolve(%q) = %q, %v, want a %v error", tc.addr, mbox, err, tc.code)
+			}
+		} else if err != nil || mbox != tc.mbox {
+			t.Errorf("Resolve(%q) = %q, %v, want %q", tc.addr, mbox, err, tc.mbox)
+		}
+	}
+}
+
+func TestResolveBackend(t *testing.T) {
+	rec := &recordBackend{}
+	be := &backendutil.ResolveBackend{
+		Backend: rec,
+		Resolver: &backendutil.Resolver{
+			Domains: map[string]*backendutil.DomainRules{
+				"example.org": {
+					Mailboxes:     map[string]string{"alice": "alice@example.org"},
+					TagSeparators: "+",
+				},
+			},
+		},
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := smtp.NewServer(be)
+	s.Domain = "localhost"
+	s.LMTP = true
+	go s.Serve(l)
+	defer s.Close()
+
+	to := []string{"Alice+news@example.org", "bob@example.org"}
+	status, err := smtp.SendMailLMTP("tcp", l.Addr().String(), "root@nsa.gov", to, strings.NewReader("Hey <3\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := status["Alice+news@example.org"]; err != nil {
+		t.Errorf("Delivery to alice failed: %v", err)
+	}
+	if err, ok := status["bob@example.org"].(*smtp.SMTPError); !ok || err.Code != 550 {
+		t.Errorf("Expected bob to be rejected with 550, got %v", status["bob@example.org"])
+	}
+
+	expected := "root@nsa.gov alice@example.org Hey <3\r\n"
+	if len(rec.messages) != 1 || rec.messages[0] != expected {
+		t.Errorf("Messages = %q, want %q", rec.messages, expected)
+	}
+}
@@ -0,0 +1,302 @@
+package backendutil
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+)
+
+// SpamScore is the verdict of a Scorer.
+type SpamScore struct {
+	// Whether the message is considered as spam.
+	Spam bool
+	// Score of the message, and score above which a message is considered
+	// as spam.
+	Score, Required float64
+	// Names of the tests which matched, optional.
+	Tests []string
+}
+
+// Scorer computes the spam score of a message, e.g. by querying rspamd or
+// SpamAssassin.
+type Scorer interface {
+	// Score reads the message data from r. It's called while the message is
+	// being received, r returns io.EOF once the whole message has been
+	// received.
+	Score(tx *smtp.Transaction, r io.Reader) (*SpamScore, error)
+}
+
+// ScorerFunc is an adapter to use an ordinary function as a Scorer.
+type ScorerFunc func(tx *smtp.Transaction, r io.Reader) (*SpamScore, error)
+
+// Score implements Scorer.
+func (f ScorerFunc) Score(tx *smtp.Transaction, r io.Reader) (*SpamScore, error) {
+	return f(tx, r)
+}
+
+// SpamBackend wraps a backend and annotates messages with the X-Spam-Score
+// and X-Spam-Status header fields, as computed by a Scorer. The message data
+// is passed to the Scorer while it's received, and spooled to a temporary
+// file: the wrapped backend only receives the message once it has been
+// scored.
+//
+// X-Spam-Score and X-Spam-Status fields already present in the message are
+// removed, so that senders can't forge them.
+type SpamBackend struct {
+	Backend smtp.Backend
+	Scorer  Scorer
+
+	// If set, messages are passed to the wrapped backend without annotation
+	// when the Scorer fails. Otherwise, they are rejected with a 451 reply.
+	FailOpen bool
+}
+
+var _ smtp.Backend = (*SpamBackend)(nil)
+
+// NewSpamBackend creates a new SpamBackend.
+func NewSpamBackend(be smtp.Backend, scorer Scorer) *SpamBackend {
+	return &SpamBackend{Backend: be, Scorer: scorer}
+}
+
+// NewSession implements smtp.Backend.
+func (be *SpamBackend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	s, err := be.Backend.NewSession(c)
+	if err != nil {
+		return nil, err
+	}
+	return &spamSession{Session: s, be: be, conn: c}, nil
+}
+
+type spamSession struct {
+	smtp.Session
+	be   *SpamBackend
+	conn *smtp.Conn
+}
+
+var (
+	_ smtp.AuthSession        = (*spamSession)(nil)
+	_ smtp.LMTPSession        = (*spamSession)(nil)
+	_ smtp.TransactionSession = (*spamSession)(nil)
+	_ smtp.SessionLimits      = (*spamSession)(nil)
+	_ smtp.NotifySession      = (*spamSession)(nil)
+	_ smtp.ReplySession       = (*spamSession)(nil)
+)
+
+func (s *spamSession) AuthMechanisms() []string {
+	if authSession, ok := s.Session.(smtp.AuthSession); ok {
+		return authSession.AuthMechanisms()
+	}
+	return nil
+}
+
+func (s *spamSession) Auth(mech string) (sasl.Server, error) {
+	if authSession, ok := s.Session.(smtp.AuthSession); ok {
+		return authSession.Auth(mech)
+	}
+	return nil, smtp.ErrAuthUnknownMechanism
+}
+
+func (s *spamSession) MaxRecipients() int {
+	if limits, ok := s.Session.(smtp.SessionLimits); ok {
+		return limits.MaxRecipients()
+	}
+	return s.conn.Server().MaxRecipients
+}
+
+func (s *spamSession) MailReply(from string) *smtp.AcceptedReply {
+	if replySession, ok := s.Session.(smtp.ReplySession); ok {
+		return replySession.MailReply(from)
+	}
+	return nil
+}
+
+func (s *spamSession) RcptReply(to string) *smtp.AcceptedReply {
+	if replySession, ok := s.Session.(smtp.ReplySession); ok {
+		return replySession.RcptReply(to)
+	}
+	return nil
+}
+
+func (s *spamSession) OnReset() {
+	if notifySession, ok := s.Session.(smtp.NotifySession); ok {
+		notifySession.OnReset()
+	}
+}
+
+func (s *spamSession) OnQuit(reason smtp.QuitReason) {
+	if notifySession, ok := s.Session.(smtp.NotifySession); ok {
+		notifySession.OnQuit(reason)
+	}
+}
+
+func (s *spamSession) MailTx(tx *smtp.Transaction) error {
+	if txSession, ok := s.Session.(smtp.TransactionSession); ok {
+		return txSession.MailTx(tx)
+	}
+	return s.Session.Mail(tx.From, tx.MailOptions)
+}
+
+func (s *spamSession) RcptTx(tx *smtp.Transaction, to string, opts *smtp.RcptOptions) error {
+	if txSession, ok := s.Session.(smtp.TransactionSession); ok {
+		return txSession.RcptTx(tx, to, opts)
+	}
+	return s.Session.Rcpt(to, opts)
+}
+
+func (s *spamSession) DataTx(tx *smtp.Transaction, r io.Reader) error {
+	spool, annotated, err := s.score(tx, r)
+	if spool != nil {
+		defer os.Remove(spool.Name())
+		defer spool.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	if txSession, ok := s.Session.(smtp.TransactionSession); ok {
+		return txSession.DataTx(tx, annotated)
+	}
+	return s.Session.Data(annotated)
+}
+
+func (s *spamSession) LMTPData(r io.Reader, status smtp.StatusCollector) error {
+	spool, annotated, err := s.score(s.conn.Transaction(), r)
+	if spool != nil {
+		defer os.Remove(spool.Name())
+		defer spool.Close()
+	}
+	if err != nil {
+		return err
+	}
+
+	if lmtpSession, ok := s.Session.(smtp.LMTPSession); ok {
+		return lmtpSession.LMTPData(annotated, status)
+	}
+	return s.Session.Data(annotated)
+}
+
+// score spools the message data while passing it to the Scorer, and returns
+// the annotated message. The spool file must be removed by the caller.
+func (s *spamSession) score(tx *smtp.Transaction, r io.Reader) (spool *os.File, annotated io.Reader, err error) {
+	spool, err = ioutil.TempFile("", "go-smtp-spam-")
+	if err != nil {
+		return nil, nil, spamError()
+	}
+
+	pr, pw := io.Pipe()
+	done := make(chan *SpamScore, 1)
+	var scoreErr error
+	go func() {
+		score, err := s.be.Scorer.Score(tx, pr)
+		// Let the message be received even if the Scorer stops reading
+		pr.CloseWithError(io.ErrClosedPipe)
+		scoreErr = err
+		done <- score
+	}()
+
+	_, err = io.Copy(spool, io.TeeReader(r, &lenientWriter{w: pw}))
+	pw.CloseWithError(err)
+	score := <-done
+	if err != nil {
+		return spool, nil, err
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return spool, nil, spamError()
+	}
+
+	if scoreErr != nil || score == nil {
+		if !s.be.FailOpen {
+			return spool, nil, spamError()
+		}
+		score = nil
+	}
+
+	annotated, err = annotateSpam(spool, score)
+	if err != nil {
+		return spool, nil, spamError()
+	}
+	return spool, annotated, nil
+}
+
+func spamError() error {
+	return &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+		Message:      "Failed to scan message, try again later",
+	}
+}
+
+// lenientWriter writes to w until it fails, then discards the data.
+type lenientWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (w *lenientWriter) Write(b []byte) (int, error) {
+	if w.err == nil {
+		_, w.err = w.w.Write(b)
+	}
+	return len(b), nil
+}
+
+// annotateSpam prepends the X-Spam-Score and X-Spam-Status header fields to
+// a message, and removes the existing ones. If score is nil, only existing
+// fields are removed.
+func annotateSpam(r io.Reader, score *SpamScore) (io.Reader, error) {
+	var header bytes.Buffer
+	if score != nil {
+		status := "No"
+		if score.Spam {
+			status = "Yes"
+		}
+		fmt.Fprintf(&header, "X-Spam-Score: %.1f\r\n", score.Score)
+		fmt.Fprintf(&header, "X-Spam-Status: %v, score=%.1f required=%.1f", status, score.Score, score.Required)
+		if len(score.Tests) > 0 {
+			fmt.Fprintf(&header, " tests=%v", strings.Join(score.Tests, ","))
+		}
+		header.WriteString("\r\n")
+	}
+
+	// The header is buffered in memory, the body is streamed from the spool
+	br := bufio.NewReader(r)
+	skip := false
+	for {
+		line, err := br.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			// End of the header
+			header.Write(line)
+			break
+		}
+
+		if line[0] != ' ' && line[0] != '\t' {
+			skip = isSpamField(line)
+		}
+		if !skip {
+			header.Write(line)
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+
+	return io.MultiReader(&header, br), nil
+}
+
+func isSpamField(line []byte) bool {
+	i := bytes.IndexByte(line, ':')
+	if i < 0 {
+		return false
+	}
+	name := strings.TrimSpace(string(line[:i]))
+	return strings.EqualFold(name, "X-Spam-Score") || strings.EqualFold(name, "X-Spam-Status")
+}
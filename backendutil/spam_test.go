@@ -0,0 +1,79 @@
+package backendutil_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/emersion/go-smtp/backendutil"
+)
+
+func TestSpamBackend(t *testing.T) {
+	scorer := backendutil.ScorerFunc(func(tx *smtp.Transaction, r io.Reader) (*backendutil.SpamScore, error) {
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Contains(b, []byte("scanner down")) {
+			return nil, errors.New("connection refused")
+		}
+		if bytes.Contains(b, []byte("viagra")) {
+			return &backendutil.SpamScore{Spam: true, Score: 12.5, Required: 5, Tests: []string{"PILLS", "BAYES_99"}}, nil
+		}
+		return &backendutil.SpamScore{Score: 0.3, Required: 5}, nil
+	})
+	be := &recordBackend{}
+	s, addr := testServer(t, backendutil.NewSpamBackend(be, scorer))
+	defer s.Close()
+
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	msg := "X-Spam-Status: No, trust me\r\n" +
+		"x-spam-score: -100\r\n" +
+		" (continued)\r\n" +
+		"Subject: Hi\r\n" +
+		"\r\n" +
+		"X-Spam-Status: not a header field\r\n"
+	if err := c.SendMail("root@nsa.gov", []string{"root@gchq.gov.uk"}, strings.NewReader(msg)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SendMail("root@nsa.gov", []string{"root@gchq.gov.uk"}, strings.NewReader("Subject: Cheap viagra\r\n\r\nBuy now\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	err = c.SendMail("root@nsa.gov", []string{"root@gchq.gov.uk"}, strings.NewReader("Subject: Hi\r\n\r\nscanner down\r\n"))
+	var smtpErr *smtp.SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 451 {
+		t.Fatal("Expected a 451 error, got:", err)
+	}
+
+	want := []string{
+		"root@nsa.gov root@gchq.gov.uk X-Spam-Score: 0.3\r\n" +
+			"X-Spam-Status: No, score=0.3 required=5.0\r\n" +
+			"Subject: Hi\r\n" +
+			"\r\n" +
+			"X-Spam-Status: not a header field\r\n",
+		"root@nsa.gov root@gchq.gov.uk X-Spam-Score: 12.5\r\n" +
+			"X-Spam-Status: Yes, score=12.5 required=5.0 tests=PILLS,BAYES_99\r\n" +
+			"Subject: Cheap viagra\r\n" +
+			"\r\n" +
+			"Buy now\r\n",
+	}
+	be.mu.Lock()
+	defer be.mu.Unlock()
+	if len(be.messages) != len(want) {
+		t.Fatalf("Expected %v messages, got %v", len(want), len(be.messages))
+	}
+	for i, msg := range be.messages {
+		if msg != want[i] {
+			t.Errorf("Message #%v:\n%q\nwant:\n%q", i, msg, want[i])
+		}
+	}
+}
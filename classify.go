@@ -0,0 +1,201 @@
+package smtp
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrorCategory is a coarse category of SMTP errors, meant to help retry
+// engines decide what to do with a failed delivery.
+type ErrorCategory int
+
+const (
+	// The error doesn't match any rule.
+	CategoryUnknown ErrorCategory = iota
+	// The credentials were rejected or authentication is required.
+	CategoryAuthFailure
+	// The message was temporarily deferred by greylisting. Retrying after a
+	// few minutes usually succeeds.
+	CategoryGreylisted
+	// The sending host or domain has a poor reputation or is listed in a
+	// blocklist.
+	CategoryReputationBlock
+	// The recipient's mailbox is over quota.
+	CategoryMailboxFull
+	// TLS is required by the server, or the TLS requirements of the message
+	// can't be met.
+	CategoryPolicyTLS
+)
+
+func (cat ErrorCategory) String() string {
+	switch cat {
+	case CategoryUnknown:
+		return "unknown"
+	case CategoryAuthFailure:
+		return "auth-failure"
+	case CategoryGreylisted:
+		return "greylisted"
+	case CategoryReputationBlock:
+		return "reputation-block"
+	case CategoryMailboxFull:
+		return "mailbox-full"
+	case CategoryPolicyTLS:
+		return "policy-tls"
+	}
+	return fmt.Sprintf("ErrorCategory(%d)", int(cat))
+}
+
+// ClassifyRule maps errors to a category. All non-empty fields must match.
+type ClassifyRule struct {
+	Category ErrorCategory
+
+	// Reply code pattern, with "x" matching any digit, e.g. "4xx" or "550".
+	Code string
+	// Enhanced code pattern, with "x" matching any component, e.g. "x.7.1"
+	// or "5.2.2".
+	EnhancedCode string
+	// Case-insensitive substrings of the error message. At least one of them
+	// must be present.
+	Patterns []string
+}
+
+func (rule *ClassifyRule) match(err *SMTPError) bool {
+	if rule.Code != "" && !matchCode(rule.Code, fmt.Sprintf("%03d", err.Code)) {
+		return false
+	}
+	if rule.EnhancedCode != "" && !matchEnhancedCode(rule.EnhancedCode, err.EnhancedCode) {
+		return false
+	}
+	if len(rule.Patterns) == 0 {
+		return true
+	}
+	msg := strings.ToLower(err.Message)
+	for _, pattern := range rule.Patterns {
+		if strings.Contains(msg, strings.ToLower(pattern)) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchCode(pattern, code string) bool {
+	if len(pattern) != len(code) {
+		return false
+	}
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] != 'x' && pattern[i] != code[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func matchEnhancedCode(pattern string, code EnhancedCode) bool {
+	if code == EnhancedCodeNotSet || code == NoEnhancedCode {
+		return false
+	}
+	parts := strings.Split(pattern, ".")
+	if len(parts) != len(code) {
+		return false
+	}
+	for i, part := range parts {
+		if part == "x" {
+			continue
+		}
+		if n, err := strconv.Atoi(part); err != nil || n != code[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Classifier is a list of rules, evaluated in order.
+type Classifier []ClassifyRule
+
+// Classify returns the category of the first rule matching err. Errors
+// which don't wrap a *SMTPError are classified as CategoryUnknown.
+func (cl Classifier) Classify(err error) ErrorCategory {
+	var smtpErr *SMTPError
+	if !errors.As(err, &smtpErr) {
+		return CategoryUnknown
+	}
+	for i := range cl {
+		if cl[i].match(smtpErr) {
+			return cl[i].Category
+		}
+	}
+	return CategoryUnknown
+}
+
+// DefaultClassifier contains rules for standard enhanced codes and the
+// replies of well-known providers. Custom rules can be added by building a
+// new Classifier on top of it.
+var DefaultClassifier = Classifier{
+	// TLS policies, checked before authentication since some servers reply
+	// with 530 5.7.0 when STARTTLS is required
+	{Category: CategoryPolicyTLS, EnhancedCode: "x.7.10"}, // encryption needed
+	{Category: CategoryPolicyTLS, EnhancedCode: "x.7.11"}, // encryption required for mechanism
+	{Category: CategoryPolicyTLS, EnhancedCode: "x.7.30"}, // REQUIRETLS support required
+	{Category: CategoryPolicyTLS, Code: "5xx", Patterns: []string{"starttls", "must issue a tls", "tls required", "encryption required"}},
+
+	{Category: CategoryAuthFailure, EnhancedCode: "x.7.8"}, // credentials invalid
+	{Category: CategoryAuthFailure, EnhancedCode: "x.7.9"}, // mechanism too weak
+	{Category: CategoryAuthFailure, Code: "535"},
+	{Category: CategoryAuthFailure, Code: "534"},
+	{Category: CategoryAuthFailure, Code: "530", Patterns: []string{"auth"}},
+	{Category: CategoryAuthFailure, Code: "5xx", Patterns: []string{"authentication required", "authentication failed", "username and password not accepted"}},
+
+	{Category: CategoryGreylisted, Code: "4xx", Patterns: []string{"greylist", "graylist", "grey-list", "gray-list"}},
+
+	{Category: CategoryMailboxFull, EnhancedCode: "x.2.2"}, // mailbox full
+	{Category: CategoryMailboxFull, Patterns: []string{"over quota", "quota exceeded", "mailbox full", "mailbox is full", "out of storage space"}},
+
+	{Category: CategoryReputationBlock, EnhancedCode: "x.7.25"}, // reverse DNS validation failed
+	{Category: CategoryReputationBlock, Patterns: []string{
+		"blocklist", "blacklist", "block list", "black list",
+		"spamhaus", "spamcop", "barracuda", "sorbs",
+		"dnsbl", "poor reputation", "low reputation", "ip reputation",
+		"banned sending ip", "unsolicited mail",
+	}},
+}
+
+// ClassifyError returns the category of err according to DefaultClassifier.
+func ClassifyError(err error) ErrorCategory {
+	return DefaultClassifier.Classify(err)
+}
+
+// retryAfterRegexp matches the common ways servers suggest a delay, e.g.
+// "try again in 5 minutes", "retry after 300 seconds" or "wait 60s".
+var retryAfterRegexp = regexp.MustCompile(`(?i)\b(?:retry|try again|come back|wait)(?:\s+(?:after|in|for))?\s+(\d+)\s*(seconds?|secs?|s|minutes?|mins?|m|hours?|hrs?|h)\b`)
+
+// parseRetryAfter returns the delay suggested by the text of a 4xx reply, or
+// zero.
+func parseRetryAfter(code int, msg string) time.Duration {
+	if code/100 != 4 {
+		return 0
+	}
+	m := retryAfterRegexp.FindStringSubmatch(msg)
+	if m == nil {
+		return 0
+	}
+	n, err := strconv.Atoi(m[1])
+	if err != nil {
+		return 0
+	}
+
+	unit := time.Second
+	switch strings.ToLower(m[2])[0] {
+	case 'm':
+		unit = time.Minute
+	case 'h':
+		unit = time.Hour
+	}
+	if max := int(24 * time.Hour / unit); n > max {
+		n = max
+	}
+	return time.Duration(n) * unit
+}
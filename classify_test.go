@@ -0,0 +1,69 @@
+package smtp
+
+import (
+	"fmt"
+	"net/textproto"
+	"testing"
+	"time"
+)
+
+func TestClassifyError(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want ErrorCategory
+	}{
+		{&SMTPError{Code: 535, EnhancedCode: EnhancedCode{5, 7, 8}, Message: "Username and Password not accepted"}, CategoryAuthFailure},
+		{&SMTPError{Code: 530, EnhancedCode: EnhancedCode{5, 7, 0}, Message: "Authentication Required"}, CategoryAuthFailure},
+		{&SMTPError{Code: 530, EnhancedCode: EnhancedCode{5, 7, 0}, Message: "Must issue a STARTTLS command first"}, CategoryPolicyTLS},
+		{&SMTPError{Code: 550, EnhancedCode: EnhancedCode{5, 7, 30}, Message: "REQUIRETLS support required"}, CategoryPolicyTLS},
+		{&SMTPError{Code: 451, EnhancedCode: EnhancedCode{4, 7, 1}, Message: "Greylisted, please try again in 300 seconds"}, CategoryGreylisted},
+		{&SMTPError{Code: 550, EnhancedCode: EnhancedCode{5, 7, 1}, Message: "Greylisted"}, CategoryUnknown},
+		{&SMTPError{Code: 552, EnhancedCode: EnhancedCode{5, 2, 2}, Message: "The email account that you tried to reach is over quota"}, CategoryMailboxFull},
+		{&SMTPError{Code: 452, EnhancedCode: EnhancedCodeNotSet, Message: "Mailbox full"}, CategoryMailboxFull},
+		{&SMTPError{Code: 554, EnhancedCode: EnhancedCode{5, 7, 1}, Message: "Service unavailable; Client host [192.0.2.1] blocked using zen.spamhaus.org"}, CategoryReputationBlock},
+		{&SMTPError{Code: 550, EnhancedCode: EnhancedCode{5, 7, 25}, Message: "The IP address sending this message does not have a PTR record"}, CategoryReputationBlock},
+		{&SMTPError{Code: 550, EnhancedCode: EnhancedCode{5, 1, 1}, Message: "No such user"}, CategoryUnknown},
+		{fmt.Errorf("delivery failed: %w", &SMTPError{Code: 535, Message: "Bad credentials"}), CategoryAuthFailure},
+		{fmt.Errorf("connection refused"), CategoryUnknown},
+	} {
+		if got := ClassifyError(tc.err); got != tc.want {
+			t.Errorf("ClassifyError(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestClassifier_custom(t *testing.T) {
+	cl := append(Classifier{
+		{Category: CategoryGreylisted, Code: "421", Patterns: []string{"too many connections"}},
+	}, DefaultClassifier...)
+
+	err := &SMTPError{Code: 421, EnhancedCode: EnhancedCode{4, 7, 0}, Message: "Too many connections from your IP"}
+	if got := cl.Classify(err); got != CategoryGreylisted {
+		t.Errorf("Classify() = %v, want %v", got, CategoryGreylisted)
+	}
+	if got := ClassifyError(err); got != CategoryUnknown {
+		t.Errorf("ClassifyError() = %v, want %v", got, CategoryUnknown)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	for _, tc := range []struct {
+		code int
+		msg  string
+		want time.Duration
+	}{
+		{451, "4.7.1 Greylisted, please try again in 300 seconds", 300 * time.Second},
+		{450, "4.2.0 Retry after 5 minutes", 5 * time.Minute},
+		{421, "4.7.0 Too many connections, wait 60s", time.Minute},
+		{421, "4.7.0 Come back in 2 hours", 2 * time.Hour},
+		{421, "4.7.0 Please retry in 1000000 hours", 24 * time.Hour},
+		{421, "4.7.0 Try again later, closing connection.", 0},
+		{450, "4.2.0 Mailbox busy, 5 minutes", 0},
+		{550, "5.7.1 Rejected, retry after 5 minutes", 0},
+	} {
+		err := toSMTPErr(&textproto.Error{Code: tc.code, Msg: tc.msg})
+		if err.RetryAfter != tc.want {
+			t.Errorf("RetryAfter for %q = %v, want %v", tc.msg, err.RetryAfter, tc.want)
+		}
+	}
+}
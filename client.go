@@ -12,8 +12,12 @@ import (
 	"io"
 	"net"
 	"net/textproto"
+	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/emersion/go-sasl"
@@ -29,21 +33,107 @@ type Client struct {
 	lmtp       bool
 	ext        map[string]string // supported extensions
 	localName  string            // the name to use in HELO/EHLO/LHLO
+	didSetName bool              // whether Hello has set localName
 	didGreet   bool              // whether we've received greeting from server
 	greetError error             // the error from the greeting
+	greeting   string            // the text of the greeting
 	didHello   bool              // whether we've said HELO/EHLO/LHLO
 	helloError error             // the error from the hello
 	rcpts      []string          // recipients accumulated for the current session
+	txStatus   TransactionStatus // RCPT replies for the current transaction
+	preTLSExt  map[string]string // extensions supported before STARTTLS
+	txFrom     string            // reverse-path of the current transaction
+	txStart    time.Time         // when the current transaction started
+
+	connectStart time.Time              // when the connection was established
+	pendingHooks []func(h *ClientHooks) // events recorded before Hooks was set
 
 	// Time to wait for command responses (this includes 3xx reply to DATA).
 	CommandTimeout time.Duration
-	// Time to wait for responses after final dot.
+	// Time to wait for responses after final dot. It is also used as the
+	// write deadline for each write of the message data.
 	SubmissionTimeout time.Duration
 
+	// Called after each write of the message data with the total number of
+	// bytes written so far, e.g. to display upload progress.
+	DataProgress func(written int64)
+
+	// Minimum upload rate of the message data, in bytes per second. If less
+	// than MinDataRate*MinDataRateWindow bytes are written during a window,
+	// e.g. because the route is blackholed, the connection is closed and the
+	// message data writer returns a *ThroughputError. This includes time
+	// spent by the caller producing the data. Zero disables the watchdog.
+	MinDataRate int
+	// Period over which MinDataRate is checked. Defaults to 30 seconds.
+	MinDataRateWindow time.Duration
+
+	// Called after each command round trip, e.g. to record the latency of
+	// the server in a histogram.
+	CommandDone func(stats *CommandStats)
+
+	// Called at milestones of the session, e.g. to record metrics or traces.
+	Hooks *ClientHooks
+
 	// Logger for all network activity.
 	DebugWriter io.Writer
+
+	// If set and Hello isn't called, the client introduces itself with the
+	// name found by a reverse DNS lookup of the local address of the
+	// connection instead of "localhost", or with the address literal (e.g.
+	// "[192.0.2.1]") if there is none. Many servers penalize clients
+	// introducing themselves as "localhost". Lookups are cached for an hour.
+	AutoLocalName bool
+
+	// Send HELO instead of EHLO, for servers known to mishandle EHLO. No
+	// extension can be used. Ignored for LMTP.
+	ForceHELO bool
+
+	// Issue a new EHLO after a successful AUTH command, to refresh the list
+	// of supported extensions. Some servers advertise additional extensions
+	// to authenticated clients.
+	RefreshExtensionsAfterAuth bool
+	// If not nil, called with the extensions parsed from each EHLO or LHLO
+	// reply, before they're used. Entries can be added, changed or removed,
+	// e.g. to force-enable an extension supported by a server whose
+	// advertisement is stripped by a broken proxy. Not called after HELO.
+	OverrideExtensions func(ext map[string]string)
+	// Called each time the list of supported extensions is (re-)loaded, e.g.
+	// after STARTTLS.
+	ExtensionsChanged func(ext map[string]string)
+
+	// Minimum number of recipients which must have been accepted by the
+	// server for Data and LMTPData to issue the DATA command. A negative value
+	// requires all recipients to be accepted. Zero disables the check.
+	MinAcceptedRecipients int
+	// If not nil, called by Data and LMTPData before issuing the DATA command
+	// with the replies to the RCPT commands. If it returns an error, the
+	// transaction is aborted.
+	ProceedToData func(status *TransactionStatus) error
+
+	// If not nil, commands sent and replies received are appended to the
+	// transcript. Authentication data is redacted.
+	Transcript *Transcript
+
+	// If set, ErrConcurrentUse errors include the stack trace of the
+	// goroutine using the client, to help find the culprit. Recording the
+	// stack trace for each command is expensive.
+	DebugConcurrentUse bool
+
+	redact bool // whether commands are currently redacted in the transcript
+
+	busy      int32      // whether a command is in progress, accessed atomically
+	busyMu    sync.Mutex // protects busyStack
+	busyStack []byte     // stack trace of the goroutine which set busy
+
+	idle *idleMonitor // see StartIdleMonitor
 }
 
+// ErrConcurrentUse is returned when a command is issued while another one is
+// in progress, e.g. by another goroutine or while the message data writer
+// returned by Data is still open. A Client must not be used by multiple
+// goroutines at once.
+var ErrConcurrentUse = errors.New("smtp: concurrent use of client")
+
 // 30 seconds was chosen as it's the same duration as http.DefaultTransport's
 // timeout.
 var defaultDialer = net.Dialer{Timeout: 30 * time.Second}
@@ -54,11 +144,13 @@ var defaultDialer = net.Dialer{Timeout: 30 * time.Second}
 // This function returns a plaintext connection. To enable TLS, use
 // DialStartTLS.
 func Dial(addr string) (*Client, error) {
+	start := time.Now()
 	conn, err := defaultDialer.Dial("tcp", addr)
 	if err != nil {
 		return nil, err
 	}
 	client := NewClient(conn)
+	client.connectStart = start
 	client.serverName, _, _ = net.SplitHostPort(addr)
 	return client, nil
 }
@@ -72,19 +164,62 @@ func DialTLS(addr string, tlsConfig *tls.Config) (*Client, error) {
 		NetDialer: &defaultDialer,
 		Config:    tlsConfig,
 	}
+	start := time.Now()
 	conn, err := tlsDialer.Dial("tcp", addr)
 	if err != nil {
 		return nil, err
 	}
 	client := NewClient(conn)
+	client.connectStart = start
 	client.serverName, _, _ = net.SplitHostPort(addr)
 	return client, nil
 }
 
+// DialTLSExternal returns a new Client connected to an SMTP server via TLS at
+// addr, authenticated with the client certificate from tlsConfig via the
+// SASL EXTERNAL mechanism. identity is the optional authorization identity.
+//
+// This is typically used by relays which are authorized by certificate
+// instead of password.
+func DialTLSExternal(addr string, tlsConfig *tls.Config, identity string) (*Client, error) {
+	if tlsConfig == nil || (len(tlsConfig.Certificates) == 0 && tlsConfig.GetClientCertificate == nil) {
+		return nil, errors.New("smtp: no client certificate configured for AUTH EXTERNAL")
+	}
+
+	c, err := DialTLS(addr, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.authExternal(identity); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Client) authExternal(identity string) error {
+	if err := c.hello(); err != nil {
+		if _, ok := err.(*SMTPError); !ok {
+			// With TLS 1.3, a rejected client certificate is only noticed
+			// when reading from the connection
+			return fmt.Errorf("smtp: connection failed, the server may have rejected the client certificate: %w", err)
+		}
+		return err
+	}
+	if !c.SupportsAuth(sasl.External) {
+		return errors.New("smtp: server doesn't offer AUTH EXTERNAL, the client certificate may not have been accepted")
+	}
+	if err := c.Auth(sasl.NewExternalClient(identity)); err != nil {
+		return fmt.Errorf("smtp: AUTH EXTERNAL failed: %w", err)
+	}
+	return nil
+}
+
 // DialStartTLS retruns a new Client connected to an SMTP server via STARTTLS
 // at addr. The addr must include a port, as in "mail.example.com:smtp".
 //
-// A nil tlsConfig is equivalent to a zero tls.Config.
+// A nil tlsConfig is equivalent to a zero tls.Config. If TLS can't be
+// negotiated, a *StartTLSError is returned, see also DialStartTLSPolicy.
 func DialStartTLS(addr string, tlsConfig *tls.Config) (*Client, error) {
 	c, err := Dial(addr)
 	if err != nil {
@@ -109,6 +244,7 @@ func NewClient(conn net.Conn) *Client {
 		// 10 minutes + 2 minute buffer in case the server is doing transparent
 		// forwarding and also follows recommended timeouts.
 		SubmissionTimeout: 12 * time.Minute,
+		connectStart:      time.Now(),
 	}
 
 	c.setConn(conn)
@@ -126,15 +262,32 @@ func NewClientStartTLS(conn net.Conn, tlsConfig *tls.Config) (*Client, error) {
 	return c, nil
 }
 
+// initStartTLS negotiates TLS with STARTTLS. Failures are reported as
+// *StartTLSError.
 func initStartTLS(c *Client, tlsConfig *tls.Config) error {
 	if err := c.hello(); err != nil {
 		return err
 	}
 	if ok, _ := c.Extension("STARTTLS"); !ok {
-		return errors.New("smtp: server doesn't support STARTTLS")
+		return &StartTLSError{
+			Stage: StartTLSUnsupported,
+			Err:   errors.New("server doesn't support STARTTLS"),
+		}
 	}
+	start := time.Now()
 	if err := c.startTLS(tlsConfig); err != nil {
-		return err
+		c.tlsDone(start, err)
+		return &StartTLSError{Stage: StartTLSCommand, Err: err}
+	}
+
+	// Perform the handshake right away, to report its failures here rather
+	// than on the next command
+	c.conn.SetDeadline(time.Now().Add(c.CommandTimeout))
+	err := c.conn.(*tls.Conn).Handshake()
+	c.conn.SetDeadline(time.Time{})
+	c.tlsDone(start, err)
+	if err != nil {
+		return &StartTLSError{Stage: StartTLSHandshake, Err: err}
 	}
 	return nil
 }
@@ -177,6 +330,9 @@ func (c *Client) setConn(conn net.Conn) {
 
 // Close closes the connection.
 func (c *Client) Close() error {
+	if c.idle != nil {
+		c.idle.close()
+	}
 	return c.text.Close()
 }
 
@@ -184,21 +340,37 @@ func (c *Client) greet() error {
 	if c.didGreet {
 		return c.greetError
 	}
+	if err := c.acquire(); err != nil {
+		return err
+	}
+	defer c.release()
 
 	// Initial greeting timeout. RFC 5321 recommends 5 minutes.
 	c.conn.SetDeadline(time.Now().Add(c.CommandTimeout))
 	defer c.conn.SetDeadline(time.Time{})
 
 	c.didGreet = true
-	_, _, err := c.readResponse(220)
+	_, msg, err := c.readResponse(220)
 	if err != nil {
 		c.greetError = err
 		c.text.Close()
 	}
+	c.greeting = msg
+	c.connectDone(c.connectStart, msg, c.greetError)
 
 	return c.greetError
 }
 
+// Greeting returns the lines of the server greeting, in order, e.g. to read
+// an extended banner. The first line usually starts with the domain of the
+// server.
+func (c *Client) Greeting() ([]string, error) {
+	if err := c.greet(); err != nil {
+		return nil, err
+	}
+	return strings.Split(c.greeting, "\n"), nil
+}
+
 // hello runs a hello exchange if needed.
 func (c *Client) hello() error {
 	if c.didHello {
@@ -210,9 +382,17 @@ func (c *Client) hello() error {
 	}
 
 	c.didHello = true
+	if c.AutoLocalName && !c.didSetName {
+		if name := localNameForAddr(c.conn.LocalAddr()); name != "" {
+			c.localName = name
+		}
+	}
+	if c.ForceHELO && !c.lmtp {
+		c.helloError = c.helo()
+		return c.helloError
+	}
 	if err := c.ehlo(); err != nil {
-		var smtpError *SMTPError
-		if errors.As(err, &smtpError) && (smtpError.Code == 500 || smtpError.Code == 502) {
+		if isEhloUnsupported(err) {
 			// The server doesn't support EHLO, fallback to HELO
 			c.helloError = c.helo()
 		} else {
@@ -222,6 +402,25 @@ func (c *Client) hello() error {
 	return c.helloError
 }
 
+// isEhloUnsupported reports whether an EHLO error indicates that the server
+// doesn't support EHLO, in which case HELO is worth trying.
+func isEhloUnsupported(err error) bool {
+	var smtpError *SMTPError
+	if errors.As(err, &smtpError) {
+		switch smtpError.Code {
+		case 500, 502: // command unrecognized or not implemented
+			return true
+		case 501, 504: // replied by some old servers
+			return true
+		}
+		return false
+	}
+
+	// Some broken servers send a malformed reply to EHLO
+	var protoErr textproto.ProtocolError
+	return errors.As(err, &protoErr)
+}
+
 // Hello sends a HELO or EHLO to the server as the given host name.
 // Calling this method is only necessary if the client needs control
 // over the host name used. The client will introduce itself as "localhost"
@@ -237,31 +436,127 @@ func (c *Client) Hello(localName string) error {
 		return errors.New("smtp: Hello called after other methods")
 	}
 	c.localName = localName
+	c.didSetName = true
 	return c.hello()
 }
 
 func (c *Client) readResponse(expectCode int) (int, string, error) {
 	code, msg, err := c.text.ReadResponse(expectCode)
+	if c.Transcript != nil && code != 0 {
+		c.Transcript.addReply(code, msg)
+	}
 	if protoErr, ok := err.(*textproto.Error); ok {
 		err = toSMTPErr(protoErr)
 	}
 	return code, msg, err
 }
 
+// acquire marks the client as busy until release is called. It fails with
+// ErrConcurrentUse if the client is already busy, instead of interleaving
+// commands on the connection.
+func (c *Client) acquire() error {
+	if !atomic.CompareAndSwapInt32(&c.busy, 0, 1) {
+		if c.DebugConcurrentUse {
+			c.busyMu.Lock()
+			stack := c.busyStack
+			c.busyMu.Unlock()
+			if stack != nil {
+				return fmt.Errorf("%w, client in use by:\n%s", ErrConcurrentUse, stack)
+			}
+		}
+		return ErrConcurrentUse
+	}
+	if c.DebugConcurrentUse {
+		c.busyMu.Lock()
+		c.busyStack = debug.Stack()
+		c.busyMu.Unlock()
+	}
+	if c.idle != nil {
+		if err := c.idle.pause(); err != nil {
+			c.release()
+			return err
+		}
+	}
+	c.flushHooks()
+	return nil
+}
+
+func (c *Client) release() {
+	if c.DebugConcurrentUse {
+		c.busyMu.Lock()
+		c.busyStack = nil
+		c.busyMu.Unlock()
+	}
+	if c.idle != nil {
+		c.idle.resume()
+	}
+	atomic.StoreInt32(&c.busy, 0)
+}
+
 // cmd is a convenience function that sends a command and returns the response
 // textproto.Error returned by c.text.ReadResponse is converted into SMTPError.
 func (c *Client) cmd(expectCode int, format string, args ...interface{}) (int, string, error) {
+	if err := c.acquire(); err != nil {
+		return 0, "", err
+	}
+	defer c.release()
+	return c.cmdAcquired(expectCode, format, args...)
+}
+
+// cmdAcquired is like cmd, but the caller must have called acquire.
+func (c *Client) cmdAcquired(expectCode int, format string, args ...interface{}) (int, string, error) {
 	c.conn.SetDeadline(time.Now().Add(c.CommandTimeout))
 	defer c.conn.SetDeadline(time.Time{})
 
-	id, err := c.text.Cmd(format, args...)
+	line := fmt.Sprintf(format, args...)
+	if c.Transcript != nil {
+		c.Transcript.addCommand(line, c.redact)
+	}
+
+	verb := "AUTH"
+	if !c.redact {
+		verb = strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+	}
+	start := time.Now()
+
+	id, err := c.text.Cmd("%s", line)
 	if err != nil {
+		c.commandDone(verb, start, 0, err)
 		return 0, "", err
 	}
 	c.text.StartResponse(id)
 	defer c.text.EndResponse(id)
 
-	return c.readResponse(expectCode)
+	code, msg, err := c.readResponse(expectCode)
+	c.commandDone(verb, start, code, err)
+	return code, msg, err
+}
+
+// CommandStats describes the round trip of a command, see
+// Client.CommandDone.
+type CommandStats struct {
+	// Command verb, e.g. "MAIL". Commands sent during authentication are
+	// reported as "AUTH", the end of the message data as ".".
+	Verb string
+	// Time between sending the command and reading the reply. For the end of
+	// the message data over LMTP, the last reply is used.
+	Latency time.Duration
+	// Reply code, zero if no reply could be read.
+	Code int
+	// Error returned for the command, nil if it succeeded.
+	Err error
+}
+
+func (c *Client) commandDone(verb string, start time.Time, code int, err error) {
+	if c.CommandDone == nil {
+		return
+	}
+	c.CommandDone(&CommandStats{
+		Verb:    verb,
+		Latency: time.Since(start),
+		Code:    code,
+		Err:     err,
+	})
 }
 
 // helo sends the HELO greeting to the server. It should be used only when the
@@ -269,6 +564,9 @@ func (c *Client) cmd(expectCode int, format string, args ...interface{}) (int, s
 func (c *Client) helo() error {
 	c.ext = nil
 	_, _, err := c.cmd(250, "HELO %s", c.localName)
+	if err == nil {
+		c.setExtensions(nil)
+	}
 	return err
 }
 
@@ -297,10 +595,31 @@ func (c *Client) ehlo() error {
 			}
 		}
 	}
-	c.ext = ext
+	if c.OverrideExtensions != nil {
+		c.OverrideExtensions(ext)
+	}
+	c.setExtensions(ext)
 	return err
 }
 
+func (c *Client) setExtensions(ext map[string]string) {
+	c.ext = ext
+	if c.ExtensionsChanged != nil {
+		c.ExtensionsChanged(copyExtensions(ext))
+	}
+}
+
+func copyExtensions(ext map[string]string) map[string]string {
+	if ext == nil {
+		return nil
+	}
+	m := make(map[string]string, len(ext))
+	for k, v := range ext {
+		m[k] = v
+	}
+	return m
+}
+
 // startTLS sends the STARTTLS command and encrypts all further communication.
 // Only servers that advertise the STARTTLS extension support this function.
 //
@@ -311,7 +630,12 @@ func (c *Client) startTLS(config *tls.Config) error {
 	if err := c.hello(); err != nil {
 		return err
 	}
-	_, _, err := c.cmd(220, "STARTTLS")
+	// The connection must not be used until it's upgraded
+	if err := c.acquire(); err != nil {
+		return err
+	}
+	defer c.release()
+	_, _, err := c.cmdAcquired(220, "STARTTLS")
 	if err != nil {
 		return err
 	}
@@ -327,6 +651,10 @@ func (c *Client) startTLS(config *tls.Config) error {
 		testHookStartTLS(config)
 	}
 	c.setConn(tls.Client(c.conn, config))
+	// RFC 3207 section 4.2: the client must discard the knowledge obtained
+	// from the server before the TLS negotiation, and issue EHLO again.
+	c.preTLSExt = c.ext
+	c.ext = nil
 	c.didHello = false
 	return nil
 }
@@ -335,13 +663,48 @@ func (c *Client) startTLS(config *tls.Config) error {
 // The return values are their zero values if STARTTLS did
 // not succeed.
 func (c *Client) TLSConnectionState() (state tls.ConnectionState, ok bool) {
-	tc, ok := c.conn.(*tls.Conn)
+	tc, ok := unwrapConn(c.conn).(*tls.Conn)
 	if !ok {
 		return
 	}
 	return tc.ConnectionState(), true
 }
 
+// Compress enables DEFLATE compression of the stream with the experimental
+// XCOMPRESS extension, see Server.EnableXCOMPRESS. It must be called outside
+// of a mail transaction, after STARTTLS if TLS is desired. It can't be used
+// with StartIdleMonitor.
+func (c *Client) Compress() error {
+	if err := c.hello(); err != nil {
+		return err
+	}
+	ok, args := c.Extension("XCOMPRESS")
+	if !ok || !containsFold(strings.Fields(args), "DEFLATE") {
+		return errors.New("smtp: server doesn't support XCOMPRESS DEFLATE")
+	}
+	if c.idle != nil {
+		return errors.New("smtp: compression can't be used with the idle monitor")
+	}
+	if err := c.acquire(); err != nil {
+		return err
+	}
+	defer c.release()
+	if _, _, err := c.cmdAcquired(220, "XCOMPRESS DEFLATE"); err != nil {
+		return err
+	}
+	c.setConn(newCompressConn(c.conn))
+	return nil
+}
+
+func containsFold(l []string, s string) bool {
+	for _, v := range l {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
 // Verify checks the validity of an email address on the server.
 // If Verify returns nil, the address is valid. A non-nil return
 // does not necessarily indicate an invalid address. Many servers
@@ -372,6 +735,16 @@ func (c *Client) Auth(a sasl.Client) error {
 	if err != nil {
 		return err
 	}
+	// Other commands must not be interleaved with the exchange
+	if err := c.acquire(); err != nil {
+		return err
+	}
+	defer c.release()
+	start := time.Now()
+	c.redact = true
+	defer func() {
+		c.redact = false
+	}()
 	var resp64 []byte
 	if len(resp) > 0 {
 		resp64 = make([]byte, encoding.EncodedLen(len(resp)))
@@ -379,7 +752,7 @@ func (c *Client) Auth(a sasl.Client) error {
 	} else if resp != nil {
 		resp64 = []byte{'='}
 	}
-	code, msg64, err := c.cmd(0, strings.TrimSpace(fmt.Sprintf("AUTH %s %s", mech, resp64)))
+	code, msg64, err := c.cmdAcquired(0, strings.TrimSpace(fmt.Sprintf("AUTH %s %s", mech, resp64)))
 	for err == nil {
 		var msg []byte
 		switch code {
@@ -400,7 +773,7 @@ func (c *Client) Auth(a sasl.Client) error {
 		}
 		if err != nil {
 			// abort the AUTH
-			c.cmd(501, "*")
+			c.cmdAcquired(501, "*")
 			break
 		}
 		if resp == nil {
@@ -408,11 +781,105 @@ func (c *Client) Auth(a sasl.Client) error {
 		}
 		resp64 = make([]byte, encoding.EncodedLen(len(resp)))
 		encoding.Encode(resp64, resp)
-		code, msg64, err = c.cmd(0, string(resp64))
+		code, msg64, err = c.cmdAcquired(0, string(resp64))
+	}
+	c.authDone(mech, start, err)
+	if err == nil && c.RefreshExtensionsAfterAuth {
+		c.ext = nil
+		c.didHello = false
+		c.helloError = nil
 	}
 	return err
 }
 
+// ErrInsecureAuth is returned by Client.AuthAuto when the only mutually
+// supported mechanisms would send the password in clear text over a
+// connection without TLS.
+var ErrInsecureAuth = errors.New("smtp: refusing to send the password in clear text over a connection without TLS")
+
+// AuthCredentials holds the credentials used by Client.AuthAuto.
+type AuthCredentials struct {
+	// Authorization identity, usually empty.
+	Identity string
+	Username string
+	Password string
+	// Clients for additional mechanisms by upper-case name, e.g.
+	// "SCRAM-SHA-256". They take precedence over the built-in PLAIN and LOGIN
+	// clients.
+	Mechanisms map[string]sasl.Client
+	// Allow PLAIN and LOGIN on connections without TLS.
+	AllowInsecure bool
+}
+
+// defaultAuthPreference is the mechanism order used by AuthAuto, strongest
+// first.
+var defaultAuthPreference = []string{
+	"SCRAM-SHA-256-PLUS",
+	"SCRAM-SHA-256",
+	"SCRAM-SHA-1-PLUS",
+	"SCRAM-SHA-1",
+	sasl.Plain,
+	sasl.Login,
+}
+
+// isClearTextMechanism returns whether a SASL mechanism sends the password in
+// clear text.
+func isClearTextMechanism(mech string) bool {
+	return strings.EqualFold(mech, sasl.Plain) || strings.EqualFold(mech, sasl.Login)
+}
+
+// AuthAuto authenticates a client with the first mechanism of preference
+// supported by both the server and the client. If preference is nil, SCRAM
+// mechanisms are tried first, then PLAIN and LOGIN.
+//
+// PLAIN and LOGIN are provided by the client, other mechanisms must be in
+// creds.Mechanisms. Unless creds.AllowInsecure is set, PLAIN and LOGIN are
+// only used on connections with TLS, and ErrInsecureAuth is returned if no
+// other mechanism is available.
+func (c *Client) AuthAuto(creds *AuthCredentials, preference []string) error {
+	if err := c.hello(); err != nil {
+		return err
+	}
+	if ok, _ := c.Extension("AUTH"); !ok {
+		return errors.New("smtp: server doesn't support AUTH")
+	}
+	if preference == nil {
+		preference = defaultAuthPreference
+	}
+	_, isTLS := c.TLSConnectionState()
+
+	insecure := false
+	for _, mech := range preference {
+		mech = strings.ToUpper(mech)
+		if !c.SupportsAuth(mech) {
+			continue
+		}
+
+		a := creds.Mechanisms[mech]
+		if a == nil {
+			switch mech {
+			case sasl.Plain:
+				a = sasl.NewPlainClient(creds.Identity, creds.Username, creds.Password)
+			case sasl.Login:
+				a = sasl.NewLoginClient(creds.Username, creds.Password)
+			default:
+				continue
+			}
+		}
+		if isClearTextMechanism(mech) && !isTLS && !creds.AllowInsecure {
+			insecure = true
+			continue
+		}
+
+		return c.Auth(a)
+	}
+
+	if insecure {
+		return ErrInsecureAuth
+	}
+	return errors.New("smtp: no mutually supported authentication mechanism")
+}
+
 // Mail issues a MAIL command to the server using the provided email address.
 // If the server supports the 8BITMIME extension, Mail adds the BODY=8BITMIME
 // parameter.
@@ -434,25 +901,77 @@ func (c *Client) Mail(from string, opts *MailOptions) error {
 	// A high enough power of 2 than 510+14+26+11+9+9+39+500
 	sb.Grow(2048)
 	fmt.Fprintf(&sb, "MAIL FROM:<%s>", from)
-	if _, ok := c.ext["8BITMIME"]; ok {
+	var body BodyType
+	if opts != nil {
+		body = opts.Body
+	}
+	switch body {
+	case "":
+		if _, ok := c.ext["8BITMIME"]; ok {
+			sb.WriteString(" BODY=8BITMIME")
+		}
+	case Body7Bit:
+		// The BODY parameter can only be used with 8BITMIME
+		if _, ok := c.ext["8BITMIME"]; ok {
+			sb.WriteString(" BODY=7BIT")
+		}
+	case Body8BitMIME:
+		if _, ok := c.ext["8BITMIME"]; !ok {
+			return &OptionError{
+				Option: "BODY=8BITMIME",
+				Reason: "server does not support 8BITMIME",
+				Hint:   "encode the message with quoted-printable or base64 and use BODY=7BIT",
+			}
+		}
 		sb.WriteString(" BODY=8BITMIME")
+	case BodyBinaryMIME:
+		reason := "client does not support CHUNKING"
+		if _, ok := c.ext["CHUNKING"]; !ok {
+			reason = "server does not support CHUNKING, required by BINARYMIME"
+		} else if _, ok := c.ext["BINARYMIME"]; !ok {
+			reason = "server does not support BINARYMIME"
+		}
+		return &OptionError{
+			Option: "BODY=BINARYMIME",
+			Reason: reason,
+			Hint:   "encode binary parts with base64 and use BODY=8BITMIME or BODY=7BIT",
+		}
+	default:
+		return &OptionError{
+			Option: "BODY=" + string(body),
+			Reason: "unknown body type",
+			Hint:   "use BODY=7BIT or BODY=8BITMIME",
+		}
 	}
 	if _, ok := c.ext["SIZE"]; ok && opts != nil && opts.Size != 0 {
 		fmt.Fprintf(&sb, " SIZE=%v", opts.Size)
 	}
 	if opts != nil && opts.RequireTLS {
-		if _, ok := c.ext["REQUIRETLS"]; ok {
-			sb.WriteString(" REQUIRETLS")
-		} else {
-			return errors.New("smtp: server does not support REQUIRETLS")
+		if _, isTLS := c.TLSConnectionState(); !isTLS {
+			return &OptionError{
+				Option: "REQUIRETLS",
+				Reason: "connection is not using TLS",
+				Hint:   "use STARTTLS or implicit TLS before sending the message",
+			}
+		}
+		if _, ok := c.ext["REQUIRETLS"]; !ok {
+			return &OptionError{
+				Option: "REQUIRETLS",
+				Reason: "server does not support REQUIRETLS",
+				Hint:   "deliver the message to another server or drop the requirement",
+			}
 		}
+		sb.WriteString(" REQUIRETLS")
 	}
 	if opts != nil && opts.UTF8 {
-		if _, ok := c.ext["SMTPUTF8"]; ok {
-			sb.WriteString(" SMTPUTF8")
-		} else {
-			return errors.New("smtp: server does not support SMTPUTF8")
+		if _, ok := c.ext["SMTPUTF8"]; !ok {
+			return &OptionError{
+				Option: "SMTPUTF8",
+				Reason: "server does not support SMTPUTF8",
+				Hint:   "use ASCII addresses and encode non-ASCII header fields (RFC 2047)",
+			}
 		}
+		sb.WriteString(" SMTPUTF8")
 	}
 	if _, ok := c.ext["DSN"]; ok && opts != nil {
 		switch opts.Return {
@@ -476,8 +995,29 @@ func (c *Client) Mail(from string, opts *MailOptions) error {
 		}
 		// We can safely discard parameter if server does not support AUTH.
 	}
-	_, _, err := c.cmd(250, "%s", sb.String())
-	return err
+	start := time.Now()
+	if _, _, err := c.cmd(250, "%s", sb.String()); err != nil {
+		return err
+	}
+	c.txStatus = TransactionStatus{}
+	c.txFrom = from
+	c.txStart = start
+	return nil
+}
+
+// OptionError is returned by Client.Mail and Client.Rcpt when the requested
+// options can't be used with the server.
+type OptionError struct {
+	// The offending parameter, e.g. "BODY=BINARYMIME".
+	Option string
+	// Why it can't be used.
+	Reason string
+	// How to work around the issue.
+	Hint string
+}
+
+func (err *OptionError) Error() string {
+	return fmt.Sprintf("smtp: cannot use %v: %v (%v)", err.Option, err.Reason, err.Hint)
 }
 
 // Rcpt issues a RCPT command to the server using the provided email address.
@@ -515,7 +1055,11 @@ func (c *Client) Rcpt(to string, opts *RcptOptions) error {
 			switch opts.OriginalRecipientType {
 			case DSNAddressTypeRFC822:
 				if !isPrintableASCII(opts.OriginalRecipient) {
-					return errors.New("smtp: Illegal address")
+					return &OptionError{
+						Option: "ORCPT",
+						Reason: "non-ASCII address with the rfc822 address type",
+						Hint:   "use DSNAddressTypeUTF8",
+					}
 				}
 				enc = encodeXtext(opts.OriginalRecipient)
 			case DSNAddressTypeUTF8:
@@ -525,77 +1069,349 @@ func (c *Client) Rcpt(to string, opts *RcptOptions) error {
 					enc = encodeUTF8AddrXtext(opts.OriginalRecipient)
 				}
 			default:
-				return errors.New("smtp: Unknown address type")
+				return &OptionError{
+					Option: "ORCPT",
+					Reason: fmt.Sprintf("unknown address type %q", opts.OriginalRecipientType),
+					Hint:   "use DSNAddressTypeRFC822 or DSNAddressTypeUTF8",
+				}
 			}
 			fmt.Fprintf(&sb, " ORCPT=%s;%s", string(opts.OriginalRecipientType), enc)
 		}
 	}
-	if _, _, err := c.cmd(25, "%s", sb.String()); err != nil {
+	code, msg, err := c.cmd(25, "%s", sb.String())
+	if smtpErr, ok := err.(*SMTPError); ok {
+		c.txStatus.Rejected = append(c.txStatus.Rejected, RcptStatus{
+			Addr:         to,
+			Code:         smtpErr.Code,
+			EnhancedCode: smtpErr.EnhancedCode,
+			Message:      smtpErr.Message,
+		})
+	}
+	if err != nil {
 		return err
 	}
+	reply := toSMTPErr(&textproto.Error{Code: code, Msg: msg})
+	c.txStatus.Accepted = append(c.txStatus.Accepted, RcptStatus{
+		Addr:         to,
+		Code:         reply.Code,
+		EnhancedCode: reply.EnhancedCode,
+		Message:      reply.Message,
+	})
 	c.rcpts = append(c.rcpts, to)
 	return nil
 }
 
+// RcptStatus is the server reply to a RCPT command.
+type RcptStatus struct {
+	Addr         string
+	Code         int
+	EnhancedCode EnhancedCode
+	Message      string
+}
+
+// Err returns the reply as an *SMTPError if the recipient has been rejected,
+// nil otherwise.
+func (st *RcptStatus) Err() error {
+	if st.Code < 400 {
+		return nil
+	}
+	return &SMTPError{
+		Code:         st.Code,
+		EnhancedCode: st.EnhancedCode,
+		Message:      st.Message,
+		RetryAfter:   parseRetryAfter(st.Code, st.Message),
+	}
+}
+
+// Lines returns the lines of the reply text, in order. Enhanced codes
+// prepended to the lines are stripped.
+func (st *RcptStatus) Lines() []string {
+	return strings.Split(st.Message, "\n")
+}
+
+// Forwarding returns the forward-path given by the server in a 251 or 551
+// reply (RFC 5321 section 3.4), or nil. Permanent is set for 551 replies: the
+// recipient has been rejected, and the message can be sent to the new
+// address instead.
+func (st *RcptStatus) Forwarding() *ForwardingResult {
+	return parseForwarding(st.Code, st.Message)
+}
+
+// parseForwarding parses the forward-path of a 251 or 551 reply, e.g.
+// "User not local; will forward to <bob@example.org>".
+func parseForwarding(code int, msg string) *ForwardingResult {
+	if code != 251 && code != 551 {
+		return nil
+	}
+	start := strings.LastIndexByte(msg, '<')
+	if start < 0 {
+		return nil
+	}
+	end := strings.IndexByte(msg[start:], '>')
+	if end < 0 {
+		return nil
+	}
+	addr := msg[start+1 : start+end]
+	if addr == "" {
+		return nil
+	}
+	return &ForwardingResult{Address: addr, Permanent: code == 551}
+}
+
+// TransactionStatus contains the recipients of the current mail transaction,
+// in the order the RCPT commands have been issued.
+type TransactionStatus struct {
+	Accepted []RcptStatus
+	Rejected []RcptStatus
+}
+
+// TransactionStatus returns the server replies to the RCPT commands issued
+// since the last MAIL command. It can be used to decide whether to proceed to
+// DATA when some recipients have been rejected.
+//
+// I/O errors aren't recorded.
+func (c *Client) TransactionStatus() *TransactionStatus {
+	return &TransactionStatus{
+		Accepted: append([]RcptStatus(nil), c.txStatus.Accepted...),
+		Rejected: append([]RcptStatus(nil), c.txStatus.Rejected...),
+	}
+}
+
 type dataCloser struct {
 	c *Client
 	io.WriteCloser
 	statusCb func(rcpt string, status *SMTPError)
 	closed   bool
+	released bool // whether the client has been released, see Client.acquire
+	response string
+	written  int64
+
+	watchdog *throughputWatchdog
+}
+
+func (c *Client) newDataCloser(w io.WriteCloser, statusCb func(rcpt string, status *SMTPError)) *dataCloser {
+	d := &dataCloser{c: c, WriteCloser: w, statusCb: statusCb}
+	if c.MinDataRate > 0 {
+		window := c.MinDataRateWindow
+		if window <= 0 {
+			window = 30 * time.Second
+		}
+		d.watchdog = newThroughputWatchdog(c.conn, c.MinDataRate, window)
+	}
+	return d
+}
+
+func (d *dataCloser) Write(b []byte) (int, error) {
+	if d.watchdog == nil {
+		return d.write(b)
+	}
+
+	// Write small pieces, so that the watchdog sees the progress of big
+	// writes
+	var n int
+	for n < len(b) {
+		end := n + throughputWatchdogChunk
+		if end > len(b) {
+			end = len(b)
+		}
+		m, err := d.write(b[n:end])
+		n += m
+		d.watchdog.add(m)
+		if err != nil {
+			return n, d.watchdog.wrapErr(err)
+		}
+	}
+	return n, nil
+}
+
+func (d *dataCloser) write(b []byte) (int, error) {
+	// Refresh the deadline for each write, so that large messages sent over
+	// slow links don't time out
+	if d.c.SubmissionTimeout > 0 {
+		d.c.conn.SetWriteDeadline(time.Now().Add(d.c.SubmissionTimeout))
+	}
+	n, err := d.WriteCloser.Write(b)
+	d.written += int64(n)
+	if d.c.DataProgress != nil && n > 0 {
+		d.c.DataProgress(d.written)
+	}
+	return n, err
+}
+
+// dataCopyBufferSize is the size of the buffer used by dataCloser.ReadFrom.
+const dataCopyBufferSize = 256 * 1024
+
+// ReadFrom implements io.ReaderFrom. It is used by io.Copy and copies the
+// message data with a bigger buffer than the default 32KB, reducing the
+// per-write overhead for large messages.
+func (d *dataCloser) ReadFrom(r io.Reader) (int64, error) {
+	// Hide ReadFrom from io.CopyBuffer to avoid infinite recursion
+	w := struct{ io.Writer }{d}
+	return io.CopyBuffer(w, r, make([]byte, dataCopyBufferSize))
 }
 
 func (d *dataCloser) Close() error {
 	if d.closed {
 		return fmt.Errorf("smtp: data writer closed twice")
 	}
+	if !d.released {
+		d.released = true
+		defer d.c.release()
+	}
 
-	if err := d.WriteCloser.Close(); err != nil {
+	start := time.Now()
+	err := d.WriteCloser.Close()
+	if d.watchdog != nil {
+		err = d.watchdog.wrapErr(err)
+		d.watchdog.stop()
+	}
+	if err != nil {
+		d.c.messageSent(d.written, "", err)
 		return err
 	}
+	if d.c.Transcript != nil {
+		d.c.Transcript.addCommand(".", false)
+	}
 
 	d.c.conn.SetDeadline(time.Now().Add(d.c.SubmissionTimeout))
 	defer d.c.conn.SetDeadline(time.Time{})
 
-	expectedResponses := len(d.c.rcpts)
-	if d.c.lmtp {
-		for expectedResponses > 0 {
-			rcpt := d.c.rcpts[len(d.c.rcpts)-expectedResponses]
-			if _, _, err := d.c.readResponse(250); err != nil {
-				if smtpErr, ok := err.(*SMTPError); ok {
-					if d.statusCb != nil {
-						d.statusCb(rcpt, smtpErr)
-					}
-				} else {
-					return err
-				}
-			} else if d.statusCb != nil {
-				d.statusCb(rcpt, nil)
-			}
-			expectedResponses--
-		}
-	} else {
-		_, _, err := d.c.readResponse(250)
-		if err != nil {
-			return err
-		}
+	code, err := d.readResponses()
+	d.c.commandDone(".", start, code, err)
+	d.c.messageSent(d.written, d.response, err)
+	if err != nil {
+		return err
 	}
 
 	d.closed = true
 	return nil
 }
 
+// readResponses reads the replies to the end of the message data and
+// returns the code of the last one.
+func (d *dataCloser) readResponses() (int, error) {
+	if !d.c.lmtp {
+		code, msg, err := d.c.readResponse(250)
+		d.response = msg
+		return code, err
+	}
+
+	var code int
+	for _, rcpt := range d.c.rcpts {
+		var err error
+		code, _, err = d.c.readResponse(250)
+		if err != nil {
+			smtpErr, ok := err.(*SMTPError)
+			if !ok {
+				return code, err
+			}
+			if d.statusCb != nil {
+				d.statusCb(rcpt, smtpErr)
+			}
+		} else if d.statusCb != nil {
+			d.statusCb(rcpt, nil)
+		}
+	}
+	return code, nil
+}
+
 // Data issues a DATA command to the server and returns a writer that
 // can be used to write the mail headers and body. The caller should
 // close the writer before calling any more methods on c. A call to
 // Data must be preceded by one or more calls to Rcpt.
 //
+// If the MinAcceptedRecipients or ProceedToData policy refuses the
+// transaction, RSET is sent instead of DATA and the policy error is returned.
+//
 // If server returns an error, it will be of type *SMTPError.
 func (c *Client) Data() (io.WriteCloser, error) {
-	_, _, err := c.cmd(354, "DATA")
+	if err := c.checkProceedToData(); err != nil {
+		return nil, err
+	}
+	// The client stays busy until the data writer is closed
+	if err := c.acquire(); err != nil {
+		return nil, err
+	}
+	_, _, err := c.cmdAcquired(354, "DATA")
 	if err != nil {
+		c.release()
 		return nil, err
 	}
-	return &dataCloser{c: c, WriteCloser: c.text.DotWriter()}, nil
+	return c.newDataCloser(c.text.DotWriter(), nil), nil
+}
+
+// bdat sends a chunk of message data with the BDAT command (RFC 3030
+// CHUNKING) and returns the text of the reply. Only SMTP is supported, LMTP
+// servers reply once per recipient to the LAST chunk.
+func (c *Client) bdat(chunk []byte, last bool) (string, error) {
+	if err := c.acquire(); err != nil {
+		return "", err
+	}
+	defer c.release()
+
+	c.conn.SetDeadline(time.Now().Add(c.SubmissionTimeout))
+	defer c.conn.SetDeadline(time.Time{})
+
+	line := fmt.Sprintf("BDAT %v", len(chunk))
+	if last {
+		line += " LAST"
+	}
+	if c.Transcript != nil {
+		c.Transcript.addCommand(line, false)
+	}
+	start := time.Now()
+
+	id := c.text.Next()
+	c.text.StartRequest(id)
+	_, err := c.text.W.WriteString(line + "\r\n")
+	if err == nil {
+		_, err = c.text.W.Write(chunk)
+	}
+	if err == nil {
+		err = c.text.W.Flush()
+	}
+	c.text.EndRequest(id)
+	if err != nil {
+		c.commandDone("BDAT", start, 0, err)
+		return "", err
+	}
+
+	c.text.StartResponse(id)
+	defer c.text.EndResponse(id)
+
+	code, msg, err := c.readResponse(250)
+	c.commandDone("BDAT", start, code, err)
+	return msg, err
+}
+
+// ErrTooFewRecipients is returned by Data and LMTPData when fewer recipients
+// than Client.MinAcceptedRecipients have been accepted.
+var ErrTooFewRecipients = errors.New("smtp: too few recipients accepted")
+
+// checkProceedToData applies the MinAcceptedRecipients and ProceedToData
+// policy. If the transaction must be aborted, RSET is sent to the server.
+func (c *Client) checkProceedToData() error {
+	if c.MinAcceptedRecipients == 0 && c.ProceedToData == nil {
+		return nil
+	}
+
+	status := c.TransactionStatus()
+	var err error
+	if c.MinAcceptedRecipients < 0 && len(status.Rejected) > 0 {
+		err = ErrTooFewRecipients
+	} else if c.MinAcceptedRecipients > 0 && len(status.Accepted) < c.MinAcceptedRecipients {
+		err = ErrTooFewRecipients
+	} else if c.ProceedToData != nil {
+		err = c.ProceedToData(status)
+	}
+	if err == nil {
+		return nil
+	}
+
+	if resetErr := c.Reset(); resetErr != nil {
+		return resetErr
+	}
+	return err
 }
 
 // LMTPData is the LMTP-specific version of the Data method. It accepts a callback
@@ -610,12 +1426,20 @@ func (c *Client) LMTPData(statusCb func(rcpt string, status *SMTPError)) (io.Wri
 	if !c.lmtp {
 		return nil, errors.New("smtp: not a LMTP client")
 	}
+	if err := c.checkProceedToData(); err != nil {
+		return nil, err
+	}
 
-	_, _, err := c.cmd(354, "DATA")
+	// The client stays busy until the data writer is closed
+	if err := c.acquire(); err != nil {
+		return nil, err
+	}
+	_, _, err := c.cmdAcquired(354, "DATA")
 	if err != nil {
+		c.release()
 		return nil, err
 	}
-	return &dataCloser{c: c, WriteCloser: c.text.DotWriter(), statusCb: statusCb}, nil
+	return c.newDataCloser(c.text.DotWriter(), statusCb), nil
 }
 
 // SendMail will use an existing connection to send an email from
@@ -624,7 +1448,8 @@ func (c *Client) LMTPData(statusCb func(rcpt string, status *SMTPError)) (io.Wri
 // This function does not start TLS, nor does it perform authentication. Use
 // DialStartTLS and Auth before-hand if desirable.
 //
-// The addresses in the to parameter are the SMTP RCPT addresses.
+// The addresses in the to parameter are the SMTP RCPT addresses. They are
+// sent as is, see SendMailEAI for internationalized addresses.
 //
 // The r parameter should be an RFC 822-style email with headers
 // first, a blank line, and then the message body. The lines of r
@@ -633,9 +1458,30 @@ func (c *Client) LMTPData(statusCb func(rcpt string, status *SMTPError)) (io.Wri
 // messages is accomplished by including an email address in the to
 // parameter but not including it in the r headers.
 func (c *Client) SendMail(from string, to []string, r io.Reader) error {
-	var err error
+	return c.sendMailWithOptions(from, to, nil, r)
+}
+
+// SendMailEAI works like SendMail, but prepares the envelope of an
+// internationalized message (Email Address Internationalization, RFC 6530)
+// with PrepareEnvelope: the SMTPUTF8 parameter is used if the server supports
+// it, otherwise non-ASCII domains are converted to A-labels. An *OptionError
+// is returned if an address can't be sent to the server.
+func (c *Client) SendMailEAI(from string, to []string, r io.Reader) error {
+	from, to, smtputf8, err := c.PrepareEnvelope(from, to)
+	if err != nil {
+		return err
+	}
 
-	if err = c.Mail(from, nil); err != nil {
+	var opts *MailOptions
+	if smtputf8 {
+		opts = &MailOptions{UTF8: true}
+	}
+	return c.sendMailWithOptions(from, to, opts, r)
+}
+
+func (c *Client) sendMailWithOptions(from string, to []string, opts *MailOptions, r io.Reader) error {
+	err := c.Mail(from, opts)
+	if err != nil {
 		return err
 	}
 	for _, addr := range to {
@@ -656,13 +1502,29 @@ func (c *Client) SendMail(from string, to []string, r io.Reader) error {
 
 var testHookStartTLS func(*tls.Config) // nil, except for tests
 
-func sendMail(addr string, implicitTLS bool, a sasl.Client, from string, to []string, r io.Reader) error {
-	if err := validateLine(from); err != nil {
+func sendMail(addr string, implicitTLS bool, a sasl.Client, from string, to []string, r io.Reader, transcript *Transcript) error {
+	c, err := dialSendMail(addr, implicitTLS, a, from, to, transcript)
+	if err != nil {
 		return err
 	}
+	defer c.Close()
+
+	if err := c.SendMail(from, to, r); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
+
+// dialSendMail validates the envelope, connects to addr, switches to TLS and
+// authenticates with the optional SASL client.
+func dialSendMail(addr string, implicitTLS bool, a sasl.Client, from string, to []string, transcript *Transcript) (*Client, error) {
+	if err := validateLine(from); err != nil {
+		return nil, err
+	}
 	for _, recp := range to {
 		if err := validateLine(recp); err != nil {
-			return err
+			return nil, err
 		}
 	}
 
@@ -673,27 +1535,39 @@ func sendMail(addr string, implicitTLS bool, a sasl.Client, from string, to []st
 	if implicitTLS {
 		c, err = DialTLS(addr, nil)
 	} else {
-		c, err = DialStartTLS(addr, nil)
+		c, err = Dial(addr)
 	}
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	// The transcript is attached before the greeting is read, so that it
+	// starts with the 220 reply
+	c.Transcript = transcript
+	if err := c.greet(); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	if !implicitTLS {
+		if err := initStartTLS(c, nil); err != nil {
+			c.Close()
+			return nil, err
+		}
 	}
-	defer c.Close()
 
 	if a != nil {
 		if ok, _ := c.Extension("AUTH"); !ok {
-			return errors.New("smtp: server doesn't support AUTH")
+			c.Close()
+			return nil, errors.New("smtp: server doesn't support AUTH")
 		}
 		if err = c.Auth(a); err != nil {
-			return err
+			c.Close()
+			return nil, err
 		}
 	}
 
-	if err := c.SendMail(from, to, r); err != nil {
-		return err
-	}
-
-	return c.Quit()
+	return c, nil
 }
 
 // SendMail connects to the server at addr, switches to TLS, authenticates with
@@ -718,12 +1592,152 @@ func sendMail(addr string, implicitTLS bool, a sasl.Client, from string, to []st
 // attachments (see the mime/multipart package or the go-message package), or
 // other mail functionality.
 func SendMail(addr string, a sasl.Client, from string, to []string, r io.Reader) error {
-	return sendMail(addr, false, a, from, to, r)
+	return sendMail(addr, false, a, from, to, r, nil)
 }
 
 // SendMailTLS works like SendMail, but with implicit TLS.
 func SendMailTLS(addr string, a sasl.Client, from string, to []string, r io.Reader) error {
-	return sendMail(addr, true, a, from, to, r)
+	return sendMail(addr, true, a, from, to, r, nil)
+}
+
+// SendMailTranscript works like SendMail, but additionally returns the
+// transcript of the SMTP dialogue. The transcript is returned even if an
+// error occurs, it can be attached to bug reports when a server rejects a
+// message.
+func SendMailTranscript(addr string, a sasl.Client, from string, to []string, r io.Reader) (*Transcript, error) {
+	transcript := &Transcript{}
+	err := sendMail(addr, false, a, from, to, r, transcript)
+	return transcript, err
+}
+
+// SendMailResult contains details about a message sent with
+// SendMailDetailed.
+type SendMailResult struct {
+	// Text of the server reply to the message data. It usually contains the
+	// queue ID assigned to the message.
+	Response string
+	// Lines of Response, in order.
+	ResponseLines []string
+	// Status of each recipient: nil if the recipient was accepted, the
+	// *SMTPError returned by the server otherwise.
+	Recipients map[string]error
+	// Whether the message was sent over TLS.
+	TLS bool
+	// Address of the server the message was sent to.
+	RemoteAddr string
+}
+
+// SendMailDetailed works like SendMail, but returns details about the
+// delivery, e.g. to be kept in an audit trail.
+//
+// Unlike SendMail, recipients rejected by the server don't abort the
+// transaction: the message is sent to the accepted recipients, and the
+// rejections are reported in SendMailResult.Recipients. An error is returned
+// if all recipients are rejected.
+func SendMailDetailed(addr string, a sasl.Client, from string, to []string, r io.Reader) (*SendMailResult, error) {
+	c, err := dialSendMail(addr, false, a, from, to, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	_, isTLS := c.TLSConnectionState()
+	result := &SendMailResult{
+		Recipients: make(map[string]error, len(to)),
+		TLS:        isTLS,
+		RemoteAddr: c.conn.RemoteAddr().String(),
+	}
+
+	if err := c.Mail(from, nil); err != nil {
+		return result, err
+	}
+	var rcptErr error
+	for _, addr := range to {
+		err := c.Rcpt(addr, nil)
+		if _, ok := err.(*SMTPError); err != nil && !ok {
+			return result, err
+		}
+		if err != nil && rcptErr == nil {
+			rcptErr = err
+		}
+		result.Recipients[addr] = err
+	}
+	if len(c.rcpts) == 0 {
+		c.Quit()
+		return result, rcptErr
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return result, err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		return result, err
+	}
+	if err := w.Close(); err != nil {
+		return result, err
+	}
+	result.Response = w.(*dataCloser).response
+	result.ResponseLines = strings.Split(result.Response, "\n")
+
+	// The message has been accepted, ignore QUIT errors
+	c.Quit()
+	return result, nil
+}
+
+// SendMailLMTP connects to the LMTP server at addr on the named network (e.g.
+// "unix" or "tcp") and delivers message r from address from to addresses to.
+//
+// The returned map contains the delivery status of each recipient: nil if the
+// message was delivered, the *SMTPError returned by the server otherwise.
+// Recipients rejected at the RCPT stage are included. A non-nil error is
+// returned if the transaction as a whole failed.
+func SendMailLMTP(network, addr string, from string, to []string, r io.Reader) (map[string]error, error) {
+	conn, err := net.DialTimeout(network, addr, defaultDialer.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := NewClientLMTP(conn)
+	defer c.Close()
+
+	if err := c.Mail(from, nil); err != nil {
+		return nil, err
+	}
+
+	status := make(map[string]error, len(to))
+	for _, addr := range to {
+		if err := c.Rcpt(addr, nil); err != nil {
+			if _, ok := err.(*SMTPError); !ok {
+				return nil, err
+			}
+			status[addr] = err
+		}
+	}
+	if len(c.rcpts) == 0 {
+		c.Quit()
+		return status, nil
+	}
+
+	w, err := c.LMTPData(func(rcpt string, err *SMTPError) {
+		if err != nil {
+			status[rcpt] = err
+		} else {
+			status[rcpt] = nil
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	// The message has been delivered, ignore QUIT errors
+	c.Quit()
+	return status, nil
 }
 
 // Extension reports whether an extension is support by the server.
@@ -739,6 +1753,24 @@ func (c *Client) Extension(ext string) (bool, string) {
 	return ok, param
 }
 
+// Extensions returns the extensions supported by the server, with their
+// parameters.
+func (c *Client) Extensions() map[string]string {
+	if err := c.hello(); err != nil {
+		return nil
+	}
+	return copyExtensions(c.ext)
+}
+
+// PreTLSExtensions returns the extensions advertised by the server before
+// STARTTLS. It returns nil if STARTTLS hasn't been used.
+//
+// This is only useful for diagnostics: per RFC 3207 the capabilities
+// advertised before the TLS negotiation must not be trusted.
+func (c *Client) PreTLSExtensions() map[string]string {
+	return copyExtensions(c.preTLSExt)
+}
+
 // SupportsAuth checks whether an authentication mechanism is supported.
 func (c *Client) SupportsAuth(mech string) bool {
 	if err := c.hello(); err != nil {
@@ -790,6 +1822,7 @@ func (c *Client) Reset() error {
 	c.helloError = nil
 
 	c.rcpts = nil
+	c.txStatus = TransactionStatus{}
 	return nil
 }
 
@@ -803,8 +1836,34 @@ func (c *Client) Noop() error {
 	return err
 }
 
+// RawCmd sends a command to the server and reads the reply. It's an escape
+// hatch for extensions this package doesn't implement, such as XCLIENT or
+// vendor-specific commands. The caller is responsible for keeping the
+// session consistent, e.g. by calling Hello again if the command resets it.
+//
+// The command line is built with fmt.Sprintf, it must not contain CR or LF.
+// expectCode is the expected reply code, as in textproto.Reader.ReadResponse:
+// e.g. 250, or 2 to accept any 2xx reply. The lines of multi-line replies
+// are separated by "\n" in msg.
+//
+// If the reply code doesn't match, the error is of type *SMTPError.
+func (c *Client) RawCmd(expectCode int, format string, args ...interface{}) (code int, msg string, err error) {
+	line := fmt.Sprintf(format, args...)
+	if err := validateLine(line); err != nil {
+		return 0, "", err
+	}
+	if err := c.hello(); err != nil {
+		return 0, "", err
+	}
+	return c.cmd(expectCode, "%s", line)
+}
+
 // Quit sends the QUIT command and closes the connection to the server.
 //
+// Many servers close the connection without replying to QUIT. This isn't
+// considered as an error: Quit returns nil, and CommandDone is called with a
+// zero code and the connection error.
+//
 // If Quit fails the connection is not closed, Close should be used
 // in this case.
 func (c *Client) Quit() error {
@@ -812,10 +1871,17 @@ func (c *Client) Quit() error {
 		return err
 	}
 	_, _, err := c.cmd(221, "QUIT")
-	if err != nil {
+	if err != nil && !isConnClosed(err) {
 		return err
 	}
-	return c.Close()
+	c.Close()
+	return nil
+}
+
+// isConnClosed reports whether err indicates that the server has closed the
+// connection.
+func isConnClosed(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
 }
 
 func parseEnhancedCode(s string) (EnhancedCode, error) {
@@ -839,27 +1905,34 @@ func parseEnhancedCode(s string) (EnhancedCode, error) {
 // enhanced status code if it is present.
 func toSMTPErr(protoErr *textproto.Error) *SMTPError {
 	smtpErr := &SMTPError{
-		Code:    protoErr.Code,
-		Message: protoErr.Msg,
+		Code:       protoErr.Code,
+		Message:    protoErr.Msg,
+		RetryAfter: parseRetryAfter(protoErr.Code, protoErr.Msg),
+	}
+
+	// Per RFC 2034, enhanced code should be prepended to each line, but some
+	// servers only prepend it to the last one.
+	lines := strings.Split(protoErr.Msg, "\n")
+	prefix := ""
+	for _, line := range []string{lines[0], lines[len(lines)-1]} {
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if enchCode, err := parseEnhancedCode(parts[0]); err == nil {
+			smtpErr.EnhancedCode = enchCode
+			prefix = parts[0] + " "
+			break
+		}
 	}
-
-	parts := strings.SplitN(protoErr.Msg, " ", 2)
-	if len(parts) != 2 {
+	if prefix == "" {
 		return smtpErr
 	}
 
-	enchCode, err := parseEnhancedCode(parts[0])
-	if err != nil {
-		return smtpErr
+	for i, line := range lines {
+		lines[i] = strings.TrimPrefix(line, prefix)
 	}
-
-	msg := parts[1]
-
-	// Per RFC 2034, enhanced code should be prepended to each line.
-	msg = strings.ReplaceAll(msg, "\n"+parts[0]+" ", "\n")
-
-	smtpErr.EnhancedCode = enchCode
-	smtpErr.Message = msg
+	smtpErr.Message = strings.Join(lines, "\n")
 	return smtpErr
 }
 
@@ -7,13 +7,17 @@ package smtp
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/textproto"
 	"reflect"
+	"runtime"
 	"strings"
 	"testing"
 	"time"
@@ -665,11 +669,88 @@ func TestTLSConnState(t *testing.T) {
 		if cs.Version == 0 || !cs.HandshakeComplete {
 			t.Errorf("ConnectionState = %#v; expect non-zero Version and HandshakeComplete", cs)
 		}
+		if _, ok := c.PreTLSExtensions()["STARTTLS"]; !ok {
+			t.Errorf("STARTTLS missing from pre-TLS extensions: %v", c.PreTLSExtensions())
+		}
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			t.Errorf("STARTTLS still advertised after TLS negotiation")
+		}
 	}()
 	<-clientDone
 	<-serverDone
 }
 
+func TestSendMailDetailed(t *testing.T) {
+	ln := newLocalListener(t)
+	defer ln.Close()
+	serverDone := make(chan bool)
+	go func() {
+		defer close(serverDone)
+		c, err := ln.Accept()
+		if err != nil {
+			t.Errorf("Server accept: %v", err)
+			return
+		}
+		defer c.Close()
+		if err := serverHandle(c, t); err != nil {
+			t.Errorf("server error: %v", err)
+		}
+	}()
+
+	from := "joe1@example.com"
+	to := []string{"joe2@example.com"}
+	result, err := SendMailDetailed(ln.Addr().String(), nil, from, to, strings.NewReader("Subject: test\n\nhowdy!"))
+	if err != nil {
+		t.Fatalf("SendMailDetailed() = %v", err)
+	}
+	<-serverDone
+
+	if result.Response != "Ok" {
+		t.Errorf("Response = %q, want %q", result.Response, "Ok")
+	}
+	if !result.TLS {
+		t.Errorf("TLS = false, want true")
+	}
+	if result.RemoteAddr != ln.Addr().String() {
+		t.Errorf("RemoteAddr = %q, want %q", result.RemoteAddr, ln.Addr().String())
+	}
+	if err, ok := result.Recipients["joe2@example.com"]; !ok || err != nil {
+		t.Errorf("Recipients = %v, want joe2@example.com accepted", result.Recipients)
+	}
+}
+
+func TestSendMailTranscript(t *testing.T) {
+	ln := newLocalListener(t)
+	defer ln.Close()
+	serverDone := make(chan bool)
+	go func() {
+		defer close(serverDone)
+		c, err := ln.Accept()
+		if err != nil {
+			t.Errorf("Server accept: %v", err)
+			return
+		}
+		defer c.Close()
+		if err := serverHandle(c, t); err != nil {
+			t.Errorf("server error: %v", err)
+		}
+	}()
+
+	from := "joe1@example.com"
+	to := []string{"joe2@example.com"}
+	transcript, err := SendMailTranscript(ln.Addr().String(), nil, from, to, strings.NewReader("Subject: test\n\nhowdy!"))
+	if err != nil {
+		t.Fatalf("SendMailTranscript() = %v", err)
+	}
+	<-serverDone
+
+	want := "S: 220 127.0.0.1 ESMTP service ready\n" +
+		"C: EHLO localhost\n"
+	if got := transcript.String(); !strings.HasPrefix(got, want) {
+		t.Errorf("Transcript doesn't start with the greeting:\n%s", got)
+	}
+}
+
 func newLocalListener(t *testing.T) net.Listener {
 	ln, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
@@ -1044,3 +1125,1509 @@ func TestClientDSN(t *testing.T) {
 		t.Errorf("wrote %q; want %q", actualcmds, client)
 	}
 }
+
+func TestClientTranscript(t *testing.T) {
+	server := "220 hello world\r\n" +
+		"250-mx.google.com at your service\r\n" +
+		"250 AUTH PLAIN\r\n" +
+		"235 Accepted\r\n" +
+		"250 Sender OK\r\n" +
+		"250 Receiver OK\r\n" +
+		"354 Go ahead\r\n" +
+		"250 OK: queued as 42\r\n" +
+		"221 Goodbye\r\n"
+	var wrote bytes.Buffer
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{
+		strings.NewReader(server),
+		&wrote,
+	}
+	c := NewClient(fake)
+	c.Transcript = &Transcript{}
+
+	if err := c.Auth(sasl.NewPlainClient("", "user", "pass")); err != nil {
+		t.Fatalf("AUTH failed: %s", err)
+	}
+	if err := c.SendMail("user@gmail.com", []string{"golang-nuts@googlegroups.com"}, strings.NewReader("Hey <3\r\n")); err != nil {
+		t.Fatalf("SendMail failed: %s", err)
+	}
+	if err := c.Quit(); err != nil {
+		t.Fatalf("QUIT failed: %s", err)
+	}
+
+	expected := `S: 220 hello world
+C: EHLO localhost
+S: 250-mx.google.com at your service
+S: 250 AUTH PLAIN
+C: AUTH PLAIN <redacted>
+S: 235 Accepted
+C: MAIL FROM:<user@gmail.com>
+S: 250 Sender OK
+C: RCPT TO:<golang-nuts@googlegroups.com>
+S: 250 Receiver OK
+C: DATA
+S: 354 Go ahead
+C: .
+S: 250 OK: queued as 42
+C: QUIT
+S: 221 Goodbye
+`
+	if got := c.Transcript.String(); got != expected {
+		t.Fatalf("Invalid transcript:\n%s\nExpected:\n%s", got, expected)
+	}
+	if strings.Contains(c.Transcript.String(), "AHVzZXIAcGFzcw") {
+		t.Fatal("Transcript contains credentials")
+	}
+}
+
+func TestClientDataProgress(t *testing.T) {
+	server := "220 hello world\r\n" +
+		"250 mx.google.com at your service\r\n" +
+		"250 Sender OK\r\n" +
+		"250 Receiver OK\r\n" +
+		"354 Go ahead\r\n" +
+		"250 OK\r\n"
+	var wrote bytes.Buffer
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{
+		strings.NewReader(server),
+		&wrote,
+	}
+	c := NewClient(fake)
+
+	var progress []int64
+	c.DataProgress = func(written int64) {
+		progress = append(progress, written)
+	}
+
+	if err := c.Mail("user@gmail.com", nil); err != nil {
+		t.Fatalf("MAIL failed: %s", err)
+	}
+	if err := c.Rcpt("golang-nuts@googlegroups.com", nil); err != nil {
+		t.Fatalf("RCPT failed: %s", err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatalf("DATA failed: %s", err)
+	}
+	io.WriteString(w, "Subject: Hi\r\n\r\n")
+	io.WriteString(w, "Hey <3\r\n")
+	if err := w.Close(); err != nil {
+		t.Fatalf("Bad data response: %s", err)
+	}
+
+	if len(progress) != 2 || progress[0] != 15 || progress[1] != 23 {
+		t.Errorf("Invalid progress: %v", progress)
+	}
+}
+
+func TestClientOptionErrors(t *testing.T) {
+	server := "220 hello world\r\n" +
+		"250-mx.google.com at your service\r\n" +
+		"250-CHUNKING\r\n" +
+		"250-DSN\r\n" +
+		"250 REQUIRETLS\r\n"
+	var wrote bytes.Buffer
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{
+		strings.NewReader(server),
+		&wrote,
+	}
+	c := NewClient(fake)
+
+	for _, opts := range []*MailOptions{
+		{Body: Body8BitMIME},
+		{Body: BodyBinaryMIME},
+		{Body: "16BITMIME"},
+		{RequireTLS: true},
+		{UTF8: true},
+	} {
+		err := c.Mail("root@nsa.gov", opts)
+		if _, ok := err.(*OptionError); !ok {
+			t.Errorf("Mail(%+v) = %v, want *OptionError", opts, err)
+		}
+	}
+
+	for _, opts := range []*RcptOptions{
+		{OriginalRecipientType: DSNAddressTypeRFC822, OriginalRecipient: "rööt@nsa.gov"},
+		{OriginalRecipientType: "X400", OriginalRecipient: "root@nsa.gov"},
+	} {
+		err := c.Rcpt("root@nsa.gov", opts)
+		if _, ok := err.(*OptionError); !ok {
+			t.Errorf("Rcpt(%+v) = %v, want *OptionError", opts, err)
+		}
+	}
+
+	if strings.Contains(wrote.String(), "MAIL") || strings.Contains(wrote.String(), "RCPT") {
+		t.Errorf("Invalid commands sent to the server:\n%v", wrote.String())
+	}
+}
+
+func TestClientRefreshExtensionsAfterAuth(t *testing.T) {
+	server := "220 hello world\r\n" +
+		"250-mx.google.com at your service\r\n" +
+		"250 AUTH PLAIN\r\n" +
+		"235 Accepted\r\n" +
+		"250-mx.google.com at your service\r\n" +
+		"250 SIZE 1024\r\n"
+	var wrote bytes.Buffer
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{
+		strings.NewReader(server),
+		&wrote,
+	}
+	c := NewClient(fake)
+	c.RefreshExtensionsAfterAuth = true
+	var changes []map[string]string
+	c.ExtensionsChanged = func(ext map[string]string) {
+		changes = append(changes, ext)
+	}
+
+	if err := c.Auth(sasl.NewPlainClient("", "user", "pass")); err != nil {
+		t.Fatalf("AUTH failed: %s", err)
+	}
+	if size, ok := c.MaxMessageSize(); !ok || size != 1024 {
+		t.Fatalf("Extensions not refreshed after AUTH: %v", c.ext)
+	}
+
+	expected := []map[string]string{{"AUTH": "PLAIN"}, {"SIZE": "1024"}}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Fatalf("ExtensionsChanged called with %v, want %v", changes, expected)
+	}
+	if got, want := wrote.String(), "EHLO localhost\r\nAUTH PLAIN AHVzZXIAcGFzcw==\r\nEHLO localhost\r\n"; got != want {
+		t.Errorf("wrote %q; want %q", got, want)
+	}
+}
+
+func TestClientOverrideExtensions(t *testing.T) {
+	server := "220 hello world\r\n" +
+		"250-mx.google.com at your service\r\n" +
+		"250-SIZE 1024\r\n" +
+		"250 XBROKEN\r\n"
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{
+		strings.NewReader(server),
+		ioutil.Discard,
+	}
+	c := NewClient(fake)
+	c.OverrideExtensions = func(ext map[string]string) {
+		delete(ext, "XBROKEN")
+		ext["8BITMIME"] = ""
+		ext["SIZE"] = "2048"
+	}
+	var changed map[string]string
+	c.ExtensionsChanged = func(ext map[string]string) {
+		changed = ext
+	}
+
+	if err := c.Hello("localhost"); err != nil {
+		t.Fatalf("Hello failed: %v", err)
+	}
+	if ok, _ := c.Extension("8BITMIME"); !ok {
+		t.Error("Injected extension not supported")
+	}
+	if ok, _ := c.Extension("XBROKEN"); ok {
+		t.Error("Removed extension still supported")
+	}
+	if size, ok := c.MaxMessageSize(); !ok || size != 2048 {
+		t.Errorf("MaxMessageSize() = %v, %v, want 2048", size, ok)
+	}
+	expected := map[string]string{"8BITMIME": "", "SIZE": "2048"}
+	if !reflect.DeepEqual(changed, expected) {
+		t.Errorf("ExtensionsChanged called with %v, want %v", changed, expected)
+	}
+}
+
+type staticSASLClient struct {
+	mech string
+	ir   []byte
+}
+
+func (a *staticSASLClient) Start() (string, []byte, error) {
+	return a.mech, a.ir, nil
+}
+
+func (a *staticSASLClient) Next(challenge []byte) ([]byte, error) {
+	return nil, errors.New("unexpected challenge")
+}
+
+func TestClientAuthAuto(t *testing.T) {
+	scram := &staticSASLClient{mech: "SCRAM-SHA-256", ir: []byte("n,,n=user,r=nonce")}
+
+	for _, tc := range []struct {
+		name       string
+		auth       string
+		creds      AuthCredentials
+		preference []string
+		replies    string
+		cmd        string // AUTH command sent, empty if none
+		err        error
+	}{
+		{
+			name:    "SCRAM preferred",
+			auth:    "LOGIN PLAIN SCRAM-SHA-256",
+			creds:   AuthCredentials{Username: "user", Password: "pass", Mechanisms: map[string]sasl.Client{"SCRAM-SHA-256": scram}},
+			replies: "235 2.7.0 Accepted\r\n",
+			cmd:     "AUTH SCRAM-SHA-256 biwsbj11c2VyLHI9bm9uY2U=",
+		},
+		{
+			name:    "SCRAM not supported by the client",
+			auth:    "LOGIN PLAIN SCRAM-SHA-256",
+			creds:   AuthCredentials{Username: "user", Password: "pass", AllowInsecure: true},
+			replies: "235 2.7.0 Accepted\r\n",
+			cmd:     "AUTH PLAIN AHVzZXIAcGFzcw==",
+		},
+		{
+			name:       "preference",
+			auth:       "LOGIN PLAIN",
+			creds:      AuthCredentials{Username: "user", Password: "pass", AllowInsecure: true},
+			preference: []string{"login", "plain"},
+			replies:    "334 UGFzc3dvcmQ6\r\n235 2.7.0 Accepted\r\n",
+			cmd:        "AUTH LOGIN dXNlcg==",
+		},
+		{
+			name:  "insecure",
+			auth:  "LOGIN PLAIN",
+			creds: AuthCredentials{Username: "user", Password: "pass"},
+			err:   ErrInsecureAuth,
+		},
+		{
+			name:  "no mutual mechanism",
+			auth:  "SCRAM-SHA-256 XOAUTH2",
+			creds: AuthCredentials{Username: "user", Password: "pass", AllowInsecure: true},
+			err:   errors.New("smtp: no mutually supported authentication mechanism"),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server := "220 hello world\r\n" +
+				"250-mx.google.com at your service\r\n" +
+				"250 AUTH " + tc.auth + "\r\n" +
+				tc.replies
+			var wrote bytes.Buffer
+			var fake faker
+			fake.ReadWriter = struct {
+				io.Reader
+				io.Writer
+			}{
+				strings.NewReader(server),
+				&wrote,
+			}
+			c := NewClient(fake)
+
+			err := c.AuthAuto(&tc.creds, tc.preference)
+			if (err == nil) != (tc.err == nil) || (err != nil && err.Error() != tc.err.Error()) {
+				t.Fatalf("AuthAuto() = %v, want %v", err, tc.err)
+			}
+
+			var cmd string
+			for _, line := range strings.Split(wrote.String(), "\r\n") {
+				if strings.HasPrefix(line, "AUTH ") {
+					cmd = line
+				}
+			}
+			if cmd != tc.cmd {
+				t.Errorf("Sent %q, want %q", cmd, tc.cmd)
+			}
+		})
+	}
+}
+
+func TestClientReplyLines(t *testing.T) {
+	server := "220-mx.example.org ESMTP\r\n" +
+		"220 Unsolicited mail is not welcome\r\n" +
+		"250 mx.example.org at your service\r\n" +
+		"250 2.1.0 Sender OK\r\n" +
+		"250-2.1.5 Recipient OK\r\n" +
+		"250 2.1.5 Policy: https://example.org/policy\r\n" +
+		"250-Recipient OK\r\n" +
+		"250 2.1.5 Policy: https://example.org/policy\r\n"
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{
+		strings.NewReader(server),
+		ioutil.Discard,
+	}
+	c := NewClient(fake)
+
+	greeting, err := c.Greeting()
+	if err != nil {
+		t.Fatalf("Greeting() = %v", err)
+	}
+	if want := []string{"mx.example.org ESMTP", "Unsolicited mail is not welcome"}; !reflect.DeepEqual(greeting, want) {
+		t.Errorf("Greeting() = %q, want %q", greeting, want)
+	}
+
+	if err := c.Mail("root@nsa.gov", nil); err != nil {
+		t.Fatalf("Mail() = %v", err)
+	}
+	// The enhanced code may be prepended to each line or only to the last
+	// one
+	for _, rcpt := range []string{"root@gchq.gov.uk", "root@bnd.bund.de"} {
+		if err := c.Rcpt(rcpt, nil); err != nil {
+			t.Fatalf("Rcpt(%v) = %v", rcpt, err)
+		}
+	}
+	want := []string{"Recipient OK", "Policy: https://example.org/policy"}
+	for _, st := range c.TransactionStatus().Accepted {
+		if st.EnhancedCode != (EnhancedCode{2, 1, 5}) {
+			t.Errorf("EnhancedCode for %v = %v, want 2.1.5", st.Addr, st.EnhancedCode)
+		}
+		if lines := st.Lines(); !reflect.DeepEqual(lines, want) {
+			t.Errorf("Lines() for %v = %q, want %q", st.Addr, lines, want)
+		}
+	}
+}
+
+type fakerLocalAddr struct {
+	faker
+	local net.Addr
+}
+
+func (f fakerLocalAddr) LocalAddr() net.Addr { return f.local }
+
+func TestClientAutoLocalName(t *testing.T) {
+	defer func(orig func(context.Context, string) ([]string, error)) {
+		lookupAddr = orig
+	}(lookupAddr)
+	lookups := 0
+	lookupAddr = func(ctx context.Context, addr string) ([]string, error) {
+		lookups++
+		switch addr {
+		case "192.0.2.1":
+			return []string{"mail.example.org."}, nil
+		default:
+			return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+		}
+	}
+
+	for _, tc := range []struct {
+		ip, name string
+	}{
+		{"192.0.2.1", "mail.example.org"},
+		{"192.0.2.1", "mail.example.org"},
+		{"192.0.2.2", "[192.0.2.2]"},
+		{"2001:db8::1", "[IPv6:2001:db8::1]"},
+	} {
+		var wrote bytes.Buffer
+		var fake fakerLocalAddr
+		fake.ReadWriter = struct {
+			io.Reader
+			io.Writer
+		}{
+			strings.NewReader("220 hello world\r\n250 mx.google.com at your service\r\n"),
+			&wrote,
+		}
+		fake.local = &net.TCPAddr{IP: net.ParseIP(tc.ip), Port: 12345}
+		c := NewClient(fake)
+		c.AutoLocalName = true
+
+		if err := c.hello(); err != nil {
+			t.Fatalf("hello() = %v", err)
+		}
+		if want := "EHLO " + tc.name + "\r\n"; !strings.HasPrefix(wrote.String(), want) {
+			t.Errorf("Sent %q for %v, want %q", wrote.String(), tc.ip, want)
+		}
+	}
+	if lookups != 3 {
+		t.Errorf("%v lookups, want 3", lookups)
+	}
+}
+
+func benchmarkClientData(b *testing.B, readFrom bool) {
+	msg := bytes.Repeat([]byte("Lorem ipsum dolor sit amet, consectetur adipiscing elit.\r\n"), 25*1024*1024/58)
+
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{
+		strings.NewReader(""),
+		ioutil.Discard,
+	}
+	c := NewClient(fake)
+
+	b.SetBytes(int64(len(msg)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var w io.Writer = &dataCloser{c: c, WriteCloser: c.text.DotWriter()}
+		if !readFrom {
+			w = struct{ io.Writer }{w}
+		}
+		// Hide bytes.Reader's WriteTo
+		r := struct{ io.Reader }{bytes.NewReader(msg)}
+		if _, err := io.Copy(w, r); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkClientData(b *testing.B) {
+	b.Run("Write", func(b *testing.B) { benchmarkClientData(b, false) })
+	b.Run("ReadFrom", func(b *testing.B) { benchmarkClientData(b, true) })
+}
+
+func TestClientRelay(t *testing.T) {
+	server := "220 hello world\r\n" +
+		"250 mx.google.com at your service\r\n" +
+		"250 Sender OK\r\n" +
+		"250 Receiver OK\r\n" +
+		"354 Go ahead\r\n" +
+		"250 Data OK\r\n"
+
+	newClient := func(wrote io.Writer) *Client {
+		var fake faker
+		fake.ReadWriter = struct {
+			io.Reader
+			io.Writer
+		}{
+			strings.NewReader(server),
+			wrote,
+		}
+		return NewClient(fake)
+	}
+
+	msg := "DKIM-Signature: v=1; b=abc\r\n\r\n.leading dot\r\n..two dots\r\nh\xc3\xa9\r\n"
+	var wrote bytes.Buffer
+	c := newClient(&wrote)
+	res, err := c.Relay("root@nsa.gov", []string{"root@gchq.gov.uk"}, strings.NewReader(msg), nil)
+	if err != nil {
+		t.Fatalf("Relay() = %v", err)
+	}
+	if res.Size != int64(len(msg)) || res.SHA256 != sha256.Sum256([]byte(msg)) || res.Response != "Data OK" {
+		t.Errorf("Invalid result: %+v", res)
+	}
+	wantData := "DATA\r\n" +
+		"DKIM-Signature: v=1; b=abc\r\n\r\n..leading dot\r\n...two dots\r\nh\xc3\xa9\r\n.\r\n"
+	if !strings.HasSuffix(wrote.String(), wantData) {
+		t.Errorf("Invalid data sent:\n%q", wrote.String())
+	}
+
+	for _, msg := range []string{
+		"Subject: bare LF\n\r\n",
+		"Subject: bare CR\r\r\n",
+		"Subject: no final CRLF\r\n\r\nHello",
+	} {
+		wrote.Reset()
+		c := newClient(&wrote)
+		if _, err := c.Relay("root@nsa.gov", []string{"root@gchq.gov.uk"}, strings.NewReader(msg), nil); err == nil {
+			t.Errorf("Relay(%q) = nil, want an error", msg)
+		}
+		if strings.Contains(wrote.String(), "\r\n.\r\n") {
+			t.Errorf("Relay(%q) terminated the message data", msg)
+		}
+	}
+}
+
+func TestClientRelayMinDataRate(t *testing.T) {
+	server := "220 hello world\r\n" +
+		"250 mx.google.com at your service\r\n" +
+		"250 Sender OK\r\n" +
+		"250 Receiver OK\r\n" +
+		"354 Go ahead\r\n"
+
+	before := runtime.NumGoroutine()
+	for i := 0; i < 10; i++ {
+		var fake faker
+		fake.ReadWriter = struct {
+			io.Reader
+			io.Writer
+		}{
+			strings.NewReader(server),
+			ioutil.Discard,
+		}
+		c := NewClient(fake)
+		c.MinDataRate = 1
+		c.MinDataRateWindow = time.Hour
+		if _, err := c.Relay("root@nsa.gov", []string{"root@gchq.gov.uk"}, strings.NewReader("Subject: bare LF\n\r\n"), nil); err == nil {
+			t.Fatal("Relay() = nil, want an error")
+		}
+	}
+
+	// The throughput watchdogs must be stopped when the message is refused
+	for i := 0; runtime.NumGoroutine() > before; i++ {
+		if i == 100 {
+			t.Fatalf("%v goroutines left running, want %v", runtime.NumGoroutine(), before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClientHELOFallback(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		forceHELO bool
+		server    string
+		client    string
+		err       bool
+	}{
+		{
+			name:      "ForceHELO",
+			forceHELO: true,
+			server:    "220 hello world\r\n250 ok\r\n",
+			client:    "HELO localhost\r\n",
+		},
+		{
+			name:   "501",
+			server: "220 hello world\r\n501 Syntax error\r\n250 ok\r\n",
+			client: "EHLO localhost\r\nHELO localhost\r\n",
+		},
+		{
+			name:   "malformed",
+			server: "220 hello world\r\nEHLO what?\r\n250 ok\r\n",
+			client: "EHLO localhost\r\nHELO localhost\r\n",
+		},
+		{
+			name:   "421",
+			server: "220 hello world\r\n421 Service not available\r\n",
+			client: "EHLO localhost\r\n",
+			err:    true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var wrote bytes.Buffer
+			var fake faker
+			fake.ReadWriter = struct {
+				io.Reader
+				io.Writer
+			}{
+				strings.NewReader(tc.server),
+				&wrote,
+			}
+			c := NewClient(fake)
+			c.ForceHELO = tc.forceHELO
+
+			err := c.hello()
+			if tc.err && err == nil {
+				t.Error("hello() = nil, want an error")
+			} else if !tc.err && err != nil {
+				t.Errorf("hello() = %v", err)
+			}
+			if wrote.String() != tc.client {
+				t.Errorf("Got:\n%s\nExpected:\n%s", wrote.String(), tc.client)
+			}
+			if !tc.err {
+				if ok, _ := c.Extension("PIPELINING"); ok {
+					t.Error("Extensions available after HELO")
+				}
+			}
+		})
+	}
+}
+
+func TestClientRcptForwarding(t *testing.T) {
+	server := "220 hello world\r\n" +
+		"250 mx.google.com at your service\r\n" +
+		"250 Sender OK\r\n" +
+		"251 2.1.5 User not local; will forward to <bob@example.net>\r\n" +
+		"551 5.1.6 User not local; please try <alice@example.com>\r\n" +
+		"550 5.1.1 No such user\r\n"
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{
+		strings.NewReader(server),
+		ioutil.Discard,
+	}
+	c := NewClient(fake)
+
+	if err := c.Mail("user@gmail.com", nil); err != nil {
+		t.Fatalf("MAIL failed: %s", err)
+	}
+	if err := c.Rcpt("bob@example.org", nil); err != nil {
+		t.Fatalf("RCPT failed: %s", err)
+	}
+	err := c.Rcpt("alice@example.org", nil)
+	smtpErr, ok := err.(*SMTPError)
+	if !ok {
+		t.Fatalf("RCPT = %v, want an *SMTPError", err)
+	}
+	expected := &ForwardingResult{Address: "alice@example.com", Permanent: true}
+	if fwd := smtpErr.Forwarding(); !reflect.DeepEqual(fwd, expected) {
+		t.Errorf("Forwarding() = %+v, want %+v", fwd, expected)
+	}
+	if err := c.Rcpt("nobody@example.org", nil); err == nil {
+		t.Fatal("RCPT succeeded, want an error")
+	}
+
+	status := c.TransactionStatus()
+	expected = &ForwardingResult{Address: "bob@example.net"}
+	if fwd := status.Accepted[0].Forwarding(); !reflect.DeepEqual(fwd, expected) {
+		t.Errorf("Forwarding() = %+v, want %+v", fwd, expected)
+	}
+	if fwd := status.Rejected[1].Forwarding(); fwd != nil {
+		t.Errorf("Forwarding() = %+v for a 550 reply", fwd)
+	}
+}
+
+func TestClientTransactionStatus(t *testing.T) {
+	server := "220 hello world\r\n" +
+		"250 mx.google.com at your service\r\n" +
+		"250 Sender OK\r\n" +
+		"250 2.1.5 Receiver OK\r\n" +
+		"550 5.1.1 No such user\r\n" +
+		"451 Try again later\r\n" +
+		"250 Reset OK\r\n"
+	var wrote bytes.Buffer
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{
+		strings.NewReader(server),
+		&wrote,
+	}
+	c := NewClient(fake)
+
+	if err := c.Mail("user@gmail.com", nil); err != nil {
+		t.Fatalf("MAIL failed: %s", err)
+	}
+	if err := c.Rcpt("golang-nuts@googlegroups.com", nil); err != nil {
+		t.Fatalf("RCPT failed: %s", err)
+	}
+	if err := c.Rcpt("nobody@googlegroups.com", nil); err == nil {
+		t.Fatal("RCPT succeeded, want an error")
+	}
+	if err := c.Rcpt("later@googlegroups.com", nil); err == nil {
+		t.Fatal("RCPT succeeded, want an error")
+	}
+
+	status := c.TransactionStatus()
+	expectedAccepted := []RcptStatus{
+		{Addr: "golang-nuts@googlegroups.com", Code: 250, EnhancedCode: EnhancedCode{2, 1, 5}, Message: "Receiver OK"},
+	}
+	expectedRejected := []RcptStatus{
+		{Addr: "nobody@googlegroups.com", Code: 550, EnhancedCode: EnhancedCode{5, 1, 1}, Message: "No such user"},
+		{Addr: "later@googlegroups.com", Code: 451, Message: "Try again later"},
+	}
+	if !reflect.DeepEqual(status.Accepted, expectedAccepted) {
+		t.Errorf("Accepted = %+v, want %+v", status.Accepted, expectedAccepted)
+	}
+	if !reflect.DeepEqual(status.Rejected, expectedRejected) {
+		t.Errorf("Rejected = %+v, want %+v", status.Rejected, expectedRejected)
+	}
+	if err := status.Accepted[0].Err(); err != nil {
+		t.Errorf("Err() = %v for an accepted recipient", err)
+	}
+	if err, ok := status.Rejected[0].Err().(*SMTPError); !ok || err.Code != 550 {
+		t.Errorf("Err() = %v, want a 550 *SMTPError", err)
+	}
+
+	if err := c.Reset(); err != nil {
+		t.Fatalf("RSET failed: %s", err)
+	}
+	status = c.TransactionStatus()
+	if len(status.Accepted) != 0 || len(status.Rejected) != 0 {
+		t.Errorf("TransactionStatus() = %+v after RSET, want empty", status)
+	}
+}
+
+func TestClientProceedToData(t *testing.T) {
+	errAbort := errors.New("abort")
+	for _, tc := range []struct {
+		name    string
+		min     int
+		proceed func(status *TransactionStatus) error
+		err     error
+	}{
+		{name: "default"},
+		{name: "min-ok", min: 1},
+		{name: "min-refused", min: 2, err: ErrTooFewRecipients},
+		{name: "all-refused", min: -1, err: ErrTooFewRecipients},
+		{
+			name: "callback-refused",
+			proceed: func(status *TransactionStatus) error {
+				if len(status.Rejected) != 1 || status.Rejected[0].Addr != "nobody@googlegroups.com" {
+					t.Errorf("ProceedToData called with %+v", status)
+				}
+				return errAbort
+			},
+			err: errAbort,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server := "220 hello world\r\n" +
+				"250 mx.google.com at your service\r\n" +
+				"250 Sender OK\r\n" +
+				"250 Receiver OK\r\n" +
+				"550 No such user\r\n"
+			client := "EHLO localhost\r\n" +
+				"MAIL FROM:<user@gmail.com>\r\n" +
+				"RCPT TO:<golang-nuts@googlegroups.com>\r\n" +
+				"RCPT TO:<nobody@googlegroups.com>\r\n"
+			if tc.err != nil {
+				server += "250 Reset OK\r\n"
+				client += "RSET\r\n"
+			} else {
+				server += "354 Go ahead\r\n"
+				client += "DATA\r\n"
+			}
+
+			var wrote bytes.Buffer
+			var fake faker
+			fake.ReadWriter = struct {
+				io.Reader
+				io.Writer
+			}{
+				strings.NewReader(server),
+				&wrote,
+			}
+			c := NewClient(fake)
+			c.MinAcceptedRecipients = tc.min
+			c.ProceedToData = tc.proceed
+
+			if err := c.Mail("user@gmail.com", nil); err != nil {
+				t.Fatalf("MAIL failed: %s", err)
+			}
+			c.Rcpt("golang-nuts@googlegroups.com", nil)
+			c.Rcpt("nobody@googlegroups.com", nil)
+
+			if _, err := c.Data(); err != tc.err {
+				t.Errorf("Data() = %v, want %v", err, tc.err)
+			}
+			if wrote.String() != client {
+				t.Errorf("Got:\n%s\nExpected:\n%s", wrote.String(), client)
+			}
+		})
+	}
+}
+
+func TestClientCommandDone(t *testing.T) {
+	server := "220 hello world\r\n" +
+		"250 mx.google.com at your service\r\n" +
+		"250 Sender OK\r\n" +
+		"550 No such user\r\n" +
+		"250 Receiver OK\r\n" +
+		"354 Go ahead\r\n" +
+		"250 OK\r\n"
+	var wrote bytes.Buffer
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{
+		strings.NewReader(server),
+		&wrote,
+	}
+	c := NewClient(fake)
+
+	var stats []*CommandStats
+	c.CommandDone = func(s *CommandStats) {
+		stats = append(stats, s)
+	}
+
+	if err := c.Mail("user@gmail.com", nil); err != nil {
+		t.Fatalf("MAIL failed: %s", err)
+	}
+	c.Rcpt("nobody@googlegroups.com", nil)
+	if err := c.Rcpt("golang-nuts@googlegroups.com", nil); err != nil {
+		t.Fatalf("RCPT failed: %s", err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatalf("DATA failed: %s", err)
+	}
+	io.WriteString(w, "Hey <3\r\n")
+	if err := w.Close(); err != nil {
+		t.Fatalf("Bad data response: %s", err)
+	}
+
+	expected := []struct {
+		verb string
+		code int
+		err  bool
+	}{
+		{"EHLO", 250, false},
+		{"MAIL", 250, false},
+		{"RCPT", 550, true},
+		{"RCPT", 250, false},
+		{"DATA", 354, false},
+		{".", 250, false},
+	}
+	if len(stats) != len(expected) {
+		t.Fatalf("Got %v command stats, want %v", len(stats), len(expected))
+	}
+	for i, want := range expected {
+		got := stats[i]
+		if got.Verb != want.verb || got.Code != want.code || (got.Err != nil) != want.err {
+			t.Errorf("stats[%v] = %+v, want verb %v code %v", i, got, want.verb, want.code)
+		}
+		if got.Latency < 0 {
+			t.Errorf("stats[%v].Latency = %v", i, got.Latency)
+		}
+	}
+}
+
+func TestClientHooks(t *testing.T) {
+	server := "220 hello world\r\n" +
+		"250-mx.google.com at your service\r\n" +
+		"250 AUTH PLAIN\r\n" +
+		"235 Accepted\r\n" +
+		"250 Sender OK\r\n" +
+		"550 No such user\r\n" +
+		"250 Receiver OK\r\n" +
+		"354 Go ahead\r\n" +
+		"250 2.0.0 Queued as 42\r\n"
+	var wrote bytes.Buffer
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{
+		strings.NewReader(server),
+		&wrote,
+	}
+	c := NewClient(fake)
+
+	// The greeting is read before the hooks are set
+	if _, err := c.Greeting(); err != nil {
+		t.Fatalf("Greeting() = %v", err)
+	}
+
+	var events []string
+	var connect *ConnectInfo
+	var auth *AuthInfo
+	var sent *MessageSentInfo
+	c.Hooks = &ClientHooks{
+		OnConnect: func(info *ConnectInfo) {
+			events = append(events, "connect")
+			connect = info
+		},
+		OnTLS: func(info *TLSInfo) {
+			events = append(events, "tls")
+		},
+		OnAuth: func(info *AuthInfo) {
+			events = append(events, "auth")
+			auth = info
+		},
+		OnMessageSent: func(info *MessageSentInfo) {
+			events = append(events, "sent")
+			sent = info
+		},
+	}
+
+	if err := c.Auth(sasl.NewPlainClient("", "user", "pass")); err != nil {
+		t.Fatalf("AUTH failed: %v", err)
+	}
+	if err := c.Mail("user@gmail.com", nil); err != nil {
+		t.Fatalf("MAIL failed: %v", err)
+	}
+	c.Rcpt("nobody@googlegroups.com", nil)
+	if err := c.Rcpt("golang-nuts@googlegroups.com", nil); err != nil {
+		t.Fatalf("RCPT failed: %v", err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatalf("DATA failed: %v", err)
+	}
+	io.WriteString(w, "Hey <3\r\n")
+	if err := w.Close(); err != nil {
+		t.Fatalf("Bad data response: %v", err)
+	}
+
+	if want := []string{"connect", "auth", "sent"}; !reflect.DeepEqual(events, want) {
+		t.Fatalf("events = %v, want %v", events, want)
+	}
+	if connect.Greeting != "hello world" || connect.Err != nil {
+		t.Errorf("OnConnect() = %+v, want greeting without error", connect)
+	}
+	if auth.Mechanism != sasl.Plain || auth.Err != nil {
+		t.Errorf("OnAuth() = %+v, want PLAIN without error", auth)
+	}
+	if sent.From != "user@gmail.com" ||
+		!reflect.DeepEqual(sent.Recipients, []string{"golang-nuts@googlegroups.com"}) ||
+		sent.Size != 8 || sent.Response != "2.0.0 Queued as 42" || sent.Err != nil {
+		t.Errorf("OnMessageSent() = %+v", sent)
+	}
+}
+
+func TestClientMinDataRate(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+
+	go func() {
+		io.WriteString(serverConn, "220 hello world\r\n")
+		scanner := bufio.NewScanner(serverConn)
+		for _, reply := range []string{
+			"250 mx.google.com at your service\r\n",
+			"250 Sender OK\r\n",
+			"250 Receiver OK\r\n",
+			"354 Go ahead\r\n",
+		} {
+			if !scanner.Scan() {
+				return
+			}
+			io.WriteString(serverConn, reply)
+		}
+		// Stop reading, the message data is stuck
+	}()
+
+	c := NewClient(clientConn)
+	defer c.Close()
+	c.MinDataRate = 1000
+	c.MinDataRateWindow = 100 * time.Millisecond
+
+	if err := c.Mail("user@gmail.com", nil); err != nil {
+		t.Fatalf("MAIL failed: %s", err)
+	}
+	if err := c.Rcpt("golang-nuts@googlegroups.com", nil); err != nil {
+		t.Fatalf("RCPT failed: %s", err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatalf("DATA failed: %s", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(w, strings.NewReader(strings.Repeat("Hey <3\r\n", 100000)))
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if _, ok := err.(*ThroughputError); !ok {
+			t.Errorf("Write error = %v, want a *ThroughputError", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stuck upload not aborted")
+	}
+}
+
+func TestRetryingSender(t *testing.T) {
+	const chunkingServer = "220 hello world\r\n" +
+		"250-mx.google.com at your service\r\n" +
+		"250 CHUNKING\r\n" +
+		"250 Sender OK\r\n" +
+		"250 Receiver OK\r\n"
+
+	var dialed []*bytes.Buffer
+	dial := func(replies ...string) func() (*Client, error) {
+		return func() (*Client, error) {
+			if len(dialed) == len(replies) {
+				t.Fatal("Too many attempts")
+			}
+			var cmdbuf bytes.Buffer
+			dialed = append(dialed, &cmdbuf)
+			server := chunkingServer + replies[len(dialed)-1]
+			var fake faker
+			fake.ReadWriter = struct {
+				io.Reader
+				io.Writer
+			}{strings.NewReader(server), &cmdbuf}
+			return NewClient(fake), nil
+		}
+	}
+
+	msg := "Hello, world!\r\n"
+
+	var retries []int64
+	s := &RetryingSender{
+		Dial: dial(
+			"250 Chunk OK\r\n421 4.4.2 Timeout\r\n",
+			"250 Chunk OK\r\n250 Chunk OK\r\n250 Message OK\r\n221 Bye\r\n",
+		),
+		From:      "user@gmail.com",
+		To:        []string{"golang-nuts@googlegroups.com"},
+		ChunkSize: 6,
+		OnRetry: func(attempt int, acked int64, err error) {
+			retries = append(retries, acked)
+		},
+	}
+	if err := s.Send(strings.NewReader(msg), int64(len(msg))); err != nil {
+		t.Fatalf("Send() = %v", err)
+	}
+	if !reflect.DeepEqual(retries, []int64{6}) {
+		t.Errorf("Acknowledged offsets passed to OnRetry = %v, want [6]", retries)
+	}
+	expected := "EHLO localhost\r\n" +
+		"MAIL FROM:<user@gmail.com>\r\n" +
+		"RCPT TO:<golang-nuts@googlegroups.com>\r\n" +
+		"BDAT 6\r\nHello," +
+		"BDAT 6\r\n world" +
+		"BDAT 3 LAST\r\n!\r\n" +
+		"QUIT\r\n"
+	if len(dialed) != 2 || dialed[1].String() != expected {
+		t.Errorf("Unexpected commands in the second attempt: %q", dialed[1])
+	}
+
+	// Connection lost before the reply to the LAST chunk
+	dialed = nil
+	s.Dial = dial("250 Chunk OK\r\n250 Chunk OK\r\n", "")
+	err := s.Send(strings.NewReader(msg), int64(len(msg)))
+	if _, ok := err.(*UncertainDeliveryError); !ok {
+		t.Errorf("Send() = %v, want an *UncertainDeliveryError", err)
+	}
+	if len(dialed) != 1 {
+		t.Errorf("Uncertain delivery retried")
+	}
+
+	// Permanent errors aren't retried
+	dialed = nil
+	s.Dial = dial("552 5.3.4 Message too big\r\n", "")
+	err = s.Send(strings.NewReader(msg), int64(len(msg)))
+	if smtpErr, ok := err.(*SMTPError); !ok || smtpErr.Code != 552 {
+		t.Errorf("Send() = %v, want a 552 error", err)
+	}
+	if len(dialed) != 1 {
+		t.Errorf("Permanent error retried")
+	}
+}
+
+func TestClientQuitWithoutReply(t *testing.T) {
+	server := "220 mx.example.org ESMTP\r\n" +
+		"250 mx.example.org at your service\r\n"
+	var wrote bytes.Buffer
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{
+		strings.NewReader(server),
+		&wrote,
+	}
+	c := NewClient(fake)
+
+	var stats *CommandStats
+	c.CommandDone = func(s *CommandStats) {
+		stats = s
+	}
+
+	if err := c.Hello("localhost"); err != nil {
+		t.Fatalf("Hello() = %v", err)
+	}
+	if err := c.Quit(); err != nil {
+		t.Fatalf("Quit() = %v, want nil", err)
+	}
+	if !strings.HasSuffix(wrote.String(), "QUIT\r\n") {
+		t.Errorf("QUIT not sent, got:\n%s", wrote.String())
+	}
+	if stats == nil || stats.Verb != "QUIT" || stats.Code != 0 || stats.Err == nil {
+		t.Errorf("CommandDone() = %+v, want QUIT without reply", stats)
+	}
+}
+
+func TestDialStartTLSPolicy(t *testing.T) {
+	ln := newLocalListener(t)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				serverHandle(conn, t)
+			}()
+		}
+	}()
+
+	// The test certificate isn't valid for this name
+	badConfig := &tls.Config{ServerName: "mx.example.org"}
+
+	_, err := DialStartTLSPolicy(ln.Addr().String(), badConfig, nil)
+	var tlsErr *StartTLSError
+	if !errors.As(err, &tlsErr) || tlsErr.Stage != StartTLSHandshake {
+		t.Fatalf("DialStartTLSPolicy() = %v, want handshake failure", err)
+	}
+
+	var fallbacks []StartTLSStage
+	policy := &StartTLSPolicy{
+		RelaxedConfig: &tls.Config{ServerName: "example.com"},
+		OnFallback: func(err *StartTLSError) {
+			fallbacks = append(fallbacks, err.Stage)
+		},
+	}
+	c, err := DialStartTLSPolicy(ln.Addr().String(), badConfig, policy)
+	if err != nil {
+		t.Fatalf("DialStartTLSPolicy() with relaxed config = %v", err)
+	}
+	if _, ok := c.TLSConnectionState(); !ok {
+		t.Error("Relaxed connection doesn't use TLS")
+	}
+	c.Close()
+	if want := []StartTLSStage{StartTLSHandshake}; !reflect.DeepEqual(fallbacks, want) {
+		t.Errorf("Fallbacks = %v, want %v", fallbacks, want)
+	}
+
+	fallbacks = nil
+	policy = &StartTLSPolicy{
+		AllowPlaintext: true,
+		OnFallback:     policy.OnFallback,
+	}
+	c, err = DialStartTLSPolicy(ln.Addr().String(), badConfig, policy)
+	if err != nil {
+		t.Fatalf("DialStartTLSPolicy() with plaintext fallback = %v", err)
+	}
+	if _, ok := c.TLSConnectionState(); ok {
+		t.Error("Plaintext connection uses TLS")
+	}
+	if err := c.hello(); err != nil {
+		t.Errorf("hello() on plaintext connection = %v", err)
+	}
+	c.Close()
+	if want := []StartTLSStage{StartTLSHandshake}; !reflect.DeepEqual(fallbacks, want) {
+		t.Errorf("Fallbacks = %v, want %v", fallbacks, want)
+	}
+}
+
+func TestClientRawCmd(t *testing.T) {
+	server := "220 mx.example.org ESMTP\r\n" +
+		"250-mx.example.org at your service\r\n" +
+		"250 XCLIENT ADDR NAME\r\n" +
+		"250-2.0.0 Proxy OK\r\n" +
+		"250 2.0.0 Welcome\r\n" +
+		"550 5.7.0 Nope\r\n"
+	var wrote bytes.Buffer
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{
+		strings.NewReader(server),
+		&wrote,
+	}
+	c := NewClient(fake)
+
+	code, msg, err := c.RawCmd(250, "XCLIENT ADDR=%v NAME=%v", "192.0.2.1", "[UNAVAILABLE]")
+	if err != nil {
+		t.Fatalf("RawCmd() = %v", err)
+	}
+	if code != 250 || msg != "2.0.0 Proxy OK\n2.0.0 Welcome" {
+		t.Errorf("RawCmd() = %v %q", code, msg)
+	}
+
+	_, _, err = c.RawCmd(2, "XVENDOR")
+	var smtpErr *SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 550 || smtpErr.EnhancedCode != (EnhancedCode{5, 7, 0}) {
+		t.Errorf("RawCmd() = %v, want a 550 error", err)
+	}
+
+	if _, _, err := c.RawCmd(250, "XVENDOR %v", "a\r\nRSET"); err == nil {
+		t.Error("RawCmd() with CRLF succeeded")
+	}
+
+	want := "EHLO localhost\r\n" +
+		"XCLIENT ADDR=192.0.2.1 NAME=[UNAVAILABLE]\r\n" +
+		"XVENDOR\r\n"
+	if wrote.String() != want {
+		t.Errorf("Wrote:\n%v\nwant:\n%v", wrote.String(), want)
+	}
+}
+
+func TestClientConcurrentUse(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{
+		io.MultiReader(strings.NewReader("220 mx.example.org ESMTP\r\n"+
+			"250 mx.example.org at your service\r\n"), pr),
+		ioutil.Discard,
+	}
+	c := NewClient(fake)
+	c.DebugConcurrentUse = true
+	if err := c.Hello("localhost"); err != nil {
+		t.Fatalf("Hello() = %v", err)
+	}
+
+	// One of the commands waits for the reply, the other one must fail
+	done := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			done <- c.Noop()
+		}()
+	}
+	err := <-done
+	if !errors.Is(err, ErrConcurrentUse) {
+		t.Fatalf("Noop() = %v, want ErrConcurrentUse", err)
+	}
+	if !strings.Contains(err.Error(), "goroutine") {
+		t.Errorf("Noop() = %v, want a stack trace", err)
+	}
+	io.WriteString(pw, "250 2.0.0 OK\r\n")
+	if err := <-done; err != nil {
+		t.Fatalf("Noop() = %v", err)
+	}
+
+	go io.WriteString(pw, "250 2.0.0 Sender OK\r\n"+
+		"250 2.0.0 Recipient OK\r\n"+
+		"354 Go ahead\r\n")
+	if err := c.Mail("alice@example.org", nil); err != nil {
+		t.Fatalf("Mail() = %v", err)
+	}
+	if err := c.Rcpt("bob@example.org", nil); err != nil {
+		t.Fatalf("Rcpt() = %v", err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		t.Fatalf("Data() = %v", err)
+	}
+	if err := c.Reset(); !errors.Is(err, ErrConcurrentUse) {
+		t.Errorf("Reset() with an open data writer = %v, want ErrConcurrentUse", err)
+	}
+	io.WriteString(w, "Hey <3\r\n")
+	go io.WriteString(pw, "250 2.0.0 Queued\r\n"+
+		"250 2.0.0 Reset\r\n")
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	if err := c.Reset(); err != nil {
+		t.Errorf("Reset() = %v", err)
+	}
+}
+
+// callbackSASLClient is a SASL client calling next for each challenge.
+type callbackSASLClient struct {
+	next func()
+}
+
+func (a *callbackSASLClient) Start() (mech string, ir []byte, err error) {
+	return "X-TEST", nil, nil
+}
+
+func (a *callbackSASLClient) Next(challenge []byte) ([]byte, error) {
+	a.next()
+	return []byte("response"), nil
+}
+
+func TestClientAuthConcurrentUse(t *testing.T) {
+	var fake faker
+	fake.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{
+		strings.NewReader("220 mx.example.org ESMTP\r\n" +
+			"250-mx.example.org at your service\r\n" +
+			"250 AUTH X-TEST\r\n" +
+			"334 \r\n" +
+			"235 2.7.0 Authenticated\r\n"),
+		ioutil.Discard,
+	}
+	c := NewClient(fake)
+
+	// Commands can't be interleaved with the exchange
+	var noopErr error
+	a := &callbackSASLClient{next: func() {
+		noopErr = c.Noop()
+	}}
+	if err := c.Auth(a); err != nil {
+		t.Fatalf("Auth() = %v", err)
+	}
+	if !errors.Is(noopErr, ErrConcurrentUse) {
+		t.Errorf("Noop() during AUTH = %v, want ErrConcurrentUse", noopErr)
+	}
+}
+
+func TestClientRelayIdleMonitor(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+
+	go func() {
+		io.WriteString(serverConn, "220 mx.example.org ESMTP\r\n")
+		scanner := bufio.NewScanner(serverConn)
+		data := false
+		for scanner.Scan() {
+			cmd := scanner.Text()
+			switch {
+			case data:
+				if cmd == "." {
+					data = false
+					io.WriteString(serverConn, "250 2.0.0 Queued\r\n")
+				}
+			case cmd == "EHLO localhost":
+				io.WriteString(serverConn, "250 mx.example.org at your service\r\n")
+			case strings.HasPrefix(cmd, "MAIL FROM:"), strings.HasPrefix(cmd, "RCPT TO:"), cmd == "NOOP":
+				io.WriteString(serverConn, "250 2.0.0 OK\r\n")
+			case cmd == "DATA":
+				data = true
+				io.WriteString(serverConn, "354 Go ahead\r\n")
+			default:
+				t.Errorf("Unexpected command: %v", cmd)
+			}
+		}
+	}()
+
+	c := NewClient(clientConn)
+	defer c.Close()
+
+	if _, err := c.StartIdleMonitor(); err != nil {
+		t.Fatalf("StartIdleMonitor() = %v", err)
+	}
+	res, err := c.Relay("alice@example.org", []string{"bob@example.org"}, strings.NewReader("Hey <3\r\n"), nil)
+	if err != nil {
+		t.Fatalf("Relay() = %v", err)
+	}
+	if res.Response != "2.0.0 Queued" {
+		t.Errorf("Relay() response = %q", res.Response)
+	}
+
+	// The monitor must be paused during the next commands, and not read
+	// their replies
+	for i := 0; i < 10; i++ {
+		if err := c.Noop(); err != nil {
+			t.Fatalf("Noop() = %v", err)
+		}
+	}
+	if err := c.Err(); err != nil {
+		t.Errorf("Err() = %v", err)
+	}
+}
+
+func TestClientSendMailEAI(t *testing.T) {
+	for _, tc := range []struct {
+		name, ext string
+		from      string
+		to        []string
+		want      string
+		err       bool
+	}{
+		{
+			name: "smtputf8",
+			ext:  "250 SMTPUTF8\r\n",
+			from: "ålice@bücher.example",
+			to:   []string{"bob@example.org"},
+			want: "MAIL FROM:<ålice@bücher.example> SMTPUTF8\r\n" +
+				"RCPT TO:<bob@example.org>\r\n",
+		},
+		{
+			name: "ascii",
+			ext:  "250 SMTPUTF8\r\n",
+			from: "alice@example.org",
+			to:   []string{"bob@example.org"},
+			want: "MAIL FROM:<alice@example.org>\r\n" +
+				"RCPT TO:<bob@example.org>\r\n",
+		},
+		{
+			name: "a-labels",
+			ext:  "250 8BITMIME\r\n",
+			from: "alice@example.org",
+			to:   []string{"bob@bücher.example"},
+			want: "MAIL FROM:<alice@example.org> BODY=8BITMIME\r\n" +
+				"RCPT TO:<bob@xn--bcher-kva.example>\r\n",
+		},
+		{
+			name: "unsupported",
+			ext:  "250 8BITMIME\r\n",
+			from: "alice@example.org",
+			to:   []string{"bøb@example.org"},
+			err:  true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server := "220 mx.example.org ESMTP\r\n" +
+				"250-mx.example.org at your service\r\n" +
+				tc.ext +
+				"250 Sender OK\r\n" +
+				"250 Receiver OK\r\n" +
+				"354 Go ahead\r\n" +
+				"250 OK\r\n"
+			var wrote bytes.Buffer
+			var fake faker
+			fake.ReadWriter = struct {
+				io.Reader
+				io.Writer
+			}{
+				strings.NewReader(server),
+				&wrote,
+			}
+			c := NewClient(fake)
+
+			err := c.SendMailEAI(tc.from, tc.to, strings.NewReader("Hey <3\r\n"))
+			if tc.err {
+				var optErr *OptionError
+				if !errors.As(err, &optErr) {
+					t.Fatalf("SendMailEAI() = %v, want an OptionError", err)
+				}
+				return
+			} else if err != nil {
+				t.Fatalf("SendMailEAI() = %v", err)
+			}
+
+			want := "EHLO localhost\r\n" + tc.want + "DATA\r\nHey <3\r\n.\r\n"
+			if wrote.String() != want {
+				t.Errorf("Wrote:\n%v\nwant:\n%v", wrote.String(), want)
+			}
+		})
+	}
+}
+
+func TestClientIdleMonitor(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+
+	idle := make(chan struct{})
+	go func() {
+		io.WriteString(serverConn, "220 mx.example.org ESMTP\r\n")
+		scanner := bufio.NewScanner(serverConn)
+		noops := 0
+		for scanner.Scan() {
+			switch cmd := scanner.Text(); cmd {
+			case "EHLO localhost":
+				io.WriteString(serverConn, "250 mx.example.org at your service\r\n")
+			case "NOOP":
+				io.WriteString(serverConn, "250 2.0.0 OK\r\n")
+				noops++
+			default:
+				t.Errorf("Unexpected command: %v", cmd)
+			}
+			if noops == 3 {
+				break
+			}
+		}
+
+		// Hang up on the idle client
+		<-idle
+		io.WriteString(serverConn, "421 4.4.2 Idle timeout, bye bye\r\n")
+		serverConn.Close()
+	}()
+
+	c := NewClient(clientConn)
+	defer c.Close()
+
+	done, err := c.StartIdleMonitor()
+	if err != nil {
+		t.Fatalf("StartIdleMonitor() = %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := c.Noop(); err != nil {
+			t.Fatalf("Noop() = %v", err)
+		}
+	}
+	if err := c.Err(); err != nil {
+		t.Fatalf("Err() = %v", err)
+	}
+	close(idle)
+
+	err = <-done
+	var smtpErr *SMTPError
+	if !errors.As(err, &smtpErr) || smtpErr.Code != 421 {
+		t.Fatalf("Idle monitor error = %v, want a 421 error", err)
+	}
+	if c.Err() != err {
+		t.Errorf("Err() = %v, want %v", c.Err(), err)
+	}
+	if err := c.Noop(); err != smtpErr {
+		t.Errorf("Noop() = %v, want %v", err, smtpErr)
+	}
+}
@@ -0,0 +1,65 @@
+package smtp
+
+import (
+	"time"
+)
+
+// Clock is a source of time. It can be replaced in Server.Clock to run tests
+// instantly and deterministically.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// NewTimer creates a timer sending the current time on its channel after
+	// at least d.
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is a single event created by Clock.NewTimer, see time.Timer.
+type Timer interface {
+	// C returns the channel on which the time is delivered.
+	C() <-chan time.Time
+	// Stop prevents the timer from firing. It returns false if the timer has
+	// already expired or been stopped.
+	Stop() bool
+}
+
+// systemClock is the Clock backed by the time package.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTimer(d time.Duration) Timer {
+	return systemTimer{time.NewTimer(d)}
+}
+
+type systemTimer struct {
+	*time.Timer
+}
+
+func (t systemTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+func (s *Server) clock() Clock {
+	if s.Clock == nil {
+		return systemClock{}
+	}
+	return s.Clock
+}
+
+// now returns the current time according to Server.Clock.
+func (s *Server) now() time.Time {
+	return s.clock().Now()
+}
+
+// sleep waits for d, or until the server is closed.
+func (s *Server) sleep(d time.Duration) {
+	timer := s.clock().NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C():
+	case <-s.done:
+	}
+}
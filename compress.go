@@ -0,0 +1,52 @@
+package smtp
+
+import (
+	"compress/flate"
+	"io"
+	"net"
+)
+
+// compressConn is a net.Conn compressing the stream with DEFLATE, as
+// negotiated by the experimental XCOMPRESS extension.
+type compressConn struct {
+	net.Conn
+	r io.ReadCloser
+	w *flate.Writer
+}
+
+func newCompressConn(conn net.Conn) *compressConn {
+	// flate.NewWriter only fails with an invalid level
+	w, _ := flate.NewWriter(conn, flate.DefaultCompression)
+	return &compressConn{
+		Conn: conn,
+		r:    flate.NewReader(conn),
+		w:    w,
+	}
+}
+
+func (c *compressConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *compressConn) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	if err != nil {
+		return n, err
+	}
+	// SMTP is interactive, the peer needs to see the data right away
+	return n, c.w.Flush()
+}
+
+func (c *compressConn) Close() error {
+	c.r.Close()
+	return c.Conn.Close()
+}
+
+// unwrapConn returns the connection underlying the transport compression
+// layer, if any.
+func unwrapConn(conn net.Conn) net.Conn {
+	if cc, ok := conn.(*compressConn); ok {
+		return cc.Conn
+	}
+	return conn
+}
@@ -1,6 +1,7 @@
 package smtp
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/base64"
 	"errors"
@@ -14,6 +15,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/emersion/go-sasl"
@@ -27,38 +29,93 @@ type Conn struct {
 	text   *textproto.Conn
 	server *Server
 	helo   string
+	ehlo   bool // whether EHLO or LHLO was used instead of HELO
+
+	// Underlying connection, below TLS and compression
+	netConn net.Conn
 
 	// Number of errors witnessed on this connection
 	errCount int
+	// Number of too long command lines received on this connection
+	tooLongLines int
+	// Memory accounted for the connection and for the current mail
+	// transaction, see Server.MaxConnMemory. Accessed atomically.
+	memUsed, dataMemory int64
+
+	// Number of junk lines still tolerated after the message data, see
+	// Server.MaxDataTrailerLines
+	dataTrailerLeft int
+
+	stats ConnStats // protected by locker
+
+	// Number of 4xx and 5xx replies sent on this connection
+	failedReplies int
+	// Delay before the next reply, if the session is tarpitted
+	tarpitDelay time.Duration
 
 	session    Session
 	locker     sync.Mutex
 	binarymime bool
+	// Whether the current command relies on Server.LenientSyntax, see
+	// allowLenient
+	lenient bool
+
+	// Protects the reply buffer, replies may be written by LMTPData while
+	// the message data is being read
+	writeLocker sync.Mutex
+
+	utf8      bool   // whether replies may contain UTF-8
+	command   string // command being handled
+	replyCode int    // code of the last reply, protected by writeLocker
 
 	lineLimitReader *lineLimitReader
+	deadlineReader  *deadlineReader
 	bdatPipe        *io.PipeWriter
 	bdatStatus      *statusCollector // used for BDAT on LMTP
 	dataResult      chan error
-	bytesReceived   int64 // counts total size of chunks when BDAT is used
+	bytesReceived   int64             // counts total size of chunks when BDAT is used
+	inspection      *inspectingReader // see Server.DataInspectors
 
-	fromReceived bool
-	recipients   []string
+	domain string // see Server.DomainForConn
+
+	tx           *Transaction
 	didAuth      bool
+	authIdentity string
+
+	// Whether Close has been called. Protected by locker.
+	closed bool
+
+	// Reply text of the 421 to send once the current transaction is over,
+	// see requestClose. Protected by locker.
+	closeRequest string
+	// Whether the connection is waiting for a command. Protected by locker.
+	waitingCommand bool
+
+	ctx       context.Context
+	cancelCtx context.CancelFunc
 }
 
 func newConn(c net.Conn, s *Server) *Conn {
 	sc := &Conn{
-		server: s,
-		conn:   c,
+		server:  s,
+		conn:    c,
+		netConn: c,
+	}
+	if tlsConn, ok := c.(*tls.Conn); ok {
+		if conn, ok := s.tlsNetConns.Load(tlsConn); ok {
+			sc.netConn = conn.(net.Conn)
+		}
 	}
+	sc.ctx, sc.cancelCtx = context.WithCancel(s.baseContext())
 
 	sc.init()
 	return sc
 }
 
 func (c *Conn) init() {
+	c.deadlineReader = &deadlineReader{conn: c.conn, clock: c.server.clock(), flush: c.flush}
 	c.lineLimitReader = &lineLimitReader{
-		R:         c.conn,
+		R:         c.deadlineReader,
 		LineLimit: c.server.MaxLineLength,
 	}
 	rwc := struct {
@@ -67,7 +124,7 @@ func (c *Conn) init() {
 		io.Closer
 	}{
 		Reader: c.lineLimitReader,
-		Writer: c.conn,
+		Writer: &deadlineWriter{conn: c.conn, server: c.server},
 		Closer: c.conn,
 	}
 
@@ -88,12 +145,25 @@ func (c *Conn) init() {
 
 // Commands are dispatched to the appropriate handler functions.
 func (c *Conn) handle(cmd string, arg string) {
+	if c.server.OnCommandDone != nil && cmd != "" {
+		c.writeLocker.Lock()
+		c.replyCode = 0
+		c.writeLocker.Unlock()
+		// Deferred first, so that the reply sent on panic is reported
+		defer func() {
+			c.writeLocker.Lock()
+			code := c.replyCode
+			c.writeLocker.Unlock()
+			c.server.OnCommandDone(c, cmd, commandHookArg(cmd, arg), code)
+		}()
+	}
+
 	// If panic happens during command handling - send 421 response
 	// and close connection.
 	defer func() {
 		if err := recover(); err != nil {
 			c.writeResponse(421, EnhancedCode{4, 0, 0}, "Internal server error")
-			c.Close()
+			c.closeWithReason(QuitError)
 
 			stack := debug.Stack()
 			c.server.ErrorLog.Printf("panic serving %v: %v\n%s", c.conn.RemoteAddr(), err, stack)
@@ -106,8 +176,32 @@ func (c *Conn) handle(cmd string, arg string) {
 	}
 
 	cmd = strings.ToUpper(cmd)
+	c.command = cmd
+	c.lenient = false
+	// BDAT is always followed by the chunk
+	if cmd != "BDAT" && c.text.R.Buffered() > 0 {
+		c.locker.Lock()
+		c.stats.PipelinedCommands++
+		c.locker.Unlock()
+	}
+	defer func() {
+		c.command = ""
+	}()
+	// BDAT is checked once the size of the chunk is known, so that it can be
+	// discarded
+	if cmd != "BDAT" {
+		if err := c.checkCommand(cmd, arg); err != nil {
+			c.writeError(550, EnhancedCode{5, 7, 1}, err)
+			return
+		}
+	}
+	if extCmd := c.extensionCommand(cmd); extCmd != nil {
+		extCmd.Handler(c, arg)
+		return
+	}
+
 	switch cmd {
-	case "SEND", "SOML", "SAML", "EXPN", "HELP", "TURN":
+	case "SEND", "SOML", "SAML", "TURN":
 		// These commands are not implemented in any state
 		c.writeResponse(502, EnhancedCode{5, 5, 1}, fmt.Sprintf("%v command not implemented", cmd))
 	case "HELO", "EHLO", "LHLO":
@@ -127,10 +221,15 @@ func (c *Conn) handle(cmd string, arg string) {
 	case "RCPT":
 		c.handleRcpt(arg)
 	case "VRFY":
-		c.writeResponse(252, EnhancedCode{2, 5, 0}, "Cannot VRFY user, but will accept message")
+		c.handleVrfy(arg)
+	case "EXPN":
+		c.handleExpn(arg)
 	case "NOOP":
 		c.writeResponse(250, EnhancedCode{2, 0, 0}, "I have successfully done nothing")
 	case "RSET": // Reset session
+		if session, ok := c.Session().(NotifySession); ok {
+			session.OnReset()
+		}
 		c.reset()
 		c.writeResponse(250, EnhancedCode{2, 0, 0}, "Session reset")
 	case "BDAT":
@@ -139,17 +238,45 @@ func (c *Conn) handle(cmd string, arg string) {
 		c.handleData(arg)
 	case "QUIT":
 		c.writeResponse(221, EnhancedCode{2, 0, 0}, "Bye")
-		c.Close()
+		c.closeWithReason(QuitCommand)
+	case "HELP":
+		c.handleHelp(arg)
 	case "AUTH":
 		c.handleAuth(arg)
 	case "STARTTLS":
 		c.handleStartTLS()
+	case "XCOMPRESS":
+		if !c.server.EnableXCOMPRESS {
+			c.protocolError(500, EnhancedCode{5, 5, 2}, "Syntax errors, XCOMPRESS command unrecognized")
+			return
+		}
+		c.handleXCompress(arg)
 	default:
 		msg := fmt.Sprintf("Syntax errors, %v command unrecognized", cmd)
 		c.protocolError(500, EnhancedCode{5, 5, 2}, msg)
 	}
 }
 
+// checkCommand calls Server.OnCommand.
+func (c *Conn) checkCommand(cmd, arg string) error {
+	if c.server.OnCommand == nil {
+		return nil
+	}
+	return c.server.OnCommand(c, cmd, commandHookArg(cmd, arg))
+}
+
+// commandHookArg returns the argument of a command passed to
+// Server.OnCommand and Server.OnCommandDone: the AUTH initial response is
+// removed, since it may contain credentials.
+func commandHookArg(cmd, arg string) string {
+	if cmd == "AUTH" {
+		if fields := strings.Fields(arg); len(fields) > 0 {
+			return fields[0]
+		}
+	}
+	return arg
+}
+
 func (c *Conn) Server() *Server {
 	return c.server
 }
@@ -160,43 +287,380 @@ func (c *Conn) Session() Session {
 	return c.session
 }
 
-func (c *Conn) setSession(session Session) {
+// ConnStats contains statistics about a connection.
+type ConnStats struct {
+	// Number of mail transactions started, i.e. of accepted MAIL commands.
+	Transactions int
+	// Total size of the message data received, in bytes.
+	BytesReceived int64
+	// Size of the message data sent with DATA which hasn't been read by the
+	// backend and has been discarded by the server, in bytes.
+	DiscardedBytes int64
+	// Size of the message data sent with DATA past Server.MaxMessageBytes,
+	// in bytes. This data is discarded by the server.
+	OversizeBytes int64
+	// Number of commands only accepted because of Server.LenientSyntax.
+	LenientCommands int
+	// Number of challenges (334 replies) sent during AUTH exchanges.
+	AuthChallenges int
+	// Number of AUTH exchanges aborted because of Server.MaxAuthLineLength,
+	// Server.MaxAuthExchanges or Server.MaxAuthResponseSize.
+	AuthLimitsExceeded int
+	// Number of commands followed by another command sent without waiting
+	// for the reply (RFC 2920 PIPELINING). Non-zero if the client has used
+	// pipelining.
+	PipelinedCommands int
+	// Number of junk lines ignored after the end of the message data, see
+	// Server.MaxDataTrailerLines.
+	DataTrailerLines int
+	// JA4 fingerprint of the TLS ClientHello, see Server.FingerprintTLS.
+	TLSFingerprint string
+}
+
+// Stats returns statistics about the connection.
+func (c *Conn) Stats() ConnStats {
 	c.locker.Lock()
 	defer c.locker.Unlock()
-	c.session = session
+	return c.stats
 }
 
-func (c *Conn) Close() error {
+// allowLenient reports whether a syntax error can be tolerated because of
+// Server.LenientSyntax. Its use is recorded by countLenient once the command
+// has been validated.
+func (c *Conn) allowLenient() bool {
+	if !c.server.LenientSyntax {
+		return false
+	}
+	c.lenient = true
+	return true
+}
+
+// countLenient records that the current command has only been accepted
+// because of Server.LenientSyntax, if that's the case.
+func (c *Conn) countLenient() {
+	if !c.lenient {
+		return
+	}
+	c.lenient = false
+	c.locker.Lock()
+	c.stats.LenientCommands++
+	c.locker.Unlock()
+}
+
+// cutPathPrefix removes the "FROM:" or "TO:" prefix of MAIL and RCPT
+// arguments. In lenient mode, spaces before the colon are allowed, and the
+// colon can be omitted if the keyword is followed by a space or the path,
+// e.g. "MAIL FROM <alice@example.org>".
+func (c *Conn) cutPathPrefix(arg, keyword string) (string, bool) {
+	if s, ok := cutPrefixFold(arg, keyword+":"); ok {
+		return s, true
+	}
+	s, ok := cutPrefixFold(arg, keyword)
+	if !ok {
+		return "", false
+	}
+	trimmed := strings.TrimLeft(s, " \t")
+	if strings.HasPrefix(trimmed, ":") {
+		if !c.allowLenient() {
+			return "", false
+		}
+		return trimmed[1:], true
+	}
+	if trimmed == "" || (trimmed == s && !strings.HasPrefix(s, "<")) || !c.allowLenient() {
+		return "", false
+	}
+	return trimmed, true
+}
+
+// parsePathArg parses the path at the start of MAIL and RCPT arguments, and
+// returns the ESMTP parameters which follow. In lenient mode, a display name
+// before the path is ignored, e.g. in `"Alice" <alice@example.org>`.
+func (c *Conn) parsePathArg(arg string, reverse bool) (path, rawPath, params string, err error) {
+	parse := func(s string) (path, rawPath, params string, err error) {
+		p := parser{s: s}
+		f := p.parsePath
+		if reverse {
+			f = p.parseReversePath
+		}
+		path, rawPath, err = p.parseRaw(f)
+		return path, rawPath, p.s, err
+	}
+
+	arg = strings.TrimSpace(arg)
+	path, rawPath, params, err = parse(arg)
+	if err == nil || !c.server.LenientSyntax {
+		return path, rawPath, params, err
+	}
+
+	i := strings.IndexByte(arg, '<')
+	if i <= 0 {
+		return "", "", "", err
+	}
+	path, rawPath, params, lenientErr := parse(arg[i:])
+	if lenientErr != nil {
+		return "", "", "", err
+	}
+	c.allowLenient()
+	return path, rawPath, params, nil
+}
+
+// skipDataTrailer reports whether line is junk sent by a broken client after
+// the end of the message data, e.g. an extra blank line, to be ignored
+// according to Server.MaxDataTrailerLines.
+func (c *Conn) skipDataTrailer(line string) bool {
+	if c.dataTrailerLeft <= 0 {
+		return false
+	}
+	if strings.Trim(line, " \t.") != "" {
+		// Back in sync
+		c.dataTrailerLeft = 0
+		return false
+	}
+
+	c.dataTrailerLeft--
+	c.locker.Lock()
+	c.stats.DataTrailerLines++
+	c.locker.Unlock()
+	return true
+}
+
+func (c *Conn) addBytesReceived(n int64) {
+	c.locker.Lock()
+	c.stats.BytesReceived += n
+	c.locker.Unlock()
+}
+
+// Transaction returns the mail transaction in progress, or nil if no MAIL
+// command has been accepted yet.
+func (c *Conn) Transaction() *Transaction {
 	c.locker.Lock()
 	defer c.locker.Unlock()
+	return c.tx
+}
+
+func (c *Conn) setSession(session Session) {
+	c.locker.Lock()
+	closed := c.closed
+	if !closed {
+		c.session = session
+	}
+	c.locker.Unlock()
+
+	// The connection has been closed while the session was being created
+	if closed && session != nil {
+		c.logout(session)
+	}
+}
+
+// Context returns a context cancelled when the connection is closed, when the
+// server is closed or when the deadline passed to Server.Shutdown expires. It
+// can be used to stop backend work for clients which have gone away.
+func (c *Conn) Context() context.Context {
+	return c.ctx
+}
+
+func (c *Conn) Close() error {
+	return c.closeWithReason(QuitServer)
+}
 
+// closeWithReason closes the connection, passing reason to
+// NotifySession.OnQuit.
+func (c *Conn) closeWithReason(reason QuitReason) error {
+	c.locker.Lock()
 	if c.bdatPipe != nil {
 		c.bdatPipe.CloseWithError(ErrDataReset)
 		c.bdatPipe = nil
 	}
+	if c.inspection != nil {
+		c.inspection.abort(ErrDataReset)
+		c.inspection = nil
+	}
+	session := c.session
+	c.session = nil
+	c.closed = true
+	c.locker.Unlock()
 
-	if c.session != nil {
-		c.session.Logout()
-		c.session = nil
+	// TODO: error handling
+	c.flush()
+	c.cancelCtx()
+
+	if session != nil {
+		if session, ok := session.(NotifySession); ok {
+			session.OnQuit(reason)
+		}
+		c.logout(session)
 	}
 
 	return c.conn.Close()
 }
 
+// logout calls session.Logout. Errors and panics are logged, and the server
+// stops waiting for Logout after Server.LogoutTimeout.
+//
+// The caller must make sure logout is called only once per session.
+func (c *Conn) logout(session Session) {
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				stack := debug.Stack()
+				c.server.ErrorLog.Printf("panic in Logout for %v: %v\n%s", c.conn.RemoteAddr(), err, stack)
+				done <- nil
+			}
+		}()
+		done <- session.Logout()
+	}()
+
+	timeout := c.server.LogoutTimeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	timer := c.server.clock().NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			c.server.ErrorLog.Printf("error logging out %v: %v", c.conn.RemoteAddr(), err)
+		}
+	case <-timer.C():
+		c.server.ErrorLog.Printf("timeout logging out %v after %v", c.conn.RemoteAddr(), timeout)
+	}
+}
+
 // TLSConnectionState returns the connection's TLS connection state.
 // Zero values are returned if the connection doesn't use TLS.
 func (c *Conn) TLSConnectionState() (state tls.ConnectionState, ok bool) {
-	tc, ok := c.conn.(*tls.Conn)
+	tc, ok := unwrapConn(c.conn).(*tls.Conn)
 	if !ok {
 		return
 	}
 	return tc.ConnectionState(), true
 }
 
+// NegotiatedProtocol returns the ALPN protocol negotiated during the TLS
+// handshake, see Server.StrictALPN. It's empty if the connection doesn't use
+// TLS or if the client didn't request ALPN.
+func (c *Conn) NegotiatedProtocol() string {
+	state, ok := c.TLSConnectionState()
+	if !ok {
+		return ""
+	}
+	return state.NegotiatedProtocol
+}
+
+// checkALPN returns an error if Server.StrictALPN is set and the TLS
+// handshake negotiated an unexpected ALPN protocol.
+func (c *Conn) checkALPN(state tls.ConnectionState) error {
+	proto := state.NegotiatedProtocol
+	if !c.server.StrictALPN || proto == "" || proto == alpnProtocol {
+		return nil
+	}
+	if c.server.LMTP && proto == "lmtp" {
+		return nil
+	}
+	return fmt.Errorf("unexpected ALPN protocol %q", proto)
+}
+
+// Domain returns the domain of the server for this connection, as chosen by
+// Server.DomainForConn, or Server.Domain.
+func (c *Conn) Domain() string {
+	if c.domain != "" {
+		return c.domain
+	}
+	return c.server.Domain
+}
+
+// selectDomain calls Server.DomainForConn.
+func (c *Conn) selectDomain() {
+	if c.server.DomainForConn != nil {
+		c.domain = c.server.DomainForConn(c)
+	}
+}
+
 func (c *Conn) Hostname() string {
 	return c.helo
 }
 
+// AuthIdentity returns the identity the client authenticated as, as set by
+// the backend with SetAuthIdentity. It is empty if the client isn't
+// authenticated.
+func (c *Conn) AuthIdentity() string {
+	return c.authIdentity
+}
+
+// SetAuthIdentity sets the identity the client authenticates as. It must be
+// called by the backend during the AUTH exchange, once the credentials have
+// been verified, e.g. from the callback of the sasl.Server returned by
+// AuthSession.Auth or from ExternalAuthSession.AuthExternal. It's discarded
+// if the exchange fails.
+//
+// The identity is used by Server.Quota, Server.Accounting,
+// Server.RejectionLogger and CheckSubmissionHeader.
+func (c *Conn) SetAuthIdentity(identity string) {
+	c.authIdentity = identity
+}
+
+// TransmissionType returns the protocol type used in the "with" clause of
+// Received header fields, as defined in RFC 3848: SMTP, ESMTP or LMTP,
+// followed by "S" if TLS is used and "A" if the client is authenticated
+// (e.g. ESMTPSA).
+func (c *Conn) TransmissionType() string {
+	if !c.ehlo && !c.server.LMTP {
+		return "SMTP"
+	}
+
+	s := "ESMTP"
+	if c.server.LMTP {
+		s = "LMTP"
+	}
+	if _, isTLS := c.TLSConnectionState(); isTLS {
+		s += "S"
+	}
+	if c.didAuth {
+		s += "A"
+	}
+	return s
+}
+
+// addressLiteral formats the IP address of addr as an address literal (RFC
+// 5321 section 4.1.3). It returns an empty string if addr isn't a TCP
+// address.
+func addressLiteral(addr net.Addr) string {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return ""
+	}
+	if ip4 := tcpAddr.IP.To4(); ip4 != nil {
+		return "[" + ip4.String() + "]"
+	}
+	return "[IPv6:" + tcpAddr.IP.String() + "]"
+}
+
+// receivedHeader formats a Received header field (RFC 5321 section 4.4) for
+// a transaction.
+func (c *Conn) receivedHeader(tx *Transaction) string {
+	var sb strings.Builder
+	sb.WriteString("Received: from " + c.helo)
+	if lit := addressLiteral(c.conn.RemoteAddr()); lit != "" {
+		sb.WriteString(" (" + lit + ")")
+	}
+	sb.WriteString("\r\n\tby " + c.Domain() + " with " + c.TransmissionType())
+	if tx.ID != "" {
+		sb.WriteString(" id " + tx.ID)
+	}
+	// Listing several recipients would disclose Bcc recipients
+	if len(tx.Recipients) == 1 {
+		sb.WriteString("\r\n\tfor <" + tx.Recipients[0] + ">")
+	}
+	date := tx.DataStartedAt
+	if date.IsZero() {
+		date = c.server.now()
+	}
+	sb.WriteString("; " + date.Format(time.RFC1123Z) + "\r\n")
+	return sb.String()
+}
+
 func (c *Conn) Conn() net.Conn {
 	return c.conn
 }
@@ -220,14 +684,25 @@ func (c *Conn) protocolError(code int, ec EnhancedCode, msg string) {
 
 // GREET state -> waiting for HELO
 func (c *Conn) handleGreet(enhanced bool, arg string) {
+	if msg := c.repeatedHelloError(); msg != "" {
+		c.writeResponse(503, EnhancedCode{5, 5, 1}, msg)
+		return
+	}
+
 	domain, err := parseHelloArgument(arg)
 	if err != nil {
-		c.writeResponse(501, EnhancedCode{5, 5, 2}, "Domain/address argument required for HELO")
-		return
+		// Some ancient clients don't send their name
+		domain = addressLiteral(c.conn.RemoteAddr())
+		if arg != "" || domain == "" || !c.allowLenient() {
+			c.writeResponse(501, EnhancedCode{5, 5, 2}, "Domain/address argument required for HELO")
+			return
+		}
 	}
+	c.countLenient()
 	// c.helo is populated before NewSession so
 	// NewSession can access it via Conn.Hostname.
 	c.helo = domain
+	c.ehlo = enhanced
 
 	// RFC 5321: "An EHLO command MAY be issued by a client later in the session"
 	if c.session != nil {
@@ -283,50 +758,78 @@ func (c *Conn) handleGreet(enhanced bool, arg string) {
 	if c.server.EnableDSN {
 		caps = append(caps, "DSN")
 	}
-	if c.server.MaxMessageBytes > 0 {
-		caps = append(caps, fmt.Sprintf("SIZE %v", c.server.MaxMessageBytes))
-	} else {
+	if _, compressed := c.conn.(*compressConn); c.server.EnableXCOMPRESS && !compressed {
+		caps = append(caps, "XCOMPRESS DEFLATE")
+	}
+	if size := c.advertisedMessageBytes(); size > 0 {
+		caps = append(caps, fmt.Sprintf("SIZE %v", size))
+	} else if size == 0 {
+		// No fixed maximum, see RFC 1870 section 4
 		caps = append(caps, "SIZE")
 	}
 	if c.server.MaxRecipients > 0 {
 		caps = append(caps, fmt.Sprintf("LIMITS RCPTMAX=%v", c.server.MaxRecipients))
 	}
+	caps = append(caps, c.extensionCaps()...)
 
 	args := []string{"Hello " + domain}
 	args = append(args, caps...)
 	c.writeResponse(250, NoEnhancedCode, args...)
 }
 
+// advertisedMessageBytes returns the size to advertise with the SIZE
+// capability: zero for no fixed maximum, a negative value to omit the
+// capability.
+func (c *Conn) advertisedMessageBytes() int64 {
+	if c.server.AdvertisedMessageBytes != 0 {
+		return c.server.AdvertisedMessageBytes
+	}
+	if c.server.MaxMessageBytes < 0 {
+		return 0
+	}
+	return c.server.MaxMessageBytes
+}
+
 // READY state -> waiting for MAIL
 func (c *Conn) handleMail(arg string) {
-	if c.helo == "" {
-		c.writeResponse(502, EnhancedCode{5, 5, 1}, "Please introduce yourself first.")
+	if !c.checkCommandOrder("MAIL") {
 		return
 	}
-	if c.bdatPipe != nil {
-		c.writeResponse(502, EnhancedCode{5, 5, 1}, "MAIL not allowed during message transfer")
+
+	if fi := c.server.faultInjection(); fi != nil && c.server.chance(fi.MailFailure) {
+		c.writeResponse(451, EnhancedCode{4, 3, 0}, "Simulated failure, please try again later")
+		return
+	}
+
+	if max := c.server.MaxTransactionsPerConn; max > 0 && c.Stats().Transactions >= max {
+		c.writeResponse(421, EnhancedCode{4, 7, 0}, "Too many transactions on this connection, please reconnect")
+		c.Close()
+		return
+	}
+	if max := c.server.MaxBytesPerConn; max > 0 && c.Stats().BytesReceived >= max {
+		c.writeResponse(421, EnhancedCode{4, 7, 0}, "Too much data sent on this connection, please reconnect")
+		c.Close()
 		return
 	}
 
-	arg, ok := cutPrefixFold(arg, "FROM:")
+	arg, ok := c.cutPathPrefix(arg, "FROM")
 	if !ok {
 		c.writeResponse(501, EnhancedCode{5, 5, 2}, "Was expecting MAIL arg syntax of FROM:<address>")
 		return
 	}
 
-	p := parser{s: strings.TrimSpace(arg)}
-	from, err := p.parseReversePath()
+	from, rawPath, params, err := c.parsePathArg(arg, true)
 	if err != nil {
 		c.writeResponse(501, EnhancedCode{5, 5, 2}, "Was expecting MAIL arg syntax of FROM:<address>")
 		return
 	}
-	args, err := parseArgs(p.s)
+	args, err := parseArgs(params)
 	if err != nil {
 		c.writeResponse(501, EnhancedCode{5, 5, 4}, "Unable to parse MAIL ESMTP parameters")
 		return
 	}
 
-	opts := &MailOptions{}
+	opts := &MailOptions{RawPath: rawPath}
 
 	c.binarymime = false
 	// This is where the Conn may put BODY=8BITMIME, but we already
@@ -422,13 +925,55 @@ func (c *Conn) handleMail(arg string) {
 		}
 	}
 
-	if err := c.Session().Mail(from, opts); err != nil {
+	c.countLenient()
+
+	if !c.allowRate(RateLimitMail) {
+		c.writeResponse(450, EnhancedCode{4, 7, 1}, "Too many messages from your address, try again later")
+		return
+	}
+
+	if c.server.Quota != nil {
+		if err := c.server.Quota.CheckSender(c.AuthIdentity(), from); err != nil {
+			if quotaErr, ok := err.(*QuotaError); ok {
+				err = quotaErr.smtpError()
+			}
+			c.writeError(450, EnhancedCode{4, 7, 1}, err)
+			return
+		}
+	}
+
+	id, err := newTransactionID(c.server.now(), c.server.Rand)
+	if err != nil {
+		c.server.ErrorLog.Printf("error handling %v: %s", c.conn.RemoteAddr(), err)
+		c.writeResponse(451, EnhancedCode{4, 3, 0}, "Internal server error, try again later")
+		return
+	}
+	tx := &Transaction{
+		ID:          id,
+		From:        from,
+		MailOptions: opts,
+		StartedAt:   c.server.now(),
+		ctx:         c.ctx,
+	}
+	enhCode, text := EnhancedCode{2, 0, 0}, []string{fmt.Sprintf("Roger, accepting mail from <%v>", from)}
+	if err := c.sessionMail(tx); err != nil {
 		c.writeError(451, EnhancedCode{4, 0, 0}, err)
 		return
 	}
+	if session, ok := c.Session().(ReplySession); ok {
+		if reply := session.MailReply(from); reply != nil {
+			_, enhCode, text = reply.reply(text[0], false)
+		}
+	}
 
-	c.writeResponse(250, EnhancedCode{2, 0, 0}, fmt.Sprintf("Roger, accepting mail from <%v>", from))
-	c.fromReceived = true
+	// RFC 6531 section 3.7.4.2: replies may contain UTF-8 once the client
+	// has used SMTPUTF8
+	c.utf8 = opts.UTF8
+	c.writeResponse(250, enhCode, text...)
+	c.locker.Lock()
+	c.tx = tx
+	c.stats.Transactions++
+	c.locker.Unlock()
 }
 
 // This regexp matches 'hexchar' token defined in
@@ -651,42 +1196,44 @@ func isPrintableASCII(val string) bool {
 	return true
 }
 
+// maxRecipients returns the recipient limit for the current session.
+func (c *Conn) maxRecipients() int {
+	if limits, ok := c.Session().(SessionLimits); ok {
+		return limits.MaxRecipients()
+	}
+	return c.server.MaxRecipients
+}
+
 // MAIL state -> waiting for RCPTs followed by DATA
 func (c *Conn) handleRcpt(arg string) {
-	if !c.fromReceived {
-		c.writeResponse(502, EnhancedCode{5, 5, 1}, "Missing MAIL FROM command.")
-		return
-	}
-	if c.bdatPipe != nil {
-		c.writeResponse(502, EnhancedCode{5, 5, 1}, "RCPT not allowed during message transfer")
+	if !c.checkCommandOrder("RCPT") {
 		return
 	}
 
-	arg, ok := cutPrefixFold(arg, "TO:")
+	arg, ok := c.cutPathPrefix(arg, "TO")
 	if !ok {
 		c.writeResponse(501, EnhancedCode{5, 5, 2}, "Was expecting RCPT arg syntax of TO:<address>")
 		return
 	}
 
-	p := parser{s: strings.TrimSpace(arg)}
-	recipient, err := p.parsePath()
+	recipient, rawPath, params, err := c.parsePathArg(arg, false)
 	if err != nil {
 		c.writeResponse(501, EnhancedCode{5, 5, 2}, "Was expecting RCPT arg syntax of TO:<address>")
 		return
 	}
 
-	if c.server.MaxRecipients > 0 && len(c.recipients) >= c.server.MaxRecipients {
-		c.writeResponse(452, EnhancedCode{4, 5, 3}, fmt.Sprintf("Maximum limit of %v recipients reached", c.server.MaxRecipients))
+	if max := c.maxRecipients(); max > 0 && len(c.tx.Recipients) >= max {
+		c.writeResponse(452, EnhancedCode{4, 5, 3}, fmt.Sprintf("Maximum limit of %v recipients reached", max))
 		return
 	}
 
-	args, err := parseArgs(p.s)
+	args, err := parseArgs(params)
 	if err != nil {
 		c.writeResponse(501, EnhancedCode{5, 5, 4}, "Unable to parse RCPT ESMTP parameters")
 		return
 	}
 
-	opts := &RcptOptions{}
+	opts := &RcptOptions{RawPath: rawPath}
 
 	for key, value := range args {
 		switch key {
@@ -721,13 +1268,74 @@ func (c *Conn) handleRcpt(arg string) {
 			return
 		}
 	}
+	c.countLenient()
+
+	code, enhCode, text := 250, EnhancedCode{2, 0, 0}, []string{fmt.Sprintf("I'll make sure <%v> gets this", recipient)}
+	if err := c.sessionRcpt(recipient, opts); err != nil {
+		var fwd *ForwardingResult
+		if errors.As(err, &fwd) {
+			c.writeResponse(fwd.reply())
+			return
+		}
+		c.writeError(451, EnhancedCode{4, 0, 0}, err)
+		return
+	}
+	if session, ok := c.Session().(ReplySession); ok {
+		if reply := session.RcptReply(recipient); reply != nil {
+			code, enhCode, text = reply.reply(text[0], true)
+		}
+	}
+	c.tx.Recipients = append(c.tx.Recipients, recipient)
+	c.tx.RcptOptions = append(c.tx.RcptOptions, opts)
+	c.writeResponse(code, enhCode, text...)
+}
+
+// handleVrfy handles the VRFY command, see VerifySession.
+func (c *Conn) handleVrfy(arg string) {
+	session, ok := c.Session().(VerifySession)
+	if !ok {
+		c.writeResponse(252, EnhancedCode{2, 5, 0}, "Cannot VRFY user, but will accept message")
+		return
+	}
+	if arg == "" {
+		c.writeResponse(501, EnhancedCode{5, 5, 4}, "Was expecting VRFY arg syntax of VRFY <user>")
+		return
+	}
+
+	mailbox, err := session.Verify(arg)
+	if err != nil {
+		c.writeError(451, EnhancedCode{4, 0, 0}, err)
+		return
+	}
+	c.writeResponse(250, EnhancedCode{2, 1, 5}, "<"+mailbox+">")
+}
+
+// handleExpn handles the EXPN command, see ExpandSession.
+func (c *Conn) handleExpn(arg string) {
+	session, ok := c.Session().(ExpandSession)
+	if !ok {
+		c.writeResponse(502, EnhancedCode{5, 5, 1}, "EXPN command not implemented")
+		return
+	}
+	if arg == "" {
+		c.writeResponse(501, EnhancedCode{5, 5, 4}, "Was expecting EXPN arg syntax of EXPN <list>")
+		return
+	}
 
-	if err := c.Session().Rcpt(recipient, opts); err != nil {
+	mailboxes, err := session.Expand(arg)
+	if err != nil {
 		c.writeError(451, EnhancedCode{4, 0, 0}, err)
 		return
 	}
-	c.recipients = append(c.recipients, recipient)
-	c.writeResponse(250, EnhancedCode{2, 0, 0}, fmt.Sprintf("I'll make sure <%v> gets this", recipient))
+	if len(mailboxes) == 0 {
+		c.writeResponse(550, EnhancedCode{5, 1, 1}, "Mailing list has no members")
+		return
+	}
+	lines := make([]string, len(mailboxes))
+	for i, mailbox := range mailboxes {
+		lines[i] = "<" + mailbox + ">"
+	}
+	c.writeResponse(250, EnhancedCode{2, 1, 5}, lines...)
 }
 
 func checkNotifySet(values []DSNNotify) error {
@@ -755,8 +1363,7 @@ func checkNotifySet(values []DSNNotify) error {
 }
 
 func (c *Conn) handleAuth(arg string) {
-	if c.helo == "" {
-		c.writeResponse(502, EnhancedCode{5, 5, 1}, "Please introduce yourself first.")
+	if !c.checkCommandOrder("AUTH") {
 		return
 	}
 	if c.didAuth {
@@ -776,6 +1383,10 @@ func (c *Conn) handleAuth(arg string) {
 	}
 
 	mechanism := strings.ToUpper(parts[0])
+	if !isSASLMechanism(mechanism) {
+		c.writeResponse(501, EnhancedCode{5, 5, 2}, "Invalid mechanism name")
+		return
+	}
 
 	// Parse client initial response if there is one
 	var ir []byte
@@ -788,45 +1399,82 @@ func (c *Conn) handleAuth(arg string) {
 		}
 	}
 
+	if !c.checkSASLResponseSize(ir) {
+		return
+	}
+
+	if c.rateLimitedAuth() {
+		c.writeResponse(421, EnhancedCode{4, 7, 0}, "Too many authentication failures, try again later")
+		c.Close()
+		return
+	}
+
 	sasl, err := c.auth(mechanism)
 	if err != nil {
 		c.writeError(454, EnhancedCode{4, 7, 0}, err)
 		return
 	}
 
+	c.lineLimitReader.LineLimit = c.authLineLimit()
+	defer func() {
+		c.lineLimitReader.LineLimit = c.server.MaxLineLength
+	}()
+
+	// The identity set by the backend only counts if the exchange succeeds
+	defer func() {
+		if !c.didAuth {
+			c.authIdentity = ""
+		}
+	}()
+
 	response := ir
+	challenges := 0
 	for {
 		challenge, done, err := sasl.Next(response)
 		if err != nil {
+			if !c.allowRate(RateLimitAuthFailure) {
+				c.writeResponse(421, EnhancedCode{4, 7, 0}, "Too many authentication failures, try again later")
+				c.Close()
+				return
+			}
 			c.writeError(454, EnhancedCode{4, 7, 0}, err)
 			return
 		}
 
-		if done {
+		if done && len(challenge) == 0 {
 			break
 		}
 
+		if max := c.maxAuthExchanges(); max > 0 && challenges >= max {
+			c.authLimitExceeded()
+			c.writeResponse(535, EnhancedCode{5, 7, 8}, "Too many authentication exchanges")
+			return
+		}
+		challenges++
+		c.locker.Lock()
+		c.stats.AuthChallenges++
+		c.locker.Unlock()
+
+		// Additional data sent with the outcome, e.g. the SCRAM
+		// server-final-message, goes in a last challenge which the client
+		// acknowledges with an empty response (RFC 4954 section 4)
 		encoded := ""
 		if len(challenge) > 0 {
 			encoded = base64.StdEncoding.EncodeToString(challenge)
 		}
 		c.writeResponse(334, NoEnhancedCode, encoded)
 
-		encoded, err = c.readLine()
-		if err != nil {
-			return // TODO: error handling
-		}
-
-		if encoded == "*" {
-			// https://tools.ietf.org/html/rfc4954#page-4
-			c.writeResponse(501, EnhancedCode{5, 0, 0}, "Negotiation cancelled")
+		var ok bool
+		response, ok = c.readSASLResponse()
+		if !ok {
 			return
 		}
-
-		response, err = decodeSASLResponse(encoded)
-		if err != nil {
-			c.writeResponse(454, EnhancedCode{4, 7, 0}, "Invalid base64 data")
-			return
+		if done {
+			if len(response) > 0 {
+				c.writeResponse(501, EnhancedCode{5, 5, 2}, "Expected an empty response")
+				return
+			}
+			break
 		}
 	}
 
@@ -834,7 +1482,84 @@ func (c *Conn) handleAuth(arg string) {
 	c.didAuth = true
 }
 
-func decodeSASLResponse(s string) ([]byte, error) {
+// readSASLResponse reads a client response during an AUTH exchange. If the
+// response can't be read or the exchange is cancelled, a reply is sent and ok
+// is false.
+func (c *Conn) readSASLResponse() (response []byte, ok bool) {
+	encoded, err := c.readLine()
+	if err == ErrTooLongLine {
+		c.authLimitExceeded()
+		if err := c.lineLimitReader.discardLine(); err == nil {
+			c.writeResponse(500, EnhancedCode{5, 5, 6}, "Authentication Exchange line is too long")
+		}
+		return nil, false
+	} else if err != nil {
+		return nil, false // TODO: error handling
+	}
+
+	if encoded == "*" {
+		// https://tools.ietf.org/html/rfc4954#page-4
+		c.writeResponse(501, EnhancedCode{5, 0, 0}, "Negotiation cancelled")
+		return nil, false
+	}
+
+	response, err = decodeSASLResponse(encoded)
+	if err != nil {
+		c.writeResponse(454, EnhancedCode{4, 7, 0}, "Invalid base64 data")
+		return nil, false
+	}
+	return response, c.checkSASLResponseSize(response)
+}
+
+// checkSASLResponseSize sends a 500 reply and returns false if a decoded
+// client response exceeds Server.MaxAuthResponseSize.
+func (c *Conn) checkSASLResponseSize(response []byte) bool {
+	if max := c.server.MaxAuthResponseSize; max > 0 && len(response) > max {
+		c.authLimitExceeded()
+		c.writeResponse(500, EnhancedCode{5, 5, 6}, "Authentication response too large")
+		return false
+	}
+	return true
+}
+
+func (c *Conn) maxAuthExchanges() int {
+	if c.server.MaxAuthExchanges == 0 {
+		return 16
+	}
+	return c.server.MaxAuthExchanges
+}
+
+func (c *Conn) authLimitExceeded() {
+	c.locker.Lock()
+	c.stats.AuthLimitsExceeded++
+	c.locker.Unlock()
+}
+
+// authLineLimit returns the line length limit during an AUTH exchange.
+func (c *Conn) authLineLimit() int {
+	if c.server.MaxAuthLineLength > 0 {
+		return c.server.MaxAuthLineLength
+	} else if c.server.MaxAuthLineLength < 0 {
+		return 0
+	}
+	return 12288
+}
+
+// isSASLMechanism checks the syntax of an upper-case SASL mechanism name
+// (RFC 4422 section 3.1), e.g. "SCRAM-SHA-256".
+func isSASLMechanism(s string) bool {
+	if len(s) == 0 || len(s) > 20 {
+		return false
+	}
+	for _, ch := range s {
+		if !(ch >= 'A' && ch <= 'Z') && !(ch >= '0' && ch <= '9') && ch != '-' && ch != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+func decodeSASLResponse(s string) ([]byte, error) {
 	if s == "=" {
 		return []byte{}, nil
 	}
@@ -842,24 +1567,138 @@ func decodeSASLResponse(s string) ([]byte, error) {
 }
 
 func (c *Conn) authMechanisms() []string {
+	var mechs []string
 	if authSession, ok := c.Session().(AuthSession); ok {
-		return authSession.AuthMechanisms()
+		mechs = authSession.AuthMechanisms()
 	}
-	return nil
+	if c.externalAuthAllowed() {
+		mechs = append(mechs, sasl.External)
+	}
+	return mechs
 }
 
 func (c *Conn) auth(mech string) (sasl.Server, error) {
+	if mech == sasl.External && c.externalAuthAllowed() {
+		state, _ := c.TLSConnectionState()
+		session := c.Session().(ExternalAuthSession)
+		return &externalServer{
+			authenticate: func(identity string) error {
+				return session.AuthExternal(state.VerifiedChains, identity)
+			},
+		}, nil
+	}
 	if authSession, ok := c.Session().(AuthSession); ok {
 		return authSession.Auth(mech)
 	}
 	return nil, ErrAuthUnknownMechanism
 }
 
+// externalAuthAllowed checks whether the EXTERNAL mechanism can be offered:
+// the backend needs to support it and the client needs to have presented a
+// verified TLS certificate.
+func (c *Conn) externalAuthAllowed() bool {
+	if _, ok := c.Session().(ExternalAuthSession); !ok {
+		return false
+	}
+	state, ok := c.TLSConnectionState()
+	return ok && len(state.VerifiedChains) > 0
+}
+
+// externalServer implements the server side of the SASL EXTERNAL mechanism,
+// defined in RFC 4422 appendix A.
+type externalServer struct {
+	authenticate func(identity string) error
+	done         bool
+}
+
+func (s *externalServer) Next(response []byte) (challenge []byte, done bool, err error) {
+	if s.done {
+		return nil, false, errors.New("smtp: unexpected EXTERNAL response")
+	}
+	if response == nil {
+		// No initial response, ask for the authorization identity
+		return []byte{}, false, nil
+	}
+	s.done = true
+	return nil, true, s.authenticate(string(response))
+}
+
+// sessionMail, sessionRcpt and sessionData call the TransactionSession or
+// ContextSession methods if the backend implements them, and fall back to the
+// plain Session methods otherwise.
+
+func (c *Conn) sessionMail(tx *Transaction) error {
+	switch session := c.Session().(type) {
+	case TransactionSession:
+		return session.MailTx(tx)
+	case ContextSession:
+		return session.MailContext(c.ctx, tx.From, tx.MailOptions)
+	default:
+		return session.Mail(tx.From, tx.MailOptions)
+	}
+}
+
+func (c *Conn) sessionRcpt(to string, opts *RcptOptions) error {
+	switch session := c.Session().(type) {
+	case TransactionSession:
+		return session.RcptTx(c.tx, to, opts)
+	case ContextSession:
+		return session.RcptContext(c.ctx, to, opts)
+	default:
+		return session.Rcpt(to, opts)
+	}
+}
+
+func (c *Conn) sessionData(tx *Transaction, r io.Reader) error {
+	r = c.prepareData(tx, r)
+	switch session := c.Session().(type) {
+	case TransactionSession:
+		return session.DataTx(tx, r)
+	case ContextSession:
+		return session.DataContext(c.ctx, r)
+	default:
+		return session.Data(r)
+	}
+}
+
+// prepareData starts Server.DataInspectors, checks the header if
+// Server.SubmissionHeaderCheck is set, populates tx.Header if
+// Server.MaxHeaderBytes is set, and prepends a Received header field if
+// Server.AddReceivedHeader is set.
+func (c *Conn) prepareData(tx *Transaction, r io.Reader) io.Reader {
+	if len(c.server.DataInspectors) > 0 {
+		r = c.inspectData(tx, r)
+	}
+	if c.server.SubmissionHeaderCheck != nil {
+		if !c.reserveDataMemory(int64(c.submissionHeaderBytes())) {
+			return &errorReader{err: errInsufficientMemory}
+		}
+		r = c.checkSubmissionHeader(tx, r)
+	}
+	if c.server.MaxHeaderBytes > 0 {
+		if !c.reserveDataMemory(int64(c.server.MaxHeaderBytes)) {
+			return &errorReader{err: errInsufficientMemory}
+		}
+		tx.Header, r = PeekHeader(r, c.server.MaxHeaderBytes)
+	}
+	if c.server.AddReceivedHeader {
+		r = io.MultiReader(strings.NewReader(c.receivedHeader(tx)), r)
+	}
+	return r
+}
+
 func (c *Conn) handleStartTLS() {
+	if !c.checkCommandOrder("STARTTLS") {
+		return
+	}
 	if _, isTLS := c.TLSConnectionState(); isTLS {
 		c.writeResponse(502, EnhancedCode{5, 5, 1}, "Already running in TLS")
 		return
 	}
+	if _, compressed := c.conn.(*compressConn); compressed {
+		c.writeResponse(503, EnhancedCode{5, 5, 1}, "TLS must be negotiated before compression")
+		return
+	}
 
 	if c.server.TLSConfig == nil {
 		c.writeResponse(502, EnhancedCode{5, 5, 1}, "TLS not supported")
@@ -867,6 +1706,7 @@ func (c *Conn) handleStartTLS() {
 	}
 
 	c.writeResponse(220, EnhancedCode{2, 0, 0}, "Ready to start TLS")
+	c.flush()
 
 	// Upgrade to TLS
 	tlsConn := tls.Server(c.conn, c.server.TLSConfig)
@@ -875,58 +1715,305 @@ func (c *Conn) handleStartTLS() {
 		c.writeResponse(550, EnhancedCode{5, 0, 0}, "Handshake error")
 		return
 	}
+	if err := c.checkALPN(tlsConn.ConnectionState()); err != nil {
+		c.server.ErrorLog.Printf("error handling %v: %s", c.conn.RemoteAddr(), err)
+		c.conn = tlsConn
+		c.closeWithReason(QuitError)
+		return
+	}
 
 	c.conn = tlsConn
 	c.init()
+	c.chargeMemory(tlsBufferSize)
+	c.selectDomain()
 
 	// Reset all state and close the previous Session.
 	// This is different from just calling reset() since we want the Backend to
 	// be able to see the information about TLS connection in the
 	// ConnectionState object passed to it.
-	if session := c.Session(); session != nil {
-		session.Logout()
-		c.setSession(nil)
+	c.locker.Lock()
+	session := c.session
+	c.session = nil
+	c.locker.Unlock()
+	if session != nil {
+		c.logout(session)
 	}
 	c.helo = ""
+	c.ehlo = false
 	c.didAuth = false
+	c.authIdentity = ""
 	c.reset()
 }
 
+// handleXCompress handles the experimental XCOMPRESS command, which enables
+// DEFLATE compression of the stream in both directions.
+func (c *Conn) handleXCompress(arg string) {
+	if !c.checkCommandOrder("XCOMPRESS") {
+		return
+	}
+	if _, compressed := c.conn.(*compressConn); compressed {
+		c.writeResponse(503, EnhancedCode{5, 5, 1}, "Compression already enabled")
+		return
+	}
+	if !strings.EqualFold(arg, "DEFLATE") {
+		c.writeResponse(504, EnhancedCode{5, 5, 4}, "Unsupported compression algorithm")
+		return
+	}
+	c.writeResponse(220, EnhancedCode{2, 0, 0}, "Ready to start compression")
+	c.flush()
+
+	c.conn = newCompressConn(c.conn)
+	c.init()
+}
+
 // DATA
 func (c *Conn) handleData(arg string) {
-	if arg != "" {
+	if arg != "" && !c.allowLenient() {
 		c.writeResponse(501, EnhancedCode{5, 5, 4}, "DATA command should not have any arguments")
 		return
 	}
-	if c.bdatPipe != nil {
-		c.writeResponse(502, EnhancedCode{5, 5, 1}, "DATA not allowed during message transfer")
+	if !c.checkCommandOrder("DATA") {
 		return
 	}
 	if c.binarymime {
-		c.writeResponse(502, EnhancedCode{5, 5, 1}, "DATA not allowed for BINARYMIME messages")
+		c.writeResponse(503, EnhancedCode{5, 5, 1}, "DATA not allowed for BINARYMIME messages")
 		return
 	}
+	c.countLenient()
 
-	if !c.fromReceived || len(c.recipients) == 0 {
-		c.writeResponse(502, EnhancedCode{5, 5, 1}, "Missing RCPT TO command.")
-		return
-	}
+	c.tx.DataStartedAt = c.server.now()
+	c.tx.DataStats = DataStats{Body: c.tx.MailOptions.Body}
 
 	// We have recipients, go to accept data
 	c.writeResponse(354, NoEnhancedCode, "Go ahead. End your data with <CR><LF>.<CR><LF>")
 
 	defer c.reset()
 
+	c.setDataTimeout(true)
+	defer c.setDataTimeout(false)
+
+	c.lineLimitReader.LineLimit = c.dataLineLimit()
+	defer func() {
+		// The rest of the message data can't be told apart from commands
+		if c.lineLimitReader.tooLong() {
+			c.writeResponse(500, EnhancedCode{5, 4, 0}, "Too long line, closing connection")
+			c.closeWithReason(QuitError)
+		} else {
+			c.checkTooSlow()
+		}
+		c.lineLimitReader.LineLimit = c.server.MaxLineLength
+		c.dataTrailerLeft = c.server.MaxDataTrailerLines
+	}()
+
 	if c.server.LMTP {
 		c.handleDataLMTP()
 		return
 	}
 
 	r := newDataReader(c)
-	code, enhancedCode, msg := dataErrorToStatus(c.Session().Data(r))
+	err := c.waitVerdict(c.tx, r)
+	if err == ErrVerdictTimeout {
+		// Already replied
+		c.addBytesReceived(r.count)
+		c.closeWithReason(QuitError)
+		return
+	}
+	consumed := r.count
+	if oversize := c.drainData(r); oversize > 0 && errors.Is(err, ErrDataTooLarge) {
+		err = oversizeError(c.server.MaxMessageBytes, oversize)
+	}
+	code, enhancedCode, msg := dataErrorToStatus(c.tx, err)
+	c.addBytesReceived(r.count)
+	if discarded := r.count - consumed; discarded > 0 {
+		c.locker.Lock()
+		c.stats.DiscardedBytes += discarded
+		c.locker.Unlock()
+
+		// Returning an error early is fine, but accepting a message without
+		// reading it is most likely a backend bug
+		if err == nil {
+			c.server.ErrorLog.Printf("backend accepted message from %v without reading %v bytes of data", c.conn.RemoteAddr(), discarded)
+			if c.server.AbortUnconsumedData {
+				c.writeResponse(421, EnhancedCode{4, 3, 0}, "Internal server error")
+				c.closeWithReason(QuitError)
+				return
+			}
+		}
+	}
+	c.writeResponse(code, enhancedCode, msg)
+	if err == errPanic {
+		// The session may be in an inconsistent state
+		c.closeWithReason(QuitError)
+		return
+	}
+	if err == nil {
+		c.account(r.count, c.tx.Recipients)
+	}
+}
+
+// drainData reads the rest of the message data once the backend is done with
+// it. If the message exceeds Server.MaxMessageBytes, the size of the data
+// discarded past the limit is recorded and returned.
+func (c *Conn) drainData(r *dataReader) (oversize int64) {
 	r.limited = false
 	io.Copy(ioutil.Discard, r) // Make sure all the data has been consumed
-	c.writeResponse(code, enhancedCode, msg)
+	if !r.exceeded {
+		return 0
+	}
+
+	oversize = r.count - c.server.MaxMessageBytes
+	c.locker.Lock()
+	c.stats.OversizeBytes += oversize
+	c.locker.Unlock()
+	c.server.ErrorLog.Printf("message from %v exceeds the maximum size of %v bytes, discarded %v bytes", c.conn.RemoteAddr(), c.server.MaxMessageBytes, oversize)
+	return oversize
+}
+
+// oversizeError returns ErrDataTooLarge with the truncation point and the
+// size of the discarded data, to help senders diagnose the rejection.
+func oversizeError(limit, oversize int64) *SMTPError {
+	err := *ErrDataTooLarge
+	err.Message = fmt.Sprintf("%v (%v bytes discarded after the first %v bytes)", err.Message, oversize, limit)
+	return &err
+}
+
+// dataLineLimit returns the line length limit for the message data sent with
+// DATA.
+func (c *Conn) dataLineLimit() int {
+	if c.server.MaxDataLineLength > 0 {
+		return c.server.MaxDataLineLength
+	} else if c.server.MaxDataLineLength < 0 {
+		return 0
+	}
+	return c.server.MaxLineLength
+}
+
+// waitVerdict calls Session.Data. The client is watched while the backend
+// processes the message data if Server.DataKeepAlive is set, and
+// Server.OnVerdictProgress is called periodically.
+//
+// If Session.Data doesn't return within Server.MaxVerdictWait after the end
+// of the message data, ErrVerdictTimeout is replied right away, and
+// ErrVerdictTimeout is returned once Session.Data has returned: the
+// connection must then be closed.
+func (c *Conn) waitVerdict(tx *Transaction, r io.Reader) error {
+	progress := c.server.OnVerdictProgress != nil && c.server.VerdictProgressInterval > 0
+	if c.server.MaxVerdictWait <= 0 && c.server.DataKeepAlive <= 0 && !progress {
+		return c.sessionData(tx, r)
+	}
+
+	eof := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				c.handlePanic(err, nil)
+				done <- errPanic
+			}
+		}()
+		done <- c.sessionData(tx, &eofNotifier{r: r, eof: eof})
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-eof:
+	}
+
+	if c.server.DataKeepAlive > 0 {
+		defer c.watchClient()()
+	}
+
+	start := c.server.now()
+	var expired <-chan time.Time
+	if c.server.MaxVerdictWait > 0 {
+		timer := c.server.clock().NewTimer(c.server.MaxVerdictWait)
+		defer timer.Stop()
+		expired = timer.C()
+	}
+	var ticker Timer
+	var tick <-chan time.Time
+	if progress {
+		ticker = c.server.clock().NewTimer(c.server.VerdictProgressInterval)
+		defer func() { ticker.Stop() }()
+		tick = ticker.C()
+	}
+	for {
+		select {
+		case err := <-done:
+			return err
+		case <-tick:
+			c.server.OnVerdictProgress(c, c.server.now().Sub(start))
+			ticker.Stop()
+			ticker = c.server.clock().NewTimer(c.server.VerdictProgressInterval)
+			tick = ticker.C()
+		case <-expired:
+			// The session can't be used until Session.Data returns, so
+			// the connection can't go on after the reply
+			c.writeError(0, EnhancedCode{}, ErrVerdictTimeout)
+			c.flush()
+			c.cancelCtx()
+			<-done
+			return ErrVerdictTimeout
+		}
+	}
+}
+
+// watchClient enables TCP keep-alive probes as configured by
+// Server.DataKeepAlive, and cancels the connection context if the client goes
+// away while the backend processes the message data. The returned function
+// stops watching, it must be called before reading from the connection again.
+func (c *Conn) watchClient() (stop func()) {
+	if ka, ok := c.netConn.(interface {
+		SetKeepAlive(bool) error
+		SetKeepAlivePeriod(time.Duration) error
+	}); ok {
+		ka.SetKeepAlive(true)
+		ka.SetKeepAlivePeriod(c.server.DataKeepAlive)
+	}
+
+	// The message data has been received, the client isn't expected to send
+	// anything until the reply
+	c.setDataTimeout(false)
+	c.conn.SetReadDeadline(time.Time{})
+
+	var stopped int32
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// Pipelined commands are left in the buffer
+		_, err := c.text.R.Peek(1)
+		if err != nil && atomic.LoadInt32(&stopped) == 0 {
+			c.server.ErrorLog.Printf("client %v went away while the message data was being processed: %v", c.conn.RemoteAddr(), err)
+			c.cancelCtx()
+		}
+	}()
+
+	return func() {
+		atomic.StoreInt32(&stopped, 1)
+		// Interrupt Peek
+		c.conn.SetReadDeadline(time.Unix(1, 0))
+		<-done
+		c.conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// eofNotifier closes eof once the underlying reader reaches EOF.
+type eofNotifier struct {
+	r   io.Reader
+	eof chan struct{}
+}
+
+func (n *eofNotifier) Read(b []byte) (int, error) {
+	if n.r == nil {
+		return 0, io.EOF
+	}
+	i, err := n.r.Read(b)
+	if err == io.EOF {
+		close(n.eof)
+		n.r = nil
+	}
+	return i, err
 }
 
 func (c *Conn) handleBdat(arg string) {
@@ -935,38 +2022,69 @@ func (c *Conn) handleBdat(arg string) {
 		c.writeResponse(501, EnhancedCode{5, 5, 4}, "Missing chunk size argument")
 		return
 	}
-	if len(args) > 2 {
-		c.writeResponse(501, EnhancedCode{5, 5, 4}, "Too many arguments")
+
+	// ParseUint instead of Atoi so we will not accept negative values.
+	size, err := strconv.ParseUint(args[0], 10, 32)
+	if err != nil {
+		// The chunk can't be skipped, the client will most likely send it
+		// anyway and desynchronize the command stream
+		c.writeResponse(501, EnhancedCode{5, 5, 4}, "Malformed size argument, closing connection")
+		c.closeWithReason(QuitError)
 		return
 	}
 
-	if !c.fromReceived || len(c.recipients) == 0 {
-		c.writeResponse(502, EnhancedCode{5, 5, 1}, "Missing RCPT TO command.")
+	// From now on, the chunk needs to be consumed even if the command is
+	// rejected, otherwise it would be interpreted as commands.
+
+	if len(args) > 2 {
+		c.rejectBdat(size, 501, EnhancedCode{5, 5, 4}, "Too many arguments")
 		return
 	}
 
 	last := false
 	if len(args) == 2 {
 		if !strings.EqualFold(args[1], "LAST") {
-			c.writeResponse(501, EnhancedCode{5, 5, 4}, "Unknown BDAT argument")
+			c.rejectBdat(size, 501, EnhancedCode{5, 5, 4}, "Unknown BDAT argument")
 			return
 		}
 		last = true
 	}
 
-	// ParseUint instead of Atoi so we will not accept negative values.
-	size, err := strconv.ParseUint(args[0], 10, 32)
-	if err != nil {
-		c.writeResponse(501, EnhancedCode{5, 5, 4}, "Malformed size argument")
+	if err := c.checkCommand("BDAT", arg); err != nil {
+		code, enhCode, msg := 550, EnhancedCode{5, 7, 1}, err.Error()
+		if smtpErr, ok := err.(*SMTPError); ok {
+			code, enhCode, msg = smtpErr.Code, smtpErr.EnhancedCode, smtpErr.Message
+		}
+		c.rejectBdat(size, code, enhCode, msg)
+		return
+	}
+
+	if msg := c.commandOrderError("BDAT"); msg != "" {
+		c.rejectBdat(size, 503, EnhancedCode{5, 5, 1}, msg)
 		return
 	}
 
 	if c.server.MaxMessageBytes != 0 && c.bytesReceived+int64(size) > c.server.MaxMessageBytes {
-		c.writeResponse(552, EnhancedCode{5, 3, 4}, "Max message size exceeded")
+		c.rejectBdat(size, 552, EnhancedCode{5, 3, 4}, "Max message size exceeded")
+		// The message can't be delivered anymore
+		if c.tx != nil {
+			c.reset()
+		}
+		return
+	}
 
-		// Discard chunk itself without passing it to backend.
-		io.Copy(ioutil.Discard, io.LimitReader(c.text.R, int64(size)))
+	if !c.checkBdatSize(c.bytesReceived+int64(size), last) {
+		c.rejectBdat(size, 554, EnhancedCode{5, 5, 4}, "Message size doesn't match the declared SIZE")
+		c.reset()
+		return
+	}
 
+	copyMemory := int64(size)
+	if copyMemory > bdatCopyBufferSize {
+		copyMemory = bdatCopyBufferSize
+	}
+	if !c.reserveMemory(copyMemory) {
+		c.rejectBdat(size, errInsufficientMemory.Code, errInsufficientMemory.EnhancedCode, errInsufficientMemory.Message)
 		c.reset()
 		return
 	}
@@ -976,11 +2094,15 @@ func (c *Conn) handleBdat(arg string) {
 	}
 
 	if c.bdatPipe == nil {
+		c.tx.DataStartedAt = c.server.now()
+		c.tx.DataStats = DataStats{Body: c.tx.MailOptions.Body, Chunking: true}
+
 		var r *io.PipeReader
 		r, c.bdatPipe = io.Pipe()
 
 		c.dataResult = make(chan error, 1)
 
+		tx := c.tx
 		go func() {
 			defer func() {
 				if err := recover(); err != nil {
@@ -993,16 +2115,16 @@ func (c *Conn) handleBdat(arg string) {
 
 			var err error
 			if !c.server.LMTP {
-				err = c.Session().Data(r)
+				err = c.sessionData(tx, r)
 			} else {
 				lmtpSession, ok := c.Session().(LMTPSession)
 				if !ok {
-					err = c.Session().Data(r)
-					for _, rcpt := range c.recipients {
+					err = c.sessionData(tx, r)
+					for _, rcpt := range tx.Recipients {
 						c.bdatStatus.SetStatus(rcpt, err)
 					}
 				} else {
-					err = lmtpSession.LMTPData(r, c.bdatStatus)
+					err = lmtpSession.LMTPData(c.prepareData(tx, r), c.bdatStatus)
 				}
 			}
 
@@ -1013,14 +2135,22 @@ func (c *Conn) handleBdat(arg string) {
 
 	c.lineLimitReader.LineLimit = 0
 
+	c.tx.DataStats.Chunks++
+
 	chunk := io.LimitReader(c.text.R, int64(size))
+	c.setDataTimeout(true)
 	_, err = io.Copy(c.bdatPipe, chunk)
+	c.setDataTimeout(false)
+	c.releaseMemory(copyMemory)
 	if err != nil {
 		// Backend might return an error early using CloseWithError without consuming
 		// the whole chunk.
 		io.Copy(ioutil.Discard, chunk)
 
-		c.writeResponse(dataErrorToStatus(err))
+		c.writeResponse(dataErrorToStatus(c.tx, err))
+		if c.checkTooSlow() {
+			return
+		}
 
 		if err == errPanic {
 			c.Close()
@@ -1032,23 +2162,40 @@ func (c *Conn) handleBdat(arg string) {
 	}
 
 	c.bytesReceived += int64(size)
+	c.tx.DataStats.Size = c.bytesReceived
+	c.addBytesReceived(int64(size))
 
 	if last {
 		c.lineLimitReader.LineLimit = c.server.MaxLineLength
 
 		c.bdatPipe.Close()
 
+		var stopWatching func()
+		if c.server.DataKeepAlive > 0 {
+			stopWatching = c.watchClient()
+		}
 		err := <-c.dataResult
+		if stopWatching != nil {
+			stopWatching()
+		}
 
+		var accepted []string
 		if c.server.LMTP {
 			c.bdatStatus.fillRemaining(err)
-			for i, rcpt := range c.recipients {
-				code, enchCode, msg := dataErrorToStatus(<-c.bdatStatus.status[i])
-				c.writeResponse(code, enchCode, "<"+rcpt+"> "+msg)
+			for i, rcpt := range c.tx.Recipients {
+				rcptErr := <-c.bdatStatus.status[i]
+				c.writeLMTPStatus(i, rcptErr)
+				if rcptErr == nil {
+					accepted = append(accepted, rcpt)
+				}
 			}
 		} else {
-			c.writeResponse(dataErrorToStatus(err))
+			c.writeResponse(dataErrorToStatus(c.tx, err))
+			if err == nil {
+				accepted = c.tx.Recipients
+			}
 		}
+		c.account(c.bytesReceived, accepted)
 
 		if err == errPanic {
 			c.Close()
@@ -1061,10 +2208,63 @@ func (c *Conn) handleBdat(arg string) {
 	}
 }
 
+// checkBdatSize compares the total size of the BDAT chunks with the SIZE
+// parameter of the MAIL command, according to Server.BDATSizeMismatch. It
+// returns false if the chunk must be rejected.
+func (c *Conn) checkBdatSize(total int64, last bool) bool {
+	declared := c.tx.MailOptions.Size
+	if declared == 0 || c.server.BDATSizeMismatch == SizeMismatchIgnore {
+		return true
+	}
+	if total <= declared && !(last && total < declared) {
+		return true
+	}
+
+	switch c.server.BDATSizeMismatch {
+	case SizeMismatchLog:
+		if last {
+			c.server.ErrorLog.Printf("client %v declared SIZE=%v but sent %v bytes", c.conn.RemoteAddr(), declared, total)
+		}
+		return true
+	case SizeMismatchReject:
+		return false
+	}
+	return true
+}
+
+// rejectBdat discards a BDAT chunk without passing it to the backend, and
+// aborts the message transfer if one is in progress.
+func (c *Conn) rejectBdat(size uint64, code int, enhCode EnhancedCode, text string) {
+	c.lineLimitReader.LineLimit = 0
+	c.setDataTimeout(true)
+	n, _ := io.Copy(ioutil.Discard, io.LimitReader(c.text.R, int64(size)))
+	c.setDataTimeout(false)
+	c.lineLimitReader.LineLimit = c.server.MaxLineLength
+	c.addBytesReceived(n)
+
+	c.writeResponse(code, enhCode, text)
+	if c.bdatPipe != nil {
+		c.reset()
+	}
+}
+
 // ErrDataReset is returned by Reader pased to Data function if client does not
 // send another BDAT command and instead closes connection or issues RSET command.
 var ErrDataReset = errors.New("smtp: message transmission aborted")
 
+// ErrVerdictTimeout is replied when the backend doesn't return from
+// Session.Data within Server.MaxVerdictWait, before the connection is
+// closed.
+var ErrVerdictTimeout = &SMTPError{
+	Code:         451,
+	EnhancedCode: EnhancedCode{4, 3, 0},
+	Message:      "Timeout waiting for message verdict, try again later",
+}
+
+// errCloseRequested is returned by readCommand when requestClose has been
+// called.
+var errCloseRequested = errors.New("smtp: close requested")
+
 var errPanic = &SMTPError{
 	Code:         421,
 	EnhancedCode: EnhancedCode{4, 0, 0},
@@ -1081,67 +2281,130 @@ func (c *Conn) handlePanic(err interface{}, status *statusCollector) {
 }
 
 func (c *Conn) createStatusCollector() *statusCollector {
-	rcptCounts := make(map[string]int, len(c.recipients))
-
 	status := &statusCollector{
-		statusMap: make(map[string]chan error, len(c.recipients)),
-		status:    make([]chan error, 0, len(c.recipients)),
-	}
-	for _, rcpt := range c.recipients {
-		rcptCounts[rcpt]++
-	}
-	// Create channels with buffer sizes necessary to fit all
-	// statuses for a single recipient to avoid deadlocks.
-	for rcpt, count := range rcptCounts {
-		status.statusMap[rcpt] = make(chan error, count)
-	}
-	for _, rcpt := range c.recipients {
-		status.status = append(status.status, status.statusMap[rcpt])
+		status:       make([]chan error, len(c.tx.Recipients)),
+		pending:      make(map[string][]int, len(c.tx.Recipients)),
+		pendingORCPT: make(map[string][]int),
+		conn:         c,
+	}
+	for i, rcpt := range c.tx.Recipients {
+		// Buffered to avoid deadlocks, a recipient gets a single status
+		status.status[i] = make(chan error, 1)
+		status.pending[rcpt] = append(status.pending[rcpt], i)
+		if orcpt := originalRecipient(c.tx, i); orcpt != "" {
+			status.pendingORCPT[orcpt] = append(status.pendingORCPT[orcpt], i)
+		}
 	}
 
 	return status
 }
 
-type statusCollector struct {
-	// Contains map from recipient to list of channels that are used for that
-	// recipient.
-	statusMap map[string]chan error
+// originalRecipient returns the ORCPT address of the i-th recipient of a
+// transaction, if any and different from its forward-path.
+func originalRecipient(tx *Transaction, i int) string {
+	if i >= len(tx.RcptOptions) || tx.RcptOptions[i] == nil {
+		return ""
+	}
+	orcpt := tx.RcptOptions[i].OriginalRecipient
+	if orcpt == tx.Recipients[i] {
+		return ""
+	}
+	return orcpt
+}
 
-	// Contains channels from statusMap, in the same
-	// order as Conn.recipients.
+type statusCollector struct {
+	// Channels receiving the status of each recipient, in the same order as
+	// Transaction.Recipients.
 	status []chan error
+
+	locker sync.Mutex
+	// Indexes in status of the recipients without a status yet, by
+	// forward-path and by ORCPT address. Protected by locker.
+	pending, pendingORCPT map[string][]int
+	// Whether the backend misused SetStatus. Protected by locker.
+	failed bool
+
+	conn *Conn
+}
+
+// errStatusMismatch is the status of the remaining recipients once the
+// backend has misused StatusCollector.
+var errStatusMismatch = &SMTPError{
+	Code:         554,
+	EnhancedCode: EnhancedCode{5, 0, 0},
+	Message:      "Internal server error: invalid delivery status",
 }
 
 // fillRemaining sets status for all recipients SetStatus was not called for before.
 func (s *statusCollector) fillRemaining(err error) {
-	// Amount of times certain recipient was specified is indicated by the channel
-	// buffer size, so once we fill it, we can be confident that we sent
-	// at least as much statuses as needed. Extra statuses will be ignored anyway.
-chLoop:
-	for _, ch := range s.statusMap {
-		for {
-			select {
-			case ch <- err:
-			default:
-				continue chLoop
-			}
+	for _, ch := range s.status {
+		select {
+		case ch <- err:
+		default:
 		}
 	}
 }
 
 func (s *statusCollector) SetStatus(rcptTo string, err error) {
-	ch := s.statusMap[rcptTo]
-	if ch == nil {
-		panic("SetStatus is called for recipient that was not specified before")
+	s.locker.Lock()
+	if s.failed {
+		s.locker.Unlock()
+		return
 	}
 
+	// Forward-paths take precedence over ORCPT addresses
+	pending, other := s.pending, s.pendingORCPT
+	if _, ok := pending[rcptTo]; !ok {
+		pending, other = s.pendingORCPT, s.pending
+	}
+	indexes, ok := pending[rcptTo]
+	if len(indexes) == 0 {
+		s.locker.Unlock()
+		if !ok {
+			s.fail(fmt.Sprintf("SetStatus is called for recipient %q that was not specified before", rcptTo))
+		} else {
+			s.fail(fmt.Sprintf("SetStatus is called more times than recipient %q was specified", rcptTo))
+		}
+		return
+	}
+	i := indexes[0]
+	pending[rcptTo] = indexes[1:]
+	for key, indexes := range other {
+		other[key] = removeIndex(indexes, i)
+	}
+	s.locker.Unlock()
+
 	select {
-	case ch <- err:
+	case s.status[i] <- err:
 	default:
-		// There enough buffer space to fit all statuses at once, if this is
-		// not the case - backend is doing something wrong.
-		panic("SetStatus is called more times than particular recipient was specified")
+		// The remaining recipients have already been filled
+	}
+}
+
+// removeIndex removes i from a list of indexes.
+func removeIndex(indexes []int, i int) []int {
+	for j, index := range indexes {
+		if index == i {
+			return append(indexes[:j:j], indexes[j+1:]...)
+		}
 	}
+	return indexes
+}
+
+// fail handles a backend bug: it panics if Server.StrictLMTPStatus is set,
+// otherwise it logs msg and fails the remaining recipients. Later SetStatus
+// calls are ignored.
+func (s *statusCollector) fail(msg string) {
+	if s.conn.server.StrictLMTPStatus {
+		panic(msg)
+	}
+
+	s.locker.Lock()
+	s.failed = true
+	s.locker.Unlock()
+
+	s.conn.server.ErrorLog.Printf("backend error serving %v: %v", s.conn.conn.RemoteAddr(), msg)
+	s.fillRemaining(errStatusMismatch)
 }
 
 func (c *Conn) handleDataLMTP() {
@@ -1153,9 +2416,11 @@ func (c *Conn) handleDataLMTP() {
 	lmtpSession, ok := c.Session().(LMTPSession)
 	if !ok {
 		// Fallback to using a single status for all recipients.
-		err := c.Session().Data(r)
-		io.Copy(ioutil.Discard, r) // Make sure all the data has been consumed
-		for _, rcpt := range c.recipients {
+		err := c.sessionData(c.tx, r)
+		if oversize := c.drainData(r); oversize > 0 && errors.Is(err, ErrDataTooLarge) {
+			err = oversizeError(c.server.MaxMessageBytes, oversize)
+		}
+		for _, rcpt := range c.tx.Recipients {
 			status.SetStatus(rcpt, err)
 		}
 		done <- true
@@ -1175,25 +2440,53 @@ func (c *Conn) handleDataLMTP() {
 				}
 			}()
 
-			status.fillRemaining(lmtpSession.LMTPData(r, status))
-			io.Copy(ioutil.Discard, r) // Make sure all the data has been consumed
+			status.fillRemaining(lmtpSession.LMTPData(c.prepareData(c.tx, r), status))
+			c.drainData(r)
 			done <- true
 		}()
 	}
 
-	for i, rcpt := range c.recipients {
-		code, enchCode, msg := dataErrorToStatus(<-status.status[i])
-		c.writeResponse(code, enchCode, "<"+rcpt+"> "+msg)
+	var accepted []string
+	for i, rcpt := range c.tx.Recipients {
+		err := <-status.status[i]
+		c.writeLMTPStatus(i, err)
+		// Statuses are sent as soon as they're available
+		c.flush()
+		if err == nil {
+			accepted = append(accepted, rcpt)
+		}
 	}
 
 	// If done gets false, the panic occured in LMTPData and the connection
 	// should be closed.
-	if !<-done {
+	ok = <-done
+	c.addBytesReceived(r.count)
+	c.account(r.count, accepted)
+	if !ok {
 		c.Close()
 	}
 }
 
-func dataErrorToStatus(err error) (code int, enchCode EnhancedCode, msg string) {
+// writeLMTPStatus sends the reply for the i-th recipient of the transaction.
+func (c *Conn) writeLMTPStatus(i int, err error) {
+	status := &LMTPStatus{
+		Rcpt: c.tx.Recipients[i],
+		Err:  err,
+	}
+	if i < len(c.tx.RcptOptions) && c.tx.RcptOptions[i] != nil {
+		status.RcptOptions = c.tx.RcptOptions[i]
+		status.OriginalRecipient = status.RcptOptions.OriginalRecipient
+	}
+	status.Code, status.EnhancedCode, status.Message = dataErrorToStatus(c.tx, err)
+
+	text := "<" + status.Rcpt + "> " + status.Message
+	if statusSession, ok := c.Session().(LMTPStatusSession); ok {
+		text = statusSession.LMTPStatusText(status)
+	}
+	c.writeResponse(status.Code, status.EnhancedCode, text)
+}
+
+func dataErrorToStatus(tx *Transaction, err error) (code int, enchCode EnhancedCode, msg string) {
 	if err != nil {
 		if smtperr, ok := err.(*SMTPError); ok {
 			return smtperr.Code, smtperr.EnhancedCode, smtperr.Message
@@ -1202,6 +2495,9 @@ func dataErrorToStatus(err error) (code int, enchCode EnhancedCode, msg string)
 		}
 	}
 
+	if tx != nil && tx.ID != "" {
+		return 250, EnhancedCode{2, 0, 0}, "OK: queued as " + tx.ID
+	}
 	return 250, EnhancedCode{2, 0, 0}, "OK: queued"
 }
 
@@ -1215,14 +2511,12 @@ func (c *Conn) greet() {
 	if c.server.LMTP {
 		protocol = "LMTP"
 	}
-	c.writeResponse(220, NoEnhancedCode, fmt.Sprintf("%v %s Service Ready", c.server.Domain, protocol))
+	c.selectDomain()
+	c.writeResponse(220, NoEnhancedCode, fmt.Sprintf("%v %s Service Ready", c.Domain(), protocol))
 }
 
 func (c *Conn) writeResponse(code int, enhCode EnhancedCode, text ...string) {
-	// TODO: error handling
-	if c.server.WriteTimeout != 0 {
-		c.conn.SetWriteDeadline(time.Now().Add(c.server.WriteTimeout))
-	}
+	c.delayResponse(code)
 
 	// All responses must include an enhanced code, if it is missing - use
 	// a generic code X.0.0.
@@ -1236,16 +2530,184 @@ func (c *Conn) writeResponse(code int, enhCode EnhancedCode, text ...string) {
 		}
 	}
 
+	if code >= 400 && c.server.RejectionLogger != nil {
+		c.logRejection(code, enhCode, strings.Join(text, " "))
+	}
+
+	escaped := make([]string, len(text))
+	for i, t := range text {
+		escaped[i] = c.replyText(t)
+	}
+	text = escaped
+
+	c.writeLocker.Lock()
+	defer c.writeLocker.Unlock()
+
+	c.replyCode = code
+
+	// Replies are buffered and sent at once when the next read blocks, so
+	// that a burst of pipelined commands is answered with a single write (RFC
+	// 2920 section 3.1)
+	w := c.text.W
 	for i := 0; i < len(text)-1; i++ {
-		c.text.PrintfLine("%d-%v", code, text[i])
+		fmt.Fprintf(w, "%d-%v\r\n", code, text[i])
 	}
 	if enhCode == NoEnhancedCode {
-		c.text.PrintfLine("%d %v", code, text[len(text)-1])
+		fmt.Fprintf(w, "%d %v\r\n", code, text[len(text)-1])
 	} else {
-		c.text.PrintfLine("%d %v.%v.%v %v", code, enhCode[0], enhCode[1], enhCode[2], text[len(text)-1])
+		fmt.Fprintf(w, "%d %v.%v.%v %v\r\n", code, enhCode[0], enhCode[1], enhCode[2], text[len(text)-1])
+	}
+}
+
+// flush sends the buffered replies. It's called before reading from the
+// network blocks, and before the connection is closed or upgraded.
+func (c *Conn) flush() error {
+	c.writeLocker.Lock()
+	defer c.writeLocker.Unlock()
+
+	if c.text == nil || c.text.W.Buffered() == 0 {
+		return nil
+	}
+	return c.text.W.Flush()
+}
+
+func (c *Conn) logRejection(code int, enhCode EnhancedCode, msg string) {
+	r := &Rejection{
+		Time:         c.server.now(),
+		RemoteAddr:   c.conn.RemoteAddr(),
+		Hostname:     c.helo,
+		Identity:     c.authIdentity,
+		Command:      c.command,
+		Code:         code,
+		EnhancedCode: enhCode,
+		Reason:       rejectionReason(enhCode),
+		Message:      msg,
+	}
+	if tx := c.Transaction(); tx != nil {
+		r.TransactionID = tx.ID
+	}
+	c.server.RejectionLogger.LogRejection(r)
+}
+
+// replyText escapes control characters other than HT in a reply text line,
+// as well as non-ASCII characters unless the client has enabled SMTPUTF8.
+// Escaped characters use the \x{HEXPOINT} form of RFC 6533.
+func (c *Conn) replyText(s string) string {
+	safe := true
+	for _, ch := range s {
+		if c.mustEscape(ch) {
+			safe = false
+			break
+		}
+	}
+	if safe {
+		return s
+	}
+
+	var sb strings.Builder
+	for _, ch := range s {
+		if c.mustEscape(ch) {
+			fmt.Fprintf(&sb, "\\x{%X}", ch)
+		} else {
+			sb.WriteRune(ch)
+		}
+	}
+	return sb.String()
+}
+
+// mustEscape reports whether a character can't be sent as is in a reply
+// text line. RFC 5321 section 4.2 allows HT in the textstring.
+func (c *Conn) mustEscape(ch rune) bool {
+	return (ch < ' ' && ch != '\t') || ch == '\x7F' || (ch > '\x7F' && !c.utf8)
+}
+
+// WriteResponse writes a reply to the client. It can be used by backends
+// handling custom commands.
+//
+// If enhCode is EnhancedCodeNotSet, a generic enhanced code is used. Line
+// breaks in text are split into multiple reply lines.
+//
+// WriteResponse must only be called from the goroutine serving the
+// connection, e.g. from a Session method.
+//
+// The reply is buffered until the server waits for the client, see Flush.
+func (c *Conn) WriteResponse(code int, enhCode EnhancedCode, text ...string) {
+	var lines []string
+	for _, t := range text {
+		t = strings.Replace(t, "\r\n", "\n", -1)
+		lines = append(lines, strings.Split(strings.Trim(t, "\n"), "\n")...)
+	}
+	if len(lines) == 0 {
+		lines = []string{""}
+	}
+	c.writeResponse(code, enhCode, lines...)
+}
+
+// Flush sends the buffered replies to the client.
+//
+// Replies are buffered and sent at once when the server needs more data from
+// the client, so that multi-line replies and replies to pipelined commands
+// don't cost a write each. Flush can be used to send a reply written with
+// WriteResponse before a long operation.
+func (c *Conn) Flush() error {
+	return c.flush()
+}
+
+// ReadLine reads a line sent by the client, without the trailing CRLF. It
+// honors Server.ReadTimeout and Server.MaxLineLength.
+//
+// Like WriteResponse, ReadLine must only be called from the goroutine serving
+// the connection.
+func (c *Conn) ReadLine() (string, error) {
+	return c.readLine()
+}
+
+// Tarpit flags the session as suspicious: replies will be delayed as
+// configured in Server.Tarpit. It has no effect if Server.Tarpit is nil.
+//
+// Tarpit can be called by the backend, e.g. from Session.Rcpt when a
+// recipient address is a known spam trap.
+func (c *Conn) Tarpit() {
+	t := c.server.Tarpit
+	if t == nil || c.tarpitDelay > 0 {
+		return
+	}
+	c.tarpitDelay = t.Delay
+	if c.tarpitDelay <= 0 {
+		c.tarpitDelay = time.Second
 	}
 }
 
+// delayResponse waits before writing a reply if the session is tarpitted.
+func (c *Conn) delayResponse(code int) {
+	c.injectLatency()
+
+	t := c.server.Tarpit
+	if t == nil {
+		return
+	}
+
+	if code/100 == 4 || code/100 == 5 {
+		c.failedReplies++
+		if t.ErrorThreshold > 0 && c.failedReplies >= t.ErrorThreshold {
+			c.Tarpit()
+		}
+	}
+
+	d := c.tarpitDelay
+	if d <= 0 {
+		return
+	}
+	c.tarpitDelay += t.Increment
+	if t.MaxDelay > 0 && c.tarpitDelay > t.MaxDelay {
+		c.tarpitDelay = t.MaxDelay
+	}
+
+	// Don't hold back the replies to previous commands
+	c.flush()
+	c.server.sleep(d)
+}
+
 func (c *Conn) writeError(code int, enhCode EnhancedCode, err error) {
 	if smtpErr, ok := err.(*SMTPError); ok {
 		c.writeResponse(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.Message)
@@ -1254,15 +2716,254 @@ func (c *Conn) writeError(code int, enhCode EnhancedCode, err error) {
 	}
 }
 
+const defaultReconnectMessage = "Service shutting down, please reconnect"
+
+// FinishAndClose asks for the connection to be closed once the current
+// transaction is over: the message data being received, if any, is still
+// handled, then a 421 reply is sent instead of waiting for the next command.
+// If the connection is idle, it's closed right away.
+func (c *Conn) FinishAndClose() {
+	c.requestClose(defaultReconnectMessage)
+}
+
+// requestClose asks for the connection to be closed with a 421 reply once
+// the current transaction is over. If the connection is idle, the reply is
+// sent immediately.
+func (c *Conn) requestClose(msg string) {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+
+	if c.closeRequest != "" {
+		return
+	}
+	c.closeRequest = msg
+	if c.waitingCommand && c.tx == nil {
+		// Interrupt readCommand
+		c.conn.SetReadDeadline(c.server.now())
+	}
+}
+
+// closeRequested returns the reply text passed to requestClose if the
+// connection can be closed now, i.e. if there is no transaction in progress.
+func (c *Conn) closeRequested() string {
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	if c.tx != nil {
+		return ""
+	}
+	return c.closeRequest
+}
+
+// readCommand reads a command line. It can be interrupted by requestClose,
+// in which case errCloseRequested is returned.
+func (c *Conn) readCommand() (string, error) {
+	c.locker.Lock()
+	if c.closeRequest != "" && c.tx == nil {
+		// requestClose has been called since the last check, don't wait
+		// for a command which may never come
+		c.locker.Unlock()
+		return "", errCloseRequested
+	}
+	// The deadline is set before waitingCommand, so that it doesn't
+	// overwrite the one set by requestClose to interrupt the read
+	deadline, err := c.setReadTimeout()
+	if err != nil {
+		c.locker.Unlock()
+		return "", err
+	}
+	c.waitingCommand = true
+	c.locker.Unlock()
+
+	line, err := c.readLineUntil(deadline)
+
+	c.locker.Lock()
+	c.waitingCommand = false
+	if err == nil && c.closeRequest != "" {
+		// requestClose may have set the deadline after the line was read
+		var deadline time.Time
+		if c.server.ReadTimeout != 0 {
+			deadline = c.server.now().Add(c.server.ReadTimeout)
+		}
+		c.conn.SetReadDeadline(deadline)
+	}
+	c.locker.Unlock()
+
+	return line, err
+}
+
 // Reads a line of input
 func (c *Conn) readLine() (string, error) {
+	deadline, err := c.setReadTimeout()
+	if err != nil {
+		return "", err
+	}
+	return c.readLineUntil(deadline)
+}
+
+// setReadTimeout sets the read deadline to Server.ReadTimeout from now, if
+// any, and returns it.
+func (c *Conn) setReadTimeout() (time.Time, error) {
+	var deadline time.Time
 	if c.server.ReadTimeout != 0 {
-		if err := c.conn.SetReadDeadline(time.Now().Add(c.server.ReadTimeout)); err != nil {
-			return "", err
+		deadline = c.server.now().Add(c.server.ReadTimeout)
+		if err := c.conn.SetReadDeadline(deadline); err != nil {
+			return time.Time{}, err
 		}
 	}
+	return deadline, nil
+}
+
+// readLineUntil reads a line of input. deadline is the read deadline already
+// set on the connection.
+func (c *Conn) readLineUntil(deadline time.Time) (string, error) {
+	if c.server.MaxCommandTime > 0 {
+		c.deadlineReader.startLine(c.server.MaxCommandTime, deadline)
+		defer c.deadlineReader.endLine()
+	}
+
+	line, err := c.text.ReadLine()
+	if c.deadlineReader.lineTimedOut {
+		// bufio returns the partial line before the error
+		return "", errCommandTooSlow
+	}
+	if err == nil && c.lineLimitReader.cut && c.text.R.Buffered() == 0 {
+		// The line has been cut short by the limit
+		return "", ErrTooLongLine
+	}
+	return line, err
+}
+
+// setDataTimeout enables or disables Server.DataReadTimeout and
+// Server.MinDataRate. While enabled, the read deadline is extended each time
+// data is received from the client.
+func (c *Conn) setDataTimeout(enabled bool) {
+	r := c.deadlineReader
+	if enabled {
+		r.timeout = c.server.DataReadTimeout
+		r.minRate = c.server.MinDataRate
+		r.start = c.server.now()
+		r.received = 0
+	} else {
+		r.timeout = 0
+		r.minRate = 0
+	}
+}
+
+// checkTooSlow sends a 421 reply and closes the connection if the message data
+// has been sent slower than Server.MinDataRate.
+func (c *Conn) checkTooSlow() bool {
+	if !c.deadlineReader.tooSlow {
+		return false
+	}
+	c.writeResponse(421, EnhancedCode{4, 4, 2}, "Transfer rate too low, closing connection")
+	c.closeWithReason(QuitTimeout)
+	return true
+}
+
+var (
+	errCommandTooSlow = errors.New("smtp: command line not received in time")
+	errDataTooSlow    = errors.New("smtp: message data transfer rate too low")
+)
+
+// deadlineReader reads from conn, extending its read deadline by timeout
+// before each read if timeout is non-zero.
+//
+// If minRate is non-zero, the deadline is also set so that the average
+// transfer rate since start stays above minRate bytes per second, after an
+// allowance of one second.
+//
+// Between startLine and endLine, the deadline is shortened to lineTimeout once
+// the first byte of the line has been received.
+type deadlineReader struct {
+	conn    net.Conn
+	clock   Clock
+	flush   func() error // called before each read
+	timeout time.Duration
+
+	minRate  int
+	start    time.Time
+	received int64
+	tooSlow  bool
+
+	lineTimeout  time.Duration
+	lineDeadline time.Time // deadline before the line started
+	lineStarted  bool
+	lineTimedOut bool
+}
+
+func (r *deadlineReader) Read(b []byte) (int, error) {
+	// A broken connection is reported by the read
+	r.flush()
+
+	var deadline time.Time
+	if r.timeout > 0 {
+		deadline = r.clock.Now().Add(r.timeout)
+	}
+	rateLimited := false
+	if r.minRate > 0 {
+		allowed := time.Second + time.Duration(r.received)*time.Second/time.Duration(r.minRate)
+		if d := r.start.Add(allowed); deadline.IsZero() || d.Before(deadline) {
+			deadline = d
+			rateLimited = true
+		}
+	}
+	if !deadline.IsZero() {
+		if err := r.conn.SetReadDeadline(deadline); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.conn.Read(b)
+	r.received += int64(n)
+	if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+		if rateLimited {
+			r.tooSlow = true
+			err = errDataTooSlow
+		} else if r.lineStarted {
+			r.lineTimedOut = true
+			err = errCommandTooSlow
+		}
+	}
+
+	if r.lineTimeout > 0 && n > 0 && !r.lineStarted {
+		r.lineStarted = true
+		d := r.clock.Now().Add(r.lineTimeout)
+		if r.lineDeadline.IsZero() || d.Before(r.lineDeadline) {
+			r.conn.SetReadDeadline(d)
+		}
+	}
+	return n, err
+}
 
-	return c.text.ReadLine()
+// deadlineWriter sets the write deadline to Server.WriteTimeout before each
+// write, including the ones done by bufio.Writer when its buffer is full.
+type deadlineWriter struct {
+	conn   net.Conn
+	server *Server
+}
+
+func (w *deadlineWriter) Write(b []byte) (int, error) {
+	if w.server.WriteTimeout != 0 {
+		w.conn.SetWriteDeadline(w.server.now().Add(w.server.WriteTimeout))
+	}
+	return w.conn.Write(b)
+}
+
+// startLine enables the line timeout. deadline is the read deadline currently
+// set, restored by endLine.
+func (r *deadlineReader) startLine(timeout time.Duration, deadline time.Time) {
+	r.lineTimeout = timeout
+	r.lineDeadline = deadline
+	r.lineStarted = false
+	r.lineTimedOut = false
+}
+
+func (r *deadlineReader) endLine() {
+	if r.lineStarted {
+		r.conn.SetReadDeadline(r.lineDeadline)
+	}
+	r.lineTimeout = 0
+	r.lineStarted = false
 }
 
 func (c *Conn) reset() {
@@ -1273,13 +2974,18 @@ func (c *Conn) reset() {
 		c.bdatPipe.CloseWithError(ErrDataReset)
 		c.bdatPipe = nil
 	}
+	if c.inspection != nil {
+		c.inspection.abort(ErrDataReset)
+		c.inspection = nil
+	}
 	c.bdatStatus = nil
 	c.bytesReceived = 0
+	c.releaseDataMemory()
 
 	if c.session != nil {
 		c.session.Reset()
 	}
 
-	c.fromReceived = false
-	c.recipients = nil
+	c.tx = nil
+	c.utf8 = false
 }
@@ -0,0 +1,113 @@
+package smtp
+
+import (
+	"bufio"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConn_WriteResponse(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	c := newConn(server, &Server{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer server.Close()
+		c.WriteResponse(250, EnhancedCodeNotSet, "first line\r\nsecond line", "third line")
+		c.WriteResponse(214, NoEnhancedCode)
+		if line, err := c.ReadLine(); err != nil || line != "XHELLO" {
+			t.Errorf("ReadLine() = %q, %v", line, err)
+		}
+	}()
+
+	scanner := bufio.NewScanner(client)
+	for _, want := range []string{
+		"250-first line",
+		"250-second line",
+		"250 2.0.0 third line",
+		"214 ",
+	} {
+		if !scanner.Scan() {
+			t.Fatal("Missing reply line:", want)
+		}
+		if scanner.Text() != want {
+			t.Errorf("Got %q, want %q", scanner.Text(), want)
+		}
+	}
+	client.Write([]byte("XHELLO\r\n"))
+	<-done
+}
+
+func TestConn_ReadCommandCloseRequested(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	// Without ReadTimeout, a close request made just before readCommand
+	// must not leave it waiting for a command forever
+	c := newConn(server, &Server{})
+	c.requestClose("Service shutting down")
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.readCommand()
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != errCloseRequested {
+			t.Fatalf("readCommand() = %v, want %v", err, errCloseRequested)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("readCommand() blocked after a close request")
+	}
+}
+
+// interruptClock calls interrupt the first time the current time is read,
+// i.e. when readCommand computes the read deadline.
+type interruptClock struct {
+	systemClock
+	interrupted int32
+	interrupt   func()
+}
+
+func (clk *interruptClock) Now() time.Time {
+	if atomic.CompareAndSwapInt32(&clk.interrupted, 0, 1) {
+		clk.interrupt()
+	}
+	return time.Now()
+}
+
+func TestConn_ReadCommandInterrupted(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	// The close request races with readCommand setting the read deadline
+	clk := &interruptClock{}
+	c := newConn(server, &Server{ReadTimeout: time.Hour, Clock: clk})
+	clk.interrupt = func() {
+		go c.requestClose("Service shutting down")
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.readCommand()
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if neterr, ok := err.(net.Error); !ok || !neterr.Timeout() {
+			t.Fatalf("readCommand() = %v, want a timeout", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("readCommand() not interrupted by the close request")
+	}
+}
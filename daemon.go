@@ -0,0 +1,26 @@
+package smtp
+
+import (
+	"net"
+	"os"
+)
+
+// SystemdNotify sends a state notification to the service manager, as
+// described in sd_notify(3), e.g. "READY=1" or "STOPPING=1". It does nothing
+// if the NOTIFY_SOCKET environment variable isn't set.
+func SystemdNotify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+
+	// Paths starting with "@" are abstract sockets, net handles them
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
@@ -2,8 +2,11 @@ package smtp
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io"
+	"strings"
+	"time"
 )
 
 type EnhancedCode [3]int
@@ -13,7 +16,16 @@ type EnhancedCode [3]int
 type SMTPError struct {
 	Code         int
 	EnhancedCode EnhancedCode
-	Message      string
+	// Text of the reply. The client returns it as sent by the server: it may
+	// contain UTF-8 if SMTPUTF8 has been used, otherwise servers may have
+	// escaped non-ASCII characters with the \x{HEXPOINT} form of RFC 6533,
+	// which isn't decoded.
+	Message string
+
+	// Delay suggested by the server before retrying, parsed by the client
+	// from the text of 4xx replies, e.g. "try again in 5 minutes". Zero if
+	// the reply doesn't contain any.
+	RetryAfter time.Duration
 }
 
 // NoEnhancedCode is used to indicate that enhanced error code should not be
@@ -41,6 +53,18 @@ func (err *SMTPError) Temporary() bool {
 	return err.Code/100 == 4
 }
 
+// Forwarding returns the new address of the recipient given by a 551 reply
+// to RCPT, or nil. See RcptStatus.Forwarding.
+func (err *SMTPError) Forwarding() *ForwardingResult {
+	return parseForwarding(err.Code, err.Message)
+}
+
+// Lines returns the lines of the reply text, in order. Enhanced codes
+// prepended to the lines are stripped.
+func (err *SMTPError) Lines() []string {
+	return strings.Split(err.Message, "\n")
+}
+
 var ErrDataTooLarge = &SMTPError{
 	Code:         552,
 	EnhancedCode: EnhancedCode{5, 3, 4},
@@ -51,8 +75,11 @@ type dataReader struct {
 	r     *bufio.Reader
 	state int
 
-	limited bool
-	n       int64 // Maximum bytes remaining
+	limited  bool
+	n        int64 // Maximum bytes remaining
+	exceeded bool  // ErrDataTooLarge has been returned
+
+	count int64 // Bytes read so far
 }
 
 func newDataReader(c *Conn) *dataReader {
@@ -71,6 +98,7 @@ func newDataReader(c *Conn) *dataReader {
 func (r *dataReader) Read(b []byte) (n int, err error) {
 	if r.limited {
 		if r.n <= 0 {
+			r.exceeded = true
 			return 0, ErrDataTooLarge
 		}
 		if int64(len(b)) > r.n {
@@ -78,8 +106,9 @@ func (r *dataReader) Read(b []byte) (n int, err error) {
 		}
 	}
 
-	// Code below is taken from net/textproto with only one modification to
-	// not rewrite CRLF -> LF.
+	// Code below is taken from net/textproto with two modifications: CRLF
+	// isn't rewritten to LF, and runs of bytes in the middle of a line are
+	// copied at once.
 
 	// Run data through a simple state machine to
 	// elide leading dots and detect End-of-Data (<CR><LF>.<CR><LF>) line.
@@ -92,6 +121,23 @@ func (r *dataReader) Read(b []byte) (n int, err error) {
 		stateEOF              // reached .\r\n end marker line
 	)
 	for n < len(b) && r.state != stateEOF {
+		// Fast path: in the middle of a line, copy buffered bytes up to the
+		// next CR at once
+		if r.state == stateData && r.r.Buffered() > 0 {
+			buf, _ := r.r.Peek(r.r.Buffered())
+			if len(buf) > len(b)-n {
+				buf = buf[:len(b)-n]
+			}
+			if i := bytes.IndexByte(buf, '\r'); i >= 0 {
+				buf = buf[:i]
+			}
+			if len(buf) > 0 {
+				n += copy(b[n:], buf)
+				r.r.Discard(len(buf))
+				continue
+			}
+		}
+
 		var c byte
 		c, err = r.r.ReadByte()
 		if err != nil {
@@ -144,5 +190,6 @@ func (r *dataReader) Read(b []byte) (n int, err error) {
 	if r.limited {
 		r.n -= int64(n)
 	}
+	r.count += int64(n)
 	return
 }
@@ -0,0 +1,54 @@
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestDataReader(t *testing.T) {
+	for _, tc := range []struct {
+		in, out string
+	}{
+		{".\r\n", ""},
+		{"Hey <3\r\n.\r\n", "Hey <3\r\n"},
+		{"..Leading dot\r\n.\r\n", ".Leading dot\r\n"},
+		{"a\rb\nc\r\n\r\n.\r\n", "a\rb\nc\r\n\r\n"},
+		{"Not the end\r\n.foo\r\n.\r\n", "Not the end\r\nfoo\r\n"},
+	} {
+		r := &dataReader{r: bufio.NewReader(bytes.NewReader([]byte(tc.in + "QUIT\r\n")))}
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Errorf("Reading %q: %v", tc.in, err)
+		} else if string(b) != tc.out {
+			t.Errorf("Reading %q: got %q, want %q", tc.in, b, tc.out)
+		}
+	}
+
+	r := &dataReader{r: bufio.NewReader(bytes.NewReader([]byte("Truncated\r\n")))}
+	if _, err := ioutil.ReadAll(r); err != io.ErrUnexpectedEOF {
+		t.Errorf("Reading truncated data: got %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func benchmarkDataReader(b *testing.B, size int) {
+	line := []byte("Lorem ipsum dolor sit amet, consectetur adipiscing elit.\r\n")
+	msg := bytes.Repeat(line, size/len(line))
+	msg = append(msg, ".\r\n"...)
+
+	b.SetBytes(int64(len(msg)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r := &dataReader{r: bufio.NewReader(bytes.NewReader(msg))}
+		if _, err := io.Copy(ioutil.Discard, r); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDataReader(b *testing.B) {
+	b.Run("1MB", func(b *testing.B) { benchmarkDataReader(b, 1024*1024) })
+	b.Run("25MB", func(b *testing.B) { benchmarkDataReader(b, 25*1024*1024) })
+}
@@ -0,0 +1,206 @@
+package smtp
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// PrepareEnvelope prepares the envelope addresses of an internationalized
+// message (RFC 6530) for the server:
+//
+//   - if the server supports SMTPUTF8, addresses are left as is, and
+//     smtputf8 is true if any of them contains non-ASCII characters: the
+//     SMTPUTF8 parameter must then be used with Mail (see MailOptions.UTF8),
+//   - otherwise, non-ASCII domains are converted to A-labels (RFC 5891),
+//     e.g. "bücher.example" becomes "xn--bcher-kva.example", and an
+//     *OptionError is returned if a local part contains non-ASCII
+//     characters, since such an address can't be delivered.
+//
+// The conversion only implements Punycode, not the IDNA mapping (UTS #46):
+// domains must already be mapped, i.e. in lowercase and in Unicode
+// normalization form C. Non-ASCII labels containing uppercase characters
+// are rejected, but the normalization form isn't checked.
+//
+// SendMailEAI calls PrepareEnvelope.
+func (c *Client) PrepareEnvelope(from string, to []string) (preparedFrom string, preparedTo []string, smtputf8 bool, err error) {
+	if err := c.hello(); err != nil {
+		return "", nil, false, err
+	}
+
+	if _, ok := c.ext["SMTPUTF8"]; ok {
+		smtputf8 = !isASCII(from)
+		for _, addr := range to {
+			smtputf8 = smtputf8 || !isASCII(addr)
+		}
+		return from, to, smtputf8, nil
+	}
+
+	preparedFrom, err = asciiAddress(from)
+	if err != nil {
+		return "", nil, false, err
+	}
+	preparedTo = make([]string, len(to))
+	for i, addr := range to {
+		preparedTo[i], err = asciiAddress(addr)
+		if err != nil {
+			return "", nil, false, err
+		}
+	}
+	return preparedFrom, preparedTo, false, nil
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// asciiAddress converts the domain of an address to A-labels. It fails if
+// the local part isn't ASCII.
+func asciiAddress(addr string) (string, error) {
+	if isASCII(addr) {
+		return addr, nil
+	}
+
+	i := strings.LastIndexByte(addr, '@')
+	if i < 0 {
+		return "", eaiError(addr, "address contains non-ASCII characters")
+	}
+	localPart, domain := addr[:i], addr[i+1:]
+	if !isASCII(localPart) {
+		return "", eaiError(addr, "local part contains non-ASCII characters")
+	}
+
+	domain, err := asciiDomain(domain)
+	if err != nil {
+		return "", eaiError(addr, err.Error())
+	}
+	return localPart + "@" + domain, nil
+}
+
+func eaiError(addr, reason string) error {
+	return &OptionError{
+		Option: "SMTPUTF8",
+		Reason: fmt.Sprintf("server does not support SMTPUTF8, required by <%v>: %v", addr, reason),
+		Hint:   "use an ASCII address or another server",
+	}
+}
+
+// asciiDomain converts the non-ASCII labels of a domain to A-labels.
+func asciiDomain(domain string) (string, error) {
+	// Label separators recognized by IDNA (RFC 3490 section 3.1)
+	domain = strings.NewReplacer("。", ".", "．", ".", "｡", ".").Replace(domain)
+
+	labels := strings.Split(domain, ".")
+	for i, label := range labels {
+		if isASCII(label) {
+			continue
+		}
+		if label != strings.ToLower(label) {
+			return "", fmt.Errorf("domain label %q isn't in lowercase, it must be mapped with IDNA first", label)
+		}
+		encoded := "xn--" + punycodeEncode(label)
+		if len(encoded) > 63 {
+			return "", fmt.Errorf("domain label %q is too long", label)
+		}
+		labels[i] = encoded
+	}
+	return strings.Join(labels, "."), nil
+}
+
+// Punycode parameters, see RFC 3492 section 5.
+const (
+	punycodeBase        = 36
+	punycodeTMin        = 1
+	punycodeTMax        = 26
+	punycodeSkew        = 38
+	punycodeDamp        = 700
+	punycodeInitialBias = 72
+	punycodeInitialN    = 128
+)
+
+// punycodeEncode encodes a string with Punycode (RFC 3492 section 6.3).
+func punycodeEncode(s string) string {
+	runes := []rune(s)
+
+	var out []byte
+	for _, r := range runes {
+		if r < utf8.RuneSelf {
+			out = append(out, byte(r))
+		}
+	}
+	basic := len(out)
+	if basic > 0 {
+		out = append(out, '-')
+	}
+
+	n, delta, bias := rune(punycodeInitialN), 0, punycodeInitialBias
+	for h := basic; h < len(runes); {
+		// Next code point to insert: the smallest one >= n
+		m := rune(utf8.MaxRune + 1)
+		for _, r := range runes {
+			if r >= n && r < m {
+				m = r
+			}
+		}
+		delta += int(m-n) * (h + 1)
+		n = m
+
+		for _, r := range runes {
+			if r < n {
+				delta++
+			}
+			if r != n {
+				continue
+			}
+
+			q := delta
+			for k := punycodeBase; ; k += punycodeBase {
+				t := k - bias
+				if t < punycodeTMin {
+					t = punycodeTMin
+				} else if t > punycodeTMax {
+					t = punycodeTMax
+				}
+				if q < t {
+					break
+				}
+				out = append(out, punycodeDigit(t+(q-t)%(punycodeBase-t)))
+				q = (q - t) / (punycodeBase - t)
+			}
+			out = append(out, punycodeDigit(q))
+			bias = punycodeAdapt(delta, h+1, h == basic)
+			delta = 0
+			h++
+		}
+		delta++
+		n++
+	}
+	return string(out)
+}
+
+func punycodeAdapt(delta, numPoints int, first bool) int {
+	if first {
+		delta /= punycodeDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / numPoints
+	k := 0
+	for delta > ((punycodeBase-punycodeTMin)*punycodeTMax)/2 {
+		delta /= punycodeBase - punycodeTMin
+		k += punycodeBase
+	}
+	return k + (punycodeBase-punycodeTMin+1)*delta/(delta+punycodeSkew)
+}
+
+func punycodeDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
@@ -0,0 +1,50 @@
+package smtp
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestPunycodeEncode(t *testing.T) {
+	// Vectors from RFC 3492 section 7.1
+	for _, tc := range []struct {
+		in, want string
+	}{
+		{"bücher", "bcher-kva"},
+		{"münchen", "mnchen-3ya"},
+		{"ليهمابتكلموشعربي؟", "egbpdaj6bu4bxfgehfvwxn"},
+		{"他们为什么不说中文", "ihqwcrb4cv8a8dqg056pqjye"},
+		{"3年B組金八先生", "3B-ww4c5e180e575a65lsy2b"},
+		{"安室奈美恵-with-SUPER-MONKEYS", "-with-SUPER-MONKEYS-pc58ag80a8qai00g7n9n"},
+	} {
+		if got := punycodeEncode(tc.in); got != tc.want {
+			t.Errorf("punycodeEncode(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestAsciiAddress(t *testing.T) {
+	for _, tc := range []struct {
+		in, want string
+	}{
+		{"", ""},
+		{"alice@example.org", "alice@example.org"},
+		{"alice@bücher.example", "alice@xn--bcher-kva.example"},
+		{"alice@mail。bücher．example", "alice@mail.xn--bcher-kva.example"},
+	} {
+		got, err := asciiAddress(tc.in)
+		if err != nil {
+			t.Errorf("asciiAddress(%q) = %v", tc.in, err)
+		} else if got != tc.want {
+			t.Errorf("asciiAddress(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+
+	for _, in := range []string{"ålice@example.org", "ålice", "alice@Bücher.example"} {
+		_, err := asciiAddress(in)
+		var optErr *OptionError
+		if !errors.As(err, &optErr) || optErr.Option != "SMTPUTF8" {
+			t.Errorf("asciiAddress(%q) = %v, want an SMTPUTF8 OptionError", in, err)
+		}
+	}
+}
@@ -4,6 +4,9 @@ import (
 	"errors"
 	"io"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/emersion/go-sasl"
@@ -15,28 +18,39 @@ type Backend struct{}
 
 // NewSession is called after client greeting (EHLO, HELO).
 func (bkd *Backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
-	return &Session{}, nil
+	return &Session{conn: c}, nil
 }
 
 // A Session is returned after successful login.
-type Session struct{}
+type Session struct {
+	conn *smtp.Conn
+}
 
-// AuthMechanisms returns a slice of available auth mechanisms; only PLAIN is
-// supported in this example.
+// AuthMechanisms returns a slice of available auth mechanisms; PLAIN is
+// supported, and LOGIN for legacy clients.
 func (s *Session) AuthMechanisms() []string {
-	return []string{sasl.Plain}
+	return []string{sasl.Plain, sasl.Login}
 }
 
 // Auth is the handler for supported authenticators.
 func (s *Session) Auth(mech string) (sasl.Server, error) {
+	if mech == sasl.Login {
+		return smtp.NewLoginServer(s.authenticate), nil
+	}
 	return sasl.NewPlainServer(func(identity, username, password string) error {
-		if username != "username" || password != "password" {
-			return errors.New("Invalid username or password")
-		}
-		return nil
+		return s.authenticate(username, password)
 	}), nil
 }
 
+func (s *Session) authenticate(username, password string) error {
+	if username != "username" || password != "password" {
+		return errors.New("Invalid username or password")
+	}
+	// Used for quotas, accounting and submission checks
+	s.conn.SetAuthIdentity(username)
+	return nil
+}
+
 func (s *Session) Mail(from string, opts *smtp.MailOptions) error {
 	log.Println("Mail from:", from)
 	return nil
@@ -93,3 +107,29 @@ func ExampleServer() {
 		log.Fatal(err)
 	}
 }
+
+// ExampleServer_DrainConns drains the connections on SIGTERM, e.g. during a
+// rolling restart: message transfers in progress are completed, then clients
+// are asked to reconnect, hopefully to another instance.
+func ExampleServer_DrainConns() {
+	s := smtp.NewServer(&Backend{})
+	s.Addr = "localhost:1025"
+	s.Domain = "localhost"
+
+	go func() {
+		if err := s.ListenAndServe(); err != nil {
+			log.Fatal(err)
+		}
+	}()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM)
+	<-sigs
+
+	select {
+	case <-s.DrainConns():
+	case <-time.After(5 * time.Minute):
+		log.Println("Timeout draining connections")
+	}
+	s.Close()
+}
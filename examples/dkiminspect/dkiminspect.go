@@ -0,0 +1,50 @@
+// Package dkiminspect verifies the DKIM signatures of messages while their
+// data is received, with a smtp.DataInspector.
+//
+// It is a reference implementation of Server.DataInspectors, kept in its own
+// module so that go-smtp doesn't depend on go-msgauth.
+package dkiminspect
+
+import (
+	"errors"
+	"io"
+
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/emersion/go-smtp"
+)
+
+// Name is the name of the inspector returned by Inspector.
+const Name = "dkim"
+
+// ErrNotInspected is returned by Verifications when the message data hasn't
+// been inspected.
+var ErrNotInspected = errors.New("dkiminspect: message data not inspected")
+
+// Inspector returns a smtp.DataInspector verifying DKIM signatures. options
+// can be nil.
+func Inspector(options *dkim.VerifyOptions) smtp.DataInspector {
+	return smtp.DataInspector{
+		Name: Name,
+		Inspect: func(c *smtp.Conn, tx *smtp.Transaction, r io.Reader) (interface{}, error) {
+			return dkim.VerifyWithOptions(r, options)
+		},
+	}
+}
+
+// Verifications returns the DKIM verifications of the message data of a
+// transaction. It must be called once the message data reader passed to the
+// backend has returned io.EOF.
+func Verifications(tx *smtp.Transaction) ([]*dkim.Verification, error) {
+	if tx == nil || tx.Inspections == nil {
+		return nil, ErrNotInspected
+	}
+	result := tx.Inspections.Get(Name)
+	if result == nil {
+		return nil, ErrNotInspected
+	}
+	if result.Err != nil {
+		return nil, result.Err
+	}
+	verifs, _ := result.Value.([]*dkim.Verification)
+	return verifs, nil
+}
@@ -0,0 +1,97 @@
+package dkiminspect
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/emersion/go-smtp"
+)
+
+type session struct {
+	conn   *smtp.Conn
+	verifs chan []*dkim.Verification
+}
+
+func (s *session) Reset()        {}
+func (s *session) Logout() error { return nil }
+
+func (s *session) Mail(from string, opts *smtp.MailOptions) error {
+	return nil
+}
+
+func (s *session) Rcpt(to string, opts *smtp.RcptOptions) error {
+	return nil
+}
+
+func (s *session) Data(r io.Reader) error {
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		return err
+	}
+	verifs, err := Verifications(s.conn.Transaction())
+	if err != nil {
+		return err
+	}
+	s.verifs <- verifs
+	return nil
+}
+
+func TestInspector(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var signed bytes.Buffer
+	msg := "From: <root@nsa.gov>\r\nSubject: Hello\r\n\r\nHey <3\r\n"
+	err = dkim.Sign(&signed, strings.NewReader(msg), &dkim.SignOptions{
+		Domain:   "nsa.gov",
+		Selector: "test",
+		Signer:   priv,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verifs := make(chan []*dkim.Verification, 1)
+	s := smtp.NewServer(smtp.BackendFunc(func(c *smtp.Conn) (smtp.Session, error) {
+		return &session{conn: c, verifs: verifs}, nil
+	}))
+	s.Domain = "localhost"
+	s.DataInspectors = []smtp.DataInspector{Inspector(&dkim.VerifyOptions{
+		LookupTXT: func(domain string) ([]string, error) {
+			if domain != "test._domainkey.nsa.gov" {
+				return nil, &net.DNSError{Err: "no such host", Name: domain, IsNotFound: true}
+			}
+			return []string{"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub)}, nil
+		},
+	})}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	defer s.Close()
+
+	c, err := smtp.Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.SendMail("root@nsa.gov", []string{"root@gchq.gov.uk"}, &signed); err != nil {
+		t.Fatal(err)
+	}
+
+	v := <-verifs
+	if len(v) != 1 || v[0].Domain != "nsa.gov" || v[0].Err != nil {
+		t.Fatalf("Invalid verifications: %+v", v)
+	}
+}
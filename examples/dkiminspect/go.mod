@@ -0,0 +1,15 @@
+module github.com/emersion/go-smtp/examples/dkiminspect
+
+go 1.18
+
+require (
+	github.com/emersion/go-msgauth v0.7.0
+	github.com/emersion/go-smtp v0.0.0
+)
+
+require (
+	github.com/emersion/go-sasl v0.0.0-20200509203442-7bfe0ed36a21 // indirect
+	golang.org/x/crypto v0.31.0 // indirect
+)
+
+replace github.com/emersion/go-smtp => ../..
@@ -0,0 +1,281 @@
+// Package storage is an example backend persisting received messages to disk.
+//
+// It is meant as a reference for storage engines built on top of go-smtp, and
+// as a fixture for integration tests: message data is streamed to disk as it
+// is received, never buffered in memory.
+//
+// Messages are stored in a directory, one file with the raw message data and
+// one JSON file with the envelope per message, named after the transaction
+// ID. Files are written to a temporary name and renamed once complete, so
+// readers never see partial messages. A directory is used rather than an
+// embedded database such as SQLite or Bolt to keep the example free of
+// dependencies: Store is small enough to be swapped for one.
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+const (
+	dataExt     = ".eml"
+	envelopeExt = ".json"
+	tmpPrefix   = ".tmp-"
+)
+
+// ErrNotFound is returned when a message doesn't exist in the store.
+var ErrNotFound = errors.New("storage: message not found")
+
+// Envelope describes a stored message.
+type Envelope struct {
+	ID         string    `json:"id"`
+	From       string    `json:"from"`
+	Recipients []string  `json:"recipients"`
+	Received   time.Time `json:"received"`
+	Size       int64     `json:"size"`
+	Body       string    `json:"body,omitempty"`
+	Chunking   bool      `json:"chunking,omitempty"`
+	Chunks     int       `json:"chunks,omitempty"`
+}
+
+// Store is a directory holding messages.
+type Store struct {
+	dir string
+}
+
+// Open opens a store, creating the directory if it doesn't exist.
+func Open(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &Store{dir: dir}, nil
+}
+
+func validID(id string) bool {
+	return id != "" && !strings.ContainsAny(id, `/\.`)
+}
+
+// Put stores a message, reading its data from r until EOF. The Size field
+// of env is populated.
+func (s *Store) Put(env *Envelope, r io.Reader) error {
+	if !validID(env.ID) {
+		return fmt.Errorf("storage: invalid message ID %q", env.ID)
+	}
+
+	n, err := s.writeFile(env.ID+dataExt, func(w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	env.Size = n
+
+	// The envelope is written last: a message is only listed once its data
+	// is complete
+	_, err = s.writeFile(env.ID+envelopeExt, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(env)
+	})
+	if err != nil {
+		os.Remove(filepath.Join(s.dir, env.ID+dataExt))
+	}
+	return err
+}
+
+func (s *Store) writeFile(name string, fn func(w io.Writer) error) (int64, error) {
+	f, err := ioutil.TempFile(s.dir, tmpPrefix)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	cw := &countWriter{w: f}
+	if err := fn(cw); err != nil {
+		return 0, err
+	}
+	if err := f.Sync(); err != nil {
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+	return cw.n, os.Rename(f.Name(), filepath.Join(s.dir, name))
+}
+
+// Envelope returns the envelope of a message.
+func (s *Store) Envelope(id string) (*Envelope, error) {
+	if !validID(id) {
+		return nil, ErrNotFound
+	}
+	b, err := ioutil.ReadFile(filepath.Join(s.dir, id+envelopeExt))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	var env Envelope
+	if err := json.Unmarshal(b, &env); err != nil {
+		return nil, fmt.Errorf("storage: malformed envelope for %v: %v", id, err)
+	}
+	return &env, nil
+}
+
+// Open opens the raw data of a message. The caller must close it.
+func (s *Store) Open(id string) (io.ReadCloser, error) {
+	if !validID(id) {
+		return nil, ErrNotFound
+	}
+	f, err := os.Open(filepath.Join(s.dir, id+dataExt))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+// List returns the envelopes of all messages, oldest first.
+func (s *Store) List() ([]*Envelope, error) {
+	names, err := filepath.Glob(filepath.Join(s.dir, "*"+envelopeExt))
+	if err != nil {
+		return nil, err
+	}
+
+	envs := make([]*Envelope, 0, len(names))
+	for _, name := range names {
+		id := strings.TrimSuffix(filepath.Base(name), envelopeExt)
+		env, err := s.Envelope(id)
+		if err == ErrNotFound {
+			continue // deleted in the meantime
+		} else if err != nil {
+			return nil, err
+		}
+		envs = append(envs, env)
+	}
+
+	sort.SliceStable(envs, func(i, j int) bool {
+		return envs[i].Received.Before(envs[j].Received)
+	})
+	return envs, nil
+}
+
+// Delete removes a message.
+func (s *Store) Delete(id string) error {
+	if !validID(id) {
+		return ErrNotFound
+	}
+	err := os.Remove(filepath.Join(s.dir, id+envelopeExt))
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+	return os.Remove(filepath.Join(s.dir, id+dataExt))
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(b []byte) (int, error) {
+	n, err := cw.w.Write(b)
+	cw.n += int64(n)
+	return n, err
+}
+
+// Backend is a SMTP server backend saving messages to a Store.
+type Backend struct {
+	Store *Store
+}
+
+var _ smtp.Backend = (*Backend)(nil)
+
+// NewSession implements smtp.Backend.
+func (be *Backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return &session{conn: c, store: be.Store}, nil
+}
+
+type session struct {
+	conn  *smtp.Conn
+	store *Store
+}
+
+var _ smtp.TransactionSession = (*session)(nil)
+
+func (s *session) Reset() {}
+
+func (s *session) Logout() error {
+	return nil
+}
+
+func (s *session) Mail(from string, opts *smtp.MailOptions) error {
+	return nil
+}
+
+func (s *session) Rcpt(to string, opts *smtp.RcptOptions) error {
+	return nil
+}
+
+// Data is called instead of DataTx when the session is wrapped, e.g. by a
+// backendutil wrapper only forwarding the Session methods.
+func (s *session) Data(r io.Reader) error {
+	tx := s.conn.Transaction()
+	if tx == nil {
+		return errors.New("storage: no mail transaction in progress")
+	}
+	return s.DataTx(tx, r)
+}
+
+func (s *session) MailTx(tx *smtp.Transaction) error {
+	return nil
+}
+
+func (s *session) RcptTx(tx *smtp.Transaction, to string, opts *smtp.RcptOptions) error {
+	return nil
+}
+
+func (s *session) DataTx(tx *smtp.Transaction, r io.Reader) error {
+	env := &Envelope{
+		ID:         tx.ID,
+		From:       tx.From,
+		Recipients: append([]string(nil), tx.Recipients...),
+		Received:   tx.DataStartedAt,
+	}
+	if err := s.store.Put(env, &statsReader{r: r, tx: tx, env: env}); err != nil {
+		return &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+			Message:      "Failed to store message",
+		}
+	}
+	return nil
+}
+
+// statsReader copies the transfer statistics of a transaction to an
+// envelope once the message data has been read, since they're only final at
+// that point.
+type statsReader struct {
+	r   io.Reader
+	tx  *smtp.Transaction
+	env *Envelope
+}
+
+func (sr *statsReader) Read(b []byte) (int, error) {
+	n, err := sr.r.Read(b)
+	if err == io.EOF {
+		sr.env.Body = string(sr.tx.DataStats.Body)
+		sr.env.Chunking = sr.tx.DataStats.Chunking
+		sr.env.Chunks = sr.tx.DataStats.Chunks
+	}
+	return n, err
+}
@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+)
+
+func TestBackend(t *testing.T) {
+	store, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := smtp.NewServer(&Backend{Store: store})
+	s.Domain = "localhost"
+	go s.Serve(l)
+	defer s.Close()
+
+	// Large enough to be streamed in several reads, with lines which need
+	// dot-stuffing
+	var msg bytes.Buffer
+	msg.WriteString("Subject: Hello\r\n\r\n")
+	for msg.Len() < 1<<20 {
+		msg.WriteString(".A line with a leading dot, which must survive the round-trip\r\n")
+	}
+
+	c, err := smtp.Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.SendMail("root@nsa.gov", []string{"root@gchq.gov.uk", "root@bnd.bund.de"}, bytes.NewReader(msg.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Quit()
+
+	envs, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(envs) != 1 {
+		t.Fatalf("Expected 1 message, got %v", len(envs))
+	}
+	env := envs[0]
+	if env.From != "root@nsa.gov" || strings.Join(env.Recipients, ",") != "root@gchq.gov.uk,root@bnd.bund.de" {
+		t.Errorf("Invalid envelope: %+v", env)
+	}
+	if env.Size != int64(msg.Len()) {
+		t.Errorf("Invalid size: got %v, want %v", env.Size, msg.Len())
+	}
+	if env.Chunking || env.Received.IsZero() {
+		t.Errorf("Invalid transfer information: %+v", env)
+	}
+
+	rc, err := store.Open(env.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, msg.Bytes()) {
+		t.Error("Stored message data differs from sent data")
+	}
+
+	if err := store.Delete(env.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Envelope(env.ID); err != ErrNotFound {
+		t.Errorf("Envelope() after Delete() = %v, want ErrNotFound", err)
+	}
+	if _, err := store.Open("../" + env.ID); err != ErrNotFound {
+		t.Errorf("Open() with invalid ID = %v, want ErrNotFound", err)
+	}
+}
+
+func TestBackend_Data(t *testing.T) {
+	store, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only expose the Session methods, as some wrappers do
+	be := &Backend{Store: store}
+	s := smtp.NewServer(smtp.BackendFunc(func(c *smtp.Conn) (smtp.Session, error) {
+		session, err := be.NewSession(c)
+		return struct{ smtp.Session }{session}, err
+	}))
+	s.Domain = "localhost"
+	go s.Serve(l)
+	defer s.Close()
+
+	c, err := smtp.Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.SendMail("root@nsa.gov", []string{"root@gchq.gov.uk"}, strings.NewReader("Subject: Hello\r\n\r\nHi\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Quit()
+
+	envs, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(envs) != 1 || envs[0].From != "root@nsa.gov" {
+		t.Fatalf("Invalid stored messages: %+v", envs)
+	}
+}
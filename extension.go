@@ -0,0 +1,170 @@
+package smtp
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// builtinCommands are the commands implemented by the server, which can't be
+// overridden by extensions.
+var builtinCommands = map[string]bool{
+	"HELO":      true,
+	"EHLO":      true,
+	"LHLO":      true,
+	"MAIL":      true,
+	"RCPT":      true,
+	"DATA":      true,
+	"BDAT":      true,
+	"RSET":      true,
+	"VRFY":      true,
+	"EXPN":      true,
+	"NOOP":      true,
+	"QUIT":      true,
+	"AUTH":      true,
+	"STARTTLS":  true,
+	"XCOMPRESS": true,
+	"HELP":      true,
+}
+
+// Extension is a service extension implemented by the embedder, registered
+// with Server.RegisterExtension. Its EHLO capability, its commands and their
+// HELP entries are only available when it is enabled, so that advertisement
+// and behavior are kept consistent.
+type Extension struct {
+	// EHLO keyword, e.g. "XCLIENT". If empty, nothing is advertised.
+	Keyword string
+	// Parameters advertised after the keyword, e.g. "NAME ADDR".
+	Params []string
+	// Commands implemented by the extension.
+	Commands []ExtensionCommand
+	// If not nil, called on each EHLO and command to check whether the
+	// extension is enabled for the connection, e.g. only for trusted
+	// clients.
+	Enabled func(c *Conn) bool
+}
+
+func (ext *Extension) enabled(c *Conn) bool {
+	return ext.Enabled == nil || ext.Enabled(c)
+}
+
+// capability returns the EHLO reply line of the extension.
+func (ext *Extension) capability() string {
+	return strings.Join(append([]string{ext.Keyword}, ext.Params...), " ")
+}
+
+// ExtensionCommand is a command implemented by an Extension.
+type ExtensionCommand struct {
+	// Command verb, e.g. "XCLIENT".
+	Verb string
+	// Text returned by "HELP <verb>". The first line is also used by "HELP"
+	// without arguments. If empty, no help is available.
+	Help string
+	// Handles the command, arg contains the command arguments. The handler
+	// must reply with Conn.WriteResponse. Commands can be issued in any
+	// state, Conn.Transaction can be used to check whether a mail
+	// transaction is in progress.
+	Handler func(c *Conn, arg string)
+}
+
+type extensionCommand struct {
+	*ExtensionCommand
+	ext *Extension
+}
+
+// RegisterExtension registers an extension implemented by the embedder. It
+// must be called before the server starts serving connections.
+//
+// An error is returned if one of the commands is implemented by the server
+// or by another extension.
+func (s *Server) RegisterExtension(ext *Extension) error {
+	cmds := make(map[string]*ExtensionCommand, len(ext.Commands))
+	for i := range ext.Commands {
+		cmd := &ext.Commands[i]
+		verb := strings.ToUpper(cmd.Verb)
+		if builtinCommands[verb] {
+			return fmt.Errorf("smtp: command %v is implemented by the server", verb)
+		}
+		if _, ok := s.extCommands[verb]; ok {
+			return fmt.Errorf("smtp: command %v is already registered", verb)
+		}
+		if _, ok := cmds[verb]; ok {
+			return fmt.Errorf("smtp: command %v is registered twice", verb)
+		}
+		if cmd.Handler == nil {
+			return fmt.Errorf("smtp: command %v has no handler", verb)
+		}
+		cmds[verb] = cmd
+	}
+
+	if s.extCommands == nil {
+		s.extCommands = make(map[string]extensionCommand)
+	}
+	for verb, cmd := range cmds {
+		s.extCommands[verb] = extensionCommand{cmd, ext}
+	}
+	s.extensions = append(s.extensions, ext)
+	return nil
+}
+
+// extensionCommand returns the handler of an enabled extension command.
+func (c *Conn) extensionCommand(cmd string) *ExtensionCommand {
+	extCmd, ok := c.server.extCommands[cmd]
+	if !ok || !extCmd.ext.enabled(c) {
+		return nil
+	}
+	return extCmd.ExtensionCommand
+}
+
+// extensionCaps returns the EHLO capabilities of the enabled extensions.
+func (c *Conn) extensionCaps() []string {
+	var caps []string
+	for _, ext := range c.server.extensions {
+		if ext.Keyword != "" && ext.enabled(c) {
+			caps = append(caps, ext.capability())
+		}
+	}
+	return caps
+}
+
+// handleHelp handles the HELP command. Only help about extension commands
+// is available.
+func (c *Conn) handleHelp(arg string) {
+	help := make(map[string]string)
+	for verb, extCmd := range c.server.extCommands {
+		if extCmd.Help != "" && extCmd.ext.enabled(c) {
+			help[verb] = extCmd.Help
+		}
+	}
+	if len(help) == 0 {
+		c.writeResponse(502, EnhancedCode{5, 5, 1}, "HELP command not implemented")
+		return
+	}
+
+	if arg != "" {
+		verb := strings.ToUpper(arg)
+		text, ok := help[verb]
+		if !ok {
+			c.writeResponse(504, EnhancedCode{5, 5, 4}, fmt.Sprintf("No help available for %v", verb))
+			return
+		}
+		c.WriteResponse(214, EnhancedCode{2, 0, 0}, text)
+		return
+	}
+
+	verbs := make([]string, 0, len(help))
+	for verb := range help {
+		verbs = append(verbs, verb)
+	}
+	sort.Strings(verbs)
+
+	lines := []string{"Extension commands:"}
+	for _, verb := range verbs {
+		text := help[verb]
+		if i := strings.IndexAny(text, "\r\n"); i >= 0 {
+			text = text[:i]
+		}
+		lines = append(lines, verb+" - "+text)
+	}
+	c.writeResponse(214, EnhancedCode{2, 0, 0}, lines...)
+}
@@ -0,0 +1,80 @@
+package smtp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// FaultInjection simulates transient failures, e.g. to check in a staging
+// environment that senders retry deliveries. It must never be used in
+// production.
+//
+// Fault injection is only built in with the smtp_faults build tag
+// (go build -tags smtp_faults), so that production binaries can't enable it
+// by mistake. Without it, FaultInjection has no effect.
+type FaultInjection struct {
+	// Must be set for the other fields to take effect. The server logs a
+	// warning when it starts serving with fault injection enabled, or
+	// requested in a binary built without the smtp_faults build tag.
+	Enabled bool
+
+	// Probability, between 0 and 1, that a connection is rejected with a 421
+	// reply instead of the greeting.
+	ConnectFailure float64
+	// Probability, between 0 and 1, that a MAIL command is rejected with a
+	// 451 reply.
+	MailFailure float64
+
+	// Delay before each reply.
+	Latency time.Duration
+	// Maximum random delay added to Latency.
+	LatencyJitter time.Duration
+}
+
+// faultInjection returns the fault injection configuration if it's enabled,
+// nil otherwise.
+func (s *Server) faultInjection() *FaultInjection {
+	if !faultsBuilt || s.FaultInjection == nil || !s.FaultInjection.Enabled {
+		return nil
+	}
+	return s.FaultInjection
+}
+
+// random returns a random number in [0, 1) read from Server.Rand.
+func (s *Server) random() float64 {
+	r := s.Rand
+	if r == nil {
+		r = rand.Reader
+	}
+
+	var b [8]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		panic(err)
+	}
+	return float64(binary.BigEndian.Uint64(b[:])>>11) / (1 << 53)
+}
+
+// chance returns true with probability p.
+func (s *Server) chance(p float64) bool {
+	return p > 0 && s.random() < p
+}
+
+// injectLatency waits before a reply if fault injection is enabled.
+func (c *Conn) injectLatency() {
+	fi := c.server.faultInjection()
+	if fi == nil {
+		return
+	}
+	d := fi.Latency
+	if fi.LatencyJitter > 0 {
+		d += time.Duration(c.server.random() * float64(fi.LatencyJitter))
+	}
+	if d <= 0 {
+		return
+	}
+
+	c.flush()
+	c.server.sleep(d)
+}
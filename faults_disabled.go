@@ -0,0 +1,7 @@
+//go:build !smtp_faults
+// +build !smtp_faults
+
+package smtp
+
+// faultsBuilt is true if fault injection is built in, see FaultInjection.
+const faultsBuilt = false
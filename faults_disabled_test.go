@@ -0,0 +1,32 @@
+//go:build !smtp_faults
+// +build !smtp_faults
+
+package smtp_test
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+)
+
+func TestServer_FaultInjectionNotBuilt(t *testing.T) {
+	_, s, c, scanner := testServer(t, func(s *smtp.Server) {
+		s.FaultInjection = &smtp.FaultInjection{Enabled: true, ConnectFailure: 1, MailFailure: 1}
+	})
+	defer s.Close()
+	defer c.Close()
+
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "220 ") {
+		t.Fatal("Invalid greeting:", scanner.Text())
+	}
+	io.WriteString(c, "HELO localhost\r\n")
+	scanner.Scan()
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+}
@@ -0,0 +1,89 @@
+//go:build smtp_faults
+// +build smtp_faults
+
+package smtp_test
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+func TestServer_FaultInjection(t *testing.T) {
+	for _, tc := range []struct {
+		name           string
+		faults         smtp.FaultInjection
+		greeting, mail string
+	}{
+		{
+			name:     "disabled",
+			faults:   smtp.FaultInjection{ConnectFailure: 1, MailFailure: 1},
+			greeting: "220 localhost ESMTP Service Ready",
+			mail:     "250 ",
+		},
+		{
+			name:     "connect",
+			faults:   smtp.FaultInjection{Enabled: true, ConnectFailure: 1},
+			greeting: "421 4.3.2 Simulated failure, please try again later",
+		},
+		{
+			name:     "mail",
+			faults:   smtp.FaultInjection{Enabled: true, MailFailure: 1},
+			greeting: "220 localhost ESMTP Service Ready",
+			mail:     "451 4.3.0 Simulated failure, please try again later",
+		},
+		{
+			name:     "latency",
+			faults:   smtp.FaultInjection{Enabled: true, Latency: time.Hour},
+			greeting: "220 localhost ESMTP Service Ready",
+			mail:     "250 ",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			clock := &fakeClock{now: time.Now(), maxDelay: time.Hour}
+			_, s, c, scanner := testServer(t, func(s *smtp.Server) {
+				s.Clock = clock
+				s.Rand = zeroReader{}
+				s.LogoutTimeout = 24 * time.Hour
+				s.FaultInjection = &tc.faults
+			})
+			defer s.Close()
+			defer c.Close()
+
+			scanner.Scan()
+			if scanner.Text() != tc.greeting {
+				t.Fatalf("Invalid greeting: got %q, want %q", scanner.Text(), tc.greeting)
+			}
+			if tc.mail == "" {
+				return
+			}
+
+			io.WriteString(c, "HELO localhost\r\n")
+			scanner.Scan()
+			io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+			scanner.Scan()
+			if !strings.HasPrefix(scanner.Text(), tc.mail) {
+				t.Fatalf("Invalid MAIL response: got %q, want %q", scanner.Text(), tc.mail)
+			}
+
+			delays := 0
+			clock.mu.Lock()
+			for _, d := range clock.timers {
+				if d == time.Hour {
+					delays++
+				}
+			}
+			clock.mu.Unlock()
+			want := 0
+			if tc.faults.Latency > 0 {
+				want = 3 // greeting, HELO and MAIL
+			}
+			if delays != want {
+				t.Errorf("%v replies delayed, want %v", delays, want)
+			}
+		})
+	}
+}
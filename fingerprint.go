@@ -0,0 +1,51 @@
+package smtp
+
+import (
+	"crypto/tls"
+	"net"
+)
+
+// tlsListener accepts implicit TLS connections, keeping track of the
+// underlying connections.
+type tlsListener struct {
+	net.Listener
+	server *Server
+	config *tls.Config
+}
+
+func (l *tlsListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Server(conn, l.config)
+	l.server.tlsNetConns.Store(tlsConn, conn)
+	return tlsConn, nil
+}
+
+// forgetTLSConn drops what was recorded about an implicit TLS connection
+// once it's closed.
+func (s *Server) forgetTLSConn(tlsConn *tls.Conn) {
+	if conn, ok := s.tlsNetConns.Load(tlsConn); ok {
+		s.tlsFingerprints.Delete(conn)
+		s.tlsNetConns.Delete(tlsConn)
+	}
+}
+
+// loadTLSFingerprint sets the fingerprint of the connection, recorded during
+// the handshake with implicit TLS.
+func (c *Conn) loadTLSFingerprint() {
+	v, ok := c.server.tlsFingerprints.Load(c.netConn)
+	if !ok {
+		return
+	}
+	c.locker.Lock()
+	c.stats.TLSFingerprint = v.(string)
+	c.locker.Unlock()
+}
+
+// TLSFingerprint returns the JA4 fingerprint of the TLS ClientHello sent by
+// the client, see Server.FingerprintTLS. It's empty if unavailable.
+func (c *Conn) TLSFingerprint() string {
+	return c.Stats().TLSFingerprint
+}
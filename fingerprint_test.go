@@ -0,0 +1,77 @@
+//go:build go1.24
+// +build go1.24
+
+package smtp
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestJA4Fingerprint(t *testing.T) {
+	hello := &tls.ClientHelloInfo{
+		CipherSuites:      []uint16{0x0a0a, 0x1302, 0x1301},
+		ServerName:        "mx.example.org",
+		SupportedProtos:   []string{"smtp"},
+		SupportedVersions: []uint16{0x2a2a, tls.VersionTLS13, tls.VersionTLS12},
+		SignatureSchemes:  []tls.SignatureScheme{0x0403, 0x0804},
+		Extensions:        []uint16{0x1a1a, 0x0000, 0x002b, 0x0010, 0x000d},
+	}
+	want := "t13d0204sp_62ed6f6ca7ad_ef5f37ab036a"
+	if got := JA4Fingerprint(hello); got != want {
+		t.Errorf("JA4Fingerprint() = %q, want %q", got, want)
+	}
+
+	hello = &tls.ClientHelloInfo{
+		SupportedVersions: []uint16{tls.VersionTLS12},
+		SupportedProtos:   []string{"\x00abc"},
+	}
+	want = "t12i000003_000000000000_000000000000"
+	if got := JA4Fingerprint(hello); got != want {
+		t.Errorf("JA4Fingerprint() = %q, want %q", got, want)
+	}
+}
+
+func TestServer_FingerprintTLS(t *testing.T) {
+	cert, err := tls.X509KeyPair(localhostCert, localhostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fingerprints := make(chan string, 1)
+	s := NewServer(BackendFunc(func(c *Conn) (Session, error) {
+		return nil, ErrAuthRequired
+	}))
+	s.DomainForConn = func(c *Conn) string {
+		fingerprints <- c.TLSFingerprint()
+		return ""
+	}
+	s.Domain = "localhost"
+	s.ErrorLog = log.New(ioutil.Discard, "", 0)
+	s.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	s.FingerprintTLS = true
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(&tlsListener{Listener: l, server: s, config: s.implicitTLSConfig()})
+	defer s.Close()
+
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	bufio.NewReader(conn).ReadString('\n')
+
+	// Go doesn't send SNI for IP addresses, and the ALPN protocol is unset
+	if fp := <-fingerprints; !strings.HasPrefix(fp, "t13i") || !strings.Contains(fp, "00_") {
+		t.Errorf("TLSFingerprint() = %q, want a TLS 1.3 fingerprint without SNI and ALPN", fp)
+	}
+}
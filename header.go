@@ -0,0 +1,66 @@
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/textproto"
+)
+
+// MessageHeader contains the header fields commonly needed by delivery agents.
+type MessageHeader struct {
+	MessageID string
+	From      string
+	Subject   string
+
+	// The header is larger than the limit passed to PeekHeader, fields
+	// past the limit are missing.
+	Truncated bool
+}
+
+// PeekHeader reads the header of the message from r, reading at most about
+// maxBytes. It returns the parsed header fields and a reader which yields the
+// whole message, including the bytes already consumed.
+//
+// Read errors are not returned by PeekHeader, they are returned by the
+// returned reader instead.
+func PeekHeader(r io.Reader, maxBytes int) (*MessageHeader, io.Reader) {
+	br := bufio.NewReader(r)
+	buf, fields, truncated := readHeader(br, maxBytes)
+
+	hdr := &MessageHeader{
+		MessageID: fields.Get("Message-Id"),
+		From:      fields.Get("From"),
+		Subject:   fields.Get("Subject"),
+		Truncated: truncated,
+	}
+	return hdr, io.MultiReader(buf, br)
+}
+
+// readHeader reads the header of the message from br, reading at most about
+// maxBytes. It returns the bytes consumed and the parsed header fields.
+func readHeader(br *bufio.Reader, maxBytes int) (buf *bytes.Buffer, fields textproto.MIMEHeader, truncated bool) {
+	buf = new(bytes.Buffer)
+	truncated = true
+	for buf.Len() < maxBytes {
+		line, err := br.ReadSlice('\n')
+		buf.Write(line)
+		if err == bufio.ErrBufferFull {
+			continue
+		} else if err != nil {
+			truncated = false
+			break
+		}
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			truncated = false
+			break
+		}
+	}
+
+	// ReadMIMEHeader returns the fields parsed before any error
+	fields, _ = textproto.NewReader(bufio.NewReader(bytes.NewReader(buf.Bytes()))).ReadMIMEHeader()
+	if fields == nil {
+		fields = make(textproto.MIMEHeader)
+	}
+	return buf, fields, truncated
+}
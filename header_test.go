@@ -0,0 +1,57 @@
+package smtp
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestPeekHeader(t *testing.T) {
+	tests := []struct {
+		name     string
+		msg      string
+		maxBytes int
+		want     MessageHeader
+	}{
+		{
+			name:     "complete",
+			msg:      "From: root@nsa.gov\r\nSubject: Hey\r\nMessage-ID: <42@nsa.gov>\r\n\r\nBody\r\n",
+			maxBytes: 1024,
+			want:     MessageHeader{MessageID: "<42@nsa.gov>", From: "root@nsa.gov", Subject: "Hey"},
+		},
+		{
+			name:     "bare LF",
+			msg:      "Subject: Hey\n\nFrom: not a header field\n",
+			maxBytes: 1024,
+			want:     MessageHeader{Subject: "Hey"},
+		},
+		{
+			name:     "no body",
+			msg:      "Subject: Hey\r\n",
+			maxBytes: 1024,
+			want:     MessageHeader{Subject: "Hey"},
+		},
+		{
+			name:     "truncated",
+			msg:      "Subject: Hey\r\nX-Padding: " + strings.Repeat("a", 100) + "\r\nFrom: root@nsa.gov\r\n\r\n",
+			maxBytes: 64,
+			want:     MessageHeader{Subject: "Hey", Truncated: true},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			hdr, r := PeekHeader(strings.NewReader(tc.msg), tc.maxBytes)
+			if *hdr != tc.want {
+				t.Errorf("PeekHeader() = %+v, want %+v", *hdr, tc.want)
+			}
+			b, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tc.msg {
+				t.Errorf("Message altered: got %q, want %q", string(b), tc.msg)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package smtp
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+)
+
+// HealthStatus describes the state of a server, see Server.Health.
+type HealthStatus struct {
+	// Addresses of the listeners passed to Serve.
+	Listeners []string `json:"listeners"`
+	// Number of connections being handled, and waiting for a per-IP slot
+	// (see Server.MaxConnsPerIP).
+	ActiveConns int `json:"active_conns"`
+	QueuedConns int `json:"queued_conns"`
+	// Whether Server.DrainConns has been called.
+	Draining bool `json:"draining"`
+	// Whether Server.Close or Server.Shutdown has been called.
+	Closed bool `json:"closed"`
+}
+
+// Ready reports whether the server accepts new sessions: it's serving at
+// least one listener, and isn't draining or closed.
+func (st *HealthStatus) Ready() bool {
+	return len(st.Listeners) > 0 && !st.Draining && !st.Closed
+}
+
+// Health returns the current state of the server.
+func (s *Server) Health() *HealthStatus {
+	st := &HealthStatus{Listeners: []string{}}
+
+	select {
+	case <-s.done:
+		st.Closed = true
+	default:
+	}
+
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	for _, l := range s.listeners {
+		st.Listeners = append(st.Listeners, l.Addr().String())
+	}
+	st.ActiveConns = len(s.conns)
+	st.QueuedConns = s.queued
+	st.Draining = s.draining
+	return st
+}
+
+// HealthHandler returns an HTTP handler for liveness and readiness probes,
+// e.g. from Kubernetes. It serves:
+//
+//   - /healthz: liveness, with a 200 status unless the server is closed,
+//   - /readyz: readiness, with a 200 status if HealthStatus.Ready is true.
+//
+// A 503 status is returned otherwise. The body is the HealthStatus, encoded
+// as JSON.
+func (s *Server) HealthHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		st := s.Health()
+		writeHealth(w, st, !st.Closed)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		st := s.Health()
+		writeHealth(w, st, st.Ready())
+	})
+	return mux
+}
+
+func writeHealth(w http.ResponseWriter, st *HealthStatus, ok bool) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(st)
+}
+
+// ListenHealth listens on the TCP network address addr and serves
+// HealthHandler. It returns nil once the server is closed and its
+// connections are done, so that probes keep being answered during Shutdown.
+func (s *Server) ListenHealth(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	hs := &http.Server{Handler: s.HealthHandler()}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-s.done:
+			s.wg.Wait()
+			hs.Close()
+		case <-stop:
+		}
+	}()
+
+	if err := hs.Serve(l); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
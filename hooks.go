@@ -0,0 +1,152 @@
+package smtp
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+// ClientHooks are called at milestones of the lifecycle of a Client, e.g. to
+// record metrics or traces per provider. All fields are optional.
+//
+// The greeting, the STARTTLS handshake and AUTH EXTERNAL happen before the
+// caller can set Client.Hooks when using DialStartTLS, NewClientStartTLS or
+// DialTLSExternal. These events are recorded and reported when the next
+// command is issued.
+type ClientHooks struct {
+	// Called once the server greeting has been read.
+	OnConnect func(info *ConnectInfo)
+	// Called once the TLS handshake following STARTTLS is done.
+	OnTLS func(info *TLSInfo)
+	// Called at the end of each AUTH exchange.
+	OnAuth func(info *AuthInfo)
+	// Called once the server has replied to the end of the message data, or
+	// sending it failed.
+	OnMessageSent func(info *MessageSentInfo)
+}
+
+// ConnectInfo describes the start of a session, see ClientHooks.OnConnect.
+type ConnectInfo struct {
+	RemoteAddr net.Addr
+	// Text of the greeting, lines are separated by "\n".
+	Greeting string
+	// Time between connecting (or creating the client with NewClient) and
+	// reading the greeting. The greeting is read before the first command.
+	Duration time.Duration
+	// Error returned for the greeting, nil if the server is ready.
+	Err error
+}
+
+// TLSInfo describes a STARTTLS negotiation, see ClientHooks.OnTLS.
+type TLSInfo struct {
+	// Zero if the handshake failed.
+	State tls.ConnectionState
+	// Time between sending the STARTTLS command and the end of the handshake.
+	Duration time.Duration
+	Err      error
+}
+
+// AuthInfo describes an AUTH exchange, see ClientHooks.OnAuth.
+type AuthInfo struct {
+	Mechanism string
+	// Time between sending the AUTH command and reading the last reply.
+	Duration time.Duration
+	Err      error
+}
+
+// MessageSentInfo describes a message transfer, see
+// ClientHooks.OnMessageSent.
+type MessageSentInfo struct {
+	From string
+	// Recipients accepted by the server.
+	Recipients []string
+	// Number of bytes of message data written by the caller.
+	Size int64
+	// Time between sending the MAIL command and reading the reply to the end
+	// of the message data.
+	Duration time.Duration
+	// Text of the reply to the end of the message data. Empty for LMTP, see
+	// LMTPData for the replies per recipient.
+	Response string
+	Err      error
+}
+
+// emitHook calls f with Client.Hooks, or records it until Hooks is set.
+func (c *Client) emitHook(f func(h *ClientHooks)) {
+	if c.Hooks == nil {
+		c.pendingHooks = append(c.pendingHooks, f)
+		return
+	}
+	f(c.Hooks)
+}
+
+// flushHooks reports the events recorded before Client.Hooks was set.
+func (c *Client) flushHooks() {
+	if c.Hooks == nil || len(c.pendingHooks) == 0 {
+		return
+	}
+	pending := c.pendingHooks
+	c.pendingHooks = nil
+	for _, f := range pending {
+		f(c.Hooks)
+	}
+}
+
+func (c *Client) connectDone(start time.Time, greeting string, err error) {
+	info := &ConnectInfo{
+		RemoteAddr: c.conn.RemoteAddr(),
+		Greeting:   greeting,
+		Duration:   time.Since(start),
+		Err:        err,
+	}
+	c.emitHook(func(h *ClientHooks) {
+		if h.OnConnect != nil {
+			h.OnConnect(info)
+		}
+	})
+}
+
+func (c *Client) tlsDone(start time.Time, err error) {
+	info := &TLSInfo{Duration: time.Since(start), Err: err}
+	if err == nil {
+		info.State, _ = c.TLSConnectionState()
+	}
+	c.emitHook(func(h *ClientHooks) {
+		if h.OnTLS != nil {
+			h.OnTLS(info)
+		}
+	})
+}
+
+func (c *Client) authDone(mech string, start time.Time, err error) {
+	info := &AuthInfo{
+		Mechanism: mech,
+		Duration:  time.Since(start),
+		Err:       err,
+	}
+	c.emitHook(func(h *ClientHooks) {
+		if h.OnAuth != nil {
+			h.OnAuth(info)
+		}
+	})
+}
+
+// messageSent isn't recorded until Client.Hooks is set, to avoid piling up
+// events for clients without hooks.
+func (c *Client) messageSent(size int64, response string, err error) {
+	if c.Hooks == nil || c.Hooks.OnMessageSent == nil {
+		return
+	}
+	rcpts := make([]string, len(c.txStatus.Accepted))
+	for i, st := range c.txStatus.Accepted {
+		rcpts[i] = st.Addr
+	}
+	c.Hooks.OnMessageSent(&MessageSentInfo{
+		From:       c.txFrom,
+		Recipients: rcpts,
+		Size:       size,
+		Duration:   time.Since(c.txStart),
+		Response:   response,
+		Err:        err,
+	})
+}
@@ -0,0 +1,158 @@
+package smtp
+
+import (
+	"errors"
+	"fmt"
+	"net/textproto"
+	"sync"
+	"time"
+)
+
+// StartIdleMonitor starts watching the connection while no command is in
+// progress. Servers may send a reply without being asked to, e.g. a 421
+// reply before closing an idle connection; without the monitor, it's only
+// read as the reply to the next command.
+//
+// When the monitor reads such a reply, or when the connection is closed by
+// the server, the client is marked as broken: the error is sent on the
+// returned channel, is returned by Err and by all further commands, and the
+// connection is closed. An unsolicited reply is returned as an *SMTPError.
+//
+// StartIdleMonitor greets the server first if needed. The monitor stops when
+// the client is closed. It can't be used with Compress.
+func (c *Client) StartIdleMonitor() (<-chan error, error) {
+	if err := c.hello(); err != nil {
+		return nil, err
+	}
+	if err := c.acquire(); err != nil {
+		return nil, err
+	}
+	defer c.release()
+
+	if c.idle != nil {
+		return nil, errors.New("smtp: idle monitor already started")
+	}
+	if _, ok := c.conn.(*compressConn); ok {
+		// Interrupting reads would break the DEFLATE stream
+		return nil, errors.New("smtp: idle monitor can't be used with compression")
+	}
+	m := &idleMonitor{c: c, done: make(chan error, 1)}
+	m.cond = sync.NewCond(&m.mu)
+	// Paused until the client is released
+	m.active = 1
+	c.idle = m
+
+	go m.run()
+	return m.done, nil
+}
+
+// Err returns the error which broke the connection while it was idle, see
+// StartIdleMonitor. It returns nil if the idle monitor isn't running or
+// hasn't detected anything.
+func (c *Client) Err() error {
+	if c.idle == nil {
+		return nil
+	}
+	c.idle.mu.Lock()
+	defer c.idle.mu.Unlock()
+	return c.idle.err
+}
+
+// idleMonitor reads the connection while the client is idle, see
+// StartIdleMonitor. Commands pause it with pause, and resume it with resume
+// once done.
+type idleMonitor struct {
+	c    *Client
+	done chan error
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	active  int  // number of callers which have paused the monitor
+	reading bool // whether the monitor is waiting for data
+	closed  bool
+	err     error
+}
+
+func (m *idleMonitor) run() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	defer close(m.done)
+
+	for {
+		for m.active > 0 && !m.closed {
+			m.cond.Wait()
+		}
+		if m.closed {
+			return
+		}
+
+		m.reading = true
+		m.mu.Unlock()
+		m.c.conn.SetReadDeadline(time.Time{})
+		_, err := m.c.text.R.Peek(1)
+		m.mu.Lock()
+		m.reading = false
+		m.cond.Broadcast()
+
+		if m.closed {
+			return
+		}
+		if m.active > 0 {
+			// Interrupted by a command, or the reply to a command arrived
+			// at the same time
+			continue
+		}
+
+		if err == nil {
+			code, msg, readErr := m.c.readResponse(0)
+			if readErr == nil {
+				err = toSMTPErr(&textproto.Error{Code: code, Msg: msg})
+			} else {
+				err = readErr
+			}
+		}
+		if _, ok := err.(*SMTPError); !ok {
+			err = fmt.Errorf("smtp: connection broken while idle: %w", err)
+		}
+		m.err = err
+		m.closed = true
+		m.c.text.Close()
+		m.done <- err
+		return
+	}
+}
+
+// pause stops the monitor from reading the connection until resume is
+// called. It returns the error which broke the connection, if any.
+func (m *idleMonitor) pause() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.active++
+	if m.reading {
+		// Interrupt the read
+		m.c.conn.SetReadDeadline(time.Unix(1, 0))
+		for m.reading {
+			m.cond.Wait()
+		}
+		m.c.conn.SetReadDeadline(time.Time{})
+	}
+	return m.err
+}
+
+func (m *idleMonitor) resume() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.active--
+	m.cond.Broadcast()
+}
+
+// close stops the monitor.
+func (m *idleMonitor) close() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.closed = true
+	m.cond.Broadcast()
+}
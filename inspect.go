@@ -0,0 +1,128 @@
+package smtp
+
+import (
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// DataInspector inspects the message data while it's received, see
+// Server.DataInspectors. For instance, DKIM signatures can be verified with
+// github.com/emersion/go-msgauth/dkim:
+//
+//	s.DataInspectors = []smtp.DataInspector{{
+//		Name: "dkim",
+//		Inspect: func(c *smtp.Conn, tx *smtp.Transaction, r io.Reader) (interface{}, error) {
+//			return dkim.Verify(r)
+//		},
+//	}}
+//
+// The backend can then get the []*dkim.Verification from
+// Transaction.Inspections. The examples/dkiminspect module ships this
+// inspector.
+type DataInspector struct {
+	// Name of the inspector, used to look up its result, e.g. "dkim".
+	Name string
+	// Called in a separate goroutine when the message data starts. It reads
+	// the message data from r, as sent by the client, while the backend reads
+	// it too, and returns the result. r returns io.EOF at the end of the
+	// message data, and ErrDataReset if the transaction is aborted before,
+	// e.g. because the backend has rejected the message.
+	Inspect func(c *Conn, tx *Transaction, r io.Reader) (interface{}, error)
+}
+
+// InspectionResults holds the results of Server.DataInspectors for a
+// transaction.
+//
+// The results are final once the message data reader passed to the backend
+// has returned io.EOF: it waits for all inspectors to be done.
+type InspectionResults struct {
+	mu      sync.Mutex
+	results map[string]*InspectionResult
+}
+
+// InspectionResult is the result of a DataInspector.
+type InspectionResult struct {
+	Value interface{}
+	Err   error
+}
+
+// Get returns the result of the inspector named name, or nil if it isn't
+// available.
+func (ir *InspectionResults) Get(name string) *InspectionResult {
+	ir.mu.Lock()
+	defer ir.mu.Unlock()
+	return ir.results[name]
+}
+
+func (ir *InspectionResults) set(name string, result *InspectionResult) {
+	ir.mu.Lock()
+	defer ir.mu.Unlock()
+	ir.results[name] = result
+}
+
+// inspectingReader feeds the message data to Server.DataInspectors as it's
+// read.
+type inspectingReader struct {
+	r     io.Reader
+	pipes []*io.PipeWriter
+	wg    sync.WaitGroup
+}
+
+// inspectData starts Server.DataInspectors, and returns a reader feeding
+// them the message data. The inspectors are aborted by reset.
+func (c *Conn) inspectData(tx *Transaction, r io.Reader) io.Reader {
+	results := &InspectionResults{results: make(map[string]*InspectionResult)}
+	tx.Inspections = results
+
+	ir := &inspectingReader{r: r}
+	for _, inspector := range c.server.DataInspectors {
+		pr, pw := io.Pipe()
+		ir.pipes = append(ir.pipes, pw)
+		ir.wg.Add(1)
+		go func(inspector DataInspector) {
+			defer ir.wg.Done()
+			// Let the other inspectors and the backend progress
+			defer io.Copy(ioutil.Discard, pr)
+			defer func() {
+				if err := recover(); err != nil {
+					c.handlePanic(err, nil)
+					results.set(inspector.Name, &InspectionResult{Err: errPanic})
+				}
+			}()
+
+			value, err := inspector.Inspect(c, tx, pr)
+			results.set(inspector.Name, &InspectionResult{Value: value, Err: err})
+		}(inspector)
+	}
+
+	c.locker.Lock()
+	c.inspection = ir
+	c.locker.Unlock()
+	return ir
+}
+
+func (ir *inspectingReader) Read(b []byte) (int, error) {
+	n, err := ir.r.Read(b)
+	if n > 0 {
+		for _, pw := range ir.pipes {
+			pw.Write(b[:n])
+		}
+	}
+	if err == io.EOF {
+		for _, pw := range ir.pipes {
+			pw.Close()
+		}
+		ir.wg.Wait()
+	} else if err != nil {
+		ir.abort(err)
+	}
+	return n, err
+}
+
+// abort stops feeding the inspectors, which read err.
+func (ir *inspectingReader) abort(err error) {
+	for _, pw := range ir.pipes {
+		pw.CloseWithError(err)
+	}
+}
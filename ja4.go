@@ -0,0 +1,148 @@
+//go:build go1.24
+// +build go1.24
+
+package smtp
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// JA4Fingerprint computes the JA4 fingerprint of a TLS ClientHello, e.g.
+// "t13d1516h2_8daaf6152771_e5627efa2ab1". Fingerprints identify TLS client
+// implementations, which helps to detect bots pretending to be well-known
+// MTAs.
+//
+// It can be called from tls.Config.GetConfigForClient, see
+// Server.FingerprintTLS. It requires Go 1.24, which exposes the extensions of
+// the ClientHello.
+func JA4Fingerprint(hello *tls.ClientHelloInfo) string {
+	var version uint16
+	for _, v := range hello.SupportedVersions {
+		if !isGREASE(v) && v > version {
+			version = v
+		}
+	}
+	var versionStr string
+	switch version {
+	case tls.VersionTLS13:
+		versionStr = "13"
+	case tls.VersionTLS12:
+		versionStr = "12"
+	case tls.VersionTLS11:
+		versionStr = "11"
+	case tls.VersionTLS10:
+		versionStr = "10"
+	case 0x0300: // SSL 3.0
+		versionStr = "s3"
+	default:
+		versionStr = "00"
+	}
+
+	sni := "i"
+	if hello.ServerName != "" {
+		sni = "d"
+	}
+
+	var ciphers []string
+	for _, id := range hello.CipherSuites {
+		if !isGREASE(id) {
+			ciphers = append(ciphers, fmt.Sprintf("%04x", id))
+		}
+	}
+	var exts []string
+	numExts := 0
+	for _, id := range hello.Extensions {
+		if isGREASE(id) {
+			continue
+		}
+		numExts++
+		// The server name and ALPN extensions are counted, but not hashed
+		if id != 0x0000 && id != 0x0010 {
+			exts = append(exts, fmt.Sprintf("%04x", id))
+		}
+	}
+
+	alpn := "00"
+	if len(hello.SupportedProtos) > 0 && hello.SupportedProtos[0] != "" {
+		alpn = ja4ALPN(hello.SupportedProtos[0])
+	}
+
+	a := fmt.Sprintf("t%v%v%02d%02d%v", versionStr, sni, min99(len(ciphers)), min99(numExts), alpn)
+
+	sort.Strings(ciphers)
+	b := ja4Hash(strings.Join(ciphers, ","))
+
+	sort.Strings(exts)
+	c := strings.Join(exts, ",")
+	if len(hello.SignatureSchemes) > 0 {
+		var sigs []string
+		for _, id := range hello.SignatureSchemes {
+			if !isGREASE(uint16(id)) {
+				sigs = append(sigs, fmt.Sprintf("%04x", uint16(id)))
+			}
+		}
+		c += "_" + strings.Join(sigs, ",")
+	}
+	if len(exts) == 0 {
+		c = ""
+	}
+
+	return a + "_" + b + "_" + ja4Hash(c)
+}
+
+// isGREASE reports whether a value is reserved by GREASE (RFC 8701).
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func min99(n int) int {
+	if n > 99 {
+		return 99
+	}
+	return n
+}
+
+// ja4ALPN returns the first and last characters of an ALPN protocol ID, or
+// of its hexadecimal form if they aren't alphanumeric.
+func ja4ALPN(proto string) string {
+	first, last := proto[0], proto[len(proto)-1]
+	if isAlphanumeric(first) && isAlphanumeric(last) {
+		return string([]byte{first, last})
+	}
+	h := hex.EncodeToString([]byte(proto))
+	return string([]byte{h[0], h[len(h)-1]})
+}
+
+func isAlphanumeric(ch byte) bool {
+	return ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= '0' && ch <= '9'
+}
+
+// ja4Hash returns the first 12 hexadecimal characters of the SHA-256 hash of
+// s, or zeros if s is empty.
+func ja4Hash(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// fingerprintTLSConfig returns a copy of config recording the JA4
+// fingerprint of ClientHello messages, see Server.FingerprintTLS.
+func (s *Server) fingerprintTLSConfig(config *tls.Config) *tls.Config {
+	config = config.Clone()
+	getConfigForClient := config.GetConfigForClient
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		s.tlsFingerprints.Store(hello.Conn, JA4Fingerprint(hello))
+		if getConfigForClient != nil {
+			return getConfigForClient(hello)
+		}
+		return nil, nil
+	}
+	return config
+}
@@ -0,0 +1,14 @@
+//go:build !go1.24
+// +build !go1.24
+
+package smtp
+
+import (
+	"crypto/tls"
+)
+
+// fingerprintTLSConfig returns config: the extensions of the ClientHello
+// needed by JA4 fingerprints are only exposed since Go 1.24.
+func (s *Server) fingerprintTLSConfig(config *tls.Config) *tls.Config {
+	return config
+}
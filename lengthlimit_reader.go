@@ -1,6 +1,7 @@
 package smtp
 
 import (
+	"bytes"
 	"errors"
 	"io"
 )
@@ -16,32 +17,86 @@ type lineLimitReader struct {
 	LineLimit int
 
 	curLineLength int
+	// Whether the last byte returned wasn't a line feed
+	midLine bool
+	// Whether the beginning of the too long line has been returned
+	cut bool
+	// Data read from R but not returned yet: the beginning of a too long
+	// line and what follows it
+	pending []byte
+}
+
+// tooLong reports whether the line limit has been exceeded. Reading fails
+// until discardLine is called.
+func (r *lineLimitReader) tooLong() bool {
+	return r.curLineLength > r.LineLimit && r.LineLimit > 0
 }
 
 func (r *lineLimitReader) Read(b []byte) (int, error) {
-	if r.curLineLength > r.LineLimit && r.LineLimit > 0 {
+	if r.tooLong() {
 		return 0, ErrTooLongLine
 	}
 
-	n, err := r.R.Read(b)
-	if err != nil {
-		return n, err
+	var n int
+	if len(r.pending) > 0 {
+		n = copy(b, r.pending)
+		r.pending = r.pending[n:]
+	} else {
+		var err error
+		n, err = r.R.Read(b)
+		if err != nil {
+			return n, err
+		}
 	}
 
 	if r.LineLimit == 0 {
 		return n, nil
 	}
 
-	for _, chr := range b[:n] {
+	lineStart := 0
+	for i, chr := range b[:n] {
 		if chr == '\n' {
 			r.curLineLength = 0
+			lineStart = i + 1
 		}
 		r.curLineLength++
 
 		if r.curLineLength > r.LineLimit {
-			return 0, ErrTooLongLine
+			// Return the complete lines preceding the too long one, and keep
+			// the rest for discardLine
+			r.pending = append(append([]byte(nil), b[lineStart:n]...), r.pending...)
+			if lineStart == 0 {
+				r.cut = r.midLine
+				return 0, ErrTooLongLine
+			}
+			r.cut = false
+			return lineStart, nil
 		}
 	}
 
+	if n > 0 {
+		r.midLine = b[n-1] != '\n'
+	}
 	return n, nil
 }
+
+// discardLine skips the rest of a too long line, so that reading can resume
+// with the next line.
+func (r *lineLimitReader) discardLine() error {
+	for {
+		if i := bytes.IndexByte(r.pending, '\n'); i >= 0 {
+			r.pending = r.pending[i+1:]
+			r.curLineLength = 0
+			r.midLine = false
+			r.cut = false
+			return nil
+		}
+
+		buf := make([]byte, 4096)
+		n, err := r.R.Read(buf)
+		r.pending = buf[:n]
+		if n == 0 && err != nil {
+			return err
+		}
+	}
+}
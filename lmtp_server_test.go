@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"errors"
 	"io"
+	"log"
 	"net"
 	"strings"
 	"testing"
@@ -207,3 +208,145 @@ func TestServer_LMTP_DuplicatedRcpt(t *testing.T) {
 		t.Fatal("Invalid number of sent messages:", be.messages, be.anonmsgs)
 	}
 }
+
+func TestSendMailLMTP(t *testing.T) {
+	be, s, c, _ := testServer(t, func(s *smtp.Server) {
+		s.LMTP = true
+		be := s.Backend.(*backend)
+		be.implementLMTPData = true
+		be.lmtpStatus = []struct {
+			addr string
+			err  error
+		}{
+			{"root@gchq.gov.uk", &smtp.SMTPError{Code: 552, Message: "Mailbox full"}},
+			{"root@bnd.bund.de", nil},
+		}
+	})
+	defer s.Close()
+	c.Close()
+
+	status, err := smtp.SendMailLMTP("tcp", c.RemoteAddr().String(), "root@nsa.gov", []string{"root@gchq.gov.uk", "root@bnd.bund.de"}, strings.NewReader("Hey <3\r\n"))
+	if err != nil {
+		t.Fatal("SendMailLMTP failed:", err)
+	}
+	if len(status) != 2 {
+		t.Fatal("Invalid status map:", status)
+	}
+	var smtpErr *smtp.SMTPError
+	if !errors.As(status["root@gchq.gov.uk"], &smtpErr) || smtpErr.Code != 552 {
+		t.Fatal("Invalid status for first recipient:", status["root@gchq.gov.uk"])
+	}
+	if err, ok := status["root@bnd.bund.de"]; !ok || err != nil {
+		t.Fatal("Invalid status for second recipient:", err)
+	}
+	if len(be.anonmsgs) != 1 || string(be.anonmsgs[0].Data) != "Hey <3\r\n" {
+		t.Fatal("Invalid message:", be.anonmsgs)
+	}
+}
+
+func TestServer_LMTP_StatusMismatch(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		errorLog := new(lockedBuffer)
+		_, s, c, scanner := testServerGreetedLMTP(t, func(s *smtp.Server) {
+			s.LMTP = true
+			s.StrictLMTPStatus = strict
+			s.ErrorLog = log.New(errorLog, "", 0)
+			be := s.Backend.(*backend)
+			be.implementLMTPData = true
+			be.lmtpStatus = []struct {
+				addr string
+				err  error
+			}{
+				{"root@gchq.gov.uk", nil},
+				{"root@example.org", nil},
+				{"root@bnd.bund.de", nil},
+			}
+		})
+
+		sendDeliveryCmdsLMTP(t, scanner, c)
+
+		want := []string{"250 ", "554 5.0.0 <root@bnd.bund.de>"}
+		if strict {
+			// The panic fails the remaining recipients and closes the
+			// connection
+			want = []string{"250 ", "421 "}
+		}
+		for _, w := range want {
+			scanner.Scan()
+			if !strings.HasPrefix(scanner.Text(), w) {
+				t.Errorf("Invalid DATA response (strict: %v): got %q, want %q", strict, scanner.Text(), w)
+			}
+		}
+
+		c.Close()
+		s.Close()
+
+		if !strings.Contains(errorLog.String(), `"root@example.org"`) {
+			t.Errorf("Mismatch not logged (strict: %v): %q", strict, errorLog.String())
+		}
+	}
+}
+
+type lmtpStatusTextSession struct {
+	smtp.LMTPSession
+}
+
+func (s lmtpStatusTextSession) LMTPStatusText(status *smtp.LMTPStatus) string {
+	if status.OriginalRecipient == "" {
+		return "<" + status.Rcpt + "> " + status.Message
+	}
+	return "<" + status.OriginalRecipient + "> via <" + status.Rcpt + "> " + status.Message
+}
+
+func TestServer_LMTP_OriginalRecipient(t *testing.T) {
+	_, s, c, scanner := testServerGreetedLMTP(t, func(s *smtp.Server) {
+		s.LMTP = true
+		s.EnableDSN = true
+		be := s.Backend.(*backend)
+		be.implementLMTPData = true
+		be.lmtpStatus = []struct {
+			addr string
+			err  error
+		}{
+			{"bob@example.org", errors.New("nah")},
+			{"root@example.org", nil},
+			{"root@example.org", nil},
+		}
+		s.Backend = smtp.BackendFunc(func(c *smtp.Conn) (smtp.Session, error) {
+			session, err := be.NewSession(c)
+			if err != nil {
+				return nil, err
+			}
+			return lmtpStatusTextSession{session.(smtp.LMTPSession)}, nil
+		})
+	})
+	defer s.Close()
+	defer c.Close()
+
+	sendLHLO(t, scanner, c)
+	for _, cmd := range []string{
+		"MAIL FROM:<root@nsa.gov>",
+		"RCPT TO:<root@example.org> ORCPT=rfc822;alice@example.org",
+		"RCPT TO:<root@example.org> ORCPT=rfc822;bob@example.org",
+		"RCPT TO:<root@example.org>",
+		"DATA",
+	} {
+		io.WriteString(c, cmd+"\r\n")
+		scanner.Scan()
+	}
+	io.WriteString(c, "Hey <3\r\n.\r\n")
+
+	// The status set by ORCPT goes to the matching recipient, the ones set
+	// by forward-path to the other recipients in order
+	want := []string{
+		"250 2.0.0 <alice@example.org> via <root@example.org> OK: queued",
+		"554 5.0.0 <bob@example.org> via <root@example.org> Error: transaction failed: nah",
+		"250 2.0.0 <root@example.org> OK: queued",
+	}
+	for _, w := range want {
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), w) {
+			t.Errorf("Invalid DATA response: got %q, want %q", scanner.Text(), w)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package smtp
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// How long names found by Client.AutoLocalName are cached
+	localNameTTL = time.Hour
+	// How long failed lookups are cached
+	localNameFailureTTL = 5 * time.Minute
+	// Timeout of reverse DNS lookups
+	localNameLookupTimeout = 5 * time.Second
+)
+
+// lookupAddr performs reverse DNS lookups. It's replaced in tests.
+var lookupAddr = net.DefaultResolver.LookupAddr
+
+type localNameEntry struct {
+	name    string
+	expires time.Time
+}
+
+// localNameCache caches the names found by Client.AutoLocalName, by IP
+// address.
+var localNameCache struct {
+	sync.Mutex
+	entries map[string]localNameEntry
+}
+
+// localNameForAddr returns the name to send in HELO/EHLO/LHLO for a local
+// address: the first name found by a reverse DNS lookup, or the address
+// literal if there is none. An empty string is returned if addr isn't a TCP
+// address.
+func localNameForAddr(addr net.Addr) string {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return ""
+	}
+	ip := tcpAddr.IP.String()
+	now := time.Now()
+
+	localNameCache.Lock()
+	entry, ok := localNameCache.entries[ip]
+	localNameCache.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.name
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), localNameLookupTimeout)
+	defer cancel()
+	entry = localNameEntry{
+		name:    addressLiteral(addr),
+		expires: now.Add(localNameFailureTTL),
+	}
+	if names, err := lookupAddr(ctx, ip); err == nil {
+		for _, name := range names {
+			name = strings.TrimSuffix(name, ".")
+			if name != "" && !strings.ContainsAny(name, " \t\r\n") {
+				entry = localNameEntry{name: name, expires: now.Add(localNameTTL)}
+				break
+			}
+		}
+	}
+
+	localNameCache.Lock()
+	if localNameCache.entries == nil {
+		localNameCache.entries = make(map[string]localNameEntry)
+	}
+	localNameCache.entries[ip] = entry
+	localNameCache.Unlock()
+
+	return entry.name
+}
@@ -0,0 +1,53 @@
+package smtp
+
+import (
+	"github.com/emersion/go-sasl"
+)
+
+// LoginAuthenticator checks the credentials received with the LOGIN
+// mechanism. The returned error is sent to the client, an *SMTPError can be
+// used to customize the reply.
+type LoginAuthenticator func(username, password string) error
+
+type loginState int
+
+const (
+	loginWaitingUsername loginState = iota
+	loginWaitingPassword
+	loginDone
+)
+
+type loginServer struct {
+	state        loginState
+	username     string
+	authenticate LoginAuthenticator
+}
+
+// NewLoginServer returns a server implementation of the obsolete LOGIN
+// mechanism, as described in draft-murchison-sasl-login. It can be returned
+// by AuthSession.Auth for legacy clients, such as old versions of Outlook,
+// which don't support PLAIN.
+//
+// The client is prompted with "Username:" and "Password:", unless it sends
+// the username as an initial response.
+func NewLoginServer(authenticate LoginAuthenticator) sasl.Server {
+	return &loginServer{authenticate: authenticate}
+}
+
+func (a *loginServer) Next(response []byte) (challenge []byte, done bool, err error) {
+	switch a.state {
+	case loginWaitingUsername:
+		if response == nil {
+			// No initial response
+			return []byte("Username:"), false, nil
+		}
+		a.username = string(response)
+		a.state = loginWaitingPassword
+		return []byte("Password:"), false, nil
+	case loginWaitingPassword:
+		a.state = loginDone
+		return nil, true, a.authenticate(a.username, string(response))
+	default:
+		return nil, false, sasl.ErrUnexpectedClientResponse
+	}
+}
@@ -0,0 +1,72 @@
+package smtp
+
+import (
+	"sync/atomic"
+)
+
+const (
+	// Size of the buffers of the textproto reader and writer of a
+	// connection, including the queued replies
+	connBufferSize = 2 * 4096
+	// Approximate size of the TLS record buffers of a connection
+	tlsBufferSize = 2 * (16*1024 + 512)
+	// Size of the buffer used to copy a BDAT chunk to the backend
+	bdatCopyBufferSize = 32 * 1024
+)
+
+// errInsufficientMemory is returned when the memory budget of a connection,
+// Server.MaxConnMemory, is exceeded.
+var errInsufficientMemory = &SMTPError{
+	Code:         452,
+	EnhancedCode: EnhancedCode{4, 3, 1},
+	Message:      "Insufficient system resources, try again later",
+}
+
+// MemoryUsage returns an estimate of the memory used by the buffers of all
+// connections, in bytes. See Server.MaxConnMemory.
+func (s *Server) MemoryUsage() int64 {
+	return atomic.LoadInt64(&s.memUsed)
+}
+
+// MemoryUsage returns an estimate of the memory used by the buffers of the
+// connection, in bytes. See Server.MaxConnMemory.
+func (c *Conn) MemoryUsage() int64 {
+	return atomic.LoadInt64(&c.memUsed)
+}
+
+// chargeMemory accounts for n bytes of memory, without checking the budget.
+func (c *Conn) chargeMemory(n int64) {
+	atomic.AddInt64(&c.memUsed, n)
+	atomic.AddInt64(&c.server.memUsed, n)
+}
+
+// reserveMemory accounts for n bytes of memory. It returns false, without
+// reserving anything, if it would exceed Server.MaxConnMemory.
+func (c *Conn) reserveMemory(n int64) bool {
+	if max := c.server.MaxConnMemory; max > 0 && atomic.LoadInt64(&c.memUsed)+n > max {
+		return false
+	}
+	c.chargeMemory(n)
+	return true
+}
+
+// releaseMemory releases n bytes of memory accounted with chargeMemory or
+// reserveMemory.
+func (c *Conn) releaseMemory(n int64) {
+	c.chargeMemory(-n)
+}
+
+// reserveDataMemory reserves n bytes of memory until the end of the mail
+// transaction.
+func (c *Conn) reserveDataMemory(n int64) bool {
+	if !c.reserveMemory(n) {
+		return false
+	}
+	atomic.AddInt64(&c.dataMemory, n)
+	return true
+}
+
+// releaseDataMemory releases the memory reserved with reserveDataMemory.
+func (c *Conn) releaseDataMemory() {
+	c.releaseMemory(atomic.SwapInt64(&c.dataMemory, 0))
+}
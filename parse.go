@@ -15,29 +15,25 @@ func cutPrefixFold(s, prefix string) (string, bool) {
 
 func parseCmd(line string) (cmd string, arg string, err error) {
 	line = strings.TrimRight(line, "\r\n")
-
-	l := len(line)
-	switch {
-	case strings.HasPrefix(strings.ToUpper(line), "STARTTLS"):
-		return "STARTTLS", "", nil
-	case l == 0:
+	if line == "" {
 		return "", "", nil
-	case l < 4:
-		return "", "", fmt.Errorf("command too short: %q", line)
-	case l == 4:
-		return strings.ToUpper(line), "", nil
-	case l == 5:
-		// Too long to be only command, too short to have args
-		return "", "", fmt.Errorf("mangled command: %q", line)
 	}
 
-	// If we made it here, command is long enough to have args
-	if line[4] != ' ' {
-		// There wasn't a space after the command?
-		return "", "", fmt.Errorf("mangled command: %q", line)
+	// The verb is everything up to the first space, arguments follow
+	cmd = line
+	if i := strings.IndexByte(line, ' '); i >= 0 {
+		cmd, arg = line[:i], strings.TrimSpace(line[i+1:])
+	}
+	for _, ch := range cmd {
+		if !(ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= '0' && ch <= '9' || ch == '-') {
+			return "", "", fmt.Errorf("mangled command: %q", line)
+		}
+	}
+	if len(cmd) < 4 {
+		return "", "", fmt.Errorf("command too short: %q", line)
 	}
 
-	return strings.ToUpper(line[0:4]), strings.TrimSpace(line[5:]), nil
+	return strings.ToUpper(cmd), arg, nil
 }
 
 // Takes the arguments proceeding a command and files them
@@ -122,6 +118,17 @@ func (p *parser) parseReversePath() (string, error) {
 	return p.parsePath()
 }
 
+// parseRaw calls f and returns its result along with the raw input it
+// consumed.
+func (p *parser) parseRaw(f func() (string, error)) (s, raw string, err error) {
+	before := p.s
+	s, err = f()
+	if err != nil {
+		return "", "", err
+	}
+	return s, before[:len(before)-len(p.s)], nil
+}
+
 func (p *parser) parsePath() (string, error) {
 	hasBracket := p.acceptByte('<')
 	if p.acceptByte('@') {
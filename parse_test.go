@@ -42,3 +42,40 @@ func TestParser(t *testing.T) {
 		}
 	}
 }
+
+func TestParseCmd(t *testing.T) {
+	valid := []struct {
+		line, cmd, arg string
+	}{
+		{"", "", ""},
+		{"QUIT", "QUIT", ""},
+		{"quit\r\n", "QUIT", ""},
+		{"MAIL FROM:<root@nsa.gov>", "MAIL", "FROM:<root@nsa.gov>"},
+		{"EHLO  localhost ", "EHLO", "localhost"},
+		{"STARTTLS", "STARTTLS", ""},
+		{"starttls", "STARTTLS", ""},
+		{"XCLIENT ADDR=192.0.2.1 NAME=mail.example.org", "XCLIENT", "ADDR=192.0.2.1 NAME=mail.example.org"},
+		{"XFORWARD HELO=example.org", "XFORWARD", "HELO=example.org"},
+		{"ATRN example.org", "ATRN", "example.org"},
+	}
+	for _, tc := range valid {
+		cmd, arg, err := parseCmd(tc.line)
+		if err != nil {
+			t.Errorf("parseCmd(%q) = %v", tc.line, err)
+		} else if cmd != tc.cmd || arg != tc.arg {
+			t.Errorf("parseCmd(%q) = %q, %q, want %q, %q", tc.line, cmd, arg, tc.cmd, tc.arg)
+		}
+	}
+
+	invalid := []string{
+		"HI",
+		"MAIL:FROM:<root@nsa.gov>",
+		" QUIT",
+		"NOOP\tfoo",
+	}
+	for _, tc := range invalid {
+		if cmd, _, err := parseCmd(tc); err == nil {
+			t.Errorf("parseCmd(%q) = %q, want error", tc, cmd)
+		}
+	}
+}
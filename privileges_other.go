@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package smtp
+
+import (
+	"errors"
+)
+
+// DropPrivileges switches the process to the user uid and the group gid. It
+// isn't supported on this platform.
+func DropPrivileges(uid, gid int) error {
+	return errors.New("smtp: dropping privileges is not supported on this platform")
+}
@@ -0,0 +1,38 @@
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+// +build linux darwin dragonfly freebsd netbsd openbsd
+
+package smtp
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// DropPrivileges switches the process to the user uid and the group gid,
+// clearing supplementary groups. It is meant to be called by daemons started
+// as root once their listeners are bound, e.g. on port 25.
+//
+// User and group IDs can be looked up with the os/user package. On Linux,
+// Go 1.16 or later is required for the change to apply to all threads.
+func DropPrivileges(uid, gid int) error {
+	if uid == 0 {
+		return fmt.Errorf("smtp: refusing to drop privileges to root")
+	}
+
+	// The group must be changed first, while we're still allowed to
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return fmt.Errorf("smtp: failed to set supplementary groups: %v", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("smtp: failed to set group ID: %v", err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("smtp: failed to set user ID: %v", err)
+	}
+
+	if os.Getuid() != uid || os.Geteuid() != uid || os.Getgid() != gid || os.Getegid() != gid {
+		return fmt.Errorf("smtp: failed to drop privileges")
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package smtp
+
+// Quota is used by servers to enforce per-user or per-domain sending limits.
+//
+// CheckSender is called for each MAIL command, before the backend's Session
+// is. identity is the authenticated identity (see Conn.AuthIdentity), empty
+// if the client isn't authenticated, from is the reverse-path.
+//
+// Returning a *QuotaError rejects the command with a 450 4.7.1 or 550 5.7.1
+// reply, depending on QuotaError.Temporary. Returning a *SMTPError sends it as
+// is, other errors are considered temporary.
+type Quota interface {
+	CheckSender(identity, from string) error
+}
+
+// QuotaError is returned by Quota.CheckSender when a sender exceeds its limits.
+type QuotaError struct {
+	// Temporary errors tell the client to retry later, for instance when a
+	// hourly limit is reached. Permanent errors make the client bounce the
+	// message.
+	Temporary bool
+	// Human-readable reply text. If empty, a default message is used.
+	Message string
+}
+
+func (err *QuotaError) Error() string {
+	if err.Message != "" {
+		return err.Message
+	}
+	if err.Temporary {
+		return "Sending rate limit exceeded, try again later"
+	}
+	return "Sending limit exceeded"
+}
+
+func (err *QuotaError) smtpError() *SMTPError {
+	if err.Temporary {
+		return &SMTPError{Code: 450, EnhancedCode: EnhancedCode{4, 7, 1}, Message: err.Error()}
+	}
+	return &SMTPError{Code: 550, EnhancedCode: EnhancedCode{5, 7, 1}, Message: err.Error()}
+}
@@ -0,0 +1,212 @@
+package smtp
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// RateLimitEvent is a kind of event limited by a RateLimiter.
+type RateLimitEvent int
+
+const (
+	// A command received from the client. Exceeding the limit closes the
+	// connection with a 421 reply.
+	RateLimitCommand RateLimitEvent = iota
+	// A failed AUTH exchange. Once the limit is exceeded, AUTH commands are
+	// rejected with a 421 reply and the connection is closed.
+	RateLimitAuthFailure
+	// A MAIL command. Exceeding the limit rejects the command with a 450
+	// reply.
+	RateLimitMail
+)
+
+func (ev RateLimitEvent) String() string {
+	switch ev {
+	case RateLimitCommand:
+		return "command"
+	case RateLimitAuthFailure:
+		return "auth-failure"
+	case RateLimitMail:
+		return "mail"
+	}
+	return "unknown"
+}
+
+// RateLimiter limits the rate of events per remote IP address, see
+// Server.RateLimiter. Connections which aren't over TCP aren't limited.
+//
+// Its methods are called concurrently from all connections, they should not
+// block.
+type RateLimiter interface {
+	// Allow records an event from ip at time now, and reports whether it's
+	// within the limits.
+	Allow(ip net.IP, ev RateLimitEvent, now time.Time) bool
+	// Limited reports whether an event from ip at time now would exceed the
+	// limits, without recording it.
+	Limited(ip net.IP, ev RateLimitEvent, now time.Time) bool
+}
+
+// RateLimit configures a token bucket: up to Burst events are allowed at
+// once, then Rate events per second on average.
+type RateLimit struct {
+	Rate float64
+	// Zero disables the limit.
+	Burst int
+}
+
+// TokenBucketLimiter is a RateLimiter using a token bucket per IP address
+// and kind of event. The zero value doesn't limit anything.
+type TokenBucketLimiter struct {
+	Commands     RateLimit
+	AuthFailures RateLimit
+	Mails        RateLimit
+
+	mu        sync.Mutex
+	buckets   map[rateLimitKey]*tokenBucket
+	lastSweep time.Time
+}
+
+var _ RateLimiter = (*TokenBucketLimiter)(nil)
+
+type rateLimitKey struct {
+	ip string
+	ev RateLimitEvent
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens earned since the last refill.
+func (b *tokenBucket) refill(limit RateLimit, now time.Time) {
+	elapsed := now.Sub(b.last).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+	b.tokens += elapsed * limit.Rate
+	if max := float64(limit.Burst); b.tokens > max {
+		b.tokens = max
+	}
+	b.last = now
+}
+
+// Allow implements RateLimiter.
+func (l *TokenBucketLimiter) Allow(ip net.IP, ev RateLimitEvent, now time.Time) bool {
+	return l.take(ip, ev, now, true)
+}
+
+// Limited implements RateLimiter.
+func (l *TokenBucketLimiter) Limited(ip net.IP, ev RateLimitEvent, now time.Time) bool {
+	return !l.take(ip, ev, now, false)
+}
+
+func (l *TokenBucketLimiter) limit(ev RateLimitEvent) RateLimit {
+	switch ev {
+	case RateLimitCommand:
+		return l.Commands
+	case RateLimitAuthFailure:
+		return l.AuthFailures
+	case RateLimitMail:
+		return l.Mails
+	}
+	return RateLimit{}
+}
+
+// take reports whether a token is available for an event, and consumes it if
+// consume is set.
+func (l *TokenBucketLimiter) take(ip net.IP, ev RateLimitEvent, now time.Time, consume bool) bool {
+	limit := l.limit(ev)
+	if limit.Burst <= 0 {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+
+	key := rateLimitKey{ip: ip.String(), ev: ev}
+	b := l.buckets[key]
+	if b == nil {
+		if !consume {
+			return true
+		}
+		if l.buckets == nil {
+			l.buckets = make(map[rateLimitKey]*tokenBucket)
+		}
+		b = &tokenBucket{tokens: float64(limit.Burst), last: now}
+		l.buckets[key] = b
+	}
+
+	b.refill(limit, now)
+	if b.tokens < 1 {
+		return false
+	}
+	if consume {
+		b.tokens--
+	}
+	return true
+}
+
+// sweep removes the full buckets once per minute, they behave like missing
+// ones. It must be called with l.mu held.
+func (l *TokenBucketLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+
+	for key, b := range l.buckets {
+		limit := l.limit(key.ev)
+		b.refill(limit, now)
+		if b.tokens >= float64(limit.Burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// remoteIP returns the IP address of the client, nil if the connection isn't
+// over TCP.
+func (c *Conn) remoteIP() net.IP {
+	tcpAddr, ok := c.conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return nil
+	}
+	return tcpAddr.IP
+}
+
+// allowRate records an event with Server.RateLimiter, and reports whether
+// it's within the limits. Server.OnRateLimit is called if it isn't.
+func (c *Conn) allowRate(ev RateLimitEvent) bool {
+	ip := c.remoteIP()
+	if c.server.RateLimiter == nil || ip == nil {
+		return true
+	}
+	if c.server.RateLimiter.Allow(ip, ev, c.server.now()) {
+		return true
+	}
+	c.rateLimited(ev)
+	return false
+}
+
+// rateLimitedAuth reports whether the client has exceeded the limit of
+// failed AUTH exchanges. Server.OnRateLimit is called if so.
+func (c *Conn) rateLimitedAuth() bool {
+	ip := c.remoteIP()
+	if c.server.RateLimiter == nil || ip == nil {
+		return false
+	}
+	if !c.server.RateLimiter.Limited(ip, RateLimitAuthFailure, c.server.now()) {
+		return false
+	}
+	c.rateLimited(RateLimitAuthFailure)
+	return true
+}
+
+func (c *Conn) rateLimited(ev RateLimitEvent) {
+	if c.server.OnRateLimit != nil {
+		c.server.OnRateLimit(c, ev)
+	}
+}
@@ -0,0 +1,50 @@
+package smtp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketLimiter(t *testing.T) {
+	l := &TokenBucketLimiter{
+		Mails: RateLimit{Rate: 0.5, Burst: 2},
+	}
+	ip := net.IPv4(192, 0, 2, 1)
+	other := net.IPv4(192, 0, 2, 2)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 2; i++ {
+		if !l.Allow(ip, RateLimitMail, now) {
+			t.Fatalf("Allow() #%v = false", i)
+		}
+	}
+	if !l.Limited(ip, RateLimitMail, now) {
+		t.Error("Limited() = false after the burst")
+	}
+	if l.Allow(ip, RateLimitMail, now) {
+		t.Error("Allow() = true after the burst")
+	}
+	if !l.Allow(other, RateLimitMail, now) {
+		t.Error("Allow() = false for another IP address")
+	}
+	if !l.Allow(ip, RateLimitCommand, now) {
+		t.Error("Allow() = false for an unlimited event")
+	}
+
+	now = now.Add(time.Second)
+	if l.Allow(ip, RateLimitMail, now) {
+		t.Error("Allow() = true before a token has been refilled")
+	}
+	now = now.Add(time.Second)
+	if !l.Allow(ip, RateLimitMail, now) {
+		t.Error("Allow() = false after a token has been refilled")
+	}
+
+	// Full buckets are removed
+	now = now.Add(time.Hour)
+	l.Limited(ip, RateLimitMail, now)
+	if len(l.buckets) != 0 {
+		t.Errorf("%v buckets left, want none", len(l.buckets))
+	}
+}
@@ -0,0 +1,68 @@
+package smtp
+
+import (
+	"net"
+	"time"
+)
+
+// RejectionReason classifies a rejection, based on the subject of its
+// enhanced status code (RFC 3463 section 3).
+type RejectionReason string
+
+const (
+	ReasonOther    RejectionReason = "other"    // X.0.X or no enhanced code
+	ReasonAddress  RejectionReason = "address"  // X.1.X
+	ReasonMailbox  RejectionReason = "mailbox"  // X.2.X
+	ReasonSystem   RejectionReason = "system"   // X.3.X, e.g. message too big
+	ReasonNetwork  RejectionReason = "network"  // X.4.X, e.g. timeouts
+	ReasonProtocol RejectionReason = "protocol" // X.5.X, e.g. syntax errors
+	ReasonContent  RejectionReason = "content"  // X.6.X
+	ReasonPolicy   RejectionReason = "policy"   // X.7.X, e.g. authentication, quotas
+)
+
+func rejectionReason(enhCode EnhancedCode) RejectionReason {
+	switch enhCode[1] {
+	case 1:
+		return ReasonAddress
+	case 2:
+		return ReasonMailbox
+	case 3:
+		return ReasonSystem
+	case 4:
+		return ReasonNetwork
+	case 5:
+		return ReasonProtocol
+	case 6:
+		return ReasonContent
+	case 7:
+		return ReasonPolicy
+	}
+	return ReasonOther
+}
+
+// Rejection is a machine-readable record of a negative (4xx or 5xx) reply
+// sent by the server.
+type Rejection struct {
+	Time       time.Time
+	RemoteAddr net.Addr
+	// Domain sent with HELO/EHLO/LHLO, empty if not received yet.
+	Hostname string
+	// Authenticated identity, see Conn.AuthIdentity.
+	Identity string
+	// ID of the mail transaction in progress, empty if none.
+	TransactionID string
+
+	// The command being rejected, e.g. "RCPT". Empty for replies not tied
+	// to a command, e.g. when the connection is rejected or times out.
+	Command      string
+	Code         int
+	EnhancedCode EnhancedCode
+	Reason       RejectionReason
+	Message      string
+}
+
+// RejectionLogger receives a record for each negative reply sent by the
+// server. LogRejection is called synchronously, it should not block.
+type RejectionLogger interface {
+	LogRejection(r *Rejection)
+}
@@ -0,0 +1,174 @@
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// RelayResult describes a message sent with Client.Relay.
+type RelayResult struct {
+	// Size of the message data, without dot-stuffing.
+	Size int64
+	// SHA-256 digest of the message data.
+	SHA256 [sha256.Size]byte
+	// Reply text of the server to the message data.
+	Response string
+}
+
+var (
+	errRelayBareCR   = errors.New("smtp: message contains a bare CR, it can't be relayed unaltered")
+	errRelayBareLF   = errors.New("smtp: message contains a bare LF, it can't be relayed unaltered")
+	errRelayNoEOL    = errors.New("smtp: message doesn't end with CRLF, it can't be relayed unaltered")
+	errRelayMismatch = errors.New("smtp: relayed message data differs from input")
+)
+
+// Relay sends a message without altering it, for forwarders which need to
+// preserve message signatures such as DKIM or ARC.
+//
+// Unlike Data, which normalizes line endings, Relay only applies
+// dot-stuffing. Messages which can't be sent as-is are refused: r must not
+// contain bare CR or LF characters and must end with CRLF. Before the message
+// data is terminated, the digest of the data read from r is compared with the
+// digest of the data sent with dot-stuffing removed.
+//
+// Since the DATA command can't be aborted, the connection is closed if r is
+// refused or can't be read, and the message isn't delivered.
+//
+// This function does not start TLS, nor does it perform authentication.
+func (c *Client) Relay(from string, to []string, r io.Reader, opts *MailOptions) (*RelayResult, error) {
+	if err := c.Mail(from, opts); err != nil {
+		return nil, err
+	}
+	for _, addr := range to {
+		if err := c.Rcpt(addr, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	// The client stays busy until the data writer is closed
+	if err := c.acquire(); err != nil {
+		return nil, err
+	}
+	if _, _, err := c.cmdAcquired(354, "DATA"); err != nil {
+		c.release()
+		return nil, err
+	}
+
+	sent := &unstuffHash{Hash: sha256.New(), lineStart: true}
+	rw := &relayWriter{
+		w:         io.MultiWriter(c.text.W, sent),
+		bw:        c.text.W,
+		lineStart: true,
+	}
+	w := c.newDataCloser(rw, nil)
+
+	read := sha256.New()
+	n, err := io.Copy(w, io.TeeReader(r, read))
+	if err == nil && !rw.lineStart {
+		err = errRelayNoEOL
+	}
+	if err == nil && !bytes.Equal(read.Sum(nil), sent.Sum(nil)) {
+		err = errRelayMismatch
+	}
+	if err != nil {
+		if w.watchdog != nil {
+			err = w.watchdog.wrapErr(err)
+			w.watchdog.stop()
+		}
+		c.Close()
+		c.release()
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	res := &RelayResult{Size: n, Response: w.response}
+	copy(res.SHA256[:], read.Sum(nil))
+	return res, nil
+}
+
+// relayWriter dot-stuffs message data, refusing bare CR and LF characters.
+type relayWriter struct {
+	w         io.Writer
+	bw        *bufio.Writer
+	lineStart bool // at the start of a line
+	cr        bool // last byte was a CR
+}
+
+func (rw *relayWriter) Write(b []byte) (int, error) {
+	start := 0
+	for i, ch := range b {
+		if rw.cr && ch != '\n' {
+			return rw.flush(b, start, i, errRelayBareCR)
+		} else if !rw.cr && ch == '\n' {
+			return rw.flush(b, start, i, errRelayBareLF)
+		}
+
+		if rw.lineStart && ch == '.' {
+			if n, err := rw.flush(b, start, i, nil); err != nil {
+				return n, err
+			}
+			if _, err := io.WriteString(rw.w, "."); err != nil {
+				return i, err
+			}
+			start = i
+		}
+
+		rw.cr = ch == '\r'
+		rw.lineStart = ch == '\n'
+	}
+	return rw.flush(b, start, len(b), nil)
+}
+
+// flush writes b[start:end] and returns the number of bytes of b consumed.
+func (rw *relayWriter) flush(b []byte, start, end int, err error) (int, error) {
+	n, writeErr := rw.w.Write(b[start:end])
+	if writeErr != nil {
+		return start + n, writeErr
+	}
+	return end, err
+}
+
+func (rw *relayWriter) Close() error {
+	if !rw.lineStart {
+		return errRelayNoEOL
+	}
+	if _, err := rw.bw.WriteString(".\r\n"); err != nil {
+		return err
+	}
+	return rw.bw.Flush()
+}
+
+// unstuffHash hashes dot-stuffed message data, with dot-stuffing removed.
+type unstuffHash struct {
+	hash.Hash
+	lineStart bool
+	dot       bool // a dot has been dropped at the start of the line
+}
+
+func (u *unstuffHash) Write(b []byte) (int, error) {
+	start := 0
+	for i, ch := range b {
+		if u.dot {
+			u.dot = false
+			if ch != '.' {
+				// Should never happen: the dot wasn't doubled
+				return 0, fmt.Errorf("smtp: unexpected byte %q after dot", ch)
+			}
+		} else if u.lineStart && ch == '.' {
+			u.Hash.Write(b[start:i])
+			start = i + 1
+			u.dot = true
+		}
+		u.lineStart = ch == '\n'
+	}
+	u.Hash.Write(b[start:])
+	return len(b), nil
+}
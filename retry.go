@@ -0,0 +1,167 @@
+package smtp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// UncertainDeliveryError is returned by RetryingSender.Send when the
+// connection failed after the last chunk of the message data has been sent,
+// but before the reply has been received. The server may have accepted the
+// message.
+type UncertainDeliveryError struct {
+	Err error
+}
+
+func (err *UncertainDeliveryError) Error() string {
+	return fmt.Sprintf("smtp: delivery uncertain, connection failed after the end of the message data: %v", err.Err)
+}
+
+func (err *UncertainDeliveryError) Unwrap() error {
+	return err.Err
+}
+
+var errChunkingNotSupported = errors.New("smtp: server doesn't support CHUNKING")
+
+// RetryingSender sends a large message in chunks with BDAT (RFC 3030
+// CHUNKING), and sends it again in a new transaction when the transfer fails
+// with a temporary error, e.g. a 421 reply, a timeout or a connection reset.
+// It's meant for very large messages sent over flaky links.
+//
+// The transfer is not resumed: SMTP has no way to continue an aborted
+// transaction, servers discard the chunks received so far. Each attempt
+// starts a new transaction and sends the message data from its first byte.
+// The size of the data acknowledged by the server before the failure is only
+// reported to OnRetry.
+//
+// Retrying is best-effort, and doesn't guarantee exactly-once delivery: if
+// the connection fails after the LAST chunk has been sent but before the
+// reply has been received, the server may have accepted the message. An
+// *UncertainDeliveryError is returned, and the message is only sent again if
+// RetryUncertain is set, at the risk of a duplicate delivery.
+//
+// Permanent errors (5xx replies) are returned immediately. LMTP isn't
+// supported.
+type RetryingSender struct {
+	// Connects to the server and returns a client ready to start a mail
+	// transaction, e.g. after STARTTLS and AUTH. Called once per attempt, the
+	// client is closed by RetryingSender.
+	Dial func() (*Client, error)
+
+	From        string
+	To          []string
+	MailOptions *MailOptions
+
+	// Size of the BDAT chunks, in bytes. Defaults to 1MiB.
+	ChunkSize int
+	// Maximum number of attempts. Defaults to 3.
+	MaxAttempts int
+	// Send the message again after an *UncertainDeliveryError.
+	RetryUncertain bool
+
+	// If not nil, called before each new attempt with the number of the
+	// failed attempt (starting at 1), the size of the message data
+	// acknowledged by the server during that attempt and its error.
+	OnRetry func(attempt int, acked int64, err error)
+}
+
+// Send sends the message data of the given size read from r. Each attempt
+// reads r from offset zero.
+func (s *RetryingSender) Send(r io.ReaderAt, size int64) error {
+	chunkSize := s.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = 1024 * 1024
+	}
+	maxAttempts := s.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = 3
+	}
+	buf := make([]byte, chunkSize)
+
+	for attempt := 1; ; attempt++ {
+		acked, fatal, err := s.attempt(r, size, buf)
+		if err == nil {
+			return nil
+		}
+		if fatal || attempt >= maxAttempts || !s.retryable(err) {
+			return err
+		}
+		if s.OnRetry != nil {
+			s.OnRetry(attempt, acked, err)
+		}
+	}
+}
+
+// retryable returns whether the message can be sent again after err.
+func (s *RetryingSender) retryable(err error) bool {
+	switch err := err.(type) {
+	case *UncertainDeliveryError:
+		return s.RetryUncertain
+	case *SMTPError:
+		return err.Temporary()
+	default:
+		// Network error
+		return true
+	}
+}
+
+// attempt sends the message in a new transaction. It returns the size of the
+// message data acknowledged by the server, and whether the error is not
+// worth another attempt.
+func (s *RetryingSender) attempt(r io.ReaderAt, size int64, buf []byte) (acked int64, fatal bool, err error) {
+	c, err := s.Dial()
+	if err != nil {
+		return 0, false, err
+	}
+	defer c.Close()
+
+	if err := c.hello(); err != nil {
+		return 0, false, err
+	}
+	if ok, _ := c.Extension("CHUNKING"); !ok {
+		return 0, true, errChunkingNotSupported
+	}
+
+	if err := c.Mail(s.From, s.MailOptions); err != nil {
+		_, isOptionErr := err.(*OptionError)
+		return 0, isOptionErr, err
+	}
+	for _, to := range s.To {
+		if err := c.Rcpt(to, nil); err != nil {
+			return 0, false, err
+		}
+	}
+	if err := c.checkProceedToData(); err != nil {
+		return 0, true, err
+	}
+
+	for {
+		chunk := buf
+		if remaining := size - acked; remaining < int64(len(chunk)) {
+			chunk = chunk[:remaining]
+		}
+		if _, err := io.ReadFull(io.NewSectionReader(r, acked, int64(len(chunk))), chunk); err != nil {
+			return acked, true, err
+		}
+
+		last := acked+int64(len(chunk)) == size
+		msg, err := c.bdat(chunk, last)
+		if err != nil {
+			if _, ok := err.(*SMTPError); !ok && last {
+				err = &UncertainDeliveryError{err}
+			}
+			c.messageSent(acked, "", err)
+			return acked, false, err
+		}
+		acked += int64(len(chunk))
+		if last {
+			c.messageSent(acked, msg, nil)
+			break
+		}
+	}
+
+	// The message has been accepted, ignore QUIT errors
+	c.Quit()
+	return acked, false, nil
+}
@@ -0,0 +1,205 @@
+package smtp
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"time"
+)
+
+// CheckSeverity is the severity of a CheckFinding.
+type CheckSeverity int
+
+const (
+	// The configuration works but is likely to cause problems.
+	CheckWarning CheckSeverity = iota
+	// The configuration is broken.
+	CheckError
+)
+
+func (sev CheckSeverity) String() string {
+	switch sev {
+	case CheckWarning:
+		return "warning"
+	case CheckError:
+		return "error"
+	}
+	return fmt.Sprintf("CheckSeverity(%d)", int(sev))
+}
+
+// CheckFinding is a problem found by Server.SelfCheck.
+type CheckFinding struct {
+	Severity CheckSeverity
+	// Machine-readable identifier of the problem, e.g. "tls-cert-expired".
+	ID string
+	// Human-readable description.
+	Message string
+}
+
+func (f *CheckFinding) String() string {
+	return fmt.Sprintf("%v: %v: %v", f.Severity, f.ID, f.Message)
+}
+
+type checkFindings []CheckFinding
+
+func (findings *checkFindings) add(sev CheckSeverity, id, format string, args ...interface{}) {
+	*findings = append(*findings, CheckFinding{
+		Severity: sev,
+		ID:       id,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// certExpiryWarning is how long before expiry SelfCheck warns about a
+// certificate.
+const certExpiryWarning = 14 * 24 * time.Hour
+
+// SelfCheck validates the server configuration, e.g. for readiness probes.
+// It checks the TLS certificates (key match, validity period, chain, host
+// name), the TLS settings, the listener settings and the advertised
+// capabilities. It returns an empty list if no problem has been found.
+//
+// Certificates provided by TLSConfig.GetCertificate can't be checked.
+func (s *Server) SelfCheck() []CheckFinding {
+	var findings checkFindings
+
+	if s.Backend == nil {
+		findings.add(CheckError, "backend-missing", "no backend configured")
+	}
+	if s.Domain == "" {
+		findings.add(CheckWarning, "domain-missing", "no domain configured, it is used in the greeting")
+	}
+
+	switch s.network() {
+	case "tcp", "tcp4", "tcp6":
+	case "unix":
+		if s.Addr == "" {
+			findings.add(CheckError, "addr-missing", "no socket path configured")
+		}
+	default:
+		findings.add(CheckError, "network-invalid", "unsupported network %q", s.Network)
+	}
+
+	if s.ReadTimeout == 0 {
+		findings.add(CheckWarning, "read-timeout-disabled", "no read timeout, idle clients can hold connections forever")
+	}
+	if s.WriteTimeout == 0 {
+		findings.add(CheckWarning, "write-timeout-disabled", "no write timeout, stalled clients can hold connections forever")
+	}
+	if s.MaxMessageBytes == 0 {
+		findings.add(CheckWarning, "size-unlimited", "no maximum message size")
+	}
+	if s.MaxMessageBytes > 0 && s.AdvertisedMessageBytes > s.MaxMessageBytes {
+		findings.add(CheckWarning, "size-advertised-above-limit", "advertised maximum message size %v exceeds the enforced maximum %v", s.AdvertisedMessageBytes, s.MaxMessageBytes)
+	}
+	if s.MaxLineLength == 0 {
+		findings.add(CheckWarning, "line-length-unlimited", "no maximum line length")
+	}
+
+	if s.TLSConfig == nil {
+		if s.EnableREQUIRETLS {
+			findings.add(CheckError, "requiretls-without-tls", "REQUIRETLS is enabled but TLS isn't configured, it is never advertised")
+		}
+		if s.AllowInsecureAuth && !s.LMTP {
+			findings.add(CheckWarning, "insecure-auth", "authentication is allowed without TLS")
+		}
+		if !s.LMTP {
+			findings.add(CheckWarning, "tls-disabled", "TLS isn't configured, STARTTLS isn't advertised")
+		}
+		return findings
+	}
+
+	if s.AllowInsecureAuth {
+		findings.add(CheckWarning, "insecure-auth", "authentication is allowed before STARTTLS")
+	}
+	s.checkTLS(&findings, s.now())
+	return findings
+}
+
+func (s *Server) checkTLS(findings *checkFindings, now time.Time) {
+	cfg := s.TLSConfig
+	if cfg.MinVersion != 0 && cfg.MinVersion < tls.VersionTLS12 {
+		findings.add(CheckWarning, "tls-min-version", "TLS versions older than 1.2 are enabled")
+	}
+	if len(cfg.NextProtos) > 0 {
+		found := false
+		for _, proto := range cfg.NextProtos {
+			if proto == alpnProtocol || proto == "lmtp" {
+				found = true
+			}
+		}
+		if !found {
+			findings.add(CheckWarning, "tls-alpn-mismatch", "ALPN protocols %q don't include smtp, handshakes with clients requesting it will fail", cfg.NextProtos)
+		}
+	}
+
+	if len(cfg.Certificates) == 0 {
+		if cfg.GetCertificate == nil {
+			findings.add(CheckError, "tls-cert-missing", "no TLS certificate configured")
+		}
+		return
+	}
+
+	for i, cert := range cfg.Certificates {
+		if len(cert.Certificate) == 0 {
+			findings.add(CheckError, "tls-cert-missing", "certificate #%v is empty", i)
+			continue
+		}
+		leaf := cert.Leaf
+		if leaf == nil {
+			var err error
+			leaf, err = x509.ParseCertificate(cert.Certificate[0])
+			if err != nil {
+				findings.add(CheckError, "tls-cert-invalid", "failed to parse certificate #%v: %v", i, err)
+				continue
+			}
+		}
+		name := leaf.Subject.CommonName
+
+		if signer, ok := cert.PrivateKey.(crypto.Signer); !ok {
+			findings.add(CheckError, "tls-key-invalid", "private key of certificate %q can't sign", name)
+		} else if pub, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool }); ok && !pub.Equal(leaf.PublicKey) {
+			findings.add(CheckError, "tls-key-mismatch", "private key doesn't match certificate %q", name)
+		}
+
+		validNow := true
+		if now.After(leaf.NotAfter) {
+			validNow = false
+			findings.add(CheckError, "tls-cert-expired", "certificate %q expired on %v", name, leaf.NotAfter)
+		} else if leaf.NotAfter.Sub(now) < certExpiryWarning {
+			findings.add(CheckWarning, "tls-cert-expiring", "certificate %q expires on %v", name, leaf.NotAfter)
+		}
+		if now.Before(leaf.NotBefore) {
+			validNow = false
+			findings.add(CheckError, "tls-cert-not-yet-valid", "certificate %q is only valid from %v", name, leaf.NotBefore)
+		}
+
+		if s.Domain != "" {
+			if err := leaf.VerifyHostname(s.Domain); err != nil {
+				findings.add(CheckWarning, "tls-name-mismatch", "certificate %q isn't valid for %q", name, s.Domain)
+			}
+		}
+
+		intermediates := x509.NewCertPool()
+		for _, der := range cert.Certificate[1:] {
+			c, err := x509.ParseCertificate(der)
+			if err != nil {
+				findings.add(CheckError, "tls-cert-invalid", "failed to parse intermediate certificate of %q: %v", name, err)
+				continue
+			}
+			intermediates.AddCert(c)
+		}
+		if !validNow {
+			continue
+		}
+		_, err := leaf.Verify(x509.VerifyOptions{
+			Intermediates: intermediates,
+			CurrentTime:   now,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		})
+		if err != nil {
+			findings.add(CheckWarning, "tls-chain-incomplete", "certificate %q can't be verified against the system roots: %v", name, err)
+		}
+	}
+}
@@ -14,6 +14,9 @@ import (
 
 var ErrServerClosed = errors.New("smtp: server already closed")
 
+// ALPN protocol ID registered for SMTP.
+const alpnProtocol = "smtp"
+
 // Logger interface is used by Server to report unexpected internal errors.
 type Logger interface {
 	Printf(format string, v ...interface{})
@@ -41,6 +44,102 @@ type Server struct {
 	ReadTimeout       time.Duration
 	WriteTimeout      time.Duration
 
+	// Maximum message size advertised with the SIZE capability, instead of
+	// MaxMessageBytes, e.g. to advertise a soft limit lower than the size
+	// actually enforced. Zero means MaxMessageBytes is advertised, a negative
+	// value omits the SIZE capability. It doesn't change which messages are
+	// accepted, MaxMessageBytes is always enforced.
+	AdvertisedMessageBytes int64
+
+	// If set, TLS connections which negotiated an ALPN protocol (RFC 7301)
+	// other than "smtp" ("lmtp" is also accepted in LMTP mode) are closed
+	// right after the handshake, e.g. when TLSConfig is shared with an HTTPS
+	// server. Clients which don't use ALPN are accepted. See
+	// Conn.NegotiatedProtocol.
+	StrictALPN bool
+
+	// If set, the JA4 fingerprint of the TLS ClientHello of implicit TLS
+	// connections accepted by ListenAndServeTLS is recorded, e.g. to detect
+	// bots from OnCommand or the backend. See Conn.TLSFingerprint.
+	// TLSConfig.GetConfigForClient is still called. This requires Go 1.24,
+	// it's a no-op with earlier versions.
+	FingerprintTLS bool
+
+	// If set, called to choose the domain of a connection in multi-homed
+	// deployments, e.g. depending on the local address (Conn.Conn) or on the
+	// TLS server name (Conn.TLSConnectionState). The domain is used in the
+	// greeting and in generated header fields, see Conn.Domain. It's called
+	// when the connection is accepted, after the handshake with implicit TLS,
+	// and again after STARTTLS. An empty result means Domain.
+	DomainForConn func(c *Conn) string
+
+	// Read timeout applied while receiving the message data (DATA or BDAT
+	// chunk), instead of ReadTimeout. The deadline is extended each time data
+	// is received, so that slow transfers are only aborted if they stall.
+	// Zero means the ReadTimeout of the DATA or BDAT command applies to the
+	// whole transfer.
+	DataReadTimeout time.Duration
+
+	// If non-zero, once the message data sent with DATA (over SMTP) or BDAT
+	// has been received and while the backend processes it, TCP keep-alive
+	// probes are enabled with this period, and the connection is watched:
+	// if the client goes away, the connection context is cancelled (see
+	// ContextSession) so that backends can stop wasting work. Keep-alive
+	// probes stay enabled afterwards.
+	DataKeepAlive time.Duration
+
+	// Minimum average transfer rate of the message data sent with DATA or
+	// BDAT, in bytes per second. Slower clients are disconnected with a 421
+	// reply; one second worth of data is allowed before the rate applies.
+	// Zero disables the check.
+	MinDataRate int
+	// Maximum time to receive a command line once its first byte has been
+	// received. Unlike ReadTimeout, which includes the time waiting for the
+	// client, it prevents clients from trickling commands byte by byte. Zero
+	// disables the limit.
+	MaxCommandTime time.Duration
+
+	// Maximum length of message data lines sent with DATA, used instead of
+	// MaxLineLength. Zero means MaxLineLength applies, a negative value
+	// disables the limit. A too long data line fails the message and closes
+	// the connection.
+	MaxDataLineLength int
+	// Maximum length of the lines sent by the client during an AUTH exchange,
+	// used instead of MaxLineLength. Defaults to 12288, as recommended by RFC
+	// 4954 section 4. A negative value disables the limit. A too long line
+	// aborts the exchange with a 500 reply.
+	MaxAuthLineLength int
+	// Maximum number of challenges (334 replies) sent during an AUTH
+	// exchange. The exchange is aborted with a 535 reply when the SASL
+	// mechanism needs more. Defaults to 16, a negative value disables the
+	// limit.
+	MaxAuthExchanges int
+	// Maximum size of a decoded client response during an AUTH exchange,
+	// including the initial response, in bytes. A larger response aborts the
+	// exchange with a 500 reply. Zero means only MaxAuthLineLength applies.
+	MaxAuthResponseSize int
+	// Number of junk lines tolerated after the end of the message data sent
+	// with DATA, for broken clients sending extra blank lines or dots after
+	// the terminating dot. Up to this number, blank lines and lines only made
+	// of dots are ignored until the next command, instead of being rejected
+	// as bad commands. They are counted in ConnStats.DataTrailerLines. Zero
+	// disables the tolerance.
+	MaxDataTrailerLines int
+	// Number of too long command lines tolerated per connection. Up to this
+	// number, too long commands are rejected with a 500 reply and the session
+	// continues. Zero means the connection is closed on the first one.
+	MaxTooLongLines int
+
+	// Tolerate common syntax errors of legacy clients: spaces before or no
+	// colon in "MAIL FROM:" and "RCPT TO:", display names before the path
+	// (e.g. `MAIL FROM:"Alice" <alice@example.org>`), HELO or EHLO without
+	// a domain and arguments to DATA. Uses are counted in
+	// ConnStats.LenientCommands.
+	//
+	// Spaces after the colon, trailing spaces and lowercase keywords are
+	// always accepted.
+	LenientSyntax bool
+
 	// Advertise SMTPUTF8 (RFC 6531) capability.
 	// Should be used only if backend supports it.
 	EnableSMTPUTF8 bool
@@ -57,19 +156,228 @@ type Server struct {
 	// Should be used only if backend supports it.
 	EnableDSN bool
 
+	// Advertise the experimental XCOMPRESS capability, which allows the
+	// client to enable DEFLATE compression of the stream. It is non-standard
+	// and only intended for private MTA-to-MTA links where bandwidth
+	// matters; both peers need to use go-smtp. Compression over TLS may leak
+	// information about the transmitted data (see CRIME).
+	EnableXCOMPRESS bool
+
+	// Maximum number of concurrent connections from a single IP address. Zero
+	// means no limit.
+	//
+	// Connections exceeding the limit are queued until a slot is available or
+	// ConnQueueTimeout expires, and are then rejected with a 421 reply.
+	MaxConnsPerIP int
+	// Maximum time a connection waits in the per-IP queue. Defaults to 30
+	// seconds.
+	ConnQueueTimeout time.Duration
+	// Maximum number of connections queued per IP address. Zero means no
+	// limit.
+	MaxQueuedConnsPerIP int
+
+	// Maximum number of mail transactions per connection. Once reached, the
+	// next MAIL command is rejected with a 421 reply and the connection is
+	// closed. Zero means no limit.
+	MaxTransactionsPerConn int
+	// Maximum total size of the message data received per connection, in
+	// bytes. Enforced like MaxTransactionsPerConn. Zero means no limit.
+	MaxBytesPerConn int64
+
+	// If set, a Received header field (RFC 5321 section 4.4) is prepended to
+	// the message data passed to the backend. Its "with" clause is given by
+	// Conn.TransmissionType.
+	AddReceivedHeader bool
+
+	// If positive, the server reads up to MaxHeaderBytes of the message
+	// header before calling Session.Data, and makes the main header fields
+	// available in Transaction.Header.
+	MaxHeaderBytes int
+
+	// If set, called with the message header before the message data is
+	// passed to the backend, to validate and fix messages received over
+	// submission. See CheckSubmissionHeader. The header is read up to
+	// MaxHeaderBytes, or 64 KiB if unset. Rejections are returned by the
+	// message data reader, backends must return its errors.
+	SubmissionHeaderCheck SubmissionHeaderCheck
+
+	// Inspectors reading the message data while the backend receives it,
+	// e.g. to verify DKIM signatures without reading the message again.
+	// Their results are available in Transaction.Inspections. Each inspector
+	// must keep reading: the message data is only passed to the backend as
+	// fast as the slowest inspector reads it.
+	DataInspectors []DataInspector
+
+	// If Session.Data returns nil without having read the whole message, the
+	// server discards the rest of the data and logs an error. If
+	// AbortUnconsumedData is set, the connection is closed with a 421 reply
+	// instead, to avoid wasting bandwidth and hiding backend bugs.
+	AbortUnconsumedData bool
+
+	// Memory budget of each connection, in bytes. It covers estimates of
+	// the connection buffers (including TLS and queued replies), which are
+	// always allocated, and of the buffers needed to process the message
+	// data: the header read for MaxHeaderBytes and SubmissionHeaderCheck,
+	// and the copy of BDAT chunks. Messages needing more memory are
+	// rejected with a 452 reply. Zero means no limit. The memory usage is
+	// reported by Server.MemoryUsage and Conn.MemoryUsage either way.
+	MaxConnMemory int64
+
+	// Maximum time to wait for Session.Logout to return. Defaults to 30
+	// seconds.
+	LogoutTimeout time.Duration
+
+	// Maximum time to wait for the backend's verdict once the message data
+	// sent with DATA has been received, e.g. while the message is scanned.
+	// Once exceeded, the message is rejected with a 451 reply, the
+	// connection context is cancelled (see ContextSession), and the
+	// connection is closed once Session.Data has returned; its result is
+	// discarded. Zero means no limit.
+	//
+	// The wait starts once the backend has read the whole message data: a
+	// backend which stops reading before the end isn't timed out, the
+	// client is then stuck sending the message data.
+	//
+	// The connection isn't subject to ReadTimeout while waiting. RFC 5321
+	// recommends clients to wait 10 minutes for the reply, MaxVerdictWait
+	// should be lower than that.
+	MaxVerdictWait time.Duration
+	// If both are set, OnVerdictProgress is called every
+	// VerdictProgressInterval while waiting for the backend's verdict, with
+	// the time waited so far, e.g. to log slow scans. SMTP has no way to
+	// tell the client that the server is still working: use DataKeepAlive to
+	// keep the connection alive through middleboxes.
+	VerdictProgressInterval time.Duration
+	OnVerdictProgress       func(c *Conn, waited time.Duration)
+
+	// If set, a LMTPSession calling StatusCollector.SetStatus for a recipient
+	// which wasn't specified, or more times than it was specified, causes a
+	// panic. This is useful in tests. By default, the error is logged and the
+	// recipients without a status are failed with a 554 reply.
+	StrictLMTPStatus bool
+
+	// What to do when the total size of the message data sent with BDAT
+	// doesn't match the SIZE parameter of the MAIL command. Both sizes are
+	// available to the backend in Transaction.MailOptions.Size and
+	// Transaction.DataStats.Size.
+	BDATSizeMismatch SizeMismatchPolicy
+
+	// What to do when a client sends HELO, EHLO or LHLO again after having
+	// been greeted. Some operators consider greetings in the middle of a
+	// mail transaction as a sign of a spam bot.
+	RepeatedHello HelloPolicy
+
+	// If not nil, replies to suspicious sessions are delayed to slow down
+	// spam bots. See Conn.Tarpit.
+	Tarpit *Tarpit
+
+	// If not nil and enabled, failures are simulated to test clients. Only
+	// available with the smtp_faults build tag, see FaultInjection.
+	FaultInjection *FaultInjection
+
+	// If not nil, receives a structured record of each rejection.
+	RejectionLogger RejectionLogger
+
+	// If not nil, receives a record of each accepted message.
+	Accounting Accounting
+
+	// If not nil, consulted on each MAIL command to enforce sending limits.
+	Quota Quota
+
+	// If not nil, called before each command is handled, with the verb in
+	// upper case and the argument, e.g. to veto commands according to a
+	// policy. If it returns an error, the command is rejected: an *SMTPError
+	// is sent as is, other errors are sent with a 550 5.7.1 reply. The
+	// initial response of AUTH is omitted from the argument.
+	OnCommand func(c *Conn, verb, arg string) error
+	// If not nil, called after each command has been handled with the code
+	// of the last reply sent, e.g. for auditing. The code is zero if no reply
+	// was sent, e.g. because the connection was closed. For DATA and BDAT
+	// LAST, the reply is the one sent after the message data.
+	OnCommandDone func(c *Conn, verb, arg string, code int)
+
+	// If not nil, limits the rate of commands, failed AUTH exchanges and
+	// MAIL commands per remote IP address. See TokenBucketLimiter.
+	RateLimiter RateLimiter
+	// If not nil, called each time a client exceeds a limit of RateLimiter,
+	// before the reply is sent. It's called synchronously, it should not
+	// block.
+	OnRateLimit func(c *Conn, ev RateLimitEvent)
+
+	// If set, READY=1 is sent to the service manager with SystemdNotify once
+	// the first listener is being served.
+	NotifyReady bool
+
+	// Source of time for timestamps, delays, timeouts and network deadlines.
+	// Defaults to the system clock. Deadlines are interpreted by the network
+	// connections, so a Clock which doesn't follow the system time should
+	// only be used with connections honoring it (e.g. in-memory connections
+	// created by a test) or with timeouts disabled.
+	Clock Clock
+	// Source of randomness for transaction IDs and FaultInjection. Defaults
+	// to crypto/rand.
+	//
+	// Rand is read concurrently by all connections, so it must be safe for
+	// concurrent use: a *math/rand.Rand isn't, it needs to be guarded by a
+	// mutex.
+	Rand io.Reader
+
 	// The server backend.
 	Backend Backend
 
 	wg   sync.WaitGroup
 	done chan struct{}
 
+	readyOnce sync.Once
+
+	// Parent of the connection contexts, cancelled by Close
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	extensions  []*Extension
+	extCommands map[string]extensionCommand
+
 	locker    sync.Mutex
 	listeners []net.Listener
 	conns     map[*Conn]struct{}
+	ipSlots   map[string]*ipSlot
+	queued    int
+	draining  bool
+
+	memUsed int64 // see MemoryUsage, accessed atomically
+
+	tlsNetConns     sync.Map // *tls.Conn -> net.Conn, see tlsListener
+	tlsFingerprints sync.Map // net.Conn -> JA4 fingerprint, see FingerprintTLS
+}
+
+// ipSlot tracks the connections from a single IP address.
+type ipSlot struct {
+	sem    chan struct{}
+	refs   int // active and queued connections
+	queued int
+}
+
+// Tarpit configures the delays applied to replies sent to suspicious
+// sessions.
+//
+// A session is flagged either explicitly by the backend via Conn.Tarpit, or
+// automatically once enough error replies have been sent to it.
+type Tarpit struct {
+	// Delay before the first reply once the session is flagged. Defaults to
+	// one second.
+	Delay time.Duration
+	// Added to the delay after each reply.
+	Increment time.Duration
+	// Maximum delay. Zero means no limit.
+	MaxDelay time.Duration
+	// Number of 4xx and 5xx replies after which a session is flagged. Zero
+	// disables automatic flagging.
+	ErrorThreshold int
 }
 
 // New creates a new SMTP server.
 func NewServer(be Backend) *Server {
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Server{
 		// Doubled maximum line length per RFC 5321 (Section 4.5.3.1.6)
 		MaxLineLength: 2000,
@@ -78,6 +386,22 @@ func NewServer(be Backend) *Server {
 		done:     make(chan struct{}, 1),
 		ErrorLog: log.New(os.Stderr, "smtp/server ", log.LstdFlags),
 		conns:    make(map[*Conn]struct{}),
+		ipSlots:  make(map[string]*ipSlot),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+func (s *Server) baseContext() context.Context {
+	if s.ctx == nil {
+		return context.Background()
+	}
+	return s.ctx
+}
+
+func (s *Server) cancelContexts() {
+	if s.cancel != nil {
+		s.cancel()
 	}
 }
 
@@ -87,6 +411,20 @@ func (s *Server) Serve(l net.Listener) error {
 	s.listeners = append(s.listeners, l)
 	s.locker.Unlock()
 
+	if s.NotifyReady {
+		s.readyOnce.Do(func() {
+			if err := SystemdNotify("READY=1"); err != nil {
+				s.ErrorLog.Printf("failed to notify service manager: %v", err)
+			}
+		})
+	}
+
+	if s.faultInjection() != nil {
+		s.ErrorLog.Printf("fault injection is enabled on %v, clients will see simulated failures", l.Addr())
+	} else if s.FaultInjection != nil && s.FaultInjection.Enabled {
+		s.ErrorLog.Printf("fault injection is ignored on %v: not built with the smtp_faults build tag", l.Addr())
+	}
+
 	var tempDelay time.Duration // how long to sleep on accept failure
 
 	for {
@@ -108,7 +446,7 @@ func (s *Server) Serve(l net.Listener) error {
 					tempDelay = max
 				}
 				s.ErrorLog.Printf("accept error: %s; retrying in %s", err, tempDelay)
-				time.Sleep(tempDelay)
+				s.sleep(tempDelay)
 				continue
 			}
 			return err
@@ -117,6 +455,16 @@ func (s *Server) Serve(l net.Listener) error {
 		s.wg.Add(1)
 		go func() {
 			defer s.wg.Done()
+			if tlsConn, ok := c.(*tls.Conn); ok {
+				defer s.forgetTLSConn(tlsConn)
+			}
+
+			release, ok := s.acquireIPSlot(c)
+			if !ok {
+				newConn(c, s).Reject()
+				return
+			}
+			defer release()
 
 			err := s.handleConn(newConn(c, s))
 			if err != nil {
@@ -126,13 +474,101 @@ func (s *Server) Serve(l net.Listener) error {
 	}
 }
 
+// acquireIPSlot waits until the number of connections from the remote IP
+// address of c is below MaxConnsPerIP. It returns false if the connection
+// should be rejected.
+func (s *Server) acquireIPSlot(c net.Conn) (release func(), ok bool) {
+	tcpAddr, isTCP := c.RemoteAddr().(*net.TCPAddr)
+	if s.MaxConnsPerIP <= 0 || !isTCP {
+		return func() {}, true
+	}
+	ip := tcpAddr.IP.String()
+
+	s.locker.Lock()
+	slot := s.ipSlots[ip]
+	if slot == nil {
+		slot = &ipSlot{sem: make(chan struct{}, s.MaxConnsPerIP)}
+		s.ipSlots[ip] = slot
+	}
+	slot.refs++
+
+	release = func() {
+		s.locker.Lock()
+		<-slot.sem
+		s.unrefIPSlot(ip, slot)
+		s.locker.Unlock()
+	}
+
+	select {
+	case slot.sem <- struct{}{}:
+		s.locker.Unlock()
+		return release, true
+	default:
+	}
+
+	if s.MaxQueuedConnsPerIP > 0 && slot.queued >= s.MaxQueuedConnsPerIP {
+		s.unrefIPSlot(ip, slot)
+		s.locker.Unlock()
+		return nil, false
+	}
+	slot.queued++
+	s.queued++
+	s.locker.Unlock()
+
+	timeout := s.ConnQueueTimeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	timer := s.clock().NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case slot.sem <- struct{}{}:
+		ok = true
+	case <-timer.C():
+	case <-s.done:
+	}
+
+	s.locker.Lock()
+	slot.queued--
+	s.queued--
+	if !ok {
+		s.unrefIPSlot(ip, slot)
+	}
+	s.locker.Unlock()
+
+	return release, ok
+}
+
+// unrefIPSlot must be called with s.locker held.
+func (s *Server) unrefIPSlot(ip string, slot *ipSlot) {
+	slot.refs--
+	if slot.refs == 0 {
+		delete(s.ipSlots, ip)
+	}
+}
+
+// QueuedConns returns the number of connections currently waiting for a
+// per-IP slot, see MaxConnsPerIP.
+func (s *Server) QueuedConns() int {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	return s.queued
+}
+
 func (s *Server) handleConn(c *Conn) error {
 	s.locker.Lock()
 	s.conns[c] = struct{}{}
+	if s.draining {
+		c.FinishAndClose()
+	}
 	s.locker.Unlock()
 
+	c.chargeMemory(connBufferSize)
+	quitReason := QuitServer
 	defer func() {
-		c.Close()
+		c.closeWithReason(quitReason)
+		c.releaseMemory(c.MemoryUsage())
 
 		s.locker.Lock()
 		delete(s.conns, c)
@@ -141,42 +577,88 @@ func (s *Server) handleConn(c *Conn) error {
 
 	if tlsConn, ok := c.conn.(*tls.Conn); ok {
 		if d := s.ReadTimeout; d != 0 {
-			c.conn.SetReadDeadline(time.Now().Add(d))
+			c.conn.SetReadDeadline(s.now().Add(d))
 		}
 		if d := s.WriteTimeout; d != 0 {
-			c.conn.SetWriteDeadline(time.Now().Add(d))
+			c.conn.SetWriteDeadline(s.now().Add(d))
 		}
 		if err := tlsConn.Handshake(); err != nil {
 			return err
 		}
+		c.chargeMemory(tlsBufferSize)
+		c.loadTLSFingerprint()
+		if err := c.checkALPN(tlsConn.ConnectionState()); err != nil {
+			quitReason = QuitError
+			return err
+		}
+	}
+
+	if fi := s.faultInjection(); fi != nil && s.chance(fi.ConnectFailure) {
+		c.writeResponse(421, EnhancedCode{4, 3, 2}, "Simulated failure, please try again later")
+		return nil
 	}
 
 	c.greet()
 
 	for {
-		line, err := c.readLine()
+		if msg := c.closeRequested(); msg != "" {
+			c.writeResponse(421, EnhancedCode{4, 3, 2}, msg)
+			return nil
+		}
+
+		line, err := c.readCommand()
 		if err == nil {
+			if c.skipDataTrailer(line) {
+				continue
+			}
+
 			cmd, arg, err := parseCmd(line)
 			if err != nil {
 				c.protocolError(501, EnhancedCode{5, 5, 2}, "Bad command")
 				continue
 			}
+			if !c.allowRate(RateLimitCommand) {
+				c.writeResponse(421, EnhancedCode{4, 7, 0}, "Too many commands, slow down")
+				return nil
+			}
 
 			c.handle(cmd, arg)
 		} else {
+			if err == ErrTooLongLine {
+				c.tooLongLines++
+				if c.tooLongLines > s.MaxTooLongLines {
+					quitReason = QuitError
+					c.writeResponse(500, EnhancedCode{5, 4, 0}, "Too long line, closing connection")
+					return nil
+				}
+				// Only reply once the whole line has been received, to keep
+				// replies in sync with pipelined commands
+				if err = c.lineLimitReader.discardLine(); err == nil {
+					c.writeResponse(500, EnhancedCode{5, 5, 2}, "Line too long")
+					continue
+				}
+			}
 			if err == io.EOF || errors.Is(err, net.ErrClosed) {
+				quitReason = QuitDisconnected
 				return nil
 			}
-			if err == ErrTooLongLine {
-				c.writeResponse(500, EnhancedCode{5, 4, 0}, "Too long line, closing connection")
+
+			if msg := c.closeRequested(); msg != "" {
+				c.writeResponse(421, EnhancedCode{4, 3, 2}, msg)
+				return nil
+			}
+			if err == errCommandTooSlow {
+				quitReason = QuitTimeout
+				c.writeResponse(421, EnhancedCode{4, 4, 2}, "Command not received in time, bye bye")
 				return nil
 			}
-
 			if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+				quitReason = QuitTimeout
 				c.writeResponse(421, EnhancedCode{4, 4, 2}, "Idle timeout, bye bye")
 				return nil
 			}
 
+			quitReason = QuitError
 			c.writeResponse(421, EnhancedCode{4, 4, 0}, "Connection error, sorry")
 			return err
 		}
@@ -216,6 +698,8 @@ func (s *Server) ListenAndServe() error {
 // ListenAndServeTLS listens on the TCP network address s.Addr and then calls
 // Serve to handle requests on incoming TLS connections.
 //
+// If s.TLSConfig doesn't define ALPN protocols, "smtp" is used.
+//
 // If s.Addr is blank and LMTP is disabled, ":smtps" is used.
 func (s *Server) ListenAndServeTLS() error {
 	network := s.network()
@@ -225,12 +709,87 @@ func (s *Server) ListenAndServeTLS() error {
 		addr = ":smtps"
 	}
 
-	l, err := tls.Listen(network, addr, s.TLSConfig)
+	config := s.implicitTLSConfig()
+	if config == nil || len(config.Certificates) == 0 && config.GetCertificate == nil && config.GetConfigForClient == nil {
+		return errors.New("smtp: neither Certificates, GetCertificate, nor GetConfigForClient set in TLSConfig")
+	}
+
+	l, err := net.Listen(network, addr)
 	if err != nil {
 		return err
 	}
 
-	return s.Serve(l)
+	return s.Serve(&tlsListener{Listener: l, server: s, config: config})
+}
+
+// implicitTLSConfig returns the TLS configuration of implicit TLS listeners:
+// TLSConfig, with the "smtp" ALPN protocol if none is configured. Clients
+// requesting other protocols, e.g. in cross-protocol attacks, fail the
+// handshake.
+func (s *Server) implicitTLSConfig() *tls.Config {
+	config := s.TLSConfig
+	if config == nil {
+		return nil
+	}
+	if s.FingerprintTLS {
+		config = s.fingerprintTLSConfig(config)
+	}
+	if len(config.NextProtos) > 0 {
+		return config
+	}
+	if config == s.TLSConfig {
+		config = config.Clone()
+	}
+	config.NextProtos = []string{alpnProtocol}
+	return config
+}
+
+// RequestReconnect asks all connections to close once their current
+// transaction is over: a 421 reply with the text msg is sent to idle
+// connections right away, and to busy connections after the end of the
+// message data. Clients are expected to reconnect.
+//
+// Contrary to Close and Shutdown, the server keeps accepting connections.
+// This is useful e.g. when a configuration reload requires clients to start
+// new sessions. If msg is empty, a default text is used.
+func (s *Server) RequestReconnect(msg string) {
+	if msg == "" {
+		msg = defaultReconnectMessage
+	}
+
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	for conn := range s.conns {
+		conn.requestClose(msg)
+	}
+}
+
+// DrainConns calls Conn.FinishAndClose on all active connections, and on the
+// connections accepted from now on, e.g. to restart the server without
+// cutting message transfers in progress. The returned channel is closed once
+// the connections active when DrainConns was called are closed.
+//
+// The server keeps accepting connections, which are closed right after the
+// greeting. Close or Shutdown can be called once the channel is closed.
+func (s *Server) DrainConns() <-chan struct{} {
+	s.locker.Lock()
+	s.draining = true
+	conns := make([]*Conn, 0, len(s.conns))
+	for conn := range s.conns {
+		conn.FinishAndClose()
+		conns = append(conns, conn)
+	}
+	s.locker.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, conn := range conns {
+			// The context is cancelled when the connection is closed
+			<-conn.Context().Done()
+		}
+	}()
+	return done
 }
 
 // Close immediately closes all active listeners and connections.
@@ -258,6 +817,7 @@ func (s *Server) Close() error {
 	}
 	s.locker.Unlock()
 
+	s.cancelContexts()
 	return err
 }
 
@@ -265,8 +825,9 @@ func (s *Server) Close() error {
 // active connections. Shutdown works by first closing all open
 // listeners and then waiting indefinitely for connections to return to
 // idle and then shut down.
-// If the provided context expires before the shutdown is complete,
-// Shutdown returns the context's error, otherwise it returns any
+// If the provided context expires before the shutdown is complete, the
+// contexts returned by Conn.Context are cancelled and Shutdown returns the
+// context's error, otherwise it returns any
 // error returned from closing the Server's underlying Listener(s).
 func (s *Server) Shutdown(ctx context.Context) error {
 	select {
@@ -293,6 +854,7 @@ func (s *Server) Shutdown(ctx context.Context) error {
 
 	select {
 	case <-ctx.Done():
+		s.cancelContexts()
 		return ctx.Err()
 	case <-connDone:
 		return err
@@ -4,14 +4,31 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math/big"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/emersion/go-sasl"
 	"github.com/emersion/go-smtp"
@@ -31,8 +48,17 @@ type backend struct {
 	messages []*message
 	anonmsgs []*message
 
-	implementLMTPData bool
-	lmtpStatus        []struct {
+	implementLMTPData    bool
+	implementTransaction bool
+	sessionMaxRecipients int
+	implementNotify      bool
+	implementVerify      bool
+	notifications        chan string
+	// If not nil, a ContextSession is used. DataContext waits for its
+	// context to be cancelled and sends the context error.
+	contextDone  chan error
+	transactions []*smtp.Transaction
+	lmtpStatus   []struct {
 		addr string
 		err  error
 	}
@@ -47,24 +73,176 @@ type backend struct {
 	// Read N bytes of message before returning dataErr.
 	dataErrOffset int64
 
+	// Time spent by Data after reading the message, the message isn't saved.
+	dataDelay time.Duration
+
+	// Accept messages without reading them.
+	dataSkip bool
+
 	panicOnMail bool
+	panicOnData bool
 	userErr     error
+
+	logoutErr     error
+	logoutDelay   time.Duration
+	panicOnLogout bool
+	logoutsLock   sync.Mutex
+	logouts       int
+
+	// Returned by Rcpt for the matching recipients.
+	forwards map[string]*smtp.ForwardingResult
+	// If not nil, returned by Mail and Rcpt on success.
+	acceptedReply *smtp.AcceptedReply
+
+	// If not nil, used by Auth instead of PLAIN.
+	saslServer func(c *smtp.Conn, mech string) sasl.Server
 }
 
-func (be *backend) NewSession(_ *smtp.Conn) (smtp.Session, error) {
+func (be *backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
 	if be.implementLMTPData {
-		return &lmtpSession{&session{backend: be, anonymous: true}}, nil
+		return &lmtpSession{&session{backend: be, conn: c, anonymous: true}}, nil
+	}
+	if be.implementTransaction {
+		return &txSession{&session{backend: be, conn: c, anonymous: true}}, nil
+	}
+	if be.implementNotify {
+		return &notifySession{&session{backend: be, conn: c, anonymous: true}}, nil
+	}
+	if be.sessionMaxRecipients != 0 {
+		return &limitsSession{&session{backend: be, conn: c, anonymous: true}}, nil
+	}
+	if be.contextDone != nil {
+		return &contextSession{&session{backend: be, conn: c, anonymous: true}}, nil
+	}
+	if be.implementVerify {
+		return &verifySession{&session{backend: be, conn: c, anonymous: true}}, nil
 	}
 
-	return &session{backend: be, anonymous: true}, nil
+	return &session{backend: be, conn: c, anonymous: true}, nil
 }
 
 type lmtpSession struct {
 	*session
 }
 
+type txSession struct {
+	*session
+}
+
+var _ smtp.TransactionSession = (*txSession)(nil)
+
+func (s *txSession) MailTx(tx *smtp.Transaction) error {
+	s.backend.transactions = append(s.backend.transactions, tx)
+	return s.Mail(tx.From, tx.MailOptions)
+}
+
+func (s *txSession) RcptTx(tx *smtp.Transaction, to string, opts *smtp.RcptOptions) error {
+	if s.backend.transactions[len(s.backend.transactions)-1] != tx {
+		return errors.New("RcptTx called with a different transaction")
+	}
+	return s.Rcpt(to, opts)
+}
+
+func (s *txSession) DataTx(tx *smtp.Transaction, r io.Reader) error {
+	if s.backend.transactions[len(s.backend.transactions)-1] != tx {
+		return errors.New("DataTx called with a different transaction")
+	}
+	return s.Data(r)
+}
+
+type notifySession struct {
+	*session
+}
+
+var _ smtp.NotifySession = (*notifySession)(nil)
+
+func (s *notifySession) OnReset() {
+	s.backend.notifications <- "reset"
+}
+
+func (s *notifySession) OnQuit(reason smtp.QuitReason) {
+	s.backend.notifications <- "quit " + reason.String()
+}
+
+type contextSession struct {
+	*session
+}
+
+var _ smtp.ContextSession = (*contextSession)(nil)
+
+func (s *contextSession) MailContext(ctx context.Context, from string, opts *smtp.MailOptions) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Mail(from, opts)
+}
+
+func (s *contextSession) RcptContext(ctx context.Context, to string, opts *smtp.RcptOptions) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.Rcpt(to, opts)
+}
+
+func (s *contextSession) DataContext(ctx context.Context, r io.Reader) error {
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		return err
+	}
+	<-ctx.Done()
+	s.backend.contextDone <- ctx.Err()
+	return ctx.Err()
+}
+
+type limitsSession struct {
+	*session
+}
+
+var _ smtp.SessionLimits = (*limitsSession)(nil)
+
+func (s *limitsSession) MaxRecipients() int {
+	if s.anonymous {
+		return 1
+	}
+	return s.backend.sessionMaxRecipients
+}
+
+type verifySession struct {
+	*session
+}
+
+var (
+	_ smtp.VerifySession = (*verifySession)(nil)
+	_ smtp.ExpandSession = (*verifySession)(nil)
+)
+
+func (s *verifySession) Verify(user string) (string, error) {
+	switch user {
+	case "alice":
+		return "alice@example.org", nil
+	case "bob":
+		return "", errors.New("Directory unavailable")
+	}
+	return "", &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+		Message:      "No such user",
+	}
+}
+
+func (s *verifySession) Expand(list string) ([]string, error) {
+	if list != "staff" {
+		return nil, &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+			Message:      "No such list",
+		}
+	}
+	return []string{"alice@example.org", "bob@example.org"}, nil
+}
+
 type session struct {
 	backend   *backend
+	conn      *smtp.Conn
 	anonymous bool
 
 	msg *message
@@ -83,6 +261,9 @@ func (s *session) Auth(mech string) (sasl.Server, error) {
 	if s.backend.authDisabled {
 		return nil, smtp.ErrAuthUnsupported
 	}
+	if s.backend.saslServer != nil {
+		return s.backend.saslServer(s.conn, mech), nil
+	}
 	return sasl.NewPlainServer(func(identity, username, password string) error {
 		if identity != "" && identity != username {
 			return errors.New("Invalid identity")
@@ -91,16 +272,36 @@ func (s *session) Auth(mech string) (sasl.Server, error) {
 			return errors.New("Invalid username or password")
 		}
 		s.anonymous = false
+		s.conn.SetAuthIdentity(username)
 		return nil
 	}), nil
 }
 
+var _ smtp.ExternalAuthSession = (*session)(nil)
+
+func (s *session) AuthExternal(chains [][]*x509.Certificate, identity string) error {
+	if identity != "" && identity != chains[0][0].Subject.CommonName {
+		return errors.New("Invalid identity")
+	}
+	s.anonymous = false
+	s.conn.SetAuthIdentity(chains[0][0].Subject.CommonName)
+	return nil
+}
+
 func (s *session) Reset() {
 	s.msg = &message{}
 }
 
 func (s *session) Logout() error {
-	return nil
+	s.backend.logoutsLock.Lock()
+	s.backend.logouts++
+	s.backend.logoutsLock.Unlock()
+
+	if s.backend.panicOnLogout {
+		panic("Logout is on fire!")
+	}
+	time.Sleep(s.backend.logoutDelay)
+	return s.backend.logoutErr
 }
 
 func (s *session) Mail(from string, opts *smtp.MailOptions) error {
@@ -116,13 +317,33 @@ func (s *session) Mail(from string, opts *smtp.MailOptions) error {
 	return nil
 }
 
+func (s *session) MailReply(from string) *smtp.AcceptedReply {
+	return s.backend.acceptedReply
+}
+
+func (s *session) RcptReply(to string) *smtp.AcceptedReply {
+	if fwd := s.backend.forwards[to]; fwd != nil {
+		return &smtp.AcceptedReply{ForwardTo: fwd.Address}
+	}
+	return s.backend.acceptedReply
+}
+
 func (s *session) Rcpt(to string, opts *smtp.RcptOptions) error {
+	fwd := s.backend.forwards[to]
+	if fwd != nil && fwd.Permanent {
+		return fwd
+	}
 	s.msg.To = append(s.msg.To, to)
 	s.msg.RcptOpts = append(s.msg.RcptOpts, opts)
 	return nil
 }
 
 func (s *session) Data(r io.Reader) error {
+	if s.backend.panicOnData {
+		io.Copy(ioutil.Discard, r)
+		panic("Data is on fire!")
+	}
+
 	if s.backend.dataErr != nil {
 
 		if s.backend.dataErrOffset != 0 {
@@ -136,6 +357,16 @@ func (s *session) Data(r io.Reader) error {
 		return err
 	}
 
+	if s.backend.dataSkip {
+		return nil
+	}
+
+	if s.backend.dataDelay > 0 {
+		_, err := io.Copy(ioutil.Discard, r)
+		time.Sleep(s.backend.dataDelay)
+		return err
+	}
+
 	if b, err := ioutil.ReadAll(r); err != nil {
 		if s.backend.dataErrors != nil {
 			s.backend.dataErrors <- err
@@ -262,6 +493,40 @@ func testServer(t *testing.T, fn ...serverConfigureFunc) (be *backend, s *smtp.S
 	return
 }
 
+// testTLSCertificate generates a self-signed certificate, valid for both
+// server and client authentication.
+func testTLSCertificate(t *testing.T, commonName string) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, pool
+}
+
 func testServerGreeted(t *testing.T, fn ...serverConfigureFunc) (be *backend, s *smtp.Server, c net.Conn, scanner *bufio.Scanner) {
 	be, s, c, scanner = testServer(t, fn...)
 
@@ -353,8 +618,8 @@ func TestServer_helo(t *testing.T) {
 	}
 }
 
-func testServerAuthenticated(t *testing.T) (be *backend, s *smtp.Server, c net.Conn, scanner *bufio.Scanner) {
-	be, s, c, scanner, caps := testServerEhlo(t)
+func testServerAuthenticated(t *testing.T, fn ...serverConfigureFunc) (be *backend, s *smtp.Server, c net.Conn, scanner *bufio.Scanner) {
+	be, s, c, scanner, caps := testServerEhlo(t, fn...)
 
 	if _, ok := caps["AUTH PLAIN"]; !ok {
 		t.Fatal("AUTH PLAIN capability is missing when auth is enabled")
@@ -467,6 +732,39 @@ func TestServerPanicRecover(t *testing.T) {
 	}
 }
 
+func TestServerPanicRecover_Data(t *testing.T) {
+	for _, maxVerdictWait := range []time.Duration{0, time.Minute} {
+		t.Run(fmt.Sprintf("MaxVerdictWait=%v", maxVerdictWait), func(t *testing.T) {
+			_, s, c, scanner := testServerAuthenticated(t, func(s *smtp.Server) {
+				s.Backend.(*backend).panicOnData = true
+				s.MaxVerdictWait = maxVerdictWait
+				s.ErrorLog = log.New(ioutil.Discard, "", 0)
+			})
+			defer s.Close()
+			defer c.Close()
+
+			io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+			scanner.Scan()
+			io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+			scanner.Scan()
+			io.WriteString(c, "DATA\r\n")
+			scanner.Scan()
+			io.WriteString(c, "Hey <3\r\n.\r\n")
+			scanner.Scan()
+			if !strings.HasPrefix(scanner.Text(), "421 ") {
+				t.Fatal("Invalid DATA response:", scanner.Text())
+			}
+
+			// A 421 reply closes the connection
+			io.WriteString(c, "NOOP\r\n")
+			c.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if scanner.Scan() {
+				t.Fatal("Expected the connection to be closed, got:", scanner.Text())
+			}
+		})
+	}
+}
+
 func TestServerSMTPUTF8(t *testing.T) {
 	_, s, c, scanner := testServerAuthenticated(t)
 	s.EnableSMTPUTF8 = true
@@ -554,6 +852,54 @@ func TestServerTooBig(t *testing.T) {
 	}
 }
 
+func TestServerAdvertisedSize(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		maxBytes   int64
+		advertised int64
+		want       string
+	}{
+		{"unlimited", 0, 0, "SIZE"},
+		{"limit", 1024, 0, "SIZE 1024"},
+		{"soft limit", 2048, 1024, "SIZE 1024"},
+		{"omitted", 1024, -1, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, s, c, scanner, caps := testServerEhlo(t, func(s *smtp.Server) {
+				s.MaxMessageBytes = tc.maxBytes
+				s.AdvertisedMessageBytes = tc.advertised
+			})
+			defer s.Close()
+			defer c.Close()
+
+			var size string
+			for cap := range caps {
+				if cap == "SIZE" || strings.HasPrefix(cap, "SIZE ") {
+					size = cap
+				}
+			}
+			if size != tc.want {
+				t.Fatalf("SIZE capability = %q, want %q", size, tc.want)
+			}
+
+			if tc.maxBytes == 0 {
+				return
+			}
+			// The hard limit is still enforced
+			fmt.Fprintf(c, "MAIL FROM:<root@nsa.gov> SIZE=%v\r\n", tc.maxBytes+1)
+			scanner.Scan()
+			if scanner.Text() != "552 5.3.4 Max message size exceeded" {
+				t.Fatal("Invalid MAIL response:", scanner.Text())
+			}
+			fmt.Fprintf(c, "MAIL FROM:<root@nsa.gov> SIZE=%v\r\n", tc.maxBytes)
+			scanner.Scan()
+			if !strings.HasPrefix(scanner.Text(), "250 ") {
+				t.Fatal("Invalid MAIL response:", scanner.Text())
+			}
+		})
+	}
+}
+
 func TestServerEmptyTo(t *testing.T) {
 	_, s, c, scanner := testServerAuthenticated(t)
 	defer s.Close()
@@ -755,6 +1101,34 @@ func TestServer_otherCommands(t *testing.T) {
 	}
 }
 
+func TestServer_VerifyExpand(t *testing.T) {
+	_, s, c, scanner, _ := testServerEhlo(t, func(s *smtp.Server) {
+		s.Backend.(*backend).implementVerify = true
+	})
+	defer s.Close()
+	defer c.Close()
+
+	for _, tc := range []struct {
+		cmd  string
+		want []string
+	}{
+		{"VRFY alice", []string{"250 2.1.5 <alice@example.org>"}},
+		{"VRFY carol", []string{"550 5.1.1 No such user"}},
+		{"VRFY bob", []string{"451 4.0.0 Directory unavailable"}},
+		{"VRFY", []string{"501 5.5.4 Was expecting VRFY arg syntax of VRFY <user>"}},
+		{"EXPN staff", []string{"250-<alice@example.org>", "250 2.1.5 <bob@example.org>"}},
+		{"EXPN nobody", []string{"550 5.1.1 No such list"}},
+	} {
+		io.WriteString(c, tc.cmd+"\r\n")
+		for _, want := range tc.want {
+			scanner.Scan()
+			if scanner.Text() != want {
+				t.Errorf("%v: got %q, want %q", tc.cmd, scanner.Text(), want)
+			}
+		}
+	}
+}
+
 func TestServer_tooManyInvalidCommands(t *testing.T) {
 	_, s, c, scanner := testServerAuthenticated(t)
 	defer s.Close()
@@ -792,8 +1166,8 @@ func TestServer_tooLongMessage(t *testing.T) {
 	io.WriteString(c, "And much longer than the server's MaxMessageBytes.\r\n")
 	io.WriteString(c, ".\r\n")
 	scanner.Scan()
-	if !strings.HasPrefix(scanner.Text(), "552 ") {
-		t.Fatal("Invalid DATA response, expected an error but got:", scanner.Text())
+	if want := "552 5.3.4 Maximum message size exceeded (76 bytes discarded after the first 50 bytes)"; scanner.Text() != want {
+		t.Fatalf("Invalid DATA response: got %q, want %q", scanner.Text(), want)
 	}
 
 	if len(be.messages) != 0 || len(be.anonmsgs) != 0 {
@@ -1407,6 +1781,49 @@ func TestServerDSN(t *testing.T) {
 	}
 }
 
+func TestServer_RawPath(t *testing.T) {
+	be, s, c, scanner, _ := testServerEhlo(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<Root@NSA.gov> BODY=8BITMIME\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	io.WriteString(c, "RCPT TO:<\"John \\\"Doe\\\"\"@example.org>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid RCPT response:", scanner.Text())
+	}
+
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "Hey <3\r\n.\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+	if len(be.anonmsgs) != 1 {
+		t.Fatal("Invalid number of sent messages:", be.anonmsgs)
+	}
+
+	msg := be.anonmsgs[0]
+	if msg.From != "Root@NSA.gov" {
+		t.Errorf("Invalid mail sender: %q", msg.From)
+	}
+	if msg.Opts.RawPath != "<Root@NSA.gov>" {
+		t.Errorf("Invalid raw reverse-path: %q", msg.Opts.RawPath)
+	}
+	if len(msg.To) != 1 || msg.To[0] != `John "Doe"@example.org` {
+		t.Fatalf("Invalid recipients: %q", msg.To)
+	}
+	if raw := msg.RcptOpts[0].RawPath; raw != `<"John \"Doe\""@example.org>` {
+		t.Errorf("Invalid raw forward-path: %q", raw)
+	}
+}
+
 func TestServerDSNwithSMTPUTF8(t *testing.T) {
 	be, s, c, scanner, caps := testServerEhlo(t,
 		func(s *smtp.Server) {
@@ -1514,3 +1931,3431 @@ func TestServerDSNwithSMTPUTF8(t *testing.T) {
 		t.Fatal("Invalid ORCPT address:", val)
 	}
 }
+
+func TestServer_TransactionSession(t *testing.T) {
+	be, s, c, scanner, _ := testServerEhlo(t, func(s *smtp.Server) {
+		s.Backend.(*backend).implementTransaction = true
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov> BODY=8BITMIME\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid RCPT response:", scanner.Text())
+	}
+
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "354 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	io.WriteString(c, "Hey <3\r\n")
+	io.WriteString(c, ".\r\n")
+	scanner.Scan()
+	dataResp := scanner.Text()
+	if !strings.HasPrefix(dataResp, "250 ") {
+		t.Fatal("Invalid DATA response:", dataResp)
+	}
+
+	if len(be.transactions) != 1 {
+		t.Fatal("Invalid number of transactions:", len(be.transactions))
+	}
+	tx := be.transactions[0]
+	if tx.From != "root@nsa.gov" || tx.MailOptions.Body != smtp.Body8BitMIME {
+		t.Fatal("Invalid transaction sender:", tx.From, tx.MailOptions)
+	}
+	if len(tx.Recipients) != 1 || tx.Recipients[0] != "root@gchq.gov.uk" || len(tx.RcptOptions) != 1 {
+		t.Fatal("Invalid transaction recipients:", tx.Recipients)
+	}
+	if len(tx.ID) != 26 || dataResp != "250 2.0.0 OK: queued as "+tx.ID {
+		t.Fatal("Invalid transaction ID:", tx.ID, dataResp)
+	}
+	if tx.StartedAt.IsZero() || tx.DataStartedAt.Before(tx.StartedAt) {
+		t.Fatal("Invalid transaction timestamps:", tx.StartedAt, tx.DataStartedAt)
+	}
+	if len(be.anonmsgs) != 1 || string(be.anonmsgs[0].Data) != "Hey <3\r\n" {
+		t.Fatal("Invalid message:", be.anonmsgs)
+	}
+
+	// The transaction carries the connection context
+	if err := tx.Context().Err(); err != nil {
+		t.Fatal("Transaction context done before the connection is closed:", err)
+	}
+	s.Close()
+	select {
+	case <-tx.Context().Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Transaction context not cancelled on server close")
+	}
+}
+
+func TestServer_DataInspectors(t *testing.T) {
+	inspectErrs := make(chan error, 1)
+	be, s, c, scanner, _ := testServerEhlo(t, func(s *smtp.Server) {
+		s.Backend.(*backend).implementTransaction = true
+		s.DataInspectors = []smtp.DataInspector{{
+			Name: "size",
+			Inspect: func(c *smtp.Conn, tx *smtp.Transaction, r io.Reader) (interface{}, error) {
+				n, err := io.Copy(ioutil.Discard, r)
+				inspectErrs <- err
+				return n, err
+			},
+		}, {
+			Name: "noop",
+			Inspect: func(c *smtp.Conn, tx *smtp.Transaction, r io.Reader) (interface{}, error) {
+				return "done", nil
+			},
+		}}
+	})
+	defer s.Close()
+	defer c.Close()
+
+	sendMessage := func() string {
+		io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+		scanner.Scan()
+		io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+		scanner.Scan()
+		io.WriteString(c, "DATA\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "354 ") {
+			t.Fatal("Invalid DATA response:", scanner.Text())
+		}
+		io.WriteString(c, "Subject: Hey\r\n\r\n<3\r\n.\r\n")
+		scanner.Scan()
+		return scanner.Text()
+	}
+
+	if resp := sendMessage(); !strings.HasPrefix(resp, "250 ") {
+		t.Fatal("Invalid DATA response:", resp)
+	}
+	if err := <-inspectErrs; err != nil {
+		t.Fatal("Inspector failed:", err)
+	}
+	results := be.transactions[0].Inspections
+	if res := results.Get("size"); res == nil || res.Value != int64(len("Subject: Hey\r\n\r\n<3\r\n")) || res.Err != nil {
+		t.Errorf("Invalid size inspection: %+v", res)
+	}
+	if res := results.Get("noop"); res == nil || res.Value != "done" || res.Err != nil {
+		t.Errorf("Invalid noop inspection: %+v", res)
+	}
+	if res := results.Get("unknown"); res != nil {
+		t.Errorf("Unexpected inspection: %+v", res)
+	}
+
+	// The inspectors are aborted when the backend rejects the message
+	// without reading it
+	be.dataErr = errors.New("Rejected")
+	if resp := sendMessage(); !strings.HasPrefix(resp, "554 ") {
+		t.Fatal("Invalid DATA response:", resp)
+	}
+	if err := <-inspectErrs; err != smtp.ErrDataReset {
+		t.Errorf("Inspector error = %v, want %v", err, smtp.ErrDataReset)
+	}
+}
+
+func TestServer_TransactionID(t *testing.T) {
+	be, s, c, scanner, _ := testServerEhlo(t, func(s *smtp.Server) {
+		s.Backend.(*backend).implementTransaction = true
+	})
+	defer s.Close()
+	defer c.Close()
+
+	for i := 0; i < 2; i++ {
+		io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+		scanner.Scan()
+		io.WriteString(c, "RSET\r\n")
+		scanner.Scan()
+	}
+
+	if len(be.transactions) != 2 {
+		t.Fatal("Invalid number of transactions:", len(be.transactions))
+	}
+	if be.transactions[0].ID == be.transactions[1].ID {
+		t.Fatal("Transaction IDs are not unique:", be.transactions[0].ID)
+	}
+	if be.transactions[0].ID[:10] > be.transactions[1].ID[:10] {
+		t.Fatal("Transaction IDs are not time-ordered:", be.transactions[0].ID, be.transactions[1].ID)
+	}
+}
+
+func TestServer_Tarpit(t *testing.T) {
+	_, s, c, scanner, _ := testServerEhlo(t, func(s *smtp.Server) {
+		s.Tarpit = &smtp.Tarpit{
+			Delay:          50 * time.Millisecond,
+			Increment:      50 * time.Millisecond,
+			ErrorThreshold: 2,
+		}
+	})
+	defer s.Close()
+	defer c.Close()
+
+	for i := 0; i < 2; i++ {
+		start := time.Now()
+		io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "503 ") {
+			t.Fatal("Invalid RCPT response:", scanner.Text())
+		}
+		if i == 0 && time.Since(start) >= 50*time.Millisecond {
+			t.Fatal("Reply delayed before the session was flagged")
+		}
+	}
+
+	start := time.Now()
+	io.WriteString(c, "NOOP\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid NOOP response:", scanner.Text())
+	}
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Fatal("Reply not delayed enough:", d)
+	}
+}
+
+func TestServer_MaxConnsPerIP(t *testing.T) {
+	_, s, c1, scanner1 := testServerGreeted(t, func(s *smtp.Server) {
+		s.MaxConnsPerIP = 1
+		s.ConnQueueTimeout = 100 * time.Millisecond
+	})
+	defer s.Close()
+	defer c1.Close()
+
+	// Queued, then rejected once the timeout expires
+	c2, err := net.Dial("tcp", c1.RemoteAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	scanner2 := bufio.NewScanner(c2)
+	scanner2.Scan()
+	if !strings.HasPrefix(scanner2.Text(), "421 ") {
+		t.Fatal("Invalid greeting for queued connection:", scanner2.Text())
+	}
+
+	// Queued, then accepted once the first connection is closed
+	c3, err := net.Dial("tcp", c1.RemoteAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c3.Close()
+	for s.QueuedConns() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	io.WriteString(c1, "QUIT\r\n")
+	scanner1.Scan()
+	c1.Close()
+
+	scanner3 := bufio.NewScanner(c3)
+	scanner3.Scan()
+	if scanner3.Text() != "220 localhost ESMTP Service Ready" {
+		t.Fatal("Invalid greeting for queued connection:", scanner3.Text())
+	}
+	if n := s.QueuedConns(); n != 0 {
+		t.Fatal("Invalid number of queued connections:", n)
+	}
+}
+
+func TestServer_MaxHeaderBytes(t *testing.T) {
+	be, s, c, scanner, _ := testServerEhlo(t, func(s *smtp.Server) {
+		s.Backend.(*backend).implementTransaction = true
+		s.MaxHeaderBytes = 1024
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "354 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	io.WriteString(c, "Message-ID: <42@nsa.gov>\r\nSubject: Hey\r\n\r\n<3\r\n.\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	hdr := be.transactions[0].Header
+	if hdr == nil || hdr.MessageID != "<42@nsa.gov>" || hdr.Subject != "Hey" {
+		t.Fatal("Invalid message header:", hdr)
+	}
+	if string(be.anonmsgs[0].Data) != "Message-ID: <42@nsa.gov>\r\nSubject: Hey\r\n\r\n<3\r\n" {
+		t.Fatal("Invalid mail data:", string(be.anonmsgs[0].Data))
+	}
+}
+
+func TestServer_RequestReconnect(t *testing.T) {
+	_, s, c1, scanner1, _ := testServerEhlo(t)
+	defer s.Close()
+	defer c1.Close()
+
+	c2, err := net.Dial("tcp", c1.RemoteAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	scanner2 := bufio.NewScanner(c2)
+	scanner2.Scan()
+	io.WriteString(c2, "HELO localhost\r\n")
+	scanner2.Scan()
+
+	// c1 is in the middle of a transaction
+	io.WriteString(c1, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner1.Scan()
+	io.WriteString(c1, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner1.Scan()
+
+	s.RequestReconnect("Reloading configuration")
+
+	// c2 is idle and is closed right away
+	scanner2.Scan()
+	if scanner2.Text() != "421 4.3.2 Reloading configuration" {
+		t.Fatal("Invalid response for idle connection:", scanner2.Text())
+	}
+	if scanner2.Scan() {
+		t.Fatal("Idle connection not closed:", scanner2.Text())
+	}
+
+	io.WriteString(c1, "DATA\r\n")
+	scanner1.Scan()
+	if !strings.HasPrefix(scanner1.Text(), "354 ") {
+		t.Fatal("Invalid DATA response:", scanner1.Text())
+	}
+	io.WriteString(c1, "Hey <3\r\n.\r\n")
+	scanner1.Scan()
+	if !strings.HasPrefix(scanner1.Text(), "250 ") {
+		t.Fatal("Invalid DATA response:", scanner1.Text())
+	}
+	scanner1.Scan()
+	if scanner1.Text() != "421 4.3.2 Reloading configuration" {
+		t.Fatal("Invalid response after transaction:", scanner1.Text())
+	}
+}
+
+func TestServer_DrainConns(t *testing.T) {
+	_, s, c1, scanner1, _ := testServerEhlo(t)
+	defer s.Close()
+	defer c1.Close()
+
+	c2, err := net.Dial("tcp", c1.RemoteAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	scanner2 := bufio.NewScanner(c2)
+	scanner2.Scan()
+	io.WriteString(c2, "HELO localhost\r\n")
+	scanner2.Scan()
+
+	// c1 is in the middle of the message data
+	io.WriteString(c1, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner1.Scan()
+	io.WriteString(c1, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner1.Scan()
+	io.WriteString(c1, "DATA\r\n")
+	scanner1.Scan()
+	io.WriteString(c1, "Hey ")
+
+	drained := s.DrainConns()
+
+	// c2 is idle and is closed right away
+	scanner2.Scan()
+	if scanner2.Text() != "421 4.3.2 Service shutting down, please reconnect" {
+		t.Fatal("Invalid response for idle connection:", scanner2.Text())
+	}
+
+	// New connections are closed after the greeting
+	c3, err := net.Dial("tcp", c1.RemoteAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c3.Close()
+	scanner3 := bufio.NewScanner(c3)
+	scanner3.Scan()
+	scanner3.Scan()
+	if !strings.HasPrefix(scanner3.Text(), "421 ") {
+		t.Fatal("Invalid response for new connection:", scanner3.Text())
+	}
+
+	select {
+	case <-drained:
+		t.Fatal("Connections drained during a message transfer")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	io.WriteString(c1, "<3\r\n.\r\n")
+	scanner1.Scan()
+	if !strings.HasPrefix(scanner1.Text(), "250 ") {
+		t.Fatal("Invalid DATA response:", scanner1.Text())
+	}
+	scanner1.Scan()
+	if !strings.HasPrefix(scanner1.Text(), "421 ") {
+		t.Fatal("Invalid response after transaction:", scanner1.Text())
+	}
+
+	select {
+	case <-drained:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Connections not drained")
+	}
+}
+
+func TestServer_MaxPerConn(t *testing.T) {
+	for _, fn := range []serverConfigureFunc{
+		func(s *smtp.Server) { s.MaxTransactionsPerConn = 1 },
+		func(s *smtp.Server) { s.MaxBytesPerConn = 5 },
+	} {
+		_, s, c, scanner := testServerAuthenticated(t)
+		fn(s)
+
+		io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+		scanner.Scan()
+		io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+		scanner.Scan()
+		io.WriteString(c, "DATA\r\n")
+		scanner.Scan()
+		io.WriteString(c, "Hey <3\r\n.\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "250 ") {
+			t.Fatal("Invalid DATA response:", scanner.Text())
+		}
+
+		io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "421 4.7.0 ") {
+			t.Fatal("Invalid MAIL response:", scanner.Text())
+		}
+		if scanner.Scan() {
+			t.Fatal("Connection not closed:", scanner.Text())
+		}
+
+		c.Close()
+		s.Close()
+	}
+}
+
+func TestServer_AuthExternal(t *testing.T) {
+	serverCert, serverPool := testTLSCertificate(t, "localhost")
+	clientCert, clientPool := testTLSCertificate(t, "relay.example.org")
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    clientPool,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	be := new(backend)
+	s := smtp.NewServer(be)
+	s.Domain = "localhost"
+	go s.Serve(l)
+	defer s.Close()
+
+	for _, tc := range []struct {
+		withCert bool
+		identity string
+		ok       bool
+	}{
+		{withCert: true, ok: true},
+		{withCert: true, identity: "relay.example.org", ok: true},
+		{withCert: true, identity: "root@nsa.gov", ok: false},
+		{withCert: false, ok: false},
+	} {
+		config := &tls.Config{RootCAs: serverPool, ServerName: "localhost"}
+		if tc.withCert {
+			config.Certificates = []tls.Certificate{clientCert}
+		}
+		conn, err := tls.Dial("tcp", l.Addr().String(), config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := smtp.NewClient(conn)
+
+		if c.SupportsAuth("EXTERNAL") != tc.withCert {
+			t.Errorf("EXTERNAL advertised = %v, want %v", !tc.withCert, tc.withCert)
+		}
+		err = c.Auth(sasl.NewExternalClient(tc.identity))
+		if (err == nil) != tc.ok {
+			t.Errorf("AUTH EXTERNAL with identity %q: got error %v", tc.identity, err)
+		}
+		c.Close()
+	}
+}
+
+func TestDialTLSExternal(t *testing.T) {
+	serverCert, serverPool := testTLSCertificate(t, "localhost")
+	clientCert, clientPool := testTLSCertificate(t, "relay.example.org")
+	untrustedCert, _ := testTLSCertificate(t, "mallory.example.org")
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    clientPool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	be := new(backend)
+	s := smtp.NewServer(be)
+	s.Domain = "localhost"
+	go s.Serve(l)
+	defer s.Close()
+
+	config := &tls.Config{
+		RootCAs:      serverPool,
+		ServerName:   "localhost",
+		Certificates: []tls.Certificate{clientCert},
+	}
+	c, err := smtp.DialTLSExternal(l.Addr().String(), config, "")
+	if err != nil {
+		t.Fatal("DialTLSExternal() =", err)
+	}
+	if err := c.Mail("root@nsa.gov", nil); err != nil {
+		t.Error("Mail() after AUTH EXTERNAL =", err)
+	}
+	c.Close()
+
+	config = &tls.Config{
+		RootCAs:      serverPool,
+		ServerName:   "localhost",
+		Certificates: []tls.Certificate{untrustedCert},
+	}
+	var opErr *net.OpError
+	if c, err := smtp.DialTLSExternal(l.Addr().String(), config, ""); err == nil {
+		c.Close()
+		t.Error("DialTLSExternal() with untrusted certificate succeeded")
+	} else if !errors.As(err, &opErr) {
+		t.Errorf("DialTLSExternal() with untrusted certificate = %v, want a wrapped *net.OpError", err)
+	}
+
+	config = &tls.Config{RootCAs: serverPool, ServerName: "localhost"}
+	if c, err := smtp.DialTLSExternal(l.Addr().String(), config, ""); err == nil {
+		c.Close()
+		t.Error("DialTLSExternal() without certificate succeeded")
+	}
+}
+
+func TestServer_SessionLimits(t *testing.T) {
+	_, s, c, scanner := testServerAuthenticated(t, func(s *smtp.Server) {
+		s.MaxRecipients = 1
+		s.Backend.(*backend).sessionMaxRecipients = 3
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	for i := 0; i < 3; i++ {
+		io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "250 ") {
+			t.Fatal("Invalid RCPT response:", scanner.Text())
+		}
+	}
+
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	if scanner.Text() != "452 4.5.3 Maximum limit of 3 recipients reached" {
+		t.Fatal("Invalid RCPT response:", scanner.Text())
+	}
+}
+
+type quotaFunc func(identity, from string) error
+
+func (f quotaFunc) CheckSender(identity, from string) error {
+	return f(identity, from)
+}
+
+func TestServer_Quota(t *testing.T) {
+	var identities []string
+	_, s, c, scanner := testServerAuthenticated(t, func(s *smtp.Server) {
+		s.Quota = quotaFunc(func(identity, from string) error {
+			identities = append(identities, identity)
+			switch from {
+			case "busy@example.org":
+				return &smtp.QuotaError{Temporary: true}
+			case "spammer@example.org":
+				return &smtp.QuotaError{Message: "Account suspended"}
+			}
+			return nil
+		})
+	})
+	defer s.Close()
+	defer c.Close()
+
+	for _, tc := range []struct {
+		from, reply string
+	}{
+		{"busy@example.org", "450 4.7.1 Sending rate limit exceeded, try again later"},
+		{"spammer@example.org", "550 5.7.1 Account suspended"},
+		{"root@nsa.gov", "250 2.0.0 Roger, accepting mail from <root@nsa.gov>"},
+	} {
+		io.WriteString(c, "MAIL FROM:<"+tc.from+">\r\n")
+		scanner.Scan()
+		if scanner.Text() != tc.reply {
+			t.Errorf("Invalid MAIL response for %v: %v", tc.from, scanner.Text())
+		}
+	}
+
+	for _, identity := range identities {
+		if identity != "username" {
+			t.Errorf("CheckSender() called with identity %q, want %q", identity, "username")
+		}
+	}
+}
+
+func TestServer_AuthIdentity(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		set  bool
+		want string
+	}{
+		{"set by backend", true, "bob"},
+		{"not set", false, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			identities := make(chan string, 1)
+			_, s, c, scanner, _ := testServerEhlo(t, func(s *smtp.Server) {
+				s.Quota = quotaFunc(func(identity, from string) error {
+					identities <- identity
+					return nil
+				})
+				s.Backend.(*backend).saslServer = func(conn *smtp.Conn, mech string) sasl.Server {
+					return sasl.NewPlainServer(func(identity, username, password string) error {
+						if tc.set {
+							conn.SetAuthIdentity(username)
+						}
+						return nil
+					})
+				}
+			})
+			defer s.Close()
+			defer c.Close()
+
+			// The authorization identity "alice" is requested by the
+			// client, but not confirmed by the backend
+			io.WriteString(c, "AUTH PLAIN "+base64.StdEncoding.EncodeToString([]byte("alice\x00bob\x00password"))+"\r\n")
+			scanner.Scan()
+			if !strings.HasPrefix(scanner.Text(), "235 ") {
+				t.Fatal("Invalid AUTH response:", scanner.Text())
+			}
+
+			io.WriteString(c, "MAIL FROM:<alice@example.org>\r\n")
+			scanner.Scan()
+			if identity := <-identities; identity != tc.want {
+				t.Errorf("CheckSender() called with identity %q, want %q", identity, tc.want)
+			}
+		})
+	}
+}
+
+func TestServer_MaxVerdictWait(t *testing.T) {
+	_, s, c, scanner := testServerAuthenticated(t, func(s *smtp.Server) {
+		s.MaxVerdictWait = 50 * time.Millisecond
+		s.Backend.(*backend).dataDelay = time.Second
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "354 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	start := time.Now()
+	io.WriteString(c, "Hey <3\r\n.\r\n")
+	scanner.Scan()
+	if scanner.Text() != "451 4.3.0 Timeout waiting for message verdict, try again later" {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("Verdict timeout took %v", d)
+	}
+
+	// The session can't be used while Data is running
+	io.WriteString(c, "NOOP\r\n")
+	if scanner.Scan() {
+		t.Fatal("Expected the connection to be closed, got:", scanner.Text())
+	}
+	if d := time.Since(start); d < time.Second {
+		t.Errorf("Connection closed after %v, before Data returned", d)
+	}
+}
+
+func TestServer_VerdictProgress(t *testing.T) {
+	var calls int32
+	_, s, c, scanner := testServerAuthenticated(t, func(s *smtp.Server) {
+		s.VerdictProgressInterval = 20 * time.Millisecond
+		s.OnVerdictProgress = func(c *smtp.Conn, waited time.Duration) {
+			if waited <= 0 {
+				t.Errorf("Invalid waited duration: %v", waited)
+			}
+			atomic.AddInt32(&calls, 1)
+		}
+		s.Backend.(*backend).dataDelay = 200 * time.Millisecond
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "Hey <3\r\n.\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+	if n := atomic.LoadInt32(&calls); n < 2 {
+		t.Errorf("OnVerdictProgress called %v times, want at least 2", n)
+	}
+}
+
+func TestServer_NotifySession(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		close  func(c net.Conn, scanner *bufio.Scanner)
+		reason string
+	}{
+		{"QUIT", func(c net.Conn, scanner *bufio.Scanner) {
+			io.WriteString(c, "QUIT\r\n")
+			scanner.Scan()
+		}, "quit quit"},
+		{"disconnect", func(c net.Conn, scanner *bufio.Scanner) {
+			c.Close()
+		}, "quit disconnected"},
+		{"timeout", func(c net.Conn, scanner *bufio.Scanner) {
+			scanner.Scan()
+			if !strings.HasPrefix(scanner.Text(), "421 ") {
+				t.Error("Invalid timeout response:", scanner.Text())
+			}
+		}, "quit timeout"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			notifications := make(chan string, 10)
+			_, s, c, scanner := testServerGreeted(t, func(s *smtp.Server) {
+				s.ReadTimeout = 200 * time.Millisecond
+				s.Backend.(*backend).implementNotify = true
+				s.Backend.(*backend).notifications = notifications
+			})
+			defer s.Close()
+			defer c.Close()
+
+			io.WriteString(c, "EHLO localhost\r\n")
+			for scanner.Scan() && !strings.HasPrefix(scanner.Text(), "250 ") {
+			}
+			io.WriteString(c, "RSET\r\n")
+			scanner.Scan()
+			if got := <-notifications; got != "reset" {
+				t.Errorf("Got notification %q, want %q", got, "reset")
+			}
+
+			tc.close(c, scanner)
+			select {
+			case got := <-notifications:
+				if got != tc.reason {
+					t.Errorf("Got notification %q, want %q", got, tc.reason)
+				}
+			case <-time.After(time.Second):
+				t.Error("OnQuit wasn't called")
+			}
+		})
+	}
+}
+
+// lockedBuffer is a bytes.Buffer safe for concurrent use, suitable for
+// Server.ErrorLog.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestServer_Logout(t *testing.T) {
+	serverCert, serverPool := testTLSCertificate(t, "localhost")
+
+	for _, tc := range []struct {
+		name      string
+		configure func(be *backend, s *smtp.Server)
+		run       func(t *testing.T, c net.Conn, scanner *bufio.Scanner) net.Conn
+		logouts   int
+		log       string
+	}{
+		{
+			name: "QUIT",
+			run: func(t *testing.T, c net.Conn, scanner *bufio.Scanner) net.Conn {
+				io.WriteString(c, "QUIT\r\n")
+				scanner.Scan()
+				return c
+			},
+			logouts: 1,
+		},
+		{
+			name: "disconnect",
+			run: func(t *testing.T, c net.Conn, scanner *bufio.Scanner) net.Conn {
+				c.Close()
+				return c
+			},
+			logouts: 1,
+		},
+		{
+			name: "panic",
+			configure: func(be *backend, s *smtp.Server) {
+				be.panicOnMail = true
+			},
+			run: func(t *testing.T, c net.Conn, scanner *bufio.Scanner) net.Conn {
+				io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+				scanner.Scan()
+				if !strings.HasPrefix(scanner.Text(), "421 ") {
+					t.Error("Invalid MAIL response:", scanner.Text())
+				}
+				return c
+			},
+			logouts: 1,
+			log:     "panic serving",
+		},
+		{
+			name: "STARTTLS",
+			configure: func(be *backend, s *smtp.Server) {
+				s.TLSConfig = &tls.Config{Certificates: []tls.Certificate{serverCert}}
+			},
+			run: func(t *testing.T, c net.Conn, scanner *bufio.Scanner) net.Conn {
+				io.WriteString(c, "STARTTLS\r\n")
+				scanner.Scan()
+				if !strings.HasPrefix(scanner.Text(), "220 ") {
+					t.Fatal("Invalid STARTTLS response:", scanner.Text())
+				}
+				tlsConn := tls.Client(c, &tls.Config{RootCAs: serverPool, ServerName: "localhost"})
+				scanner = bufio.NewScanner(tlsConn)
+				io.WriteString(tlsConn, "EHLO localhost\r\n")
+				for scanner.Scan() && !strings.HasPrefix(scanner.Text(), "250 ") {
+				}
+				io.WriteString(tlsConn, "QUIT\r\n")
+				scanner.Scan()
+				return tlsConn
+			},
+			logouts: 2,
+		},
+		{
+			name: "Logout error",
+			configure: func(be *backend, s *smtp.Server) {
+				be.logoutErr = errors.New("database is gone")
+			},
+			run: func(t *testing.T, c net.Conn, scanner *bufio.Scanner) net.Conn {
+				c.Close()
+				return c
+			},
+			logouts: 1,
+			log:     "database is gone",
+		},
+		{
+			name: "Logout panic",
+			configure: func(be *backend, s *smtp.Server) {
+				be.panicOnLogout = true
+			},
+			run: func(t *testing.T, c net.Conn, scanner *bufio.Scanner) net.Conn {
+				c.Close()
+				return c
+			},
+			logouts: 1,
+			log:     "panic in Logout",
+		},
+		{
+			name: "Logout timeout",
+			configure: func(be *backend, s *smtp.Server) {
+				be.logoutDelay = time.Second
+				s.LogoutTimeout = 50 * time.Millisecond
+			},
+			run: func(t *testing.T, c net.Conn, scanner *bufio.Scanner) net.Conn {
+				c.Close()
+				return c
+			},
+			logouts: 1,
+			log:     "timeout logging out",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			errorLog := new(lockedBuffer)
+			be, s, c, scanner, _ := testServerEhlo(t, func(s *smtp.Server) {
+				s.ErrorLog = log.New(errorLog, "", 0)
+				if tc.configure != nil {
+					tc.configure(s.Backend.(*backend), s)
+				}
+			})
+			defer s.Close()
+
+			c = tc.run(t, c, scanner)
+			c.Close()
+
+			deadline := time.Now().Add(2 * time.Second)
+			for {
+				be.logoutsLock.Lock()
+				logouts := be.logouts
+				be.logoutsLock.Unlock()
+				done := logouts >= tc.logouts && strings.Contains(errorLog.String(), tc.log)
+				if done || time.Now().After(deadline) {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			// Give the server a chance to call Logout a second time
+			time.Sleep(50 * time.Millisecond)
+			be.logoutsLock.Lock()
+			logouts := be.logouts
+			be.logoutsLock.Unlock()
+			if logouts != tc.logouts {
+				t.Errorf("Logout called %v times, want %v", logouts, tc.logouts)
+			}
+			if !strings.Contains(errorLog.String(), tc.log) {
+				t.Errorf("Error log %q doesn't contain %q", errorLog.String(), tc.log)
+			}
+		})
+	}
+}
+
+func TestServer_DataReadTimeout(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t, func(s *smtp.Server) {
+		s.ReadTimeout = 100 * time.Millisecond
+		s.DataReadTimeout = time.Second
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "354 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	// The transfer takes longer than ReadTimeout, but keeps progressing
+	for i := 0; i < 5; i++ {
+		time.Sleep(50 * time.Millisecond)
+		io.WriteString(c, "Hey <3\r\n")
+	}
+	io.WriteString(c, ".\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+	if len(be.messages) != 1 {
+		t.Fatal("Invalid number of sent messages:", be.messages)
+	}
+
+	// ReadTimeout applies again between commands
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "421 ") {
+		t.Fatal("Invalid idle response:", scanner.Text())
+	}
+}
+
+func TestServer_XCOMPRESS(t *testing.T) {
+	_, s, c, _, caps := testServerEhlo(t)
+	c.Close()
+	s.Close()
+	if _, ok := caps["XCOMPRESS DEFLATE"]; ok {
+		t.Fatal("XCOMPRESS advertised without EnableXCOMPRESS")
+	}
+
+	be, s, c, _ := testServer(t, func(s *smtp.Server) {
+		s.EnableXCOMPRESS = true
+	})
+	defer s.Close()
+
+	client := smtp.NewClient(c)
+	defer client.Close()
+	if err := client.Compress(); err != nil {
+		t.Fatal("Compress() =", err)
+	}
+	if err := client.Auth(sasl.NewPlainClient("", "username", "password")); err != nil {
+		t.Fatal("Auth() =", err)
+	}
+	msg := "Subject: Compressed\r\n\r\n" + strings.Repeat("Hey <3\r\n", 1000)
+	if err := client.SendMail("root@nsa.gov", []string{"root@gchq.gov.uk"}, strings.NewReader(msg)); err != nil {
+		t.Fatal("SendMail() =", err)
+	}
+	if err := client.Quit(); err != nil {
+		t.Fatal("Quit() =", err)
+	}
+
+	if len(be.messages) != 1 {
+		t.Fatal("Invalid number of sent messages:", be.messages)
+	}
+	if string(be.messages[0].Data) != msg {
+		t.Error("Invalid message data")
+	}
+}
+
+func TestServer_UTF8Replies(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t, func(s *smtp.Server) {
+		s.EnableSMTPUTF8 = true
+		s.Backend.(*backend).userErr = &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 0},
+			Message:      "Adresse\trefusée\x01",
+		}
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if scanner.Text() != "550 5.1.0 Adresse\trefus\\x{E9}e\\x{1}" {
+		t.Error("Invalid MAIL response without SMTPUTF8:", scanner.Text())
+	}
+
+	// A rejected MAIL command doesn't enable UTF-8 replies
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov> SMTPUTF8\r\n")
+	scanner.Scan()
+	if scanner.Text() != "550 5.1.0 Adresse\trefus\\x{E9}e\\x{1}" {
+		t.Error("Invalid rejected MAIL response with SMTPUTF8:", scanner.Text())
+	}
+
+	be.userErr = nil
+	io.WriteString(c, "MAIL FROM:<rené@example.org> SMTPUTF8\r\n")
+	scanner.Scan()
+	if scanner.Text() != "250 2.0.0 Roger, accepting mail from <rené@example.org>" {
+		t.Error("Invalid MAIL response with SMTPUTF8:", scanner.Text())
+	}
+}
+
+func TestServer_Chunking_Errors(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		setup    []string // commands sent before the rejected chunk
+		cmd      string
+		reply    string
+		closed   bool
+		resetTx  bool
+		maxBytes int64
+	}{
+		{
+			name:  "missing RCPT",
+			setup: []string{"MAIL FROM:<root@nsa.gov>"},
+			cmd:   "BDAT 8",
+			reply: "503 5.5.1 Missing RCPT TO command.",
+		},
+		{
+			name:  "missing MAIL",
+			cmd:   "BDAT 8 LAST",
+			reply: "503 5.5.1 Missing MAIL FROM command.",
+		},
+		{
+			name:  "unknown argument",
+			setup: []string{"MAIL FROM:<root@nsa.gov>", "RCPT TO:<root@gchq.gov.uk>"},
+			cmd:   "BDAT 8 FIRST",
+			reply: "501 5.5.4 Unknown BDAT argument",
+		},
+		{
+			name:  "too many arguments",
+			setup: []string{"MAIL FROM:<root@nsa.gov>", "RCPT TO:<root@gchq.gov.uk>"},
+			cmd:   "BDAT 8 LAST NOW",
+			reply: "501 5.5.4 Too many arguments",
+		},
+		{
+			name:    "unknown argument during transfer",
+			setup:   []string{"MAIL FROM:<root@nsa.gov>", "RCPT TO:<root@gchq.gov.uk>", "BDAT 0"},
+			cmd:     "BDAT 8 FIRST",
+			reply:   "501 5.5.4 Unknown BDAT argument",
+			resetTx: true,
+		},
+		{
+			name:     "size exceeded",
+			setup:    []string{"MAIL FROM:<root@nsa.gov>", "RCPT TO:<root@gchq.gov.uk>"},
+			cmd:      "BDAT 8",
+			reply:    "552 5.3.4 Max message size exceeded",
+			resetTx:  true,
+			maxBytes: 4,
+		},
+		{
+			name:   "malformed size",
+			setup:  []string{"MAIL FROM:<root@nsa.gov>", "RCPT TO:<root@gchq.gov.uk>"},
+			cmd:    "BDAT eight",
+			reply:  "501 5.5.4 Malformed size argument, closing connection",
+			closed: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, s, c, scanner := testServerAuthenticated(t, func(s *smtp.Server) {
+				s.MaxMessageBytes = tc.maxBytes
+			})
+			defer s.Close()
+			defer c.Close()
+
+			for _, cmd := range tc.setup {
+				io.WriteString(c, cmd+"\r\n")
+				scanner.Scan()
+				if !strings.HasPrefix(scanner.Text(), "250 ") {
+					t.Fatalf("Invalid %v response: %v", cmd, scanner.Text())
+				}
+			}
+
+			// The chunk looks like a command, it must not be interpreted as
+			// such
+			io.WriteString(c, tc.cmd+"\r\n")
+			io.WriteString(c, "QUIT\r\n\r\n")
+			scanner.Scan()
+			if scanner.Text() != tc.reply {
+				t.Fatalf("Invalid BDAT response: %v", scanner.Text())
+			}
+			if tc.closed {
+				if scanner.Scan() {
+					t.Fatal("Connection not closed, got:", scanner.Text())
+				}
+				return
+			}
+
+			io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+			scanner.Scan()
+			isReset := strings.HasPrefix(scanner.Text(), "503 ")
+			if isReset != (tc.resetTx || len(tc.setup) == 0) {
+				t.Errorf("Invalid RCPT response after rejected chunk: %v", scanner.Text())
+			}
+		})
+	}
+}
+
+func TestServer_UnconsumedData(t *testing.T) {
+	for _, abort := range []bool{false, true} {
+		errorLog := new(lockedBuffer)
+		_, s, c, scanner := testServerAuthenticated(t, func(s *smtp.Server) {
+			s.ErrorLog = log.New(errorLog, "", 0)
+			s.AbortUnconsumedData = abort
+			s.Backend.(*backend).dataSkip = true
+		})
+
+		io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+		scanner.Scan()
+		io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+		scanner.Scan()
+		io.WriteString(c, "DATA\r\n")
+		scanner.Scan()
+		io.WriteString(c, "Hey <3\r\n.\r\n")
+		scanner.Scan()
+
+		if abort {
+			if !strings.HasPrefix(scanner.Text(), "421 ") {
+				t.Error("Invalid DATA response with AbortUnconsumedData:", scanner.Text())
+			}
+			if scanner.Scan() {
+				t.Error("Connection not closed, got:", scanner.Text())
+			}
+		} else if !strings.HasPrefix(scanner.Text(), "250 ") {
+			t.Error("Invalid DATA response:", scanner.Text())
+		}
+		if !strings.Contains(errorLog.String(), "without reading 8 bytes") {
+			t.Errorf("Invalid error log: %q", errorLog.String())
+		}
+
+		c.Close()
+		s.Close()
+	}
+}
+
+func TestServer_DataStats(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t, func(s *smtp.Server) {
+		s.EnableBINARYMIME = true
+		s.Backend.(*backend).implementTransaction = true
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov> BODY=8BITMIME\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "Hey <3\r\n.\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov> BODY=BINARYMIME\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "BDAT 8\r\nHey <3\r\n")
+	scanner.Scan()
+	io.WriteString(c, "BDAT 8 LAST\r\nHey :3\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid BDAT response:", scanner.Text())
+	}
+
+	if len(be.transactions) != 2 {
+		t.Fatal("Invalid number of transactions:", len(be.transactions))
+	}
+	want := smtp.DataStats{Body: smtp.Body8BitMIME}
+	if got := be.transactions[0].DataStats; got != want {
+		t.Errorf("DATA stats = %+v, want %+v", got, want)
+	}
+	want = smtp.DataStats{Body: smtp.BodyBinaryMIME, Chunking: true, Chunks: 2, Size: 16}
+	if got := be.transactions[1].DataStats; got != want {
+		t.Errorf("BDAT stats = %+v, want %+v", got, want)
+	}
+}
+
+type rejectionLog []*smtp.Rejection
+
+func (l *rejectionLog) LogRejection(r *smtp.Rejection) {
+	*l = append(*l, r)
+}
+
+func TestServer_RejectionLogger(t *testing.T) {
+	var log rejectionLog
+	_, s, c, scanner := testServerAuthenticated(t, func(s *smtp.Server) {
+		s.RejectionLogger = &log
+		s.Quota = quotaFunc(func(identity, from string) error {
+			if from == "spammer@example.org" {
+				return &smtp.QuotaError{Message: "Account suspended"}
+			}
+			return nil
+		})
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<spammer@example.org>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "501 ") {
+		t.Fatal("Invalid RCPT response:", scanner.Text())
+	}
+
+	if len(log) != 2 {
+		t.Fatalf("Expected 2 rejections, got %v", len(log))
+	}
+
+	r := log[0]
+	if r.Command != "MAIL" || r.Code != 550 || r.EnhancedCode != (smtp.EnhancedCode{5, 7, 1}) {
+		t.Errorf("Invalid rejection: %v %v %v", r.Command, r.Code, r.EnhancedCode)
+	}
+	if r.Reason != smtp.ReasonPolicy {
+		t.Errorf("Invalid rejection reason: %v", r.Reason)
+	}
+	if r.Identity != "username" || r.Hostname != "localhost" || r.Message != "Account suspended" {
+		t.Errorf("Invalid rejection: identity %q, hostname %q, message %q", r.Identity, r.Hostname, r.Message)
+	}
+	if r.TransactionID != "" {
+		t.Errorf("Unexpected transaction ID: %v", r.TransactionID)
+	}
+
+	r = log[1]
+	if r.Command != "RCPT" || r.Reason != smtp.ReasonProtocol {
+		t.Errorf("Invalid rejection: %v %v", r.Command, r.Reason)
+	}
+	if r.TransactionID == "" {
+		t.Error("Missing transaction ID")
+	}
+}
+
+func TestServer_MaxTooLongLines(t *testing.T) {
+	_, s, c, scanner := testServerAuthenticated(t, func(s *smtp.Server) {
+		s.MaxTooLongLines = 1
+	})
+	defer s.Close()
+	defer c.Close()
+
+	// Pipelined commands around the too long line must still be answered
+	io.WriteString(c, "NOOP\r\nMAIL FROM:<"+strings.Repeat("a", s.MaxLineLength)+">\r\nNOOP\r\n")
+	for _, want := range []string{"250 ", "500 5.5.2 ", "250 "} {
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), want) {
+			t.Fatalf("Invalid response: got %q, want %q", scanner.Text(), want)
+		}
+	}
+
+	// The beginning of a too long line received on its own must not be
+	// handled as a command
+	io.WriteString(c, "MAIL FROM:<")
+	time.Sleep(50 * time.Millisecond)
+	io.WriteString(c, strings.Repeat("a", s.MaxLineLength)+">\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "500 5.4.0 ") {
+		t.Fatal("Invalid response to second too long line:", scanner.Text())
+	}
+	if scanner.Scan() {
+		t.Fatal("Connection not closed, got:", scanner.Text())
+	}
+}
+
+func TestServer_MaxDataLineLength(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t, func(s *smtp.Server) {
+		s.MaxLineLength = 100
+		s.MaxDataLineLength = 1000
+	})
+	defer s.Close()
+	defer c.Close()
+
+	line := strings.Repeat("a", 500)
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, line+"\r\n.\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+	if len(be.messages) != 1 || string(be.messages[0].Data) != line+"\r\n" {
+		t.Fatal("Invalid message data")
+	}
+
+	// The command line limit still applies
+	io.WriteString(c, "MAIL FROM:<"+line+"@nsa.gov>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "500 5.4.0 ") {
+		t.Fatal("Invalid response to too long command:", scanner.Text())
+	}
+}
+
+func TestServer_MaxDataLineLength_exceeded(t *testing.T) {
+	_, s, c, scanner := testServerAuthenticated(t, func(s *smtp.Server) {
+		s.MaxDataLineLength = 100
+		s.MaxTooLongLines = 10
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, strings.Repeat("a", 200)+"\r\nQUIT\r\n.\r\n")
+	scanner.Scan()
+	if strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Message with too long line accepted")
+	}
+
+	// The connection is closed even if too long command lines are tolerated
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "221 ") {
+			t.Fatal("Message data interpreted as commands")
+		}
+	}
+}
+
+func TestServer_ReceivedHeader(t *testing.T) {
+	receivedRegexp := regexp.MustCompile(`^Received: from localhost \(\[127\.0\.0\.1\]\)\r\n` +
+		`\tby localhost with (\w+) id (\w+)\r\n` +
+		`\tfor <root@gchq\.gov\.uk>; [^\r\n]+\r\n` +
+		`Hey <3\r\n$`)
+
+	for _, tc := range []struct {
+		name string
+		auth bool
+		with string
+	}{
+		{"HELO", false, "SMTP"},
+		{"EHLO+AUTH", true, "ESMTPA"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			configure := func(s *smtp.Server) {
+				s.AddReceivedHeader = true
+			}
+
+			var (
+				be      *backend
+				s       *smtp.Server
+				c       net.Conn
+				scanner *bufio.Scanner
+			)
+			if tc.auth {
+				be, s, c, scanner = testServerAuthenticated(t, configure)
+			} else {
+				be, s, c, scanner = testServerGreeted(t, configure)
+				io.WriteString(c, "HELO localhost\r\n")
+				scanner.Scan()
+			}
+			defer s.Close()
+			defer c.Close()
+
+			io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+			scanner.Scan()
+			io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+			scanner.Scan()
+			io.WriteString(c, "DATA\r\n")
+			scanner.Scan()
+			io.WriteString(c, "Hey <3\r\n.\r\n")
+			scanner.Scan()
+			if !strings.HasPrefix(scanner.Text(), "250 ") {
+				t.Fatal("Invalid DATA response:", scanner.Text())
+			}
+
+			msgs := be.messages
+			if !tc.auth {
+				msgs = be.anonmsgs
+			}
+			if len(msgs) != 1 {
+				t.Fatalf("Expected 1 message, got %v", len(msgs))
+			}
+			m := receivedRegexp.FindStringSubmatch(string(msgs[0].Data))
+			if m == nil {
+				t.Fatalf("Invalid message data: %q", msgs[0].Data)
+			}
+			if m[1] != tc.with {
+				t.Errorf("Invalid transmission type: got %v, want %v", m[1], tc.with)
+			}
+		})
+	}
+}
+
+func TestServer_LenientSyntax(t *testing.T) {
+	// In strict mode, the valid form of each command is sent after the
+	// rejection to move to the next state
+	cmds := []struct {
+		cmd, valid, strict, lenient string
+	}{
+		{"HELO", "HELO localhost", "501 ", "250 2.0.0 Hello [127.0.0.1]"},
+		// Rejected commands aren't counted as lenient
+		{"DATA please", "", "501 ", "503 "},
+		{"MAIL FROM :<root@nsa.gov> FOO=BAR", "", "501 ", "500 "},
+		{"MAIL FROM :<root@nsa.gov>", "MAIL FROM:<root@nsa.gov>", "501 ", "250 "},
+		{"RCPT TO : <root@gchq.gov.uk>", "RCPT TO:<root@gchq.gov.uk>", "501 ", "250 "},
+		{"DATA please", "", "501 ", "354 "},
+	}
+
+	for _, lenient := range []bool{false, true} {
+		var conn *smtp.Conn
+		_, s, c, scanner := testServerGreeted(t, func(s *smtp.Server) {
+			s.LenientSyntax = lenient
+			be := s.Backend
+			s.Backend = smtp.BackendFunc(func(c *smtp.Conn) (smtp.Session, error) {
+				conn = c
+				return be.NewSession(c)
+			})
+		})
+
+		for _, tc := range cmds {
+			want := tc.strict
+			if lenient {
+				want = tc.lenient
+			}
+			io.WriteString(c, tc.cmd+"\r\n")
+			scanner.Scan()
+			if !strings.HasPrefix(scanner.Text(), want) {
+				t.Errorf("Invalid response to %q (lenient: %v): got %q, want %q", tc.cmd, lenient, scanner.Text(), want)
+			}
+			if !lenient && tc.valid != "" {
+				io.WriteString(c, tc.valid+"\r\n")
+				scanner.Scan()
+			}
+		}
+
+		if lenient {
+			want := 0
+			for _, tc := range cmds {
+				if !strings.HasPrefix(tc.lenient, "5") {
+					want++
+				}
+			}
+			if n := conn.Stats().LenientCommands; n != want {
+				t.Errorf("LenientCommands = %v, want %v", n, want)
+			}
+		}
+
+		c.Close()
+		s.Close()
+	}
+}
+
+func TestServer_SelfCheck(t *testing.T) {
+	cert, _ := testTLSCertificate(t, "localhost")
+	other, _ := testTLSCertificate(t, "localhost")
+
+	expiredLeaf := *cert.Leaf
+	expiredLeaf.NotAfter = time.Now().Add(-time.Hour)
+	expired := cert
+	expired.Leaf = &expiredLeaf
+
+	mismatched := cert
+	mismatched.PrivateKey = other.PrivateKey
+
+	newServer := func() *smtp.Server {
+		s := smtp.NewServer(new(backend))
+		s.Domain = "localhost"
+		s.ReadTimeout = time.Minute
+		s.WriteTimeout = time.Minute
+		s.MaxMessageBytes = 1024 * 1024
+		return s
+	}
+
+	for _, tc := range []struct {
+		name   string
+		config func(s *smtp.Server)
+		errors []string
+	}{
+		{
+			name: "ok",
+			config: func(s *smtp.Server) {
+				s.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+			},
+		},
+		{
+			name: "expired",
+			config: func(s *smtp.Server) {
+				s.TLSConfig = &tls.Config{Certificates: []tls.Certificate{expired}}
+			},
+			errors: []string{"tls-cert-expired"},
+		},
+		{
+			name: "key-mismatch",
+			config: func(s *smtp.Server) {
+				s.TLSConfig = &tls.Config{Certificates: []tls.Certificate{mismatched}}
+			},
+			errors: []string{"tls-key-mismatch"},
+		},
+		{
+			name: "requiretls-without-tls",
+			config: func(s *smtp.Server) {
+				s.EnableREQUIRETLS = true
+			},
+			errors: []string{"requiretls-without-tls"},
+		},
+		{
+			name: "lmtp-without-socket",
+			config: func(s *smtp.Server) {
+				s.LMTP = true
+			},
+			errors: []string{"addr-missing"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newServer()
+			tc.config(s)
+
+			var errors []string
+			for _, f := range s.SelfCheck() {
+				if f.Severity == smtp.CheckError {
+					errors = append(errors, f.ID)
+				}
+			}
+			if strings.Join(errors, ",") != strings.Join(tc.errors, ",") {
+				t.Errorf("SelfCheck() errors = %v, want %v", errors, tc.errors)
+			}
+		})
+	}
+}
+
+func TestServer_NotifyReady(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	notify, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Skip("unixgram sockets not supported:", err)
+	}
+	defer notify.Close()
+	t.Setenv("NOTIFY_SOCKET", path)
+
+	_, s, c, scanner := testServerGreeted(t, func(s *smtp.Server) {
+		s.NotifyReady = true
+	})
+	defer s.Close()
+	defer c.Close()
+
+	notify.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 64)
+	n, err := notify.Read(buf)
+	if err != nil {
+		t.Fatal("Failed to read notification:", err)
+	}
+	if string(buf[:n]) != "READY=1" {
+		t.Errorf("Invalid notification: %q", buf[:n])
+	}
+
+	io.WriteString(c, "QUIT\r\n")
+	scanner.Scan()
+}
+
+func TestServer_CommandOrder(t *testing.T) {
+	commands := map[string]string{
+		"MAIL":      "MAIL FROM:<root@nsa.gov>\r\n",
+		"RCPT":      "RCPT TO:<root@gchq.gov.uk>\r\n",
+		"DATA":      "DATA\r\n",
+		"BDAT":      "BDAT 4\r\ntest",
+		"AUTH":      "AUTH PLAIN AHVzZXJuYW1lAHBhc3N3b3Jk\r\n",
+		"STARTTLS":  "STARTTLS\r\n",
+		"XCOMPRESS": "XCOMPRESS LZ4\r\n",
+	}
+
+	for _, st := range []struct {
+		name    string
+		setup   []string
+		allowed []string
+	}{
+		{
+			name:    "init",
+			allowed: []string{"STARTTLS", "XCOMPRESS"},
+		},
+		{
+			name:    "ready",
+			setup:   []string{"EHLO localhost\r\n"},
+			allowed: []string{"MAIL", "AUTH", "STARTTLS", "XCOMPRESS"},
+		},
+		{
+			name:    "mail",
+			setup:   []string{"EHLO localhost\r\n", commands["MAIL"]},
+			allowed: []string{"RCPT", "STARTTLS"},
+		},
+		{
+			name:    "rcpt",
+			setup:   []string{"EHLO localhost\r\n", commands["MAIL"], commands["RCPT"]},
+			allowed: []string{"RCPT", "DATA", "BDAT", "STARTTLS"},
+		},
+		{
+			name:    "bdat",
+			setup:   []string{"EHLO localhost\r\n", commands["MAIL"], commands["RCPT"], commands["BDAT"]},
+			allowed: []string{"BDAT"},
+		},
+	} {
+		for name, cmd := range commands {
+			allowed := false
+			for _, a := range st.allowed {
+				if a == name {
+					allowed = true
+				}
+			}
+
+			t.Run(st.name+"/"+name, func(t *testing.T) {
+				_, s, c, scanner := testServerGreeted(t, func(s *smtp.Server) {
+					s.EnableXCOMPRESS = true
+				})
+				defer s.Close()
+				defer c.Close()
+
+				readReply := func() string {
+					for scanner.Scan() {
+						if l := scanner.Text(); len(l) < 4 || l[3] != '-' {
+							return l
+						}
+					}
+					t.Fatal("Connection closed:", scanner.Err())
+					return ""
+				}
+
+				for _, setup := range st.setup {
+					io.WriteString(c, setup)
+					if reply := readReply(); !strings.HasPrefix(reply, "250 ") {
+						t.Fatalf("Invalid response to %q: %v", setup, reply)
+					}
+				}
+
+				io.WriteString(c, cmd)
+				reply := readReply()
+				if allowed && strings.HasPrefix(reply, "503 ") {
+					t.Errorf("Command rejected: %v", reply)
+				} else if !allowed && !strings.HasPrefix(reply, "503 5.5.1 ") {
+					t.Errorf("Invalid response, want 503: %v", reply)
+				}
+			})
+		}
+	}
+}
+
+func TestServer_AcceptedReply(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t, func(s *smtp.Server) {
+		s.Backend.(*backend).acceptedReply = &smtp.AcceptedReply{
+			EnhancedCode: smtp.EnhancedCode{2, 1, 0},
+			Lines: []string{
+				"Accepted",
+				"Policy: https://example.org/policy",
+			},
+		}
+	})
+	defer s.Close()
+	defer c.Close()
+
+	want := []string{
+		"250-Accepted",
+		"250 2.1.0 Policy: https://example.org/policy",
+	}
+	for _, cmd := range []string{"MAIL FROM:<root@nsa.gov>", "RCPT TO:<root@gchq.gov.uk>"} {
+		io.WriteString(c, cmd+"\r\n")
+		for _, w := range want {
+			scanner.Scan()
+			if scanner.Text() != w {
+				t.Fatalf("Invalid response to %q: got %q, want %q", cmd, scanner.Text(), w)
+			}
+		}
+	}
+
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "Hey <3\r\n.\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+	if len(be.messages) != 1 || len(be.messages[0].To) != 1 {
+		t.Fatalf("Invalid delivered messages: %v", be.messages)
+	}
+}
+
+func TestServer_DataBdatMix(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		lines []string // client lines, followed by the expected reply prefix
+		msg   string   // message delivered, if any
+	}{
+		{
+			name: "DATA after BDAT",
+			lines: []string{
+				"BDAT 4\r\ntest", "250 2.0.0 Continue",
+				"DATA\r\n", "503 5.5.1 DATA not allowed after BDAT, end the message with BDAT LAST",
+				"BDAT 0 LAST\r\n", "250 2.0.0 OK: queued",
+			},
+			msg: "test",
+		},
+		{
+			name: "BDAT after DATA",
+			lines: []string{
+				"DATA\r\n", "354 ",
+				"Hey <3\r\n.\r\n", "250 2.0.0 OK: queued",
+				"BDAT 4 LAST\r\ntest", "503 5.5.1 Missing MAIL FROM command.",
+				"NOOP\r\n", "250 ",
+			},
+			msg: "Hey <3\r\n",
+		},
+		{
+			name: "DATA after rejected BDAT",
+			lines: []string{
+				"BDAT 4 FIRST\r\ntest", "501 5.5.4 Unknown BDAT argument",
+				"DATA\r\n", "354 ",
+				"Hey <3\r\n.\r\n", "250 2.0.0 OK: queued",
+			},
+			msg: "Hey <3\r\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			be, s, c, scanner := testServerGreeted(t)
+			defer s.Close()
+			defer c.Close()
+
+			lines := append([]string{
+				"EHLO localhost\r\n", "250 ",
+				"MAIL FROM:<root@nsa.gov>\r\n", "250 ",
+				"RCPT TO:<root@gchq.gov.uk>\r\n", "250 ",
+			}, tc.lines...)
+			for i := 0; i < len(lines); i += 2 {
+				io.WriteString(c, lines[i])
+				for scanner.Scan() {
+					if l := scanner.Text(); len(l) < 4 || l[3] != '-' {
+						break
+					}
+				}
+				if !strings.HasPrefix(scanner.Text(), lines[i+1]) {
+					t.Fatalf("Invalid response to %q: got %q, want %q", lines[i], scanner.Text(), lines[i+1])
+				}
+			}
+
+			if len(be.anonmsgs) != 1 || string(be.anonmsgs[0].Data) != tc.msg {
+				t.Errorf("Delivered messages = %v, want a single message %q", be.anonmsgs, tc.msg)
+			}
+		})
+	}
+}
+
+func TestServer_Extension(t *testing.T) {
+	ext := &smtp.Extension{
+		Keyword: "XFOO",
+		Params:  []string{"BAR"},
+		Commands: []smtp.ExtensionCommand{{
+			Verb: "XFOO",
+			Help: "XFOO <text>\nEchoes text",
+			Handler: func(c *smtp.Conn, arg string) {
+				c.WriteResponse(250, smtp.EnhancedCode{2, 0, 0}, "foo "+arg)
+			},
+		}},
+		Enabled: func(c *smtp.Conn) bool {
+			return c.Hostname() != "untrusted"
+		},
+	}
+
+	s := smtp.NewServer(new(backend))
+	if err := s.RegisterExtension(ext); err != nil {
+		t.Fatalf("RegisterExtension() = %v", err)
+	}
+	if err := s.RegisterExtension(ext); err == nil {
+		t.Error("RegisterExtension() succeeded for an already registered command")
+	}
+	err := s.RegisterExtension(&smtp.Extension{
+		Commands: []smtp.ExtensionCommand{{Verb: "mail", Handler: ext.Commands[0].Handler}},
+	})
+	if err == nil {
+		t.Error("RegisterExtension() succeeded for a built-in command")
+	}
+
+	_, s, c, scanner, caps := testServerEhlo(t, func(s *smtp.Server) {
+		if err := s.RegisterExtension(ext); err != nil {
+			t.Fatalf("RegisterExtension() = %v", err)
+		}
+	})
+	defer s.Close()
+	defer c.Close()
+
+	if !caps["XFOO BAR"] {
+		t.Errorf("Extension not advertised: %v", caps)
+	}
+
+	io.WriteString(c, "xfoo hello\r\n")
+	scanner.Scan()
+	if scanner.Text() != "250 2.0.0 foo hello" {
+		t.Error("Invalid XFOO response:", scanner.Text())
+	}
+
+	io.WriteString(c, "HELP\r\n")
+	var lines []string
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+		if !strings.HasPrefix(scanner.Text(), "214-") {
+			break
+		}
+	}
+	expected := []string{"214-Extension commands:", "214 2.0.0 XFOO - XFOO <text>"}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Invalid HELP response: %q", lines)
+	}
+
+	io.WriteString(c, "HELP xfoo\r\n")
+	lines = nil
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+		if !strings.HasPrefix(scanner.Text(), "214-") {
+			break
+		}
+	}
+	expected = []string{"214-XFOO <text>", "214 2.0.0 Echoes text"}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Invalid HELP XFOO response: %q", lines)
+	}
+
+	io.WriteString(c, "HELP MAIL\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "504 ") {
+		t.Error("Invalid HELP MAIL response:", scanner.Text())
+	}
+
+	// Disabled for this client
+	io.WriteString(c, "EHLO untrusted\r\n")
+	for scanner.Scan() {
+		if scanner.Text() == "250-XFOO BAR" || scanner.Text() == "250 XFOO BAR" {
+			t.Error("Disabled extension advertised")
+		}
+		if strings.HasPrefix(scanner.Text(), "250 ") {
+			break
+		}
+	}
+	io.WriteString(c, "XFOO hello\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "500 ") {
+		t.Error("Invalid XFOO response for disabled extension:", scanner.Text())
+	}
+	io.WriteString(c, "HELP\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "502 ") {
+		t.Error("Invalid HELP response without extensions:", scanner.Text())
+	}
+}
+
+func TestServer_ContextSession(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t, func(s *smtp.Server) {
+		s.Backend.(*backend).contextDone = make(chan error, 1)
+	})
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid RCPT response:", scanner.Text())
+	}
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "354 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+	io.WriteString(c, "Hey <3\r\n.\r\n")
+
+	// DataContext only returns once the connection context is cancelled
+	select {
+	case err := <-be.contextDone:
+		t.Fatal("DataContext returned before the server was closed:", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	s.Close()
+	select {
+	case err := <-be.contextDone:
+		if err != context.Canceled {
+			t.Errorf("Context error = %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Connection context not cancelled on server close")
+	}
+}
+
+func TestServer_DataKeepAlive(t *testing.T) {
+	for _, bdat := range []bool{false, true} {
+		name := "DATA"
+		if bdat {
+			name = "BDAT"
+		}
+		t.Run(name, func(t *testing.T) {
+			be, s, c, scanner := testServerAuthenticated(t, func(s *smtp.Server) {
+				s.Backend.(*backend).contextDone = make(chan error, 1)
+				s.DataKeepAlive = time.Second
+				s.ErrorLog = log.New(ioutil.Discard, "", 0)
+			})
+			defer s.Close()
+			defer c.Close()
+
+			io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+			scanner.Scan()
+			io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+			scanner.Scan()
+			if !strings.HasPrefix(scanner.Text(), "250 ") {
+				t.Fatal("Invalid RCPT response:", scanner.Text())
+			}
+			if bdat {
+				io.WriteString(c, "BDAT 8 LAST\r\nHey <3\r\n")
+			} else {
+				io.WriteString(c, "DATA\r\n")
+				scanner.Scan()
+				if !strings.HasPrefix(scanner.Text(), "354 ") {
+					t.Fatal("Invalid DATA response:", scanner.Text())
+				}
+				io.WriteString(c, "Hey <3\r\n.\r\n")
+			}
+
+			select {
+			case err := <-be.contextDone:
+				t.Fatal("DataContext returned before the client went away:", err)
+			case <-time.After(50 * time.Millisecond):
+			}
+
+			// The client goes away while the message is processed
+			c.Close()
+			select {
+			case err := <-be.contextDone:
+				if err != context.Canceled {
+					t.Errorf("Context error = %v, want %v", err, context.Canceled)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Connection context not cancelled when the client went away")
+			}
+		})
+	}
+}
+
+func TestServer_BDATSizeMismatch(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		policy smtp.SizeMismatchPolicy
+		size   int
+		chunks []string
+		reply  string
+		log    bool
+	}{
+		{
+			name:   "match",
+			policy: smtp.SizeMismatchReject,
+			size:   16,
+			chunks: []string{"BDAT 8\r\nHey <3\r\n", "BDAT 8 LAST\r\nHey :3\r\n"},
+			reply:  "250 ",
+		},
+		{
+			name:   "smaller",
+			policy: smtp.SizeMismatchReject,
+			size:   20,
+			chunks: []string{"BDAT 8\r\nHey <3\r\n", "BDAT 8 LAST\r\nHey :3\r\n"},
+			reply:  "554 5.5.4 ",
+		},
+		{
+			name:   "larger",
+			policy: smtp.SizeMismatchReject,
+			size:   4,
+			chunks: []string{"BDAT 8\r\nHey <3\r\n"},
+			reply:  "554 5.5.4 ",
+		},
+		{
+			name:   "log",
+			policy: smtp.SizeMismatchLog,
+			size:   20,
+			chunks: []string{"BDAT 8\r\nHey <3\r\n", "BDAT 8 LAST\r\nHey :3\r\n"},
+			reply:  "250 ",
+			log:    true,
+		},
+		{
+			name:   "ignore",
+			size:   20,
+			chunks: []string{"BDAT 8\r\nHey <3\r\n", "BDAT 8 LAST\r\nHey :3\r\n"},
+			reply:  "250 ",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			errorLog := new(lockedBuffer)
+			_, s, c, scanner, _ := testServerEhlo(t, func(s *smtp.Server) {
+				s.ErrorLog = log.New(errorLog, "", 0)
+				s.BDATSizeMismatch = tc.policy
+			})
+			defer s.Close()
+			defer c.Close()
+
+			fmt.Fprintf(c, "MAIL FROM:<root@nsa.gov> SIZE=%v\r\n", tc.size)
+			scanner.Scan()
+			io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+			scanner.Scan()
+			for _, chunk := range tc.chunks {
+				io.WriteString(c, chunk)
+				scanner.Scan()
+			}
+			if !strings.HasPrefix(scanner.Text(), tc.reply) {
+				t.Errorf("Invalid BDAT response, want %q: %v", tc.reply, scanner.Text())
+			}
+
+			// The transaction is over, the server is ready for another one
+			io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+			scanner.Scan()
+			if !strings.HasPrefix(scanner.Text(), "250 ") {
+				t.Errorf("Invalid MAIL response: %v", scanner.Text())
+			}
+
+			logged := strings.Contains(errorLog.String(), "declared SIZE=20 but sent 16 bytes")
+			if logged != tc.log {
+				t.Errorf("Mismatch logged = %v, want %v: %q", logged, tc.log, errorLog.String())
+			}
+		})
+	}
+}
+
+func TestServer_MinDataRate(t *testing.T) {
+	_, s, c, scanner := testServerAuthenticated(t, func(s *smtp.Server) {
+		s.MinDataRate = 1000
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "354 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	// Stall after a few bytes
+	io.WriteString(c, "Hey <3\r\n")
+	start := time.Now()
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "421 ") {
+			break
+		}
+	}
+	if scanner.Text() != "421 4.4.2 Transfer rate too low, closing connection" {
+		t.Fatal("Invalid response to slow transfer:", scanner.Text())
+	}
+	if d := time.Since(start); d > 3*time.Second {
+		t.Errorf("Slow transfer detected after %v", d)
+	}
+	if scanner.Scan() {
+		t.Fatal("Connection not closed, got:", scanner.Text())
+	}
+}
+
+func TestServer_MaxCommandTime(t *testing.T) {
+	_, s, c, scanner := testServerGreeted(t, func(s *smtp.Server) {
+		s.ReadTimeout = 5 * time.Second
+		s.MaxCommandTime = 100 * time.Millisecond
+	})
+	defer s.Close()
+	defer c.Close()
+
+	// Waiting before a command isn't limited
+	time.Sleep(200 * time.Millisecond)
+	io.WriteString(c, "NOOP\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid NOOP response:", scanner.Text())
+	}
+
+	io.WriteString(c, "NO")
+	time.Sleep(200 * time.Millisecond)
+	io.WriteString(c, "OP\r\n")
+	scanner.Scan()
+	if scanner.Text() != "421 4.4.2 Command not received in time, bye bye" {
+		t.Fatal("Invalid response to slow command:", scanner.Text())
+	}
+	if scanner.Scan() {
+		t.Fatal("Connection not closed, got:", scanner.Text())
+	}
+}
+
+// fakeClock is a Clock stuck at a fixed time. Timers up to maxDelay fire
+// immediately, longer ones never fire.
+type fakeClock struct {
+	now      time.Time
+	maxDelay time.Duration
+
+	mu     sync.Mutex
+	timers []time.Duration
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) smtp.Timer {
+	c.mu.Lock()
+	c.timers = append(c.timers, d)
+	c.mu.Unlock()
+
+	ch := make(chan time.Time, 1)
+	if d <= c.maxDelay {
+		ch <- c.now
+	}
+	return fakeTimer(ch)
+}
+
+type fakeTimer chan time.Time
+
+func (t fakeTimer) C() <-chan time.Time {
+	return t
+}
+
+func (t fakeTimer) Stop() bool {
+	return false
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
+
+type errReader struct{}
+
+func (errReader) Read(b []byte) (int, error) {
+	return 0, errors.New("entropy source unavailable")
+}
+
+func TestServer_RandError(t *testing.T) {
+	_, s, c, scanner := testServerGreeted(t, func(s *smtp.Server) {
+		s.Rand = errReader{}
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "HELO localhost\r\n")
+	scanner.Scan()
+
+	// The transaction ID can't be generated, the client can try again later
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "451 4.3.0 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "503 ") {
+		t.Fatal("Invalid RCPT response:", scanner.Text())
+	}
+}
+
+func TestServer_Clock(t *testing.T) {
+	clock := &fakeClock{
+		now:      time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		maxDelay: time.Hour,
+	}
+	be, s, c, scanner := testServerGreeted(t, func(s *smtp.Server) {
+		s.Clock = clock
+		s.Rand = zeroReader{}
+		s.AddReceivedHeader = true
+		s.LogoutTimeout = 24 * time.Hour
+		s.Tarpit = &smtp.Tarpit{
+			Delay:          time.Hour,
+			ErrorThreshold: 1,
+		}
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "HELO localhost\r\n")
+	scanner.Scan()
+
+	// Flags the session, the following replies are delayed by an hour
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "503 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "Hey <3\r\n.\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	clock.mu.Lock()
+	timers := clock.timers
+	clock.mu.Unlock()
+	// MAIL, RCPT, DATA and the two DATA replies
+	if len(timers) != 5 {
+		t.Errorf("Expected 5 tarpit delays, got %v", timers)
+	}
+	for _, d := range timers {
+		if d != time.Hour {
+			t.Errorf("Expected tarpit delays of an hour, got %v", timers)
+			break
+		}
+	}
+
+	if len(be.anonmsgs) != 1 {
+		t.Fatalf("Expected 1 message, got %v", len(be.anonmsgs))
+	}
+	data := string(be.anonmsgs[0].Data)
+	for _, s := range []string{"id 01HK421P480000000000000000", "; Tue, 02 Jan 2024 03:04:05 +0000\r\n"} {
+		if !strings.Contains(data, s) {
+			t.Errorf("Message data %q doesn't contain %q", data, s)
+		}
+	}
+}
+
+// writeCountListener counts the writes to the connections it accepts.
+type writeCountListener struct {
+	net.Listener
+
+	mu     sync.Mutex
+	writes int
+}
+
+func (l *writeCountListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &writeCountConn{Conn: c, l: l}, nil
+}
+
+func (l *writeCountListener) Writes() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.writes
+}
+
+type writeCountConn struct {
+	net.Conn
+	l *writeCountListener
+}
+
+func (c *writeCountConn) Write(b []byte) (int, error) {
+	c.l.mu.Lock()
+	c.l.writes++
+	c.l.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+func TestServer_Pipelining(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wl := &writeCountListener{Listener: l}
+
+	be := new(backend)
+	s := smtp.NewServer(be)
+	s.Domain = "localhost"
+	go s.Serve(wl)
+	defer s.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	scanner := bufio.NewScanner(c)
+
+	scanner.Scan()
+	if n := wl.Writes(); n != 1 {
+		t.Errorf("Greeting sent in %v writes", n)
+	}
+
+	io.WriteString(c, "EHLO localhost\r\n"+
+		"MAIL FROM:<root@nsa.gov>\r\n"+
+		"RCPT TO:<root@gchq.gov.uk>\r\n"+
+		"RCPT TO:<root@bnd.bund.de>\r\n"+
+		"DATA\r\n")
+	for scanner.Scan() && strings.HasPrefix(scanner.Text(), "250-") {
+	}
+	for _, prefix := range []string{"250 ", "250 ", "250 ", "354 "} {
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), prefix) {
+			t.Fatalf("Invalid response: got %q, want %q", scanner.Text(), prefix)
+		}
+	}
+	if n := wl.Writes(); n != 2 {
+		t.Errorf("Replies to the pipelined commands sent in %v writes", n-1)
+	}
+
+	io.WriteString(c, "Hey <3\r\n.\r\nQUIT\r\n")
+	for _, prefix := range []string{"250 ", "221 "} {
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), prefix) {
+			t.Fatalf("Invalid response: got %q, want %q", scanner.Text(), prefix)
+		}
+	}
+	if n := wl.Writes(); n != 3 {
+		t.Errorf("Replies to the message data and QUIT sent in %v writes", n-2)
+	}
+
+	if len(be.anonmsgs) != 1 || !reflect.DeepEqual(be.anonmsgs[0].To, []string{"root@gchq.gov.uk", "root@bnd.bund.de"}) {
+		t.Errorf("Invalid messages: %v", be.anonmsgs)
+	}
+}
+
+func TestServer_PipeliningWriteTimeout(t *testing.T) {
+	_, s, c, scanner, _ := testServerEhlo(t, func(s *smtp.Server) {
+		s.WriteTimeout = 100 * time.Millisecond
+	})
+	defer s.Close()
+	defer c.Close()
+
+	// The deadline of the last write has expired
+	time.Sleep(200 * time.Millisecond)
+
+	// More replies than the write buffer can hold
+	const n = 200
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(c, strings.Repeat("NOOP\r\n", n))
+	for i := 0; i < n; i++ {
+		if !scanner.Scan() {
+			t.Fatalf("Failed to read reply %v: %v", i, scanner.Err())
+		}
+		if !strings.HasPrefix(scanner.Text(), "250 ") {
+			t.Fatalf("Invalid NOOP response: %v", scanner.Text())
+		}
+	}
+}
+
+func BenchmarkServer_Pipelining(b *testing.B) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	s := smtp.NewServer(smtp.BackendFunc(func(c *smtp.Conn) (smtp.Session, error) {
+		return &session{backend: &backend{}, anonymous: true}, nil
+	}))
+	s.Domain = "localhost"
+	go s.Serve(l)
+	defer s.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer c.Close()
+	r := bufio.NewReader(c)
+
+	io.WriteString(c, "EHLO localhost\r\n")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			b.Fatal(err)
+		}
+		if strings.HasPrefix(line, "250 ") {
+			break
+		}
+	}
+
+	burst := "MAIL FROM:<root@nsa.gov>\r\n" +
+		"RCPT TO:<root@gchq.gov.uk>\r\n" +
+		"DATA\r\n" +
+		"Hey <3\r\n.\r\n"
+	b.SetBytes(int64(len(burst)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := io.WriteString(c, burst); err != nil {
+			b.Fatal(err)
+		}
+		for j := 0; j < 4; j++ {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				b.Fatal(err)
+			}
+			if line[0] != '2' && line[0] != '3' {
+				b.Fatalf("Invalid response: %q", line)
+			}
+		}
+	}
+}
+
+func TestServer_Flush(t *testing.T) {
+	release := make(chan struct{})
+	ext := &smtp.Extension{
+		Keyword: "XSLOW",
+		Commands: []smtp.ExtensionCommand{{
+			Verb: "XSLOW",
+			Handler: func(c *smtp.Conn, arg string) {
+				c.WriteResponse(250, smtp.EnhancedCode{2, 0, 0}, "Started\nWorking")
+				if err := c.Flush(); err != nil {
+					t.Errorf("Flush() = %v", err)
+				}
+				<-release
+			},
+		}},
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wl := &writeCountListener{Listener: l}
+
+	s := smtp.NewServer(new(backend))
+	s.Domain = "localhost"
+	s.AllowInsecureAuth = true
+	s.EnableSMTPUTF8 = true
+	s.EnableREQUIRETLS = true
+	s.EnableBINARYMIME = true
+	s.EnableDSN = true
+	if err := s.RegisterExtension(ext); err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(wl)
+	defer s.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	scanner := bufio.NewScanner(c)
+	scanner.Scan()
+
+	io.WriteString(c, "EHLO localhost\r\n")
+	for scanner.Scan() && !strings.HasPrefix(scanner.Text(), "250 ") {
+	}
+	if n := wl.Writes(); n != 2 {
+		t.Errorf("EHLO reply sent in %v writes", n-1)
+	}
+
+	io.WriteString(c, "XSLOW\r\n")
+	for _, want := range []string{"250-Started", "250 2.0.0 Working"} {
+		scanner.Scan()
+		if scanner.Text() != want {
+			t.Errorf("Invalid XSLOW response: got %q, want %q", scanner.Text(), want)
+		}
+	}
+	close(release)
+}
+
+func TestServer_RcptForwarding(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t, func(s *smtp.Server) {
+		s.Backend.(*backend).forwards = map[string]*smtp.ForwardingResult{
+			"bob@example.org":   {Address: "bob@example.net"},
+			"alice@example.org": {Address: "alice@example.com", Permanent: true},
+		}
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+
+	for _, tc := range []struct {
+		rcpt, reply string
+	}{
+		{"bob@example.org", "251 2.1.5 User not local; will forward to <bob@example.net>"},
+		{"alice@example.org", "551 5.1.6 User not local; please try <alice@example.com>"},
+	} {
+		io.WriteString(c, "RCPT TO:<"+tc.rcpt+">\r\n")
+		scanner.Scan()
+		if scanner.Text() != tc.reply {
+			t.Errorf("Invalid RCPT response for %v: got %q, want %q", tc.rcpt, scanner.Text(), tc.reply)
+		}
+	}
+
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "Hey <3\r\n.\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+	if len(be.messages) != 1 || !reflect.DeepEqual(be.messages[0].To, []string{"bob@example.org"}) {
+		t.Errorf("Invalid messages: %v", be.messages)
+	}
+}
+
+// saslScript is a SASL server expecting a fixed sequence of client responses.
+type saslScript []saslStep
+
+type saslStep struct {
+	response  []byte // expected client response, nil if none
+	challenge []byte
+	done      bool
+}
+
+func (script *saslScript) Next(response []byte) (challenge []byte, done bool, err error) {
+	if len(*script) == 0 {
+		return nil, false, errors.New("unexpected response")
+	}
+	step := (*script)[0]
+	*script = (*script)[1:]
+	if (response == nil) != (step.response == nil) || !bytes.Equal(response, step.response) {
+		return nil, false, fmt.Errorf("unexpected response %q, want %q", response, step.response)
+	}
+	return step.challenge, step.done, nil
+}
+
+func TestServer_AuthExchange(t *testing.T) {
+	final := []saslStep{
+		{response: []byte{}, challenge: nil},
+		{response: []byte("hello"), challenge: []byte("final"), done: true},
+	}
+
+	for _, tc := range []struct {
+		name   string
+		script []saslStep
+		lines  []string // client lines, followed by the expected reply
+	}{
+		{
+			name:   "empty initial response",
+			script: final,
+			lines: []string{
+				"AUTH X-TEST_MECH-1 =", "334 ",
+				"aGVsbG8=", "334 ZmluYWw=",
+				"", "235 2.0.0 Authentication succeeded",
+			},
+		},
+		{
+			name:   "no initial response",
+			script: append([]saslStep{{response: nil, challenge: nil}}, final[1:]...),
+			lines: []string{
+				"AUTH X-TEST_MECH-1", "334 ",
+				"aGVsbG8=", "334 ZmluYWw=",
+				"=", "235 2.0.0 Authentication succeeded",
+			},
+		},
+		{
+			name:   "additional data not acknowledged",
+			script: final,
+			lines: []string{
+				"AUTH X-TEST_MECH-1 =", "334 ",
+				"aGVsbG8=", "334 ZmluYWw=",
+				"aGVsbG8=", "501 5.5.2 Expected an empty response",
+			},
+		},
+		{
+			name:   "cancelled",
+			script: final,
+			lines: []string{
+				"AUTH X-TEST_MECH-1 =", "334 ",
+				"*", "501 5.0.0 Negotiation cancelled",
+			},
+		},
+		{
+			name:   "too long line",
+			script: final,
+			lines: []string{
+				"AUTH X-TEST_MECH-1 =", "334 ",
+				strings.Repeat("A", 200), "500 5.5.6 Authentication Exchange line is too long",
+				"NOOP", "250 2.0.0 I have successfully done nothing",
+			},
+		},
+		{
+			name:  "invalid mechanism name",
+			lines: []string{"AUTH PL@IN", "501 5.5.2 Invalid mechanism name"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, s, c, scanner, _ := testServerEhlo(t, func(s *smtp.Server) {
+				s.MaxAuthLineLength = 100
+				s.Backend.(*backend).saslServer = func(conn *smtp.Conn, mech string) sasl.Server {
+					if mech != "X-TEST_MECH-1" {
+						t.Errorf("Invalid mechanism %q", mech)
+					}
+					script := saslScript(append([]saslStep(nil), tc.script...))
+					return &script
+				}
+			})
+			defer s.Close()
+			defer c.Close()
+
+			for i := 0; i < len(tc.lines); i += 2 {
+				io.WriteString(c, tc.lines[i]+"\r\n")
+				scanner.Scan()
+				if scanner.Text() != tc.lines[i+1] {
+					t.Fatalf("Invalid response to %q: got %q, want %q", tc.lines[i], scanner.Text(), tc.lines[i+1])
+				}
+			}
+		})
+	}
+}
+
+func TestServer_AuthLimits(t *testing.T) {
+	var conn *smtp.Conn
+	_, s, c, scanner, _ := testServerEhlo(t, func(s *smtp.Server) {
+		s.MaxAuthExchanges = 2
+		s.MaxAuthResponseSize = 4
+		s.Backend.(*backend).saslServer = func(conn *smtp.Conn, mech string) sasl.Server {
+			script := saslScript{
+				{response: []byte{}, challenge: []byte("more")},
+				{response: []byte("hell"), challenge: []byte("more")},
+				{response: []byte("hell"), challenge: []byte("more")},
+			}
+			return &script
+		}
+		be := s.Backend
+		s.Backend = smtp.BackendFunc(func(c *smtp.Conn) (smtp.Session, error) {
+			conn = c
+			return be.NewSession(c)
+		})
+	})
+	defer s.Close()
+	defer c.Close()
+
+	lines := []string{
+		"AUTH X-TEST_MECH-1 =", "334 bW9yZQ==",
+		"aGVsbA==", "334 bW9yZQ==",
+		"aGVsbA==", "535 5.7.8 Too many authentication exchanges",
+		"AUTH X-TEST_MECH-1 =", "334 bW9yZQ==",
+		"aGVsbG8=", "500 5.5.6 Authentication response too large",
+		"AUTH X-TEST_MECH-1 aGVsbG8=", "500 5.5.6 Authentication response too large",
+		"NOOP", "250 2.0.0 I have successfully done nothing",
+	}
+	for i := 0; i < len(lines); i += 2 {
+		io.WriteString(c, lines[i]+"\r\n")
+		scanner.Scan()
+		if scanner.Text() != lines[i+1] {
+			t.Fatalf("Invalid response to %q: got %q, want %q", lines[i], scanner.Text(), lines[i+1])
+		}
+	}
+
+	stats := conn.Stats()
+	if stats.AuthChallenges != 3 {
+		t.Errorf("AuthChallenges = %v, want 3", stats.AuthChallenges)
+	}
+	if stats.AuthLimitsExceeded != 3 {
+		t.Errorf("AuthLimitsExceeded = %v, want 3", stats.AuthLimitsExceeded)
+	}
+}
+
+func TestServer_AuthLogin(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		lines []string // client lines, followed by the expected reply
+	}{
+		{
+			name: "prompts",
+			lines: []string{
+				"AUTH LOGIN", "334 VXNlcm5hbWU6",
+				"dXNlcm5hbWU=", "334 UGFzc3dvcmQ6",
+				"cGFzc3dvcmQ=", "235 2.0.0 Authentication succeeded",
+			},
+		},
+		{
+			name: "initial response",
+			lines: []string{
+				"AUTH LOGIN dXNlcm5hbWU=", "334 UGFzc3dvcmQ6",
+				"cGFzc3dvcmQ=", "235 2.0.0 Authentication succeeded",
+			},
+		},
+		{
+			name: "invalid password",
+			lines: []string{
+				"AUTH LOGIN dXNlcm5hbWU=", "334 UGFzc3dvcmQ6",
+				"aHVudGVyMg==", "535 5.7.8 Authentication failed",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, s, c, scanner, _ := testServerEhlo(t, func(s *smtp.Server) {
+				s.Backend.(*backend).saslServer = func(conn *smtp.Conn, mech string) sasl.Server {
+					if mech != sasl.Login {
+						t.Errorf("Invalid mechanism %q", mech)
+					}
+					return smtp.NewLoginServer(func(username, password string) error {
+						if username != "username" || password != "password" {
+							return smtp.ErrAuthFailed
+						}
+						return nil
+					})
+				}
+			})
+			defer s.Close()
+			defer c.Close()
+
+			for i := 0; i < len(tc.lines); i += 2 {
+				io.WriteString(c, tc.lines[i]+"\r\n")
+				scanner.Scan()
+				if scanner.Text() != tc.lines[i+1] {
+					t.Fatalf("Invalid response to %q: got %q, want %q", tc.lines[i], scanner.Text(), tc.lines[i+1])
+				}
+			}
+		})
+	}
+}
+
+func TestServer_DomainForConn(t *testing.T) {
+	be, s, c, scanner := testServer(t, func(s *smtp.Server) {
+		s.AddReceivedHeader = true
+		s.DomainForConn = func(c *smtp.Conn) string {
+			if host, _, _ := net.SplitHostPort(c.Conn().LocalAddr().String()); host == "127.0.0.1" {
+				return "mx.example.org"
+			}
+			return ""
+		}
+	})
+	defer s.Close()
+	defer c.Close()
+
+	scanner.Scan()
+	if scanner.Text() != "220 mx.example.org ESMTP Service Ready" {
+		t.Fatal("Invalid greeting:", scanner.Text())
+	}
+
+	for _, cmd := range []string{
+		"HELO localhost",
+		"MAIL FROM:<root@nsa.gov>",
+		"RCPT TO:<root@gchq.gov.uk>",
+		"DATA",
+	} {
+		io.WriteString(c, cmd+"\r\n")
+		scanner.Scan()
+	}
+	io.WriteString(c, "Hey <3\r\n.\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	if len(be.anonmsgs) != 1 {
+		t.Fatal("Invalid number of sent messages:", len(be.anonmsgs))
+	}
+	if data := string(be.anonmsgs[0].Data); !strings.Contains(data, "\r\n\tby mx.example.org with SMTP") {
+		t.Errorf("Received header field doesn't use the domain of the connection: %q", data)
+	}
+}
+
+func TestServer_RepeatedHello(t *testing.T) {
+	for _, tc := range []struct {
+		policy smtp.HelloPolicy
+		lines  []string // client lines, followed by the expected reply prefix
+	}{
+		{
+			policy: smtp.HelloReset,
+			lines: []string{
+				"EHLO localhost", "250 ",
+				"MAIL FROM:<root@nsa.gov>", "250 ",
+				"EHLO localhost", "250 ",
+				"RCPT TO:<root@gchq.gov.uk>", "503 5.5.1 Missing MAIL FROM command.",
+			},
+		},
+		{
+			policy: smtp.HelloRejectInTransaction,
+			lines: []string{
+				"EHLO localhost", "250 ",
+				"EHLO localhost", "250 ",
+				"MAIL FROM:<root@nsa.gov>", "250 ",
+				"HELO localhost", "503 5.5.1 HELO not allowed during a mail transaction",
+				"RCPT TO:<root@gchq.gov.uk>", "250 ",
+			},
+		},
+		{
+			policy: smtp.HelloRejectRepeated,
+			lines: []string{
+				"EHLO localhost", "250 ",
+				"EHLO localhost", "503 5.5.1 Duplicate EHLO command",
+				"MAIL FROM:<root@nsa.gov>", "250 ",
+			},
+		},
+	} {
+		_, s, c, scanner := testServerGreeted(t, func(s *smtp.Server) {
+			s.RepeatedHello = tc.policy
+		})
+
+		for i := 0; i < len(tc.lines); i += 2 {
+			io.WriteString(c, tc.lines[i]+"\r\n")
+			for scanner.Scan() {
+				if l := scanner.Text(); len(l) < 4 || l[3] != '-' {
+					break
+				}
+			}
+			if !strings.HasPrefix(scanner.Text(), tc.lines[i+1]) {
+				t.Errorf("Invalid response to %q (policy %v): got %q, want %q", tc.lines[i], tc.policy, scanner.Text(), tc.lines[i+1])
+			}
+		}
+
+		c.Close()
+		s.Close()
+	}
+}
+
+func TestServer_PipelinedCommands(t *testing.T) {
+	var conn *smtp.Conn
+	_, s, c, scanner := testServerGreeted(t, func(s *smtp.Server) {
+		be := s.Backend
+		s.Backend = smtp.BackendFunc(func(c *smtp.Conn) (smtp.Session, error) {
+			conn = c
+			return be.NewSession(c)
+		})
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "HELO localhost\r\n")
+	scanner.Scan()
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\nRCPT TO:<root@gchq.gov.uk>\r\nRCPT TO:<root@bnd.bund.de>\r\nDATA\r\n")
+	for i := 0; i < 4; i++ {
+		scanner.Scan()
+	}
+	if !strings.HasPrefix(scanner.Text(), "354 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+	io.WriteString(c, "Hey <3\r\n.\r\n")
+	scanner.Scan()
+
+	if n := conn.Stats().PipelinedCommands; n != 3 {
+		t.Errorf("PipelinedCommands = %v, want 3", n)
+	}
+}
+
+func TestServer_DataTrailer(t *testing.T) {
+	var conn *smtp.Conn
+	_, s, c, scanner := testServerGreeted(t, func(s *smtp.Server) {
+		s.MaxDataTrailerLines = 2
+		be := s.Backend
+		s.Backend = smtp.BackendFunc(func(c *smtp.Conn) (smtp.Session, error) {
+			conn = c
+			return be.NewSession(c)
+		})
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "HELO localhost\r\n")
+	scanner.Scan()
+
+	sendMessage := func(trailer string) {
+		io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\nRCPT TO:<root@gchq.gov.uk>\r\nDATA\r\n")
+		for i := 0; i < 3; i++ {
+			scanner.Scan()
+		}
+		if !strings.HasPrefix(scanner.Text(), "354 ") {
+			t.Fatal("Invalid DATA response:", scanner.Text())
+		}
+		io.WriteString(c, "Hey <3\r\n.\r\n"+trailer+"NOOP\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "250 ") {
+			t.Fatal("Invalid DATA response:", scanner.Text())
+		}
+	}
+
+	sendMessage("\r\n.\r\n")
+	scanner.Scan()
+	if scanner.Text() != "250 2.0.0 I have successfully done nothing" {
+		t.Fatal("Invalid NOOP response:", scanner.Text())
+	}
+	if n := conn.Stats().DataTrailerLines; n != 2 {
+		t.Errorf("DataTrailerLines = %v, want 2", n)
+	}
+
+	// Past the tolerance, junk is rejected as usual
+	sendMessage("\r\n\r\n\r\n")
+	scanner.Scan()
+	if scanner.Text() != "500 5.5.2 Error: bad syntax" {
+		t.Fatal("Invalid response to junk:", scanner.Text())
+	}
+	scanner.Scan()
+	if scanner.Text() != "250 2.0.0 I have successfully done nothing" {
+		t.Fatal("Invalid NOOP response:", scanner.Text())
+	}
+	if n := conn.Stats().DataTrailerLines; n != 4 {
+		t.Errorf("DataTrailerLines = %v, want 4", n)
+	}
+}
+
+type accountingChan chan *smtp.AccountingRecord
+
+func (ch accountingChan) Account(r *smtp.AccountingRecord) {
+	ch <- r
+}
+
+func TestServer_Accounting(t *testing.T) {
+	records := make(accountingChan, 4)
+	_, s, c, scanner := testServerAuthenticated(t, func(s *smtp.Server) {
+		s.Accounting = records
+		s.MaxMessageBytes = 50
+	})
+	defer s.Close()
+	defer c.Close()
+
+	send := func(cmds ...string) {
+		for _, cmd := range cmds {
+			io.WriteString(c, cmd+"\r\n")
+			scanner.Scan()
+			if !strings.HasPrefix(scanner.Text(), "250 ") && !strings.HasPrefix(scanner.Text(), "354 ") {
+				t.Fatalf("Invalid %v response: %v", cmd, scanner.Text())
+			}
+		}
+	}
+
+	send("MAIL FROM:<root@nsa.gov>", "RCPT TO:<root@gchq.gov.uk>", "RCPT TO:<root@bnd.bund.de>", "DATA")
+	io.WriteString(c, "Hey <3\r\n.\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	select {
+	case r := <-records:
+		if r.Identity != "username" || r.From != "root@nsa.gov" || r.Bytes != 8 {
+			t.Errorf("Invalid record: %+v", r)
+		}
+		if want := []string{"root@gchq.gov.uk", "root@bnd.bund.de"}; !reflect.DeepEqual(r.Recipients, want) {
+			t.Errorf("Recipients = %v, want %v", r.Recipients, want)
+		}
+		if r.TransactionID == "" {
+			t.Error("Missing transaction ID")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("No record for the accepted message")
+	}
+
+	send("MAIL FROM:<root@nsa.gov>", "RCPT TO:<root@gchq.gov.uk>")
+	io.WriteString(c, "BDAT 4\r\nHey BDAT 2 LAST\r\n<3")
+	for i := 0; i < 2; i++ {
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "250 ") {
+			t.Fatal("Invalid BDAT response:", scanner.Text())
+		}
+	}
+
+	select {
+	case r := <-records:
+		if r.Bytes != 6 || len(r.Recipients) != 1 {
+			t.Errorf("Invalid record: %+v", r)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("No record for the accepted message")
+	}
+
+	// Rejected messages aren't accounted for
+	send("MAIL FROM:<root@nsa.gov>", "RCPT TO:<root@gchq.gov.uk>", "DATA")
+	io.WriteString(c, strings.Repeat("This message is too long. ", 4)+"\r\n.\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "552 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	send("NOOP")
+	select {
+	case r := <-records:
+		t.Errorf("Unexpected record: %+v", r)
+	default:
+	}
+}
+
+func TestServer_StrictALPN(t *testing.T) {
+	serverCert, serverPool := testTLSCertificate(t, "localhost")
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		NextProtos:   []string{"smtp", "h2"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	protos := make(chan string, 3)
+	s := smtp.NewServer(new(backend))
+	s.Domain = "localhost"
+	s.StrictALPN = true
+	s.ErrorLog = log.New(ioutil.Discard, "", 0)
+	s.DomainForConn = func(c *smtp.Conn) string {
+		protos <- c.NegotiatedProtocol()
+		return ""
+	}
+	go s.Serve(l)
+	defer s.Close()
+
+	for _, tc := range []struct {
+		nextProtos []string
+		ok         bool
+	}{
+		{nextProtos: []string{"smtp"}, ok: true},
+		{nextProtos: nil, ok: true},
+		{nextProtos: []string{"h2"}, ok: false},
+	} {
+		conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{
+			RootCAs:    serverPool,
+			ServerName: "localhost",
+			NextProtos: tc.nextProtos,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		scanner := bufio.NewScanner(conn)
+		greeted := scanner.Scan() && strings.HasPrefix(scanner.Text(), "220 ")
+		conn.Close()
+		if greeted != tc.ok {
+			t.Errorf("ALPN %q: greeted = %v, want %v", tc.nextProtos, greeted, tc.ok)
+		}
+		if !tc.ok {
+			continue
+		}
+
+		want := ""
+		if len(tc.nextProtos) > 0 {
+			want = tc.nextProtos[0]
+		}
+		if proto := <-protos; proto != want {
+			t.Errorf("ALPN %q: NegotiatedProtocol() = %q, want %q", tc.nextProtos, proto, want)
+		}
+	}
+}
+
+func TestServer_SubmissionHeaderCheck(t *testing.T) {
+	be, s, c, scanner, _ := testServerEhlo(t, func(s *smtp.Server) {
+		s.SubmissionHeaderCheck = smtp.CheckSubmissionHeader
+		s.Backend.(*backend).saslServer = func(conn *smtp.Conn, mech string) sasl.Server {
+			return sasl.NewPlainServer(func(identity, username, password string) error {
+				conn.SetAuthIdentity(username)
+				return nil
+			})
+		}
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "AUTH PLAIN AGFsaWNlQGV4YW1wbGUub3JnAHBhc3N3b3Jk\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "235 ") {
+		t.Fatal("Invalid AUTH response:", scanner.Text())
+	}
+
+	send := func(msg string) string {
+		io.WriteString(c, "MAIL FROM:<alice@example.org>\r\nRCPT TO:<root@gchq.gov.uk>\r\nDATA\r\n")
+		for i := 0; i < 3; i++ {
+			scanner.Scan()
+		}
+		if !strings.HasPrefix(scanner.Text(), "354 ") {
+			t.Fatal("Invalid DATA response:", scanner.Text())
+		}
+		io.WriteString(c, msg+".\r\n")
+		scanner.Scan()
+		return scanner.Text()
+	}
+
+	if reply := send("From: Alice <ALICE@example.org>\r\n\r\nHey <3\r\n"); !strings.HasPrefix(reply, "250 ") {
+		t.Fatal("Invalid DATA response:", reply)
+	}
+	if reply := send("From: bob@example.org\r\n\r\nHey <3\r\n"); reply != "550 5.7.1 Not allowed to send as <bob@example.org>" {
+		t.Error("Invalid DATA response for misaligned From:", reply)
+	}
+	if reply := send("Subject: Hey\r\n\r\nHey <3\r\n"); reply != "550 5.6.0 Missing From header field" {
+		t.Error("Invalid DATA response without From:", reply)
+	}
+
+	// The custom SASL server doesn't mark the session as authenticated
+	if len(be.anonmsgs) != 1 {
+		t.Fatalf("Expected 1 message, got %v", len(be.anonmsgs))
+	}
+	data := string(be.anonmsgs[0].Data)
+	if !strings.HasPrefix(data, "Date: ") || !strings.Contains(data, "\r\nMessage-ID: <") || !strings.HasSuffix(data, "From: Alice <ALICE@example.org>\r\n\r\nHey <3\r\n") {
+		t.Errorf("Invalid message data:\n%v", data)
+	}
+}
+
+func TestServer_MaxConnMemory(t *testing.T) {
+	var conn *smtp.Conn
+	_, s, c, scanner := testServerAuthenticated(t, func(s *smtp.Server) {
+		// Connection buffers and 1 KiB for the message data
+		s.MaxConnMemory = 8192 + 1024
+		be := s.Backend
+		s.Backend = smtp.BackendFunc(func(c *smtp.Conn) (smtp.Session, error) {
+			conn = c
+			return be.NewSession(c)
+		})
+	})
+	defer s.Close()
+
+	if n := s.MemoryUsage(); n != conn.MemoryUsage() || n < 8192 {
+		t.Errorf("MemoryUsage() = %v, Conn.MemoryUsage() = %v", n, conn.MemoryUsage())
+	}
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\nRCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	scanner.Scan()
+	io.WriteString(c, "BDAT 2100 LAST\r\n"+strings.Repeat("a\r\n", 700))
+	scanner.Scan()
+	if scanner.Text() != "452 4.3.1 Insufficient system resources, try again later" {
+		t.Fatal("Invalid BDAT response:", scanner.Text())
+	}
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\nRCPT TO:<root@gchq.gov.uk>\r\nBDAT 8 LAST\r\nHey <3\r\n")
+	for i := 0; i < 3; i++ {
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "250 ") {
+			t.Fatal("Invalid response:", scanner.Text())
+		}
+	}
+
+	c.Close()
+	for i := 0; s.MemoryUsage() != 0; i++ {
+		if i > 100 {
+			t.Fatal("Memory not released, MemoryUsage() =", s.MemoryUsage())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServer_MaxConnMemoryHeader(t *testing.T) {
+	_, s, c, scanner := testServerAuthenticated(t, func(s *smtp.Server) {
+		s.MaxConnMemory = 8192 + 1024
+		s.MaxHeaderBytes = 4096
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\nRCPT TO:<root@gchq.gov.uk>\r\nDATA\r\n")
+	for i := 0; i < 3; i++ {
+		scanner.Scan()
+	}
+	io.WriteString(c, "Subject: Hey\r\n\r\n<3\r\n.\r\n")
+	scanner.Scan()
+	if scanner.Text() != "452 4.3.1 Insufficient system resources, try again later" {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+}
+
+func TestServer_RateLimiter(t *testing.T) {
+	var (
+		mu     sync.Mutex
+		events []smtp.RateLimitEvent
+	)
+	withLimiter := func(limiter *smtp.TokenBucketLimiter) serverConfigureFunc {
+		return func(s *smtp.Server) {
+			s.RateLimiter = limiter
+			s.OnRateLimit = func(c *smtp.Conn, ev smtp.RateLimitEvent) {
+				mu.Lock()
+				events = append(events, ev)
+				mu.Unlock()
+			}
+		}
+	}
+	checkEvents := func(t *testing.T, want ...smtp.RateLimitEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !reflect.DeepEqual(events, want) {
+			t.Errorf("OnRateLimit() called with %v, want %v", events, want)
+		}
+		events = nil
+	}
+
+	t.Run("commands", func(t *testing.T) {
+		_, s, c, scanner, _ := testServerEhlo(t, withLimiter(&smtp.TokenBucketLimiter{
+			Commands: smtp.RateLimit{Burst: 2},
+		}))
+		defer s.Close()
+		defer c.Close()
+
+		io.WriteString(c, "NOOP\r\n")
+		scanner.Scan()
+		if scanner.Text() != "250 2.0.0 I have successfully done nothing" {
+			t.Fatal("Invalid NOOP response:", scanner.Text())
+		}
+		io.WriteString(c, "NOOP\r\n")
+		scanner.Scan()
+		if scanner.Text() != "421 4.7.0 Too many commands, slow down" {
+			t.Fatal("Invalid NOOP response:", scanner.Text())
+		}
+		if scanner.Scan() {
+			t.Error("Connection still open:", scanner.Text())
+		}
+		checkEvents(t, smtp.RateLimitCommand)
+	})
+
+	t.Run("auth", func(t *testing.T) {
+		_, s, c, scanner, _ := testServerEhlo(t, withLimiter(&smtp.TokenBucketLimiter{
+			AuthFailures: smtp.RateLimit{Burst: 1},
+		}))
+		defer s.Close()
+		defer c.Close()
+
+		io.WriteString(c, "AUTH PLAIN AHVzZXJuYW1lAHdyb25n\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "454 ") {
+			t.Fatal("Invalid AUTH response:", scanner.Text())
+		}
+		io.WriteString(c, "AUTH PLAIN AHVzZXJuYW1lAHdyb25n\r\n")
+		scanner.Scan()
+		if scanner.Text() != "421 4.7.0 Too many authentication failures, try again later" {
+			t.Fatal("Invalid AUTH response:", scanner.Text())
+		}
+		checkEvents(t, smtp.RateLimitAuthFailure)
+
+		// The limit applies to new connections from the same address
+		c2, err := net.Dial("tcp", c.RemoteAddr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c2.Close()
+		scanner = bufio.NewScanner(c2)
+		scanner.Scan()
+		io.WriteString(c2, "EHLO localhost\r\n")
+		for scanner.Scan() && !strings.HasPrefix(scanner.Text(), "250 ") {
+		}
+		io.WriteString(c2, "AUTH PLAIN AHVzZXJuYW1lAHBhc3N3b3Jk\r\n")
+		scanner.Scan()
+		if scanner.Text() != "421 4.7.0 Too many authentication failures, try again later" {
+			t.Fatal("Invalid AUTH response:", scanner.Text())
+		}
+		checkEvents(t, smtp.RateLimitAuthFailure)
+	})
+
+	t.Run("mail", func(t *testing.T) {
+		_, s, c, scanner, _ := testServerEhlo(t, withLimiter(&smtp.TokenBucketLimiter{
+			Mails: smtp.RateLimit{Burst: 1},
+		}))
+		defer s.Close()
+		defer c.Close()
+
+		io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "250 ") {
+			t.Fatal("Invalid MAIL response:", scanner.Text())
+		}
+		io.WriteString(c, "RSET\r\n")
+		scanner.Scan()
+		io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+		scanner.Scan()
+		if scanner.Text() != "450 4.7.1 Too many messages from your address, try again later" {
+			t.Fatal("Invalid MAIL response:", scanner.Text())
+		}
+		io.WriteString(c, "NOOP\r\n")
+		scanner.Scan()
+		if scanner.Text() != "250 2.0.0 I have successfully done nothing" {
+			t.Fatal("Invalid NOOP response:", scanner.Text())
+		}
+		checkEvents(t, smtp.RateLimitMail)
+	})
+}
+
+func TestServer_OnCommand(t *testing.T) {
+	type commandDone struct {
+		verb, arg string
+		code      int
+	}
+	var (
+		mu   sync.Mutex
+		done []commandDone
+	)
+	_, s, c, scanner, _ := testServerEhlo(t, func(s *smtp.Server) {
+		s.OnCommand = func(c *smtp.Conn, verb, arg string) error {
+			switch verb {
+			case "VRFY":
+				return &smtp.SMTPError{
+					Code:         502,
+					EnhancedCode: smtp.EnhancedCode{5, 5, 1},
+					Message:      "VRFY is disabled",
+				}
+			case "AUTH", "BDAT":
+				return errors.New("Denied by policy")
+			}
+			return nil
+		}
+		s.OnCommandDone = func(c *smtp.Conn, verb, arg string, code int) {
+			mu.Lock()
+			done = append(done, commandDone{verb, arg, code})
+			mu.Unlock()
+		}
+	})
+	defer s.Close()
+	defer c.Close()
+
+	for _, tc := range []struct {
+		cmd, reply string
+	}{
+		{"VRFY root", "502 5.5.1 VRFY is disabled"},
+		{"AUTH PLAIN AHVzZXJuYW1lAHBhc3N3b3Jk", "550 5.7.1 Denied by policy"},
+		{"MAIL FROM:<root@nsa.gov>", "250 2.0.0 Roger, accepting mail from <root@nsa.gov>"},
+		{"RCPT TO:<root@gchq.gov.uk>", "250 2.0.0 I'll make sure <root@gchq.gov.uk> gets this"},
+		// The chunk is discarded
+		{"BDAT 6 LAST\r\nNOOP", "550 5.7.1 Denied by policy"},
+		{"NOOP", "250 2.0.0 I have successfully done nothing"},
+	} {
+		io.WriteString(c, tc.cmd+"\r\n")
+		scanner.Scan()
+		if scanner.Text() != tc.reply {
+			t.Errorf("Invalid response to %q: got %q, want %q", tc.cmd, scanner.Text(), tc.reply)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []commandDone{
+		{"EHLO", "localhost", 250},
+		{"VRFY", "root", 502},
+		{"AUTH", "PLAIN", 550},
+		{"MAIL", "FROM:<root@nsa.gov>", 250},
+		{"RCPT", "TO:<root@gchq.gov.uk>", 250},
+		{"BDAT", "6 LAST", 550},
+		{"NOOP", "", 250},
+	}
+	if !reflect.DeepEqual(done, want) {
+		t.Errorf("OnCommandDone() called with %v, want %v", done, want)
+	}
+}
+
+func TestServer_MailRcptSyntaxCorpus(t *testing.T) {
+	b, err := ioutil.ReadFile("testdata/mail-rcpt-syntax.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type testCase struct {
+		strict, lenient, cmd string
+	}
+	var cases []testCase
+	for _, line := range strings.Split(string(b), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) != 3 {
+			t.Fatalf("Malformed corpus line: %q", line)
+		}
+		cases = append(cases, testCase{fields[0], fields[1], fields[2]})
+	}
+
+	for _, lenient := range []bool{false, true} {
+		_, s, c, scanner, _ := testServerEhlo(t, func(s *smtp.Server) {
+			s.LenientSyntax = lenient
+		})
+
+		for _, tc := range cases {
+			want := tc.strict
+			if lenient {
+				want = tc.lenient
+			}
+
+			io.WriteString(c, "RSET\r\n")
+			scanner.Scan()
+			if strings.HasPrefix(strings.ToUpper(tc.cmd), "RCPT") {
+				io.WriteString(c, "MAIL FROM:<>\r\n")
+				scanner.Scan()
+			}
+
+			io.WriteString(c, tc.cmd+"\r\n")
+			scanner.Scan()
+			if !strings.HasPrefix(scanner.Text(), want+" ") {
+				t.Errorf("Invalid response to %q (lenient: %v): got %q, want %v", tc.cmd, lenient, scanner.Text(), want)
+			}
+		}
+
+		c.Close()
+		s.Close()
+	}
+}
+
+func TestServer_Health(t *testing.T) {
+	_, s, c, _ := testServerGreeted(t)
+	defer c.Close()
+
+	h := s.HealthHandler()
+	check := func(path string, wantCode int) *smtp.HealthStatus {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		if rec.Code != wantCode {
+			t.Errorf("GET %v: got status %v, want %v", path, rec.Code, wantCode)
+		}
+		var st smtp.HealthStatus
+		if err := json.NewDecoder(rec.Body).Decode(&st); err != nil {
+			t.Fatalf("GET %v: failed to decode body: %v", path, err)
+		}
+		return &st
+	}
+
+	check("/healthz", http.StatusOK)
+	st := check("/readyz", http.StatusOK)
+	if len(st.Listeners) != 1 || st.ActiveConns != 1 || st.Draining || st.Closed {
+		t.Errorf("Unexpected status: %+v", st)
+	}
+
+	s.DrainConns()
+	check("/healthz", http.StatusOK)
+	if st := check("/readyz", http.StatusServiceUnavailable); !st.Draining {
+		t.Errorf("Unexpected status while draining: %+v", st)
+	}
+
+	s.Close()
+	if st := check("/healthz", http.StatusServiceUnavailable); !st.Closed {
+		t.Errorf("Unexpected status once closed: %+v", st)
+	}
+}
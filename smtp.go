@@ -64,6 +64,12 @@ type MailOptions struct {
 	//
 	// Defined in RFC 4954.
 	Auth *string
+
+	// Reverse-path exactly as sent by the client, including angle brackets
+	// and quoting. The from argument passed to the backend has quoted local
+	// parts unescaped, RawPath can be used to enforce case-sensitive or
+	// quoted local parts.
+	RawPath string
 }
 
 type DSNNotify string
@@ -91,4 +97,8 @@ type RcptOptions struct {
 	// Original recipient set by client.
 	OriginalRecipientType DSNAddressType
 	OriginalRecipient     string
+
+	// Forward-path exactly as sent by the client, including angle brackets
+	// and quoting.
+	RawPath string
 }
@@ -0,0 +1,115 @@
+package smtp
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+)
+
+// StartTLSStage is the step of the STARTTLS negotiation which failed.
+type StartTLSStage string
+
+const (
+	// The server doesn't advertise STARTTLS.
+	StartTLSUnsupported StartTLSStage = "unsupported"
+	// The STARTTLS command failed, e.g. the server replied with an error.
+	StartTLSCommand StartTLSStage = "command"
+	// The TLS handshake failed, e.g. the server certificate couldn't be
+	// verified. The connection can't be used anymore.
+	StartTLSHandshake StartTLSStage = "handshake"
+)
+
+// StartTLSError is returned by DialStartTLS, NewClientStartTLS and
+// DialStartTLSPolicy when TLS can't be negotiated with STARTTLS.
+type StartTLSError struct {
+	Stage StartTLSStage
+	Err   error
+}
+
+func (err *StartTLSError) Error() string {
+	return fmt.Sprintf("smtp: STARTTLS failed (%v): %v", err.Stage, err.Err)
+}
+
+func (err *StartTLSError) Unwrap() error {
+	return err.Err
+}
+
+// StartTLSPolicy defines what DialStartTLSPolicy does when STARTTLS fails.
+// The zero value fails hard, like DialStartTLS.
+type StartTLSPolicy struct {
+	// If not nil, used to connect again when the TLS handshake fails, e.g. a
+	// configuration with InsecureSkipVerify set for opportunistic TLS.
+	RelaxedConfig *tls.Config
+	// Continue without TLS if STARTTLS fails, connecting again if the TLS
+	// handshake has been started. This allows an active attacker to
+	// downgrade the connection, it should only be enabled for opportunistic
+	// TLS.
+	AllowPlaintext bool
+
+	// If not nil, called with the failure when falling back to RelaxedConfig
+	// or to plaintext.
+	OnFallback func(err *StartTLSError)
+}
+
+// DialStartTLSPolicy works like DialStartTLS, but falls back to a relaxed
+// TLS configuration or to plaintext according to policy when STARTTLS fails.
+// A nil policy is equivalent to a zero StartTLSPolicy.
+//
+// The returned Client uses TLS if TLSConnectionState reports so. If all
+// attempts fail, the *StartTLSError of the last one is returned.
+func DialStartTLSPolicy(addr string, tlsConfig *tls.Config, policy *StartTLSPolicy) (*Client, error) {
+	if policy == nil {
+		policy = &StartTLSPolicy{}
+	}
+
+	c, err := Dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	err = initStartTLS(c, tlsConfig)
+	if err == nil {
+		return c, nil
+	}
+	tlsErr, ok := err.(*StartTLSError)
+	if !ok {
+		c.Close()
+		return nil, err
+	}
+
+	if tlsErr.Stage == StartTLSHandshake && policy.RelaxedConfig != nil {
+		c.Close()
+		policy.fallback(tlsErr)
+
+		c, err = Dial(addr)
+		if err != nil {
+			return nil, err
+		}
+		err = initStartTLS(c, policy.RelaxedConfig)
+		if err == nil {
+			return c, nil
+		}
+		if tlsErr, ok = err.(*StartTLSError); !ok {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	if !policy.AllowPlaintext {
+		c.Close()
+		return nil, tlsErr
+	}
+	policy.fallback(tlsErr)
+	var smtpErr *SMTPError
+	if tlsErr.Stage == StartTLSUnsupported || errors.As(tlsErr.Err, &smtpErr) {
+		// The connection can still be used
+		return c, nil
+	}
+	c.Close()
+	return Dial(addr)
+}
+
+func (policy *StartTLSPolicy) fallback(err *StartTLSError) {
+	if policy.OnFallback != nil {
+		policy.OnFallback(err)
+	}
+}
@@ -0,0 +1,146 @@
+package smtp
+
+import (
+	"fmt"
+)
+
+// connState is the state of the SMTP dialogue, used to enforce the order of
+// commands described in RFC 5321 section 4.1.4.
+type connState int
+
+const (
+	// No HELO, EHLO or LHLO command has been accepted yet.
+	stateInit connState = iota
+	// The client has been greeted, no mail transaction is in progress.
+	stateReady
+	// A MAIL command has been accepted, but no RCPT command yet.
+	stateMail
+	// At least one RCPT command has been accepted.
+	stateRcpt
+	// A BDAT command without LAST has been accepted, the message data is
+	// being transferred.
+	stateBdat
+)
+
+// HelloPolicy defines how the server handles HELO, EHLO and LHLO commands
+// sent by a client which has already been greeted.
+type HelloPolicy int
+
+const (
+	// The session is reset as if RSET had been sent, as required by RFC 5321
+	// section 4.1.4.
+	HelloReset HelloPolicy = iota
+	// The command is rejected with a 503 reply during a mail transaction,
+	// and resets the session otherwise.
+	HelloRejectInTransaction
+	// The command is always rejected with a 503 reply. Clients must still
+	// greet the server again after STARTTLS.
+	HelloRejectRepeated
+)
+
+// stateSet is a set of connState values.
+type stateSet uint
+
+func statesOf(states ...connState) stateSet {
+	var set stateSet
+	for _, st := range states {
+		set |= 1 << uint(st)
+	}
+	return set
+}
+
+func (set stateSet) has(st connState) bool {
+	return set&(1<<uint(st)) != 0
+}
+
+// commandStates lists the states in which each command is allowed. Commands
+// which aren't listed are allowed in any state.
+var commandStates = map[string]stateSet{
+	"MAIL":      statesOf(stateReady),
+	"RCPT":      statesOf(stateMail, stateRcpt),
+	"DATA":      statesOf(stateRcpt),
+	"BDAT":      statesOf(stateRcpt, stateBdat),
+	"AUTH":      statesOf(stateReady),
+	"STARTTLS":  statesOf(stateInit, stateReady, stateMail, stateRcpt),
+	"XCOMPRESS": statesOf(stateInit, stateReady),
+}
+
+// state returns the current state of the SMTP dialogue.
+func (c *Conn) state() connState {
+	switch {
+	case c.helo == "":
+		return stateInit
+	case c.bdatPipe != nil:
+		return stateBdat
+	case c.tx == nil:
+		return stateReady
+	case len(c.tx.Recipients) == 0:
+		return stateMail
+	default:
+		return stateRcpt
+	}
+}
+
+// commandOrderError returns the reply text of the 503 reply to send if cmd
+// isn't allowed in the current state, or an empty string if it's allowed.
+func (c *Conn) commandOrderError(cmd string) string {
+	allowed, ok := commandStates[cmd]
+	if !ok {
+		return ""
+	}
+	st := c.state()
+	if allowed.has(st) {
+		return ""
+	}
+
+	switch st {
+	case stateInit:
+		return "Please introduce yourself first."
+	case stateBdat:
+		if cmd == "DATA" {
+			// RFC 3030 section 2: DATA and BDAT can't be mixed in a
+			// transaction
+			return "DATA not allowed after BDAT, end the message with BDAT LAST"
+		}
+		return fmt.Sprintf("%v not allowed during message transfer", cmd)
+	case stateReady:
+		return "Missing MAIL FROM command."
+	case stateMail, stateRcpt:
+		switch cmd {
+		case "MAIL":
+			return "Nested MAIL command"
+		case "DATA", "BDAT":
+			return "Missing RCPT TO command."
+		}
+		return fmt.Sprintf("%v not allowed during a mail transaction", cmd)
+	}
+	return fmt.Sprintf("%v not allowed now", cmd)
+}
+
+// repeatedHelloError returns the reply text of the 503 reply to send if a
+// HELO, EHLO or LHLO command isn't allowed by Server.RepeatedHello, or an
+// empty string if it's allowed.
+func (c *Conn) repeatedHelloError() string {
+	switch c.server.RepeatedHello {
+	case HelloRejectInTransaction:
+		switch c.state() {
+		case stateMail, stateRcpt, stateBdat:
+			return fmt.Sprintf("%v not allowed during a mail transaction", c.command)
+		}
+	case HelloRejectRepeated:
+		if c.state() != stateInit {
+			return "Duplicate " + c.command + " command"
+		}
+	}
+	return ""
+}
+
+// checkCommandOrder sends a 503 reply and returns false if cmd isn't allowed
+// in the current state.
+func (c *Conn) checkCommandOrder(cmd string) bool {
+	if msg := c.commandOrderError(cmd); msg != "" {
+		c.writeResponse(503, EnhancedCode{5, 5, 1}, msg)
+		return false
+	}
+	return true
+}
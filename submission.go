@@ -0,0 +1,146 @@
+package smtp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// Maximum size of the header read for Server.SubmissionHeaderCheck if
+// Server.MaxHeaderBytes isn't set.
+const defaultSubmissionHeaderBytes = 64 * 1024
+
+// SubmissionHeader is the header of a message, passed to
+// Server.SubmissionHeaderCheck before the message data is passed to the
+// backend.
+type SubmissionHeader struct {
+	// Header fields of the message. Fields added with Add are included.
+	Fields textproto.MIMEHeader
+	// The header is larger than the limit, fields past the limit are
+	// missing.
+	Truncated bool
+
+	added []string
+}
+
+// Add prepends a header field to the message, e.g. to fix a missing Date
+// field.
+func (h *SubmissionHeader) Add(key, value string) {
+	h.Fields.Add(key, value)
+	h.added = append(h.added, key+": "+value+"\r\n")
+}
+
+// SubmissionHeaderCheck validates and fixes the header of a message, as a
+// message submission agent should (RFC 6409 section 8). It's called with the
+// header before the message data is passed to the backend. If it returns an
+// error, the message is rejected: an *SMTPError can be used to customize the
+// reply, other errors are sent with a 550 5.7.1 reply.
+type SubmissionHeaderCheck func(c *Conn, tx *Transaction, h *SubmissionHeader) error
+
+// CheckSubmissionHeader is a SubmissionHeaderCheck which:
+//
+//   - rejects messages without a From field,
+//   - rejects messages whose From addresses don't match the authenticated
+//     identity, if it's an email address (see Conn.AuthIdentity),
+//   - adds the Date and Message-ID fields if they are missing.
+func CheckSubmissionHeader(c *Conn, tx *Transaction, h *SubmissionHeader) error {
+	from := h.Fields.Get("From")
+	if from == "" {
+		if h.Truncated {
+			return nil
+		}
+		return &SMTPError{
+			Code:         550,
+			EnhancedCode: EnhancedCode{5, 6, 0},
+			Message:      "Missing From header field",
+		}
+	}
+
+	if identity := c.AuthIdentity(); strings.Contains(identity, "@") {
+		addrs, err := mail.ParseAddressList(from)
+		if err != nil {
+			return &SMTPError{
+				Code:         550,
+				EnhancedCode: EnhancedCode{5, 6, 0},
+				Message:      "Malformed From header field",
+			}
+		}
+		for _, addr := range addrs {
+			if !strings.EqualFold(addr.Address, identity) {
+				return &SMTPError{
+					Code:         550,
+					EnhancedCode: EnhancedCode{5, 7, 1},
+					Message:      fmt.Sprintf("Not allowed to send as <%v>", addr.Address),
+				}
+			}
+		}
+	}
+
+	if h.Truncated {
+		// The missing fields may be past the limit
+		return nil
+	}
+	now := c.server.now()
+	if h.Fields.Get("Date") == "" {
+		h.Add("Date", now.Format(time.RFC1123Z))
+	}
+	if h.Fields.Get("Message-Id") == "" {
+		id := tx.ID
+		if id == "" {
+			var err error
+			if id, err = newTransactionID(now, c.server.Rand); err != nil {
+				return &SMTPError{
+					Code:         451,
+					EnhancedCode: EnhancedCode{4, 3, 0},
+					Message:      "Failed to generate a Message-ID, try again later",
+				}
+			}
+		}
+		h.Add("Message-ID", "<"+id+"@"+c.Domain()+">")
+	}
+	return nil
+}
+
+// checkSubmissionHeader reads the message header and calls
+// Server.SubmissionHeaderCheck. If the message is rejected, the returned
+// reader fails with the error.
+func (c *Conn) checkSubmissionHeader(tx *Transaction, r io.Reader) io.Reader {
+	br := bufio.NewReader(r)
+	buf, fields, truncated := readHeader(br, c.submissionHeaderBytes())
+
+	h := &SubmissionHeader{Fields: fields, Truncated: truncated}
+	if err := c.server.SubmissionHeaderCheck(c, tx, h); err != nil {
+		if _, ok := err.(*SMTPError); !ok {
+			err = &SMTPError{
+				Code:         550,
+				EnhancedCode: EnhancedCode{5, 7, 1},
+				Message:      err.Error(),
+			}
+		}
+		return &errorReader{err: err}
+	}
+
+	return io.MultiReader(strings.NewReader(strings.Join(h.added, "")), buf, br)
+}
+
+// submissionHeaderBytes returns the maximum size of the header read for
+// Server.SubmissionHeaderCheck.
+func (c *Conn) submissionHeaderBytes() int {
+	if c.server.MaxHeaderBytes > 0 {
+		return c.server.MaxHeaderBytes
+	}
+	return defaultSubmissionHeaderBytes
+}
+
+// errorReader fails all reads with err.
+type errorReader struct {
+	err error
+}
+
+func (r *errorReader) Read(b []byte) (int, error) {
+	return 0, r.err
+}
@@ -0,0 +1,111 @@
+package smtp
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// throughputWatchdogChunk is the size of the writes accounted by
+// throughputWatchdog.
+const throughputWatchdogChunk = 4096
+
+// ThroughputError is returned by the message data writer when the upload rate
+// stayed below Client.MinDataRate.
+type ThroughputError struct {
+	// Number of bytes written during the window.
+	Written int64
+	// Duration of the window.
+	Window time.Duration
+	// Minimum rate, in bytes per second.
+	MinRate int
+}
+
+func (err *ThroughputError) Error() string {
+	return fmt.Sprintf("smtp: upload rate too low: %v bytes written in %v, minimum is %v bytes/s", err.Written, err.Window, err.MinRate)
+}
+
+// throughputWatchdog closes conn if less than minRate*window bytes are
+// written during a window.
+type throughputWatchdog struct {
+	conn    net.Conn
+	minRate int
+	window  time.Duration
+	done    chan struct{}
+	once    sync.Once
+
+	mu      sync.Mutex
+	written int64
+	err     *ThroughputError
+}
+
+func newThroughputWatchdog(conn net.Conn, minRate int, window time.Duration) *throughputWatchdog {
+	w := &throughputWatchdog{
+		conn:    conn,
+		minRate: minRate,
+		window:  window,
+		done:    make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+func (w *throughputWatchdog) run() {
+	ticker := time.NewTicker(w.window)
+	defer ticker.Stop()
+
+	min := int64(float64(w.minRate) * w.window.Seconds())
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+		}
+
+		w.mu.Lock()
+		written := w.written
+		w.written = 0
+		if written < min {
+			w.err = &ThroughputError{
+				Written: written,
+				Window:  w.window,
+				MinRate: w.minRate,
+			}
+		}
+		w.mu.Unlock()
+
+		if written < min {
+			// Abort the blocked write, if any. The message data can't be
+			// interrupted without closing the connection.
+			w.conn.Close()
+			return
+		}
+	}
+}
+
+func (w *throughputWatchdog) add(n int) {
+	w.mu.Lock()
+	w.written += int64(n)
+	w.mu.Unlock()
+}
+
+// wrapErr replaces err with a *ThroughputError if the watchdog closed the
+// connection.
+func (w *throughputWatchdog) wrapErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	return err
+}
+
+func (w *throughputWatchdog) stop() {
+	w.once.Do(func() {
+		close(w.done)
+	})
+}
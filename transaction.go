@@ -0,0 +1,127 @@
+package smtp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Transaction describes a mail transaction, from the MAIL command to the end
+// of the message data.
+//
+// A Transaction is created by the server when a MAIL command is received and
+// is discarded once the message has been delivered or the transaction has
+// been aborted (RSET, new EHLO, error). Backends must not modify it.
+type Transaction struct {
+	// Unique identifier of the transaction. It is included in the default
+	// success reply to the message data ("OK: queued as <ID>").
+	ID string
+
+	// Reverse-path from the MAIL command.
+	From string
+	// Parameters of the MAIL command.
+	MailOptions *MailOptions
+
+	// Forward-paths of the accepted RCPT commands.
+	Recipients []string
+	// Parameters of the accepted RCPT commands, in the same order as
+	// Recipients.
+	RcptOptions []*RcptOptions
+
+	// Time the MAIL command was received.
+	StartedAt time.Time
+	// Time the DATA or first BDAT command was received. Zero if the message
+	// data hasn't been sent yet.
+	DataStartedAt time.Time
+
+	// How the message data has been transferred. Populated when the DATA or
+	// first BDAT command is received.
+	DataStats DataStats
+
+	// Main fields of the message header. Only populated if
+	// Server.MaxHeaderBytes is set, before the message data is passed to the
+	// backend.
+	Header *MessageHeader
+
+	// Results of Server.DataInspectors. Populated when the message data
+	// starts, final once the message data reader has returned io.EOF.
+	Inspections *InspectionResults
+
+	ctx context.Context
+}
+
+// Context returns the context of the connection, see Conn.Context. It lets
+// TransactionSession backends stop work when the client goes away, like
+// ContextSession ones.
+func (tx *Transaction) Context() context.Context {
+	if tx.ctx == nil {
+		return context.Background()
+	}
+	return tx.ctx
+}
+
+// DataStats describes the transfer of the message data, which can matter to
+// storage engines preserving transport metadata.
+type DataStats struct {
+	// Body type declared in the MAIL command, empty if not specified.
+	Body BodyType
+	// Whether the message data has been sent with BDAT (RFC 3030 CHUNKING)
+	// instead of DATA.
+	Chunking bool
+	// Number of BDAT chunks received, including the last one. Chunks is only
+	// final once the message data reader has returned io.EOF.
+	Chunks int
+	// Total size of the BDAT chunks received, in bytes. Like Chunks, Size is
+	// only final once the message data reader has returned io.EOF. Zero if
+	// the message data has been sent with DATA.
+	Size int64
+}
+
+// SizeMismatchPolicy defines how the server handles clients sending message
+// data whose size doesn't match the SIZE parameter of the MAIL command.
+type SizeMismatchPolicy int
+
+const (
+	// The declared size isn't checked.
+	SizeMismatchIgnore SizeMismatchPolicy = iota
+	// The mismatch is logged to Server.ErrorLog and the message is accepted.
+	SizeMismatchLog
+	// The message is rejected with a 554 reply as soon as the mismatch is
+	// detected.
+	SizeMismatchReject
+)
+
+// Crockford's base32 alphabet, as used by ULIDs.
+const crockfordAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// newTransactionID generates a ULID-like identifier: 48 bits of Unix time in
+// milliseconds followed by 80 random bits, encoded in 26 base32 characters.
+// IDs generated within the same millisecond are not guaranteed to be sorted.
+// If r is nil, crypto/rand is used. An error is returned if r fails.
+func newTransactionID(now time.Time, r io.Reader) (string, error) {
+	if r == nil {
+		r = rand.Reader
+	}
+
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], uint64(now.UnixNano()/int64(time.Millisecond))<<16)
+	if _, err := io.ReadFull(r, b[6:]); err != nil {
+		return "", fmt.Errorf("smtp: failed to generate transaction ID: %w", err)
+	}
+
+	hi := binary.BigEndian.Uint64(b[:8])
+	lo := binary.BigEndian.Uint64(b[8:])
+
+	// 128 bits are encoded in 26 characters, the first one only holding 3
+	// bits.
+	var out [26]byte
+	for i := len(out) - 1; i >= 0; i-- {
+		out[i] = crockfordAlphabet[lo&0x1F]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:]), nil
+}
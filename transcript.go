@@ -0,0 +1,77 @@
+package smtp
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TranscriptEntry is a single line of an SMTP dialogue.
+type TranscriptEntry struct {
+	// Time the line was sent or received.
+	Time time.Time
+	// Whether the line was sent by the client.
+	FromClient bool
+	// The line itself, without the trailing CRLF.
+	Line string
+}
+
+// Transcript records the commands sent by a Client and the replies received
+// from the server.
+//
+// Message data is not recorded: the end of the message data is represented
+// by a single "." line.
+type Transcript struct {
+	Entries []TranscriptEntry
+}
+
+func (t *Transcript) addCommand(line string, redact bool) {
+	if redact {
+		// Keep the AUTH mechanism name, which is useful for debugging
+		if fields := strings.Fields(line); len(fields) >= 2 && strings.EqualFold(fields[0], "AUTH") {
+			line = fields[0] + " " + fields[1]
+			if len(fields) > 2 {
+				line += " <redacted>"
+			}
+		} else if line != "*" {
+			line = "<redacted>"
+		}
+	}
+
+	t.Entries = append(t.Entries, TranscriptEntry{
+		Time:       time.Now(),
+		FromClient: true,
+		Line:       line,
+	})
+}
+
+func (t *Transcript) addReply(code int, msg string) {
+	now := time.Now()
+	lines := strings.Split(msg, "\n")
+	for i, l := range lines {
+		sep := "-"
+		if i == len(lines)-1 {
+			sep = " "
+		}
+		t.Entries = append(t.Entries, TranscriptEntry{
+			Time: now,
+			Line: fmt.Sprintf("%03d%v%v", code, sep, l),
+		})
+	}
+}
+
+// String formats the transcript with one line per entry, prefixed with "C: "
+// for client commands and "S: " for server replies.
+func (t *Transcript) String() string {
+	var sb strings.Builder
+	for _, e := range t.Entries {
+		if e.FromClient {
+			sb.WriteString("C: ")
+		} else {
+			sb.WriteString("S: ")
+		}
+		sb.WriteString(e.Line)
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}